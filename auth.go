@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"erebrusvps/docker"
+	"erebrusvps/websocket"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// bearerKey returns the API key of a request, if any
+func bearerKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// apiKeyID identifies an API key in project state and events without
+// storing the key itself
+func apiKeyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+// authEnabled reports whether API keys are configured. Without them the API
+// stays open and ownership isn't tracked.
+func authEnabled() bool {
+	return len(config.APIKeys) > 0 || config.AdminKey != ""
+}
+
+func keyMatches(key, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(key), []byte(want)) == 1
+}
+
+// isAdmin reports whether a request uses the admin key
+func isAdmin(r *http.Request) bool {
+	return keyMatches(bearerKey(r), config.AdminKey)
+}
+
+// validKey reports whether a request carries a configured API key
+func validKey(r *http.Request) bool {
+	key := bearerKey(r)
+	valid := isAdmin(r)
+	for _, apiKey := range config.APIKeys {
+		if keyMatches(key, apiKey) {
+			valid = true
+		}
+	}
+	return valid
+}
+
+// requestOwner returns the ID of the key a request is made with, empty when
+// auth is disabled
+func requestOwner(r *http.Request) string {
+	if !authEnabled() {
+		return ""
+	}
+	return apiKeyID(bearerKey(r))
+}
+
+// withAuth rejects requests without a valid API key once keys are configured
+func withAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authEnabled() && r.Method != http.MethodOptions && !validKey(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// authorizeProject checks the caller may read or change a project: only the
+// key that created it, or the admin key, may. It writes a 403 when not.
+func authorizeProject(w http.ResponseWriter, r *http.Request, project string) bool {
+	if !authEnabled() || isAdmin(r) {
+		return true
+	}
+	state, err := docker.LoadProjectState(project)
+	if err != nil || state.Owner == "" || state.Owner == requestOwner(r) {
+		return true
+	}
+	http.Error(w, fmt.Sprintf("project %s belongs to another API key", project), http.StatusForbidden)
+	return false
+}
+
+// logsHandler streams /ws logs, limited to the projects the caller's key
+// may see
+func logsHandler(w http.ResponseWriter, r *http.Request) {
+	websocket.Logger.ServeLogs(w, r, projectVisible(r))
+}
+
+// projectVisible returns whether a request's key may see a project's logs,
+// nil when it may see everything. Like authorizeProject, projects without an
+// owner are visible to every key. Owners are cached for the connection once
+// set, as they don't change afterwards.
+func projectVisible(r *http.Request) func(project string) bool {
+	if !authEnabled() || isAdmin(r) {
+		return nil
+	}
+	owner := requestOwner(r)
+	owners := make(map[string]string)
+	return func(project string) bool {
+		projectOwner, ok := owners[project]
+		if !ok {
+			state, err := docker.LoadProjectState(project)
+			if err != nil {
+				return false
+			}
+			if projectOwner = state.Owner; projectOwner != "" {
+				owners[project] = projectOwner
+			}
+		}
+		return projectOwner == "" || projectOwner == owner
+	}
+}
+
+// quotaError is the body of a 429 response for an exceeded quota
+type quotaError struct {
+	Error string `json:"error"`
+	Usage int    `json:"usage"`
+	Limit int    `json:"limit"`
+}
+
+// checkQuota enforces the deployment limits before new projects are
+// created, all of them counted at once, writing a 429 with the current usage
+// when one is reached. Under the evict-lru retention policy a reached global
+// limit returns how many projects to evict instead, and the caller makes
+// room with evictForQuota once the deployments are validated.
+func checkQuota(w http.ResponseWriter, r *http.Request, projects ...string) (evict int, ok bool) {
+	existing, err := docker.ListProjects()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	exists := make(map[string]bool)
+	for _, project := range existing {
+		exists[project] = true
+	}
+	added := 0
+	for _, project := range projects {
+		if !exists[project] {
+			added++ // redeploys don't count against the quota
+		}
+	}
+	if added == 0 {
+		return 0, true
+	}
+
+	owner := requestOwner(r)
+	owned := 0
+	for _, project := range existing {
+		if state, err := docker.LoadProjectState(project); err == nil && state.Owner == owner {
+			owned++
+		}
+	}
+
+	total := len(existing)
+	if config.MaxDeployments > 0 && total+added > config.MaxDeployments && config.RetentionPolicy == docker.RetentionEvict {
+		// Only the requesting key's own projects are evicted
+		evict = min(total+added-config.MaxDeployments, owned)
+		total -= evict
+		owned -= evict
+	}
+
+	switch {
+	case config.MaxDeployments > 0 && total+added > config.MaxDeployments:
+		writeQuotaError(w, &quotaError{Error: "deployment limit reached", Usage: total, Limit: config.MaxDeployments})
+	case config.MaxDeploymentsPerKey > 0 && owner != "" && !isAdmin(r) && owned+added > config.MaxDeploymentsPerKey:
+		writeQuotaError(w, &quotaError{Error: "deployment limit for this API key reached", Usage: owned, Limit: config.MaxDeploymentsPerKey})
+	default:
+		return evict, true
+	}
+	return 0, false
+}
+
+// evictForQuota makes room for deployments under the evict-lru retention
+// policy by evicting the requesting key's count least recently deployed
+// projects. Every deployment is validated first, so a malformed request
+// never costs another project.
+func evictForQuota(w http.ResponseWriter, r *http.Request, count int, deployments ...docker.Deployment) bool {
+	keep := make([]string, len(deployments))
+	for i, deployment := range deployments {
+		if err := dockerSetup.ValidateDeployment(deployment); err != nil {
+			http.Error(w, fmt.Sprintf("%s: %v", deployment.ProjectName, err), http.StatusBadRequest)
+			return false
+		}
+		keep[i] = deployment.ProjectName
+	}
+	for ; count > 0; count-- {
+		if _, err := dockerSetup.EvictLeastRecentlyUsed(requestOwner(r), keep...); err != nil {
+			writeQuotaError(w, &quotaError{Error: fmt.Sprintf("deployment limit reached: %v", err), Usage: config.MaxDeployments, Limit: config.MaxDeployments})
+			return false
+		}
+	}
+	return true
+}
+
+// writeQuotaError responds with a 429 and the exceeded quota
+func writeQuotaError(w http.ResponseWriter, exceeded *quotaError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(exceeded)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"erebrusvps/docker"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckQuotaCountsEveryNewProject(t *testing.T) {
+	base := t.TempDir()
+	docker.SetBaseDir(base)
+	defer docker.SetBaseDir("")
+	for _, project := range []string{"api", "db"} {
+		if err := os.MkdirAll(filepath.Join(base, "deployments", project), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func(saved *Config) { config = saved }(config)
+
+	tests := []struct {
+		name      string
+		policy    string
+		projects  []string
+		wantOK    bool
+		wantEvict int
+	}{
+		{name: "redeploys", policy: docker.RetentionReject, projects: []string{"api", "db"}, wantOK: true},
+		{name: "one new fits", policy: docker.RetentionReject, projects: []string{"api", "web"}, wantOK: true},
+		{name: "two new exceed", policy: docker.RetentionReject, projects: []string{"web", "worker"}},
+		{name: "two new evict one", policy: docker.RetentionEvict, projects: []string{"web", "worker"}, wantOK: true, wantEvict: 1},
+		{name: "more new than evictable", policy: docker.RetentionEvict, projects: []string{"a", "b", "c", "d", "e"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{MaxDeployments: 3, RetentionPolicy: tt.policy}
+			w := httptest.NewRecorder()
+			evict, ok := checkQuota(w, httptest.NewRequest("POST", "/stacks", nil), tt.projects...)
+			if ok != tt.wantOK || evict != tt.wantEvict {
+				t.Fatalf("got evict %d ok %v, want evict %d ok %v", evict, ok, tt.wantEvict, tt.wantOK)
+			}
+			if !ok && w.Code != http.StatusTooManyRequests {
+				t.Errorf("got status %d, want 429", w.Code)
+			}
+		})
+	}
+}
+
+func TestProjectReadsNeedTheOwningKey(t *testing.T) {
+	docker.SetBaseDir(t.TempDir())
+	defer docker.SetBaseDir("")
+	defer func(saved *Config) { config = saved }(config)
+	config = &Config{APIKeys: []string{"key-one", "key-two"}}
+	if err := docker.UpdateProjectState("app", func(state *docker.ProjectState) {
+		state.Owner = apiKeyID("key-one")
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{
+		"/deployments/app/stats",
+		"/deployments/app/events",
+		"/deployments/app/artifacts",
+		"/deployments/app/bundle",
+		"/deployments/app/logs",
+		"/deployments/app/images",
+		"/deployments/app/access-logs",
+		"/deployments/app/access-logs/summary",
+		"/deployments/app/history/1/log",
+	} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer key-two")
+		w := httptest.NewRecorder()
+		deploymentRoutes(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("GET %s with another key: got status %d, want 403", path, w.Code)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/deployments/app/events", nil)
+	r.Header.Set("Authorization", "Bearer key-one")
+	w := httptest.NewRecorder()
+	deploymentRoutes(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("GET events with the owning key: got status %d, want 200", w.Code)
+	}
+}
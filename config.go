@@ -0,0 +1,434 @@
+package main
+
+import (
+	"crypto/tls"
+	"erebrusvps/docker"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Config holds the management server settings read from the environment
+type Config struct {
+	// HTTPSAddr is the address the HTTPS management API listens on
+	HTTPSAddr string
+	// HTTPAddr is the address of the HTTP to HTTPS redirect listener
+	HTTPAddr string
+	// ReservedPorts are never assigned to deployments: the ports of the
+	// listeners above plus EREBRUS_RESERVED_PORTS
+	ReservedPorts []string
+	// UnixSocket is an optional unix socket path serving the API for local tooling
+	UnixSocket     string
+	UnixSocketMode os.FileMode
+	// TLSMinVersion is the lowest TLS version the management API accepts,
+	// independent of the nginx config of deployed apps
+	TLSMinVersion uint16
+
+	// MaxBodyBytes caps request bodies on every listener, MaxUploadBytes
+	// caps source archive uploads
+	MaxBodyBytes   int64
+	MaxUploadBytes int64
+	// MaxExtractBytes and MaxExtractEntries cap what an uploaded archive
+	// may expand to in the workspace
+	MaxExtractBytes   int64
+	MaxExtractEntries int
+	// ReadTimeout, WriteTimeout and IdleTimeout bound each connection. The
+	// write timeout also bounds synchronous deploys, so it defaults high.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	// DeployRatePerMinute and DeployBurst configure the token bucket applied
+	// to deploy requests; a rate of zero disables limiting
+	DeployRatePerMinute float64
+	DeployBurst         int
+
+	// WebhookSecret verifies push webhooks on /webhooks/<project>, which
+	// are disabled while it is empty. Pushes of the same commit within
+	// WebhookDedupWindow collapse into one redeploy.
+	WebhookSecret      string
+	WebhookDedupWindow time.Duration
+
+	// APIKeys are the keys allowed to use the API and AdminKey the one that
+	// may change any project; with neither set the API is open
+	APIKeys  []string
+	AdminKey string
+	// MaxDeployments caps the total number of projects and
+	// MaxDeploymentsPerKey those created per API key, zero is unlimited
+	MaxDeployments       int
+	MaxDeploymentsPerKey int
+	// RetentionPolicy decides what happens when a new project would exceed
+	// MaxDeployments: reject it, or evict the least recently deployed one
+	RetentionPolicy string
+	// MaxConcurrentDeploys queues deployments beyond this many running at
+	// once, zero is unlimited
+	MaxConcurrentDeploys int
+
+	// CORSOrigins lists the origins allowed to call the API; "*" allows any
+	// origin but then credentials are not allowed
+	CORSOrigins []string
+
+	// BaseDir holds deployments/ and certs/, the home directory when empty
+	BaseDir string
+
+	// LogRetentionBytes caps the compressed deploy logs kept per project
+	LogRetentionBytes int64
+
+	// NetworkName is the docker network deployments join
+	NetworkName string
+
+	// Proxy is the default reverse proxy for deployments: nginx, traefik or
+	// none. Nginx is only installed at startup in nginx mode.
+	Proxy string
+	// Traefik configures the network, entrypoint and cert resolver used in
+	// traefik mode
+	Traefik docker.TraefikConfig
+	// DockerVersion and ComposeVersion pin what the installer fetches,
+	// latest when empty
+	DockerVersion  string
+	ComposeVersion string
+	// LocalPathRoot allowlists the directory local_path deployments copy
+	// from, empty disables them
+	LocalPathRoot string
+	// Rootless runs without sudo: no packages are installed at startup and
+	// the nginx proxy is unavailable
+	Rootless bool
+	// PublicHost is the address used in URLs of deployments without a proxy,
+	// detected when empty
+	PublicHost string
+	// Registry holds default credentials for private base images, nil when
+	// EREBRUS_REGISTRY_USERNAME is unset
+	Registry *docker.RegistryAuth
+	// LocalRegistry archives builds in a local registry:2 for rollbacks
+	LocalRegistry bool
+	// PushRegistry is where push deployments send their images, nil when
+	// EREBRUS_PUSH_REPOSITORY is unset
+	PushRegistry *docker.PushRegistry
+
+	// ComposeTemplate is the parsed EREBRUS_COMPOSE_TEMPLATE file that
+	// replaces the built-in docker-compose.yml, nil when unset
+	ComposeTemplate *template.Template
+
+	// StateStore is where project state, events and the deploy sequence are
+	// kept: sqlite, the default, or json for the files of earlier versions
+	StateStore string
+	// StateDB is the SQLite database path, state.db in the state directory
+	// when empty
+	StateDB string
+
+	// SecretKeyFile holds the master key stored env vars and registry
+	// passwords are encrypted with, generated on first run
+	SecretKeyFile string
+
+	// Exec restricts the programs the exec endpoint may run, from
+	// EREBRUS_EXEC_ALLOW and EREBRUS_EXEC_DENY. Only the program name is
+	// checked; once either is set, shells and wrappers like env only run
+	// when allowed by name.
+	Exec docker.ExecPolicy
+
+	// ProjectDeployLog keeps the latest run's log in each workspace's deploy.log
+	ProjectDeployLog bool
+	// CompressWorkspaces packs each workspace's source after a successful build
+	CompressWorkspaces bool
+	// WebSocketCompression negotiates permessage-deflate for streamed logs
+	WebSocketCompression bool
+	// IPv6 adds IPv6 listeners to nginx sites and checks ports on both
+	// address families; EREBRUS_IPV6=auto, the default, detects support
+	IPv6 bool
+
+	// ImageRetention and BuildCacheMaxAge control post-deploy cleanup
+	ImageRetention   int
+	BuildCacheMaxAge time.Duration
+
+	// Watchdog configures crash loop detection for running deployments
+	Watchdog docker.WatchdogConfig
+	// Webhooks are notified of container crashes, OOM kills and restarts
+	Webhooks []string
+	// ReconcileInterval is how often missing nginx configs are restored,
+	// zero only checks at startup
+	ReconcileInterval time.Duration
+}
+
+var config *Config
+
+// getEnv returns the value of an environment variable or a fallback
+func getEnv(key, fallback string) string {
+	if value, ok := os.LookupEnv(key); ok {
+		return value
+	}
+	return fallback
+}
+
+// splitList parses a comma separated list, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// getEnvInt parses an integer environment variable
+func getEnvInt(key string, fallback int) (int, error) {
+	value, err := strconv.Atoi(getEnv(key, strconv.Itoa(fallback)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return value, nil
+}
+
+// getEnvDuration parses a duration environment variable such as "30s"
+func getEnvDuration(key string, fallback time.Duration) (time.Duration, error) {
+	value, err := time.ParseDuration(getEnv(key, fallback.String()))
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", key, err)
+	}
+	return value, nil
+}
+
+// tlsVersions maps EREBRUS_TLS_MIN_VERSION values to TLS versions
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadConfig reads the server configuration from EREBRUS_* environment variables
+func loadConfig() (*Config, error) {
+	cfg := &Config{
+		HTTPSAddr:   getEnv("EREBRUS_HTTPS_ADDR", ":8443"),
+		HTTPAddr:    getEnv("EREBRUS_HTTP_ADDR", ":8080"),
+		UnixSocket:  getEnv("EREBRUS_UNIX_SOCKET", ""),
+		CORSOrigins: splitList(getEnv("EREBRUS_CORS_ORIGINS", "*")),
+		APIKeys:     splitList(getEnv("EREBRUS_API_KEYS", "")),
+		AdminKey:    getEnv("EREBRUS_ADMIN_KEY", ""),
+	}
+
+	var err error
+
+	// Namespace the network per instance unless it is set explicitly
+	networkName := "deployment-network"
+	if instance := getEnv("EREBRUS_INSTANCE", ""); instance != "" {
+		networkName = instance + "-deployment-network"
+	}
+	cfg.NetworkName = getEnv("EREBRUS_NETWORK_NAME", networkName)
+
+	cfg.Proxy = getEnv("EREBRUS_PROXY", docker.ProxyNginx)
+	if err := docker.ValidateProxy(cfg.Proxy); err != nil {
+		return nil, fmt.Errorf("invalid EREBRUS_PROXY: %v", err)
+	}
+	cfg.Rootless = getEnv("EREBRUS_ROOTLESS", "") == "true"
+	if cfg.Rootless && cfg.Proxy == docker.ProxyNginx {
+		if _, set := os.LookupEnv("EREBRUS_PROXY"); set {
+			return nil, fmt.Errorf("EREBRUS_PROXY=%s needs root, use %s or %s with EREBRUS_ROOTLESS", docker.ProxyNginx, docker.ProxyTraefik, docker.ProxyNone)
+		}
+		cfg.Proxy = docker.ProxyNone
+	}
+	cfg.PublicHost = getEnv("EREBRUS_PUBLIC_HOST", "")
+	if username := getEnv("EREBRUS_REGISTRY_USERNAME", ""); username != "" {
+		cfg.Registry = &docker.RegistryAuth{
+			Server:   getEnv("EREBRUS_REGISTRY_SERVER", ""),
+			Username: username,
+			Password: getEnv("EREBRUS_REGISTRY_PASSWORD", ""),
+		}
+		if err := docker.ValidateRegistryAuth(cfg.Registry); err != nil {
+			return nil, fmt.Errorf("invalid EREBRUS_REGISTRY_*: %v", err)
+		}
+	}
+	cfg.LocalRegistry = getEnv("EREBRUS_LOCAL_REGISTRY", "") == "true"
+	if path := getEnv("EREBRUS_COMPOSE_TEMPLATE", ""); path != "" {
+		if cfg.ComposeTemplate, err = docker.LoadComposeTemplate(path); err != nil {
+			return nil, fmt.Errorf("invalid EREBRUS_COMPOSE_TEMPLATE: %v", err)
+		}
+	}
+	cfg.StateStore = getEnv("EREBRUS_STATE_STORE", "sqlite")
+	if cfg.StateStore != "sqlite" && cfg.StateStore != "json" {
+		return nil, fmt.Errorf("invalid EREBRUS_STATE_STORE %q, want sqlite or json", cfg.StateStore)
+	}
+	cfg.StateDB = getEnv("EREBRUS_STATE_DB", "")
+	cfg.SecretKeyFile = getEnv("EREBRUS_SECRET_KEY_FILE", docker.DefaultSecretKeyPath())
+	cfg.Exec = docker.ExecPolicy{
+		Allow: splitList(getEnv("EREBRUS_EXEC_ALLOW", "")),
+		Deny:  splitList(getEnv("EREBRUS_EXEC_DENY", "")),
+	}
+	if cfg.ReservedPorts, err = reservedPorts(cfg); err != nil {
+		return nil, err
+	}
+	if repository := getEnv("EREBRUS_PUSH_REPOSITORY", ""); repository != "" {
+		cfg.PushRegistry = &docker.PushRegistry{Repository: repository}
+		if username := getEnv("EREBRUS_PUSH_USERNAME", ""); username != "" {
+			cfg.PushRegistry.Auth = &docker.RegistryAuth{
+				Server:   strings.SplitN(repository, "/", 2)[0],
+				Username: username,
+				Password: getEnv("EREBRUS_PUSH_PASSWORD", ""),
+			}
+		}
+		if err := docker.ValidatePushRegistry(cfg.PushRegistry); err != nil {
+			return nil, fmt.Errorf("invalid EREBRUS_PUSH_*: %v", err)
+		}
+	}
+	cfg.LocalPathRoot = getEnv("EREBRUS_LOCAL_PATH_ROOT", "")
+	cfg.BaseDir = getEnv("EREBRUS_BASE_DIR", "")
+	cfg.Webhooks = splitList(getEnv("EREBRUS_WEBHOOK_URLS", ""))
+	for _, webhook := range cfg.Webhooks {
+		if u, err := url.Parse(webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid EREBRUS_WEBHOOK_URLS entry: %q", webhook)
+		}
+	}
+	cfg.ProjectDeployLog = getEnv("EREBRUS_PROJECT_DEPLOY_LOG", "true") != "false"
+	cfg.CompressWorkspaces = getEnv("EREBRUS_COMPRESS_WORKSPACES", "") == "true"
+	cfg.WebSocketCompression = getEnv("EREBRUS_WS_COMPRESSION", "") == "true"
+	switch ipv6 := getEnv("EREBRUS_IPV6", "auto"); ipv6 {
+	case "auto":
+		cfg.IPv6 = docker.HostSupportsIPv6()
+	case "true", "false":
+		cfg.IPv6 = ipv6 == "true"
+	default:
+		return nil, fmt.Errorf("invalid EREBRUS_IPV6 %q, expected auto, true or false", ipv6)
+	}
+	cfg.DockerVersion = getEnv("EREBRUS_DOCKER_VERSION", "")
+	cfg.ComposeVersion = getEnv("EREBRUS_COMPOSE_VERSION", "")
+	cfg.Traefik = docker.TraefikConfig{
+		Network:      getEnv("EREBRUS_TRAEFIK_NETWORK", "traefik"),
+		Entrypoint:   getEnv("EREBRUS_TRAEFIK_ENTRYPOINT", "websecure"),
+		CertResolver: getEnv("EREBRUS_TRAEFIK_CERT_RESOLVER", ""),
+	}
+
+	mode, err := strconv.ParseUint(getEnv("EREBRUS_UNIX_SOCKET_MODE", "0660"), 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EREBRUS_UNIX_SOCKET_MODE: %v", err)
+	}
+	cfg.UnixSocketMode = os.FileMode(mode)
+
+	minVersion := getEnv("EREBRUS_TLS_MIN_VERSION", "1.2")
+	if cfg.TLSMinVersion = tlsVersions[minVersion]; cfg.TLSMinVersion == 0 {
+		return nil, fmt.Errorf("invalid EREBRUS_TLS_MIN_VERSION: %q, expected 1.2 or 1.3", minVersion)
+	}
+
+	cfg.MaxBodyBytes, err = strconv.ParseInt(getEnv("EREBRUS_MAX_BODY_BYTES", "1048576"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EREBRUS_MAX_BODY_BYTES: %v", err)
+	}
+	cfg.MaxUploadBytes, err = strconv.ParseInt(getEnv("EREBRUS_MAX_UPLOAD_MB", "200"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EREBRUS_MAX_UPLOAD_MB: %v", err)
+	}
+	cfg.MaxUploadBytes *= 1024 * 1024
+	cfg.MaxExtractBytes, err = strconv.ParseInt(getEnv("EREBRUS_MAX_EXTRACT_MB", "1024"), 10, 64)
+	if err != nil || cfg.MaxExtractBytes <= 0 {
+		return nil, fmt.Errorf("invalid EREBRUS_MAX_EXTRACT_MB: must be a positive number of megabytes")
+	}
+	cfg.MaxExtractBytes *= 1024 * 1024
+	if cfg.MaxExtractEntries, err = getEnvInt("EREBRUS_MAX_EXTRACT_ENTRIES", 100000); err != nil {
+		return nil, err
+	}
+	if cfg.MaxExtractEntries <= 0 {
+		return nil, fmt.Errorf("invalid EREBRUS_MAX_EXTRACT_ENTRIES: must be positive")
+	}
+	if cfg.ReadTimeout, err = getEnvDuration("EREBRUS_READ_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.WriteTimeout, err = getEnvDuration("EREBRUS_WRITE_TIMEOUT", 30*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.IdleTimeout, err = getEnvDuration("EREBRUS_IDLE_TIMEOUT", 2*time.Minute); err != nil {
+		return nil, err
+	}
+
+	cfg.DeployRatePerMinute, err = strconv.ParseFloat(getEnv("EREBRUS_DEPLOY_RATE_PER_MINUTE", "6"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EREBRUS_DEPLOY_RATE_PER_MINUTE: %v", err)
+	}
+	cfg.DeployBurst, err = strconv.Atoi(getEnv("EREBRUS_DEPLOY_BURST", "3"))
+	if err == nil && cfg.DeployBurst < 1 {
+		err = fmt.Errorf("must be at least 1")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid EREBRUS_DEPLOY_BURST: %v", err)
+	}
+
+	cfg.WebhookSecret = getEnv("EREBRUS_WEBHOOK_SECRET", "")
+	if cfg.WebhookDedupWindow, err = getEnvDuration("EREBRUS_WEBHOOK_DEDUP_WINDOW", 5*time.Minute); err != nil {
+		return nil, err
+	}
+
+	retentionMB, err := strconv.ParseInt(getEnv("EREBRUS_LOG_RETENTION_MB", "50"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EREBRUS_LOG_RETENTION_MB: %v", err)
+	}
+	cfg.LogRetentionBytes = retentionMB * 1024 * 1024
+
+	if cfg.MaxDeployments, err = getEnvInt("EREBRUS_MAX_DEPLOYMENTS", 0); err != nil {
+		return nil, err
+	}
+	if cfg.MaxDeploymentsPerKey, err = getEnvInt("EREBRUS_MAX_DEPLOYMENTS_PER_KEY", 0); err != nil {
+		return nil, err
+	}
+	cfg.RetentionPolicy = getEnv("EREBRUS_RETENTION_POLICY", docker.RetentionReject)
+	if err := docker.ValidateRetentionPolicy(cfg.RetentionPolicy); err != nil {
+		return nil, fmt.Errorf("invalid EREBRUS_RETENTION_POLICY: %v", err)
+	}
+	if cfg.MaxConcurrentDeploys, err = getEnvInt("EREBRUS_MAX_CONCURRENT_DEPLOYS", 0); err != nil {
+		return nil, err
+	}
+
+	if cfg.ImageRetention, err = getEnvInt("EREBRUS_IMAGE_RETENTION", 3); err != nil {
+		return nil, err
+	}
+	if cfg.BuildCacheMaxAge, err = getEnvDuration("EREBRUS_BUILD_CACHE_MAX_AGE", 7*24*time.Hour); err != nil {
+		return nil, err
+	}
+
+	if cfg.ReconcileInterval, err = getEnvDuration("EREBRUS_RECONCILE_INTERVAL", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.Watchdog.Interval, err = getEnvDuration("EREBRUS_WATCHDOG_INTERVAL", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.Watchdog.RestartThreshold, err = getEnvInt("EREBRUS_WATCHDOG_RESTARTS", 3); err != nil {
+		return nil, err
+	}
+	if cfg.Watchdog.RestartWindow, err = getEnvDuration("EREBRUS_WATCHDOG_WINDOW", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.Watchdog.RestartingTimeout, err = getEnvDuration("EREBRUS_WATCHDOG_RESTARTING_TIMEOUT", 5*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.Watchdog.AutoStopAfter, err = getEnvInt("EREBRUS_WATCHDOG_AUTO_STOP_AFTER", 0); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// reservedPorts returns the ports of the manager's own listeners followed by
+// the extra ports in EREBRUS_RESERVED_PORTS
+func reservedPorts(cfg *Config) ([]string, error) {
+	var ports []string
+	for _, addr := range []string{cfg.HTTPSAddr, cfg.HTTPAddr} {
+		if addr == "" {
+			continue
+		}
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listen address %q: %v", addr, err)
+		}
+		ports = append(ports, port)
+	}
+	if cfg.LocalRegistry {
+		ports = append(ports, docker.LocalRegistryPort)
+	}
+	for _, port := range splitList(getEnv("EREBRUS_RESERVED_PORTS", "")) {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("invalid EREBRUS_RESERVED_PORTS entry: %q", port)
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
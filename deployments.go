@@ -0,0 +1,705 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"erebrusvps/docker"
+	"erebrusvps/websocket"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsFollowInterval is the delay between snapshots when streaming stats
+const statsFollowInterval = 2 * time.Second
+
+// listDeploymentsHandler returns the status of every managed deployment
+func listDeploymentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	deployments, err := dockerSetup.ListDeployments()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// ?mine=true keeps the projects created with the caller's API key
+	if r.URL.Query().Get("mine") == "true" {
+		owner := requestOwner(r)
+		mine := []docker.DeploymentStatus{}
+		for _, deployment := range deployments {
+			if ownedBy(deployment, owner) {
+				mine = append(mine, deployment)
+			}
+		}
+		deployments = mine
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deployments)
+}
+
+// deploymentRoutes dispatches /deployments/{project}/{action} requests
+func deploymentRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/deployments/"), "/"), "/")
+	if parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	project := parts[0]
+	if err := docker.ValidateProjectName(project); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(parts) == 1 {
+		patchDeploymentHandler(w, r, project)
+		return
+	}
+
+	switch parts[1] {
+	case "stats":
+		statsHandler(w, r, project)
+	case "events":
+		eventsHandler(w, r, project)
+	case "artifacts":
+		artifactsHandler(w, r, project)
+	case "bundle":
+		bundleHandler(w, r, project)
+	case "promote":
+		promoteHandler(w, r, project)
+	case "rename":
+		renameHandler(w, r, project)
+	case "env":
+		envHandler(w, r, project)
+	case "logs":
+		projectLogHandler(w, r, project)
+	case "images":
+		imagesHandler(w, r, project)
+	case "rollback":
+		rollbackHandler(w, r, project)
+	case "exec":
+		execHandler(w, r, project)
+	case "access-logs":
+		if len(parts) == 3 && parts[2] == "summary" {
+			accessLogSummaryHandler(w, r, project)
+			return
+		}
+		accessLogsHandler(w, r, project)
+	case "history":
+		if len(parts) == 4 && parts[3] == "log" {
+			deployLogHandler(w, r, project, parts[2])
+			return
+		}
+		http.NotFound(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// statsHandler returns a resource usage snapshot for a project, or streams
+// snapshots over a WebSocket when follow=true
+func statsHandler(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeProject(w, r, project) {
+		return
+	}
+
+	if r.URL.Query().Get("follow") == "true" {
+		websocket.Stream(w, r, func(ctx context.Context, send websocket.SendFunc) error {
+			for {
+				stats, err := dockerSetup.GetProjectStats(project)
+				if err != nil {
+					return send(map[string]string{"error": err.Error()})
+				}
+				if err := send(stats); err != nil {
+					return err
+				}
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-time.After(statsFollowInterval):
+				}
+			}
+		})
+		return
+	}
+
+	stats, err := dockerSetup.GetProjectStats(project)
+	if errors.Is(err, docker.ErrProjectNotRunning) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// containerLogsHandler streams the container logs of a project over a
+// WebSocket on /ws/logs/{project}, starting with the last ?tail= lines, of
+// one ?service= or the whole stack
+func containerLogsHandler(w http.ResponseWriter, r *http.Request) {
+	project := strings.Trim(strings.TrimPrefix(r.URL.Path, "/ws/logs/"), "/")
+	if err := docker.ValidateProjectName(project); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !authorizeProject(w, r, project) {
+		return
+	}
+
+	tail := r.URL.Query().Get("tail")
+	service := r.URL.Query().Get("service")
+	websocket.Stream(w, r, func(ctx context.Context, send websocket.SendFunc) error {
+		err := dockerSetup.FollowLogs(ctx, project, service, tail, func(line string) error {
+			return send(line)
+		})
+		if err != nil {
+			send(fmt.Sprintf("[LOGS] %v", err))
+		}
+		return err
+	})
+}
+
+// requestActor identifies who issued a management request
+func requestActor(r *http.Request) string {
+	if owner := requestOwner(r); owner != "" {
+		return "key:" + owner
+	}
+	return remoteIP(r)
+}
+
+// remoteIP returns the address a request came from, without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// recordEvent appends the outcome of a management operation to the project's history
+func recordEvent(actor, project, eventType string, started time.Time, opErr error) {
+	saveEvent(project, newEvent(actor, eventType, started, opErr))
+}
+
+// recordDeployEvent records a deploy along with how long its build took
+func recordDeployEvent(actor, project, eventType string, started time.Time, result *docker.DeploymentResult, opErr error) {
+	event := newEvent(actor, eventType, started, opErr)
+	if result != nil {
+		event.BuildMs = result.BuildMs
+		event.DeployID = result.DeployID
+		event.Sequence = result.Sequence
+	}
+	saveEvent(project, event)
+}
+
+// newEvent describes the outcome of an operation started at started
+func newEvent(actor, eventType string, started time.Time, opErr error) docker.Event {
+	event := docker.Event{
+		Timestamp:  started.UTC(),
+		Type:       eventType,
+		Actor:      actor,
+		Result:     "success",
+		DurationMs: time.Since(started).Milliseconds(),
+	}
+	if opErr != nil {
+		event.Result = "failure"
+		event.Error = opErr.Error()
+	}
+	return event
+}
+
+func saveEvent(project string, event docker.Event) {
+	if err := docker.RecordEvent(project, event); err != nil {
+		fmt.Printf("[EVENTS] Failed to record %s event for %s: %v\n", event.Type, project, err)
+	}
+}
+
+// eventsHandler returns the management event history of a project
+func eventsHandler(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeProject(w, r, project) {
+		return
+	}
+
+	events, err := docker.ListEvents(project)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// deployLogHandler downloads the log of a single deployment run, identified
+// by its deploy ID or sequence number
+func deployLogHandler(w http.ResponseWriter, r *http.Request, project, deployID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeProject(w, r, project) {
+		return
+	}
+
+	// Deploy IDs are hex and may happen to be all digits, so a number that
+	// matches no sequence is still tried as a deploy ID
+	if sequence, err := strconv.ParseUint(deployID, 10, 64); err == nil {
+		if id, ok := docker.DeployIDForSequence(project, sequence); ok {
+			deployID = id
+		}
+	}
+
+	logReader, err := docker.OpenDeployLog(project, deployID)
+	if os.IsNotExist(err) {
+		http.Error(w, "Deployment log not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer logReader.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", deployID+".log"))
+	io.Copy(w, logReader)
+}
+
+// projectLogHandler returns the deploy.log of a project's most recent run
+func projectLogHandler(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeProject(w, r, project) {
+		return
+	}
+
+	logReader, err := docker.OpenProjectLog(project)
+	if os.IsNotExist(err) {
+		http.Error(w, "Deployment log not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer logReader.Close()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.Copy(w, logReader)
+}
+
+// Defaults and caps of the number of access log lines read per request
+const (
+	defaultAccessLogTail      = 100
+	maxAccessLogTail          = 10000
+	defaultAccessSummaryLines = 1000
+	maxAccessSummaryLines     = 100000
+)
+
+// queryLines parses a positive line count query parameter
+func queryLines(r *http.Request, name string, fallback, max int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	lines, err := strconv.Atoi(value)
+	if err != nil || lines < 1 || lines > max {
+		return 0, fmt.Errorf("%s must be between 1 and %d", name, max)
+	}
+	return lines, nil
+}
+
+// accessLogsHandler returns the requests nginx served for a project, the
+// last ?tail= of them, optionally only those after ?since= (an RFC3339 time
+// or a duration such as 15m)
+func accessLogsHandler(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeProject(w, r, project) {
+		return
+	}
+
+	tail, err := queryLines(r, "tail", defaultAccessLogTail, maxAccessLogTail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		if ago, err := time.ParseDuration(value); err == nil {
+			since = time.Now().Add(-ago)
+		} else if since, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "since must be an RFC3339 time or a duration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	entries, err := dockerSetup.AccessLogs(project, tail, since)
+	if os.IsNotExist(err) {
+		http.Error(w, "Access log not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// accessLogSummaryHandler returns the request count, error rate and p95
+// upstream time over the last ?lines= requests of a project
+func accessLogSummaryHandler(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeProject(w, r, project) {
+		return
+	}
+
+	lines, err := queryLines(r, "lines", defaultAccessSummaryLines, maxAccessSummaryLines)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	summary, err := dockerSetup.SummarizeAccessLogs(project, lines)
+	if os.IsNotExist(err) {
+		http.Error(w, "Access log not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+// imagesHandler lists a project's local image tags and those pushed to the
+// push registry
+func imagesHandler(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeProject(w, r, project) {
+		return
+	}
+
+	images, err := dockerSetup.ListImages(project)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(images)
+}
+
+// maxDockerfileSize bounds the Dockerfile override accepted over the API
+const maxDockerfileSize = 1 << 20
+
+// artifactsHandler returns the files generated for a project, and on PUT
+// stores a Dockerfile override for the next deploy
+func artifactsHandler(w http.ResponseWriter, r *http.Request, project string) {
+	switch r.Method {
+	case http.MethodGet:
+		if !authorizeProject(w, r, project) {
+			return
+		}
+		artifacts, err := docker.GetArtifacts(project)
+		if os.IsNotExist(err) {
+			http.Error(w, "Deployment not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(artifacts)
+
+	case http.MethodPut:
+		if !authorizeProject(w, r, project) {
+			return
+		}
+		var body struct {
+			Dockerfile string `json:"dockerfile"`
+		}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxDockerfileSize)).Decode(&body); err != nil {
+			http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+			return
+		}
+		if err := docker.SetDockerfileOverride(project, body.Dockerfile); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// bundleHandler downloads a tar.gz of a project's generated files and spec
+func bundleHandler(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeProject(w, r, project) {
+		return
+	}
+
+	// Build the archive first so errors can still be reported with a status
+	var buf bytes.Buffer
+	if err := docker.WriteBundle(project, &buf); err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "Deployment not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", project+"-bundle.tar.gz"))
+	w.Write(buf.Bytes())
+}
+
+// ownedBy reports whether a deployment, or one of its environments, was
+// created with the given key
+func ownedBy(deployment docker.DeploymentStatus, owner string) bool {
+	if deployment.Owner == owner {
+		return true
+	}
+	for _, environment := range deployment.Environments {
+		if environment.Owner == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// promoteHandler redeploys a project's target environment from the exact
+// commit running in the source environment, e.g. {"from":"staging","to":"prod"}
+func promoteHandler(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+	if body.From == "" {
+		http.Error(w, "from is required", http.StatusBadRequest)
+		return
+	}
+
+	deployment, err := docker.PromotionSpec(project, body.From, body.To)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveDeployment(w, r, deployment)
+}
+
+// patchDeploymentHandler repoints a git deployment at a moved repository,
+// e.g. {"git_url":"https://github.com/new-org/app.git"}, and redeploys it on
+// the same port
+func patchDeploymentHandler(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeProject(w, r, project) {
+		return
+	}
+
+	var body struct {
+		GitURL string `json:"git_url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+	if body.GitURL == "" {
+		http.Error(w, "git_url is required", http.StatusBadRequest)
+		return
+	}
+
+	deployment, err := dockerSetup.RepointSpec(project, body.GitURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveDeployment(w, r, deployment)
+}
+
+// rollbackHandler redeploys a project from a build archived in the local
+// registry, e.g. {"tag":"<commit>"}, or the previous build without a tag
+func rollbackHandler(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		Tag string `json:"tag"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+			return
+		}
+	}
+
+	deployment, err := dockerSetup.RollbackSpec(project, body.Tag)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	serveDeployment(w, r, deployment)
+}
+
+// execHandler runs a one-off command in a project's container, e.g.
+// {"command":["npm","run","migrate"],"timeout":120}. Every call is recorded
+// in the project's events, as it runs arbitrary code on the server.
+func execHandler(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeProject(w, r, project) {
+		return
+	}
+
+	var req docker.ExecRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+
+	started := time.Now()
+	result, err := dockerSetup.Exec(project, req)
+	event := newEvent(requestActor(r), docker.EventExec, started, err)
+	event.Command = req.Command
+	if result != nil {
+		event.DeployID = result.ExecID
+		event.ExitCode = &result.ExitCode
+		if result.ExitCode != 0 {
+			event.Result = "failure"
+		}
+	}
+	saveEvent(project, event)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// renameHandler moves a project to a new name, e.g. {"new_name":"shop"}
+func renameHandler(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeProject(w, r, project) {
+		return
+	}
+
+	var body struct {
+		NewName string `json:"new_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+	if err := docker.ValidateProjectName(body.NewName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := dockerSetup.RenameProject(project, body.NewName); errors.Is(err, docker.ErrProjectBusy) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// envHandler sets and unsets app env vars without a rebuild, e.g.
+// {"set":{"LOG_LEVEL":"debug"},"unset":["DEBUG"]}, and returns the masked
+// result. With "signal":"HUP" the app is signalled instead of recreated.
+func envHandler(w http.ResponseWriter, r *http.Request, project string) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorizeProject(w, r, project) {
+		return
+	}
+
+	var patch docker.EnvPatch
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+	if len(patch.Set) == 0 && len(patch.Unset) == 0 && patch.Signal == "" {
+		http.Error(w, "set, unset or signal is required", http.StatusBadRequest)
+		return
+	}
+
+	started := time.Now()
+	envVars, err := dockerSetup.UpdateEnv(project, patch)
+	recordEvent(requestActor(r), project, docker.EventEnv, started, err)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(envVars)
+}
@@ -0,0 +1,42 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// validateAllowIPs ensures every allow_ips entry is an IP or CIDR range so it
+// can be embedded in the nginx config safely
+func validateAllowIPs(deployment Deployment) error {
+	if len(deployment.AllowIPs) == 0 {
+		return nil
+	}
+	if deployment.Proxy != ProxyNginx {
+		return fmt.Errorf("allow_ips is only supported with proxy %q", ProxyNginx)
+	}
+	for _, entry := range deployment.AllowIPs {
+		if net.ParseIP(entry) != nil {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(entry); err != nil {
+			return fmt.Errorf("invalid allow_ips entry: %q, expected an IP or CIDR", entry)
+		}
+	}
+	return nil
+}
+
+// nginxAllowIPs renders the allow/deny directives of a location. Blocked
+// clients get nginx's 403; without an allowlist nothing is restricted.
+func nginxAllowIPs(allowIPs []string) string {
+	if len(allowIPs) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("        # Only allow listed addresses\n")
+	for _, entry := range allowIPs {
+		fmt.Fprintf(&b, "        allow %s;\n", entry)
+	}
+	b.WriteString("        deny all;\n\n")
+	return b.String()
+}
@@ -0,0 +1,242 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nginxLogDir holds the access and error logs of every nginx site. It is a
+// subdirectory because the stock nginx logrotate config already claims
+// /var/log/nginx/*.log, and logrotate skips files listed twice.
+const nginxLogDir = "/var/log/nginx/erebrus"
+
+// accessLogFormat names the JSON log format the sites write, one request
+// per line so the manager can parse it
+const accessLogFormat = "erebrus_json"
+
+const (
+	nginxLogFormatPath = "/etc/nginx/conf.d/erebrus-log-format.conf"
+	logrotateConfPath  = "/etc/logrotate.d/erebrus-nginx"
+)
+
+const nginxLogFormatConf = `log_format ` + accessLogFormat + ` escape=json '{"time":"$time_iso8601",'
+    '"remote_addr":"$remote_addr",'
+    '"method":"$request_method",'
+    '"uri":"$request_uri",'
+    '"status":"$status",'
+    '"bytes_sent":"$body_bytes_sent",'
+    '"request_time":"$request_time",'
+    '"upstream_time":"$upstream_response_time",'
+    '"user_agent":"$http_user_agent"}';
+`
+
+const logrotateConf = nginxLogDir + `/*.log {
+    daily
+    rotate 14
+    missingok
+    notifempty
+    compress
+    delaycompress
+    sharedscripts
+    postrotate
+        invoke-rc.d nginx rotate >/dev/null 2>&1 || true
+    endscript
+}
+`
+
+// nginxLoggingInstalled is set once the log format and logrotate config are
+// in place. It is guarded by nginxMutex.
+var nginxLoggingInstalled bool
+
+// ensureNginxLogging installs the shared log format, the log directory and
+// its logrotate config. The caller holds nginxMutex.
+func (d *DockerSetup) ensureNginxLogging() error {
+	if nginxLoggingInstalled {
+		return nil
+	}
+	if err := d.runElevated("mkdir", "-p", nginxLogDir); err != nil {
+		return fmt.Errorf("failed to create %s: %v", nginxLogDir, err)
+	}
+	for path, content := range map[string]string{
+		nginxLogFormatPath: nginxLogFormatConf,
+		logrotateConfPath:  logrotateConf,
+	} {
+		tmpFile := filepath.Join(os.TempDir(), "erebrus_"+filepath.Base(path))
+		if err := os.WriteFile(tmpFile, []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write temporary config: %v", err)
+		}
+		if err := d.runElevated("mv", tmpFile, path); err != nil {
+			return fmt.Errorf("failed to install %s: %v", path, err)
+		}
+	}
+	nginxLoggingInstalled = true
+	return nil
+}
+
+func accessLogPath(project string) string {
+	return filepath.Join(nginxLogDir, project+".access.log")
+}
+
+// nginxLogging renders the per-project access and error log directives
+func nginxLogging(project string) string {
+	return fmt.Sprintf(`    access_log %s %s;
+    error_log %s;
+`, accessLogPath(project), accessLogFormat, filepath.Join(nginxLogDir, project+".error.log"))
+}
+
+// AccessLogEntry is one request served by nginx for a project
+type AccessLogEntry struct {
+	Time         time.Time `json:"time"`
+	RemoteAddr   string    `json:"remote_addr"`
+	Method       string    `json:"method"`
+	URI          string    `json:"uri"`
+	Status       int       `json:"status"`
+	BytesSent    int64     `json:"bytes_sent"`
+	RequestTime  float64   `json:"request_time"`
+	UpstreamTime *float64  `json:"upstream_time,omitempty"`
+	UserAgent    string    `json:"user_agent,omitempty"`
+}
+
+// rawAccessLogEntry mirrors the log format, where every value is a string
+type rawAccessLogEntry struct {
+	Time         string `json:"time"`
+	RemoteAddr   string `json:"remote_addr"`
+	Method       string `json:"method"`
+	URI          string `json:"uri"`
+	Status       string `json:"status"`
+	BytesSent    string `json:"bytes_sent"`
+	RequestTime  string `json:"request_time"`
+	UpstreamTime string `json:"upstream_time"`
+	UserAgent    string `json:"user_agent"`
+}
+
+// parseAccessLogLine parses one line of the access log. Lines that are
+// partially written or not in the JSON format are rejected.
+func parseAccessLogLine(line []byte) (AccessLogEntry, bool) {
+	var raw rawAccessLogEntry
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return AccessLogEntry{}, false
+	}
+	at, err := time.Parse(time.RFC3339, raw.Time)
+	if err != nil {
+		return AccessLogEntry{}, false
+	}
+	status, err := strconv.Atoi(raw.Status)
+	if err != nil {
+		return AccessLogEntry{}, false
+	}
+	entry := AccessLogEntry{
+		Time:       at,
+		RemoteAddr: raw.RemoteAddr,
+		Method:     raw.Method,
+		URI:        raw.URI,
+		Status:     status,
+		UserAgent:  raw.UserAgent,
+	}
+	entry.BytesSent, _ = strconv.ParseInt(raw.BytesSent, 10, 64)
+	entry.RequestTime, _ = strconv.ParseFloat(raw.RequestTime, 64)
+	if upstream, ok := parseUpstreamTime(raw.UpstreamTime); ok {
+		entry.UpstreamTime = &upstream
+	}
+	return entry, true
+}
+
+// parseUpstreamTime sums $upstream_response_time, which lists one time per
+// upstream tried ("0.004, 0.120") and is "-" when nothing was proxied
+func parseUpstreamTime(value string) (float64, bool) {
+	var total float64
+	found := false
+	for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ':' || r == ' ' }) {
+		seconds, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			continue
+		}
+		total += seconds
+		found = true
+	}
+	return total, found
+}
+
+// readAccessLog returns the last lines of a project's access log. The logs
+// belong to nginx, so they are read as root.
+func (d *DockerSetup) readAccessLog(project string, lines int) ([]byte, error) {
+	path := accessLogPath(project)
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	args := d.elevatedArgs("tail", "-n", strconv.Itoa(lines), path)
+	output, err := d.runner.Output(exec.Command(args[0], args[1:]...))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access log: %v", err)
+	}
+	return output, nil
+}
+
+// AccessLogs returns up to tail requests a project served, oldest first,
+// skipping those before since when it is set
+func (d *DockerSetup) AccessLogs(project string, tail int, since time.Time) ([]AccessLogEntry, error) {
+	output, err := d.readAccessLog(project, tail)
+	if err != nil {
+		return nil, err
+	}
+	entries := []AccessLogEntry{}
+	for _, line := range bytes.Split(output, []byte("\n")) {
+		entry, ok := parseAccessLogLine(line)
+		if !ok || entry.Time.Before(since) {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// AccessLogSummary aggregates the most recent requests of a project
+type AccessLogSummary struct {
+	Requests int `json:"requests"`
+	// Errors counts 5xx responses
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	// P95UpstreamMs is the 95th percentile time the app took to respond,
+	// absent when no request reached it
+	P95UpstreamMs *float64  `json:"p95_upstream_ms,omitempty"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+}
+
+// SummarizeAccessLogs aggregates the last lines of a project's access log
+func (d *DockerSetup) SummarizeAccessLogs(project string, lines int) (*AccessLogSummary, error) {
+	entries, err := d.AccessLogs(project, lines, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &AccessLogSummary{Requests: len(entries)}
+	var upstream []float64
+	for _, entry := range entries {
+		if entry.Status >= 500 {
+			summary.Errors++
+		}
+		if entry.UpstreamTime != nil {
+			upstream = append(upstream, *entry.UpstreamTime*1000)
+		}
+	}
+	if len(entries) > 0 {
+		summary.ErrorRate = float64(summary.Errors) / float64(len(entries))
+		summary.From = entries[0].Time
+		summary.To = entries[len(entries)-1].Time
+	}
+	if len(upstream) > 0 {
+		sort.Float64s(upstream)
+		p95 := upstream[(len(upstream)*95+99)/100-1]
+		summary.P95UpstreamMs = &p95
+	}
+	return summary, nil
+}
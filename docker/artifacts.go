@@ -0,0 +1,97 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Artifacts are the files the manager generated or used for a deployment
+type Artifacts struct {
+	Dockerfile       string `json:"dockerfile"`
+	DockerfileSource string `json:"dockerfile_source"`
+	Compose          string `json:"compose"`
+	NginxConfig      string `json:"nginx_config"`
+}
+
+func dockerfileOverridePath(project string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "overrides", project, "Dockerfile"), nil
+}
+
+// GetArtifacts returns the Dockerfile, compose file (with environment values
+// redacted) and nginx config currently in use by a project
+func GetArtifacts(project string) (*Artifacts, error) {
+	workDir, err := workspaceDir(project)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(workDir); err != nil {
+		return nil, err
+	}
+
+	state, err := LoadProjectState(project)
+	if err != nil {
+		return nil, err
+	}
+	artifacts := &Artifacts{DockerfileSource: state.DockerfileSource}
+
+	dockerfile := "Dockerfile"
+	if state.Deployment != nil {
+		if path, _, err := dockerfileFor(workDir, *state.Deployment); err == nil {
+			dockerfile = path
+		}
+	}
+	if data, err := os.ReadFile(filepath.Join(workDir, dockerfile)); err == nil {
+		artifacts.Dockerfile = string(data)
+	}
+	if data, err := os.ReadFile(filepath.Join(workDir, "docker-compose.yml")); err == nil {
+		artifacts.Compose = redactComposeEnv(string(data))
+	}
+	if data, err := os.ReadFile(fmt.Sprintf("/etc/nginx/sites-available/%s", project)); err == nil {
+		artifacts.NginxConfig = string(data)
+	}
+	return artifacts, nil
+}
+
+// SetDockerfileOverride stores a Dockerfile used instead of the detected one
+// from the next deploy of the project onwards
+func SetDockerfileOverride(project, content string) error {
+	if strings.TrimSpace(content) == "" {
+		return fmt.Errorf("dockerfile override must not be empty")
+	}
+	path, err := dockerfileOverridePath(project)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create override directory: %v", err)
+	}
+	return os.WriteFile(path, []byte(content), 0644)
+}
+
+var composeEnvLine = regexp.MustCompile(`^(\s+[A-Za-z_][A-Za-z0-9_]*: )".*"$`)
+
+// redactComposeEnv masks every value in environment blocks of a compose file
+func redactComposeEnv(compose string) string {
+	lines := strings.Split(compose, "\n")
+	envIndent := -1
+	for i, line := range lines {
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if envIndent >= 0 && strings.TrimSpace(line) != "" && indent <= envIndent {
+			envIndent = -1
+		}
+		if envIndent >= 0 {
+			lines[i] = composeEnvLine.ReplaceAllString(line, `${1}"****"`)
+		}
+		if strings.TrimSpace(line) == "environment:" {
+			envIndent = indent
+		}
+	}
+	return strings.Join(lines, "\n")
+}
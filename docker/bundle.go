@@ -0,0 +1,65 @@
+package docker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// WriteBundle writes a tar.gz of a project's rendered Dockerfile, compose
+// file, nginx config and deployment spec, all with secrets redacted
+func WriteBundle(project string, w io.Writer) error {
+	state, err := LoadProjectState(project)
+	if err != nil {
+		return err
+	}
+	if state.Deployment == nil {
+		return os.ErrNotExist
+	}
+	artifacts, err := GetArtifacts(project)
+	if err != nil {
+		return err
+	}
+	spec, err := json.MarshalIndent(state.Deployment.Redacted(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name    string
+		content string
+	}{
+		{"Dockerfile", artifacts.Dockerfile},
+		{"docker-compose.yml", artifacts.Compose},
+		{"nginx.conf", artifacts.NginxConfig},
+		{"deployment.json", string(spec)},
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		if file.content == "" {
+			continue // e.g. no nginx config for proxy: none
+		}
+		header := &tar.Header{
+			Name:    fmt.Sprintf("%s/%s", project, file.name),
+			Mode:    0644,
+			Size:    int64(len(file.content)),
+			ModTime: time.Now(),
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, file.content); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,66 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// generateWildcardCertificate issues a certificate covering <label>.localhost
+// and *.<label>.localhost, signed by the CA created at startup, and installs
+// it into the nginx ssl directory as <project>.crt. It returns the installed
+// cert and key paths.
+func (d *DockerSetup) generateWildcardCertificate(project, label string) (string, string, error) {
+	certDir := CertDir()
+
+	configContent := fmt.Sprintf(`[req]
+distinguished_name = req_distinguished_name
+req_extensions = v3_req
+prompt = no
+
+[req_distinguished_name]
+C = US
+ST = State
+L = City
+O = Development
+OU = Development Unit
+CN = %[1]s.localhost
+
+[v3_req]
+basicConstraints = CA:FALSE
+keyUsage = nonRepudiation, digitalSignature, keyEncipherment
+extendedKeyUsage = serverAuth
+subjectAltName = @alt_names
+
+[alt_names]
+DNS.1 = %[1]s.localhost
+DNS.2 = *.%[1]s.localhost`, label)
+
+	configPath := filepath.Join(certDir, project+".cnf")
+	if err := os.WriteFile(configPath, []byte(configContent), 0644); err != nil {
+		return "", "", fmt.Errorf("failed to write certificate config: %v", err)
+	}
+
+	base := filepath.Join(certDir, project)
+	certPath := fmt.Sprintf("/etc/nginx/ssl/%s.crt", project)
+	keyPath := fmt.Sprintf("/etc/nginx/ssl/%s.key", project)
+
+	commands := []string{
+		fmt.Sprintf("openssl genrsa -out %s.key 2048", base),
+		fmt.Sprintf("openssl req -new -key %s.key -out %s.csr -config %s", base, base, configPath),
+		fmt.Sprintf("openssl x509 -req -in %s.csr -CA %s/ca.crt -CAkey %s/ca.key -CAcreateserial -out %s.crt -days 365 -sha256 -extensions v3_req -extfile %s",
+			base, certDir, certDir, base, configPath),
+		d.Elevate(fmt.Sprintf("cp %s.crt %s", base, certPath)),
+		d.Elevate(fmt.Sprintf("cp %s.key %s", base, keyPath)),
+		d.Elevate(fmt.Sprintf("chmod 644 %s", certPath)),
+		d.Elevate(fmt.Sprintf("chmod 600 %s", keyPath)),
+	}
+
+	for _, cmd := range commands {
+		if err := d.ExecuteCommand(cmd); err != nil {
+			return "", "", fmt.Errorf("failed to execute command '%s': %v", cmd, err)
+		}
+	}
+
+	return certPath, keyPath, nil
+}
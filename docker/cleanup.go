@@ -0,0 +1,99 @@
+package docker
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// projectLabel marks images and containers created for a managed project
+const projectLabel = "erebrus.project"
+
+var reclaimedPattern = regexp.MustCompile(`(?m)^Total(?: reclaimed space)?:\s*(\S+)`)
+
+// cleanupAfterDeploy removes this project's superseded images beyond the
+// retention count, its exited containers and old build cache. Failures are
+// logged but never fail the deployment.
+func (d *DockerSetup) cleanupAfterDeploy(project string, sendLog func(string)) {
+	sendLog("[CLEANUP] Removing superseded images and build leftovers")
+	var reclaimed uint64
+
+	freed, err := d.removeOldImages(project)
+	if err != nil {
+		sendLog(fmt.Sprintf("[CLEANUP] Failed to remove old images: %v", err))
+	}
+	reclaimed += freed
+
+	// Only containers carrying our label for this project are pruned
+	out, err := d.combinedOutput(exec.Command("docker", "container", "prune", "-f",
+		"--filter", fmt.Sprintf("label=%s=%s", projectLabel, project)))
+	if err != nil {
+		sendLog(fmt.Sprintf("[CLEANUP] Failed to prune exited containers: %v", err))
+	}
+	reclaimed += parseReclaimed(string(out))
+
+	if d.BuildCacheMaxAge > 0 {
+		out, err := d.combinedOutput(exec.Command("docker", "builder", "prune", "-f",
+			"--filter", "until="+d.BuildCacheMaxAge.String()))
+		if err != nil {
+			sendLog(fmt.Sprintf("[CLEANUP] Failed to prune build cache: %v", err))
+		}
+		reclaimed += parseReclaimed(string(out))
+	}
+
+	sendLog(fmt.Sprintf("[CLEANUP] Reclaimed %d bytes", reclaimed))
+}
+
+// removeOldImages deletes the project's image tags beyond ImageRetention,
+// newest first, returning the bytes freed
+func (d *DockerSetup) removeOldImages(project string) (uint64, error) {
+	out, err := d.runner.Output(exec.Command("docker", "images", imageRepository(project), "--format", "{{.ID}}"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to list images: %v", err)
+	}
+
+	// The running image is always kept, whatever the retention setting
+	keep := d.ImageRetention
+	if keep < 1 {
+		keep = 1
+	}
+
+	var freed uint64
+	seen := make(map[string]bool)
+	for _, id := range strings.Fields(string(out)) {
+		if seen[id] {
+			continue // Same image under several tags
+		}
+		seen[id] = true
+		if len(seen) <= keep {
+			continue // docker lists newest first, keep those for rollback
+		}
+		size := d.imageSize(id)
+		if err := d.runner.Run(exec.Command("docker", "rmi", "-f", id)); err != nil {
+			continue
+		}
+		freed += size
+	}
+	return freed, nil
+}
+
+// imageSize returns the size of an image in bytes
+func (d *DockerSetup) imageSize(id string) uint64 {
+	out, err := d.runner.Output(exec.Command("docker", "image", "inspect", "--format", "{{.Size}}", id))
+	if err != nil {
+		return 0
+	}
+	size, _ := strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+	return size
+}
+
+// parseReclaimed extracts the reclaimed space from docker prune output
+func parseReclaimed(output string) uint64 {
+	match := reclaimedPattern.FindStringSubmatch(output)
+	if match == nil {
+		return 0
+	}
+	return parseSize(match[1])
+}
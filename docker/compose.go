@@ -0,0 +1,38 @@
+package docker
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// composeCandidates are the compose invocations tried in order of preference
+var composeCandidates = [][]string{
+	{"docker", "compose"}, // v2 plugin
+	{"docker-compose"},    // v1 standalone binary
+}
+
+// DetectCompose finds which docker compose flavour is installed and
+// remembers how to invoke it
+func (d *DockerSetup) DetectCompose() error {
+	for _, candidate := range composeCandidates {
+		args := append(append([]string{}, candidate[1:]...), "version")
+		if err := d.runner.Run(exec.Command(candidate[0], args...)); err == nil {
+			d.composeCommand = candidate
+			fmt.Printf("[DOCKER] Using '%s' for compose commands\n", strings.Join(candidate, " "))
+			return nil
+		}
+	}
+	return fmt.Errorf("neither 'docker compose' nor 'docker-compose' is available")
+}
+
+// composeCmd builds a compose command using the detected invocation,
+// defaulting to the v2 plugin when detection has not run
+func (d *DockerSetup) composeCmd(args ...string) *exec.Cmd {
+	command := d.composeCommand
+	if len(command) == 0 {
+		command = composeCandidates[0]
+	}
+	fullArgs := append(append([]string{}, command[1:]...), args...)
+	return exec.Command(command[0], fullArgs...)
+}
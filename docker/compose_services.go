@@ -0,0 +1,196 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Healthcheck is rendered as a compose healthcheck block
+type Healthcheck struct {
+	// Test is the compose test command, e.g. ["CMD", "pg_isready"]
+	Test        []string `json:"test"`
+	Interval    string   `json:"interval,omitempty"`
+	Timeout     string   `json:"timeout,omitempty"`
+	Retries     int      `json:"retries,omitempty"`
+	StartPeriod string   `json:"start_period,omitempty"`
+}
+
+// Service is an image based service deployed alongside the app, such as a database
+type Service struct {
+	Name        string            `json:"name"`
+	Image       string            `json:"image"`
+	EnvVars     map[string]string `json:"env_vars,omitempty"`
+	Healthcheck *Healthcheck      `json:"healthcheck,omitempty"`
+}
+
+// dependsOnConditions are the conditions compose accepts in depends_on
+var dependsOnConditions = map[string]bool{
+	"service_started":                true,
+	"service_healthy":                true,
+	"service_completed_successfully": true,
+}
+
+var (
+	serviceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+	imageNamePattern   = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._/:@-]*$`)
+)
+
+// validateServices checks the extra services, healthchecks and depends_on entries
+func validateServices(deployment Deployment) error {
+	if deployment.ServiceName != "" && !serviceNamePattern.MatchString(deployment.ServiceName) {
+		return fmt.Errorf("invalid service_name: %q", deployment.ServiceName)
+	}
+	names := make(map[string]bool)
+	for _, service := range deployment.Services {
+		if !serviceNamePattern.MatchString(service.Name) || service.Name == serviceName(deployment) {
+			return fmt.Errorf("invalid service name: %q", service.Name)
+		}
+		if names[service.Name] {
+			return fmt.Errorf("duplicate service name: %q", service.Name)
+		}
+		names[service.Name] = true
+		if !imageNamePattern.MatchString(service.Image) {
+			return fmt.Errorf("invalid image for service %s: %q", service.Name, service.Image)
+		}
+		if err := validateEnvVars(service.EnvVars); err != nil {
+			return err
+		}
+		if err := validateHealthcheck(service.Healthcheck); err != nil {
+			return fmt.Errorf("service %s: %v", service.Name, err)
+		}
+	}
+
+	if err := validateHealthcheck(deployment.Healthcheck); err != nil {
+		return err
+	}
+	for name, condition := range deployment.DependsOn {
+		if !names[name] {
+			return fmt.Errorf("depends_on references unknown service: %q", name)
+		}
+		if !dependsOnConditions[condition] {
+			return fmt.Errorf("invalid depends_on condition for %s: %q", name, condition)
+		}
+	}
+	return nil
+}
+
+func validateHealthcheck(hc *Healthcheck) error {
+	if hc == nil {
+		return nil
+	}
+	if len(hc.Test) == 0 {
+		return fmt.Errorf("healthcheck test is required")
+	}
+	for _, value := range []string{hc.Interval, hc.Timeout, hc.StartPeriod} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.ParseDuration(value); err != nil {
+			return fmt.Errorf("invalid healthcheck duration %q: %v", value, err)
+		}
+	}
+	if hc.Retries < 0 {
+		return fmt.Errorf("healthcheck retries must not be negative")
+	}
+	return nil
+}
+
+// composeQuote quotes a value for compose: JSON strings are valid YAML and $
+// is doubled so compose does not interpolate it
+func composeQuote(value string) string {
+	quoted, _ := json.Marshal(strings.ReplaceAll(value, "$", "$$"))
+	return string(quoted)
+}
+
+// composeHealthcheck renders a healthcheck block indented for a service
+func composeHealthcheck(hc *Healthcheck) string {
+	if hc == nil {
+		return ""
+	}
+	test := make([]string, len(hc.Test))
+	for i, part := range hc.Test {
+		test[i] = composeQuote(part)
+	}
+
+	var b strings.Builder
+	b.WriteString("    healthcheck:\n")
+	fmt.Fprintf(&b, "      test: [%s]\n", strings.Join(test, ", "))
+	if hc.Interval != "" {
+		fmt.Fprintf(&b, "      interval: %s\n", hc.Interval)
+	}
+	if hc.Timeout != "" {
+		fmt.Fprintf(&b, "      timeout: %s\n", hc.Timeout)
+	}
+	if hc.Retries > 0 {
+		fmt.Fprintf(&b, "      retries: %d\n", hc.Retries)
+	}
+	if hc.StartPeriod != "" {
+		fmt.Fprintf(&b, "      start_period: %s\n", hc.StartPeriod)
+	}
+	return b.String()
+}
+
+// composeDependsOn renders the app's depends_on block
+func composeDependsOn(dependsOn map[string]string) string {
+	if len(dependsOn) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(dependsOn))
+	for name := range dependsOn {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("    depends_on:\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "      %s:\n        condition: %s\n", name, dependsOn[name])
+	}
+	return b.String()
+}
+
+// composeServices renders the extra services, with their env files from
+// envFiles. They stay on the stack's default network, which the app also
+// joins when services exist.
+func composeServices(services []Service, project, restart string, envFiles map[string]string) string {
+	var b strings.Builder
+	for _, service := range services {
+		fmt.Fprintf(&b, "  %s:\n", service.Name)
+		fmt.Fprintf(&b, "    image: %s\n", composeQuote(service.Image))
+		fmt.Fprintf(&b, "    labels:\n      %s: %s\n", projectLabel, composeQuote(project))
+		b.WriteString(composeEnvFile(envFiles[service.Name]))
+		b.WriteString(composeHealthcheck(service.Healthcheck))
+		fmt.Fprintf(&b, "    restart: %s\n", restart)
+	}
+	return b.String()
+}
+
+// DefaultRestartPolicy leaves containers the operator stopped alone, unlike
+// always
+const DefaultRestartPolicy = "unless-stopped"
+
+var restartPolicyPattern = regexp.MustCompile(`^(no|always|unless-stopped|on-failure(:[1-9][0-9]*)?)$`)
+
+// validateRestartPolicy accepts the compose restart policies
+func validateRestartPolicy(policy string) error {
+	if policy != "" && !restartPolicyPattern.MatchString(policy) {
+		return fmt.Errorf("invalid restart_policy %q, expected no, on-failure[:retries], always or unless-stopped", policy)
+	}
+	return nil
+}
+
+// restartPolicy returns the restart policy rendered for a deployment. "no"
+// is quoted so YAML doesn't read it as false.
+func restartPolicy(deployment Deployment) string {
+	switch deployment.RestartPolicy {
+	case "":
+		return DefaultRestartPolicy
+	case "no":
+		return `"no"`
+	}
+	return deployment.RestartPolicy
+}
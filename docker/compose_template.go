@@ -0,0 +1,73 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/template"
+)
+
+// ComposeTemplateData is what a custom compose template is executed with.
+// The deployment's own fields are promoted, so {{.ProjectName}} and
+// {{.EnvVars}} work alongside the values resolved for this deploy.
+type ComposeTemplateData struct {
+	Deployment
+	// Service is the compose service name of the app
+	Service string
+	// Image is the tag the app is built as, or the image pulled
+	Image string
+	// Build is set when the image is built from the workspace, with
+	// Dockerfile relative to it and Target the stage to build
+	Build      bool
+	Dockerfile string
+	Target     string
+	// HostPort is the host side of the port mapping, with 127.0.0.1:
+	// prepended for bind_localhost deployments
+	HostPort string
+	// AppPort is the port the app listens on inside the container
+	AppPort string
+	// Network is the external docker network deployments join
+	Network string
+	// Restart is the resolved restart policy
+	Restart string
+	// EnvFile is the env file holding the app's env vars, empty without
+	// any. EnvVars are decrypted for the template, but rendering them
+	// inline writes secrets into the workspace.
+	EnvFile string
+	// ProjectLabel must label the app's containers for the project to be
+	// found by stats, logs and the watchdog
+	ProjectLabel string
+	// StackNetwork is the network of the deployment's stack, which the app
+	// must join with StackAlias as an alias, both empty outside a stack
+	StackNetwork string
+	StackAlias   string
+}
+
+// composeTemplateFuncs are available to custom compose templates
+var composeTemplateFuncs = template.FuncMap{
+	// quote renders a YAML double-quoted scalar
+	"quote": composeQuote,
+}
+
+// LoadComposeTemplate parses a custom docker-compose.yml template
+func LoadComposeTemplate(path string) (*template.Template, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compose template: %v", err)
+	}
+	tmpl, err := template.New(filepath.Base(path)).Funcs(composeTemplateFuncs).Option("missingkey=error").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse compose template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// renderComposeTemplate executes the configured compose template
+func (d *DockerSetup) renderComposeTemplate(data ComposeTemplateData) ([]byte, error) {
+	var out bytes.Buffer
+	if err := d.ComposeTemplate.Execute(&out, data); err != nil {
+		return nil, fmt.Errorf("failed to render compose template: %v", err)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,188 @@
+package docker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// workspaceArchiveName holds the source of a compressed workspace
+const workspaceArchiveName = "workspace.tar.gz"
+
+// uncompressedFiles stay in a compressed workspace so compose, the
+// artifacts endpoint and env updates keep working without expanding it
+var uncompressedFiles = map[string]bool{
+	"docker-compose.yml": true,
+	"Dockerfile":         true,
+	".dockerignore":      true,
+	workspaceArchiveName: true,
+}
+
+// compressWorkspace packs the source checkout of a deployed project into
+// workspace.tar.gz and removes it, since the image already holds everything
+// the app needs at runtime
+func compressWorkspace(project string) error {
+	workDir, err := workspaceDir(project)
+	if err != nil {
+		return err
+	}
+	archivePath := filepath.Join(workDir, workspaceArchiveName)
+	entries, err := os.ReadDir(workDir)
+	if err != nil {
+		return err
+	}
+	var packed []string
+	for _, entry := range entries {
+		if !keptInWorkspace(entry.Name()) && !uncompressedFiles[entry.Name()] {
+			packed = append(packed, entry.Name())
+		}
+	}
+	if len(packed) == 0 {
+		return nil
+	}
+
+	if err := writeWorkspaceArchive(workDir, archivePath, packed); err != nil {
+		os.Remove(archivePath)
+		return err
+	}
+	if err := UpdateProjectState(project, func(state *ProjectState) {
+		state.WorkspaceCompressed = true
+	}); err != nil {
+		os.Remove(archivePath)
+		return err
+	}
+	for _, name := range packed {
+		if err := os.RemoveAll(filepath.Join(workDir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeWorkspaceArchive writes the named top level entries of workDir, with
+// everything below them, to a gzipped tar
+func writeWorkspaceArchive(workDir, archivePath string, names []string) error {
+	file, err := os.OpenFile(archivePath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+
+	for _, name := range names {
+		err := filepath.Walk(filepath.Join(workDir, name), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(workDir, path)
+			if err != nil {
+				return err
+			}
+			link := ""
+			if info.Mode()&os.ModeSymlink != 0 {
+				if link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			}
+			header, err := tar.FileInfoHeader(info, link)
+			if err != nil {
+				return err
+			}
+			header.Name = filepath.ToSlash(rel)
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+			src, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			_, err = io.Copy(tw, src)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to archive %s: %v", name, err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// expandWorkspace restores a compressed workspace so a redeploy starts from
+// the same tree as an uncompressed one. It is a no-op when the workspace
+// isn't compressed.
+func expandWorkspace(project string) error {
+	workDir, err := workspaceDir(project)
+	if err != nil {
+		return err
+	}
+	archivePath := filepath.Join(workDir, workspaceArchiveName)
+	file, err := os.Open(archivePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", workspaceArchiveName, err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", workspaceArchiveName, err)
+		}
+		target, err := archiveEntryPath(workDir, header.Name)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, header.FileInfo().Mode().Perm())
+		case tar.TypeSymlink:
+			os.Remove(target)
+			err = os.Symlink(header.Linkname, target)
+		case tar.TypeReg:
+			var out *os.File
+			if out, err = os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, header.FileInfo().Mode().Perm()); err == nil {
+				_, err = io.Copy(out, tr)
+				out.Close()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %v", header.Name, err)
+		}
+	}
+
+	if err := os.Remove(archivePath); err != nil {
+		return err
+	}
+	return UpdateProjectState(project, func(state *ProjectState) {
+		state.WorkspaceCompressed = false
+	})
+}
@@ -0,0 +1,66 @@
+package docker
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// FollowLogs streams the container logs of a project to send, starting
+// with the last tail lines ("all" for everything), limited to one compose
+// service when service is set. It returns when ctx is cancelled, the
+// containers stop or send fails.
+func (d *DockerSetup) FollowLogs(ctx context.Context, project, service, tail string, send func(string) error) error {
+	if tail == "" {
+		tail = "100"
+	}
+	if _, err := strconv.Atoi(tail); err != nil && tail != "all" {
+		return fmt.Errorf("invalid tail %q, expected a number or all", tail)
+	}
+	workDir, err := workspaceDir(project)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(workDir); err != nil {
+		return fmt.Errorf("project %s not found", project)
+	}
+
+	if service != "" && !serviceNamePattern.MatchString(service) {
+		return fmt.Errorf("invalid service %q", service)
+	}
+
+	args := []string{"logs", "--follow", "--no-color", "--tail", tail}
+	if service != "" {
+		args = append(args, service)
+	}
+	command := d.composeCmd(args...)
+	cmd := exec.CommandContext(ctx, command.Path, command.Args[1:]...)
+	cmd.Dir = workDir
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	wait, err := d.runner.Start(cmd)
+	if err != nil {
+		return fmt.Errorf("failed to follow logs: %v", err)
+	}
+	go func() {
+		writer.CloseWithError(wait())
+	}()
+	// Unblock the compose process if we stop reading early
+	defer reader.Close()
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		if err := send(scanner.Text()); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return scanner.Err()
+}
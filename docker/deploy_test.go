@@ -0,0 +1,161 @@
+package docker
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestSetup returns a DockerSetup recording its commands, with its state
+// in a temporary base dir and ports assigned from firstPort
+func newTestSetup(t *testing.T, firstPort int) (*DockerSetup, *RecordingRunner) {
+	t.Helper()
+	SetBaseDir(t.TempDir())
+	t.Cleanup(func() { SetBaseDir("") })
+	startingPort = firstPort
+	runner := &RecordingRunner{Errors: map[string]error{}, Outputs: map[string][]byte{}}
+	return NewDockerSetupWithRunner(runner), runner
+}
+
+// assertCommands checks want appears in commands in order, other commands
+// being allowed in between
+func assertCommands(t *testing.T, commands, want []string) {
+	t.Helper()
+	next := 0
+	for _, command := range commands {
+		if next < len(want) && command == want[next] {
+			next++
+		}
+	}
+	if next < len(want) {
+		t.Fatalf("command %q not run in order, got:\n%s", want[next], strings.Join(commands, "\n"))
+	}
+}
+
+func assertNoCommand(t *testing.T, commands []string, prefix string) {
+	t.Helper()
+	for _, command := range commands {
+		if strings.HasPrefix(command, prefix) {
+			t.Fatalf("unexpected command %q", command)
+		}
+	}
+}
+
+func TestDeployProjectImage(t *testing.T) {
+	d, runner := newTestSetup(t, 43100)
+
+	result, err := d.DeployProject(Deployment{ProjectName: "web", Image: "nginx:1.27", Proxy: ProxyNone})
+	if err != nil {
+		t.Fatalf("DeployProject: %v", err)
+	}
+	if result.Status != "success" || result.Port != "43100" {
+		t.Fatalf("got status %s on port %s, want success on 43100", result.Status, result.Port)
+	}
+
+	assertCommands(t, runner.Commands(), []string{
+		"docker ps --format {{.Ports}}",
+		"docker compose down -v",
+		"docker network inspect deployment-network",
+		"docker compose pull app",
+		"docker compose up --no-build -d --remove-orphans",
+	})
+	assertNoCommand(t, runner.Commands(), "docker compose build")
+	assertNoCommand(t, runner.Commands(), "sh ")
+}
+
+func TestDeployProjectBuildsLocalSource(t *testing.T) {
+	d, runner := newTestSetup(t, 43110)
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "Dockerfile"), []byte("FROM scratch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d.LocalPathRoot = filepath.Dir(source)
+
+	result, err := d.DeployProject(Deployment{ProjectName: "api", LocalPath: source, Proxy: ProxyNone})
+	if err != nil {
+		t.Fatalf("DeployProject: %v", err)
+	}
+
+	assertCommands(t, runner.Commands(), []string{
+		"docker compose down -v",
+		"docker network inspect deployment-network",
+		"docker compose build",
+		"docker compose up --no-build -d --remove-orphans",
+		"docker images erebrus/api --format {{.ID}}",
+	})
+	assertNoCommand(t, runner.Commands(), "docker compose pull")
+
+	compose, err := os.ReadFile(filepath.Join(testWorkspace(t, "api"), "docker-compose.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `image: "erebrus/api:` + result.DeployID + `"`; !strings.Contains(string(compose), want) {
+		t.Errorf("compose file lacks %s:\n%s", want, compose)
+	}
+}
+
+func TestDeployProjectSkipsPortPublishedByDocker(t *testing.T) {
+	d, runner := newTestSetup(t, 43120)
+	runner.Outputs["docker ps --format {{.Ports}}"] = []byte("0.0.0.0:43120->8080/tcp, :::43120->8080/tcp\n")
+
+	result, err := d.DeployProject(Deployment{ProjectName: "web", Image: "nginx:1.27", Port: "43120", Proxy: ProxyNone})
+	if err != nil {
+		t.Fatalf("DeployProject: %v", err)
+	}
+	if result.Port != "43121" {
+		t.Fatalf("got port %s, want 43121 as docker publishes 43120", result.Port)
+	}
+}
+
+func TestDeployProjectRollsBackFailedStart(t *testing.T) {
+	d, runner := newTestSetup(t, 43130)
+	runner.Errors["docker compose up --no-build -d --remove-orphans"] = errors.New("exit status 1")
+
+	result, err := d.DeployProject(Deployment{ProjectName: "web", Image: "nginx:1.27", Proxy: ProxyNone})
+	if err == nil {
+		t.Fatal("DeployProject succeeded, want the compose up failure")
+	}
+	if result == nil || result.Status != "failed" {
+		t.Fatalf("got result %+v, want a failed result", result)
+	}
+
+	assertCommands(t, runner.Commands(), []string{
+		"docker compose up --no-build -d --remove-orphans",
+		"docker compose down --remove-orphans",
+	})
+	assertNoCommand(t, runner.Commands(), "docker container prune")
+	if state, err := LoadProjectState("web"); err != nil || state.Deployment != nil {
+		t.Errorf("failed deploy saved a deployment spec: %+v, %v", state, err)
+	}
+}
+
+func TestResolveProjectNameReadsOriginThroughRunner(t *testing.T) {
+	d, runner := newTestSetup(t, 43140)
+	workDir := testWorkspace(t, "app")
+	runner.Outputs["git -C "+workDir+" remote get-url origin"] = []byte("https://example.com/other/app.git\n")
+
+	deployment := Deployment{ProjectName: "app", GitURL: "https://example.com/me/app.git", UniqueName: true}
+	if got := d.ResolveProjectName(deployment); got == "app" || !strings.HasPrefix(got, "app-") {
+		t.Errorf("got %q, want app with a hash suffix as app is taken by another repository", got)
+	}
+
+	deployment.GitURL = "https://example.com/other/app"
+	if got := d.ResolveProjectName(deployment); got != "app" {
+		t.Errorf("got %q, want app for the repository already deployed there", got)
+	}
+}
+
+// testWorkspace returns a project's workspace, creating it
+func testWorkspace(t *testing.T, project string) string {
+	t.Helper()
+	dir, err := workspaceDir(project)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
@@ -1,129 +1,764 @@
 package docker
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	// "encoding/json"
 	"erebrusvps/websocket"
 )
 
 type Deployment struct {
-	GitURL      string            `json:"git_url"`
+	GitURL string `json:"git_url"`
+	// GitMirrors are cloned from in order when GitURL can't be
+	GitMirrors  []string          `json:"git_mirrors,omitempty"`
 	EnvVars     map[string]string `json:"env_vars,omitempty"`
 	Port        string            `json:"port"`
 	ProjectName string            `json:"project_name"`
+	// CORSOrigins restricts the origins nginx allows for the app, all when empty
+	CORSOrigins []string `json:"cors_origins,omitempty"`
+	// Headers are added to every response of the app, e.g. a
+	// Content-Security-Policy
+	Headers map[string]string `json:"headers,omitempty"`
+	// AllowIPs restricts the app to these IPs and CIDR ranges, open to
+	// everyone when empty
+	AllowIPs []string `json:"allow_ips,omitempty"`
+	// WildcardSubdomain routes *.<project>.localhost to the same container
+	WildcardSubdomain bool `json:"wildcard_subdomain,omitempty"`
+	// Static serves the built files straight from nginx without a container
+	Static bool `json:"static,omitempty"`
+	// UniqueName suffixes the project name with a hash of the git URL when
+	// another repository already uses the name
+	UniqueName bool `json:"unique_name,omitempty"`
+	// SkipCleanup keeps old images and build leftovers after this deploy
+	SkipCleanup bool `json:"skip_cleanup,omitempty"`
+	// Services are extra image based services, such as a database
+	Services []Service `json:"services,omitempty"`
+	// Healthcheck is rendered into the app service
+	Healthcheck *Healthcheck `json:"healthcheck,omitempty"`
+	// DependsOn maps service names to the compose condition the app waits for
+	DependsOn map[string]string `json:"depends_on,omitempty"`
+	// Proxy selects how the app is exposed: nginx, traefik labels, or none
+	// to publish the host port directly. Empty uses the server default.
+	Proxy string `json:"proxy,omitempty"`
+	// BindLocalhost publishes the app port on 127.0.0.1 only, leaving nginx
+	// as the sole way in
+	BindLocalhost bool `json:"bind_localhost,omitempty"`
+	// Domain is the host Traefik routes to the app, <project>.localhost by default
+	Domain string `json:"domain,omitempty"`
+	// PreDeployCmd runs in a one-off app container before the app starts,
+	// a failure aborts the deploy. PostDeployCmd runs in the started app.
+	PreDeployCmd  string `json:"pre_deploy_cmd,omitempty"`
+	PostDeployCmd string `json:"post_deploy_cmd,omitempty"`
+	// LocalPath is a directory on the host copied into the workspace instead
+	// of cloning GitURL. It must be under the configured local path root.
+	LocalPath string `json:"local_path,omitempty"`
+	// ProxyProtocol is how the proxy talks to the app: http1 (default),
+	// http2 to accept HTTP/2 from clients, or grpc to proxy gRPC to the app
+	ProxyProtocol string `json:"proxy_protocol,omitempty"`
+	// WebSocketApp raises the proxy's idle timeouts and disables buffering
+	// for apps holding long lived WebSocket connections
+	WebSocketApp bool `json:"websocket_app,omitempty"`
+	// Environment namespaces the deployment, e.g. staging or prod, so one
+	// repository can run several times under one logical project
+	Environment string `json:"environment,omitempty"`
+	// Commit pins a git deployment to a specific commit instead of the
+	// default branch
+	Commit string `json:"commit,omitempty"`
+	// Registry authenticates the build against a private registry, overriding
+	// the server-wide credentials
+	Registry *RegistryAuth `json:"registry,omitempty"`
+	// RestartPolicy is the compose restart policy of the app and its
+	// services: no, on-failure[:retries], always or unless-stopped (default)
+	RestartPolicy string `json:"restart_policy,omitempty"`
+	// Compression (gzip, plus brotli when nginx has the module) and
+	// AssetCaching of fingerprinted files matching AssetPattern are on
+	// unless set to false
+	Compression  *bool  `json:"compression,omitempty"`
+	AssetCaching *bool  `json:"asset_caching,omitempty"`
+	AssetPattern string `json:"asset_pattern,omitempty"`
+	// KeepOnFailure leaves the workspace, containers and proxy config of a
+	// failed deploy in place for debugging
+	KeepOnFailure bool `json:"keep_on_failure,omitempty"`
+	// ScanImage runs trivy against the built image before it is exposed,
+	// failing the deploy on vulnerabilities at or above ScanThreshold
+	// (CRITICAL by default)
+	ScanImage     bool   `json:"scan_image,omitempty"`
+	ScanThreshold string `json:"scan_threshold,omitempty"`
+	// NoCache builds without the layer cache and the package manager cache
+	// mounts, for a truly clean build
+	NoCache bool `json:"no_cache,omitempty"`
+	// DockerfilePath is the Dockerfile to build, relative to the repository
+	// root, for repositories that don't keep it at the root
+	DockerfilePath string `json:"dockerfile_path,omitempty"`
+	// BuildTarget is the stage of a multi-stage Dockerfile to build
+	BuildTarget string `json:"build_target,omitempty"`
+	// RunAsRoot keeps the generated Dockerfile's app running as root, for
+	// apps that need it. Repository Dockerfiles choose their own user.
+	RunAsRoot bool `json:"run_as_root,omitempty"`
+	// Platform is the os/arch the image is built or pulled for, such as
+	// linux/amd64 on an ARM host; the host platform when empty
+	Platform string `json:"platform,omitempty"`
+	// Stack is the stack the project was deployed as a member of, set by
+	// DeployStack. The app then also joins the stack's network under its
+	// member name.
+	Stack string `json:"stack,omitempty"`
+	// ErrorPage serves a maintenance page instead of nginx's default when
+	// the app is down. ErrorPageHTML replaces the default page and implies
+	// ErrorPage.
+	ErrorPage     bool   `json:"error_page,omitempty"`
+	ErrorPageHTML string `json:"error_page_html,omitempty"`
+	// ServiceName names the app's compose service, "app" by default, for
+	// repositories whose tooling expects a specific name
+	ServiceName string `json:"service_name,omitempty"`
+	// LFS forces (true) or skips (false) fetching Git LFS objects after the
+	// clone, which is otherwise done when .gitattributes uses LFS
+	LFS *bool `json:"lfs,omitempty"`
+	// Submodules checks out the repository's git submodules after the clone,
+	// with the credentials of the main repository
+	Submodules bool `json:"submodules,omitempty"`
+	// Image deploys a prebuilt image by pulling it instead of building
+	// from source, e.g. one pushed by another server
+	Image string `json:"image,omitempty"`
+	// Push tags the built image for the push registry and pushes it
+	Push bool `json:"push,omitempty"`
+	// RedeployCron redeploys the project on a schedule such as @hourly or
+	// @every 15m, whenever its branch has new commits
+	RedeployCron string `json:"redeploy_cron,omitempty"`
+	// Upload is a staged source archive deployed instead of cloning GitURL
+	Upload *Upload `json:"-"`
 }
 
 type DeploymentResult struct {
-	Status string `json:"status"`
-	URL    string `json:"url"`
-	Port   string `json:"port"`
-	Error  string `json:"error,omitempty"`
+	Status   string `json:"status"`
+	DeployID string `json:"deploy_id"`
+	// Sequence numbers deployments across all projects in the order they
+	// were requested, and survives restarts
+	Sequence    uint64 `json:"sequence,omitempty"`
+	ProjectName string `json:"project_name"`
+	URL         string `json:"url"`
+	Port        string `json:"port"`
+	Error       string `json:"error,omitempty"`
+	// Note describes how the app is expected to be reached when that isn't
+	// handled by the deployer, as in rootless mode
+	Note string `json:"note,omitempty"`
+	// GitRemote is the git_url or mirror the source was cloned from
+	GitRemote string `json:"git_remote,omitempty"`
+	// BuildMs is how long building and starting the containers took
+	BuildMs int64 `json:"build_ms,omitempty"`
+	// Scan is the image scan summary when scan_image is set
+	Scan *ScanSummary `json:"scan,omitempty"`
 }
 
 type PortMapping struct {
 	Port        string
 	ProjectName string
 	GitURL      string
+	// Reserved marks ports held for the manager itself, never a deployment
+	Reserved bool
 }
 
 var usedPorts = make(map[string]PortMapping) // key: port number, value: project details
 var startingPort = 3000
 
-func getNextAvailablePort() string {
-	port := startingPort
-	for {
-		portStr := fmt.Sprintf("%d", port)
-		// Check if port is used by our deployments and system
-		if _, exists := usedPorts[portStr]; !exists && isPortAvailable(portStr) {
-			return portStr
-		}
-		port++
+// ReservePorts seeds ports such as the manager's own listeners into the used
+// set so they are never assigned to a deployment
+func ReservePorts(ports []string) {
+	for _, port := range ports {
+		usedPorts[port] = PortMapping{Port: port, Reserved: true}
 	}
 }
 
+// isPortReserved reports whether a port was set aside by ReservePorts
+func isPortReserved(port string) bool {
+	portsMutex.Lock()
+	defer portsMutex.Unlock()
+	return usedPorts[port].Reserved
+}
+
+// getNextAvailablePort returns the first free port without claiming it
+func (d *DockerSetup) getNextAvailablePort() string {
+	return d.nextAvailablePort(nil)
+}
+
+// newDeployID returns a short random identifier used to correlate a deploy's logs
+func newDeployID() string {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// DeployProject runs a deployment under a new deploy ID that prefixes every
+// log line and is returned in the result, including on failure
 func (d *DockerSetup) DeployProject(deployment Deployment) (*DeploymentResult, error) {
-	// Send logs through WebSocket
+	deployID, sequence := d.queueDeployment(deployment)
+	return d.runDeployment(deployment, deployID, sequence)
+}
+
+// StartDeployment runs a deployment in the background and returns its deploy
+// ID straight away, so clients can follow /ws?deploy_id=<id> and reconnect to
+// it. done is called with the outcome once the deployment finishes.
+func (d *DockerSetup) StartDeployment(deployment Deployment, done func(*DeploymentResult, error)) (string, uint64) {
+	deployID, sequence := d.queueDeployment(deployment)
+	go func() {
+		result, err := d.runDeployment(deployment, deployID, sequence)
+		if done != nil {
+			done(result, err)
+		}
+	}()
+	return deployID, sequence
+}
+
+// queueDeployment assigns a deployment its deploy ID and sequence number and
+// queues it. A sequence that can't be persisted is logged and left at 0
+// rather than failing the deploy.
+func (d *DockerSetup) queueDeployment(deployment Deployment) (string, uint64) {
+	deployID := newDeployID()
+	sequence, err := nextDeploySequence()
+	if err != nil {
+		fmt.Printf("[DEPLOY] No sequence number for %s: %v\n", deployID, err)
+	}
+	d.jobs.add(deployID, sequence, d.ResolveProjectName(deployment))
+	return deployID, sequence
+}
+
+func (d *DockerSetup) runDeployment(deployment Deployment, deployID string, sequence uint64) (*DeploymentResult, error) {
+	deployment.ProjectName = d.ResolveProjectName(deployment)
+	defer websocket.Logger.EndSession(deployID)
+	if deployment.Upload != nil {
+		defer os.Remove(deployment.Upload.Path)
+	}
+	redact := newRedactor(deployment)
+
+	// Keep a copy of the run's log on disk
+	logFile, err := d.openDeployLog(deployment.ProjectName, deployID)
+	if err != nil {
+		fmt.Printf("[LOGS] Deploy log disabled for %s: %v\n", deployID, err)
+	}
+	defer d.finishDeployLog(logFile, deployment.ProjectName)
+
+	// Send logs through WebSocket, redacting secrets before they leave the process
 	sendLog := func(message string) {
-		websocket.Logger.SendLog(message)
+		message = redact(fmt.Sprintf("[%s] %s", deployID, strings.TrimLeft(message, "\n")))
+		websocket.Logger.SendSessionLog(deployID, deployment.ProjectName, message)
 		fmt.Println(message) // Still print to console
+		logFile.write(message)
+	}
+
+	// Wait for a deploy slot when the concurrency limit is reached
+	d.jobs.wait(deployID, func(position int) {
+		sendLog(fmt.Sprintf("[QUEUE] Waiting for a deploy slot, position %d in the queue", position))
+	})
+	// Deploys and env updates of one project run one after the other. The
+	// lock is taken once a slot is held, so a queued deploy never holds it
+	// while waiting for a slot.
+	unlock := d.jobs.lockProject(deployment.ProjectName)
+	if sequence > 0 {
+		sendLog(fmt.Sprintf("[DEPLOY] Deployment #%d", sequence))
+	}
+	result, err := d.deploy(context.Background(), deployment, deployID, sendLog)
+	unlock()
+	d.jobs.finish(deployID, err)
+	if err != nil {
+		sendLog(fmt.Sprintf("[DEPLOY] Deployment failed: %v", err))
+		return &DeploymentResult{
+			Status:      "failed",
+			DeployID:    deployID,
+			Sequence:    sequence,
+			ProjectName: deployment.ProjectName,
+			Error:       err.Error(),
+		}, err
+	}
+
+	result.DeployID = deployID
+	result.Sequence = sequence
+	result.ProjectName = deployment.ProjectName
+	return result, nil
+}
+
+func (d *DockerSetup) deploy(ctx context.Context, deployment Deployment, deployID string, sendLog func(string)) (*DeploymentResult, error) {
+	sendLog(fmt.Sprintf("[DEPLOY] Starting deployment for project: %s", deployment.ProjectName))
+
+	dc := &DeployContext{Deployment: deployment, DeployID: deployID, Log: sendLog}
+	if state, err := LoadProjectState(deployment.ProjectName); err != nil || state.Deployment == nil {
+		dc.Fresh = true
+	}
+	if err := runPipeline(ctx, d.deployStages(dc), dc); err != nil {
+		return nil, err
+	}
+	return dc.Result, nil
+}
+
+// deployStages returns the pipeline for a deployment. Static sites are
+// published by nginx after the source is fetched and skip the container
+// stages.
+func (d *DockerSetup) deployStages(dc *DeployContext) []Stage {
+	stages := []Stage{
+		&funcStage{name: "validate", run: d.validateStage},
+		&funcStage{name: "port", run: d.portStage, rollback: func(ctx context.Context) error {
+			forgetPort(dc.Deployment.Port, dc.Deployment.ProjectName)
+			return nil
+		}},
+		&funcStage{name: "workspace", run: d.workspaceStage, rollback: func(ctx context.Context) error {
+			if !dc.Fresh || dc.Deployment.KeepOnFailure || dc.WorkDir == "" {
+				return nil
+			}
+			// The logs stay so the failure can still be looked into
+			dc.Log("[CLEANUP] Clearing the workspace of the failed deployment")
+			return clearWorkspace(dc.WorkDir)
+		}},
+		&funcStage{name: "source", run: d.sourceStage},
+	}
+	if dc.Deployment.Static {
+		return append(stages, &funcStage{name: "static", run: func(ctx context.Context, dc *DeployContext) error {
+			result, err := d.deployStatic(dc.WorkDir, dc.Deployment, dc.Log)
+			dc.Result = result
+			return err
+		}, rollback: func(ctx context.Context) error {
+			if !dc.Fresh || dc.Deployment.KeepOnFailure {
+				return nil
+			}
+			dc.Log("[CLEANUP] Removing the published site and its nginx config")
+			if err := d.removeNginxConfig(dc.Deployment.ProjectName); err != nil {
+				return err
+			}
+			return d.runElevated("rm", "-rf", filepath.Join(staticRoot, dc.Deployment.ProjectName))
+		}})
+	}
+	return append(stages,
+		&funcStage{name: "dockerfile", run: d.dockerfileStage},
+		&funcStage{name: "compose", run: d.composeStage},
+		&funcStage{name: "build", run: d.buildStage, rollback: func(ctx context.Context) error {
+			if dc.Deployment.KeepOnFailure {
+				dc.Log("[CLEANUP] keep_on_failure is set, leaving the failed deployment in place")
+				return nil
+			}
+			// Volumes are kept, they may hold data of earlier deployments
+			dc.Log("[CLEANUP] Removing containers of the failed deployment")
+			return d.composeIn(dc.WorkDir, "down", "--remove-orphans")
+		}},
+		&funcStage{name: "scan", run: d.scanStage},
+		&funcStage{name: "push", run: d.pushStage},
+		&funcStage{name: "proxy", run: d.proxyStage, rollback: func(ctx context.Context) error {
+			if !dc.Fresh || dc.Deployment.KeepOnFailure {
+				return nil
+			}
+			dc.Log("[CLEANUP] Removing the proxy config of the failed deployment")
+			return d.reverseProxy(dc.Deployment.Proxy).Remove(dc.Deployment.ProjectName)
+		}},
+		&funcStage{name: "finalize", run: d.finalizeStage},
+	)
+}
+
+// validateStage checks the deployment spec and resolves its proxy
+func (d *DockerSetup) validateStage(ctx context.Context, dc *DeployContext) error {
+	deployment := &dc.Deployment
+	source, err := d.validateDeployment(deployment)
+	if err != nil {
+		return err
+	}
+	dc.source = source
+	return UpdateProjectState(deployment.ProjectName, func(state *ProjectState) {
+		state.Proxy = deployment.Proxy
+		state.Environment = deployment.Environment
+	})
+}
+
+// ValidateDeployment checks a deployment spec without building anything
+func (d *DockerSetup) ValidateDeployment(deployment Deployment) error {
+	_, err := d.validateDeployment(&deployment)
+	return err
+}
+
+// validateDeployment checks a deployment spec without side effects,
+// resolving its proxy and returning the fetcher for its source
+func (d *DockerSetup) validateDeployment(deployment *Deployment) (sourceFetcher, error) {
+	if err := validateCORSOrigins(deployment.CORSOrigins); err != nil {
+		return nil, err
+	}
+	if err := validateEnvVars(deployment.EnvVars); err != nil {
+		return nil, err
+	}
+	if err := validateServices(*deployment); err != nil {
+		return nil, err
+	}
+	for _, gitURL := range append([]string{deployment.GitURL}, deployment.GitMirrors...) {
+		if gitURL == "" {
+			continue
+		}
+		if err := ValidateGitURL(gitURL); err != nil {
+			return nil, fmt.Errorf("%s", newRedactor(*deployment)(err.Error()))
+		}
+	}
+	source, err := d.sourceFor(*deployment)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateHook("pre_deploy_cmd", deployment.PreDeployCmd); err != nil {
+		return nil, err
+	}
+	if err := validateHook("post_deploy_cmd", deployment.PostDeployCmd); err != nil {
+		return nil, err
+	}
+	deployment.Proxy = d.proxyFor(*deployment)
+	if err := ValidateProxy(deployment.Proxy); err != nil {
+		return nil, err
+	}
+	if deployment.BindLocalhost && deployment.Proxy == ProxyNone {
+		return nil, fmt.Errorf("bind_localhost needs a proxy, the app would be unreachable with proxy %q", ProxyNone)
+	}
+	if deployment.Static && deployment.Proxy != ProxyNginx {
+		return nil, fmt.Errorf("static deployments are served by nginx and need proxy %q", ProxyNginx)
+	}
+	if deployment.Static && (deployment.PreDeployCmd != "" || deployment.PostDeployCmd != "") {
+		return nil, fmt.Errorf("static deployments have no container to run hooks in")
+	}
+	if err := d.checkRootless(*deployment); err != nil {
+		return nil, err
+	}
+	if err := validateDomain(deployment.Domain); err != nil {
+		return nil, err
+	}
+	if deployment.Proxy == ProxyTraefik {
+		if err := d.checkTraefikNetwork(); err != nil {
+			return nil, err
+		}
+	}
+	if err := ValidateEnvironment(deployment.Environment); err != nil {
+		return nil, err
+	}
+	if err := checkEnvironmentName(deployment.ProjectName, deployment.Environment); err != nil {
+		return nil, err
+	}
+	if err := validateProxyProtocol(*deployment); err != nil {
+		return nil, err
+	}
+	if err := validateWebSocketApp(*deployment); err != nil {
+		return nil, err
+	}
+	if err := validateRestartPolicy(deployment.RestartPolicy); err != nil {
+		return nil, err
+	}
+	if err := validateAssetCaching(*deployment); err != nil {
+		return nil, err
+	}
+	if err := validateAllowIPs(*deployment); err != nil {
+		return nil, err
+	}
+	if len(deployment.Headers) > 0 && deployment.Proxy != ProxyNginx {
+		return nil, fmt.Errorf("headers are only supported with proxy %q", ProxyNginx)
+	}
+	if err := validateHeaders(deployment.Headers); err != nil {
+		return nil, err
+	}
+	if err := validateScan(*deployment); err != nil {
+		return nil, err
+	}
+	if err := validateDockerfileOptions(*deployment); err != nil {
+		return nil, err
+	}
+	if err := validatePlatform(*deployment); err != nil {
+		return nil, err
+	}
+	if err := validateStackMember(*deployment); err != nil {
+		return nil, err
+	}
+	if err := validateErrorPage(*deployment); err != nil {
+		return nil, err
+	}
+	if err := d.validateImage(*deployment); err != nil {
+		return nil, err
+	}
+	if deployment.ScanImage && deployment.Static {
+		return nil, fmt.Errorf("scan_image is not supported for static deployments, they have no image")
+	}
+	if len(deployment.GitMirrors) > 0 && deployment.GitURL == "" {
+		return nil, fmt.Errorf("git_mirrors can only be set with a git_url")
 	}
+	if deployment.Commit != "" && deployment.GitURL == "" {
+		return nil, fmt.Errorf("commit can only be set for git deployments")
+	}
+	if deployment.LFS != nil && *deployment.LFS && deployment.GitURL == "" {
+		return nil, fmt.Errorf("lfs can only be set for git deployments")
+	}
+	if deployment.Submodules && deployment.GitURL == "" {
+		return nil, fmt.Errorf("submodules can only be set for git deployments")
+	}
+	if err := validateRedeploySchedule(*deployment); err != nil {
+		return nil, err
+	}
+	if err := ValidateRegistryAuth(deployment.Registry); err != nil {
+		return nil, err
+	}
+	return source, nil
+}
 
-	sendLog(fmt.Sprintf("\n[DEPLOY] Starting deployment for project: %s", deployment.ProjectName))
+// portStage reserves the host port the app is published on
+func (d *DockerSetup) portStage(ctx context.Context, dc *DeployContext) error {
+	deployment := &dc.Deployment
 
-	// Always get next available port if the requested port is in use
-	if deployment.Port == "" || !isPortAvailable(deployment.Port) {
-		newPort := getNextAvailablePort()
-		sendLog(fmt.Sprintf("[DEPLOY] Port %s is occupied, assigning port %s for project %s",
-			deployment.Port, newPort, deployment.ProjectName))
-		deployment.Port = newPort
+	// Static sites are served by nginx directly and need no port
+	if deployment.Static {
+		deployment.Port = ""
+		return nil
 	}
 
-	// Store the port mapping
-	usedPorts[deployment.Port] = PortMapping{
-		Port:        deployment.Port,
+	// The port stays bound until compose up, so no other deploy or process
+	// can take it while the source is fetched and built
+	requested := deployment.Port
+	deployment.Port = d.claimPort(requested, PortMapping{
 		ProjectName: deployment.ProjectName,
 		GitURL:      deployment.GitURL,
+	})
+	switch {
+	case requested == deployment.Port:
+	case isPortReserved(requested):
+		dc.Log(fmt.Sprintf("[DEPLOY] Port %s is reserved, assigning port %s for project %s",
+			requested, deployment.Port, deployment.ProjectName))
+	default:
+		dc.Log(fmt.Sprintf("[DEPLOY] Port %s is occupied, assigning port %s for project %s",
+			requested, deployment.Port, deployment.ProjectName))
 	}
+	return nil
+}
 
+// workspaceStage creates the project workspace
+func (d *DockerSetup) workspaceStage(ctx context.Context, dc *DeployContext) error {
 	// Use home directory instead of /opt
-	homeDir, err := os.UserHomeDir()
+	workDir, err := workspaceDir(dc.Deployment.ProjectName)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get home directory: %v", err)
+		return err
 	}
+	dc.WorkDir = workDir
 
 	// Create workspace directory
-	workDir := filepath.Join(homeDir, "deployments", deployment.ProjectName)
-	sendLog(fmt.Sprintf("[DEPLOY] Creating workspace directory: %s", workDir))
+	dc.Log(fmt.Sprintf("[DEPLOY] Creating workspace directory: %s", workDir))
 	if err := os.MkdirAll(workDir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create workspace: %v", err)
+		return fmt.Errorf("failed to create workspace: %v", err)
 	}
 
-	// Clone repository
-	sendLog(fmt.Sprintf("[DEPLOY] Cloning repository: %s", deployment.GitURL))
-	if err := d.cloneRepository(deployment.GitURL, workDir); err != nil {
-		return nil, fmt.Errorf("failed to clone repository: %v", err)
+	// A workspace packed after the last deploy is restored first
+	if _, err := os.Stat(filepath.Join(workDir, workspaceArchiveName)); err == nil {
+		dc.Log("[DEPLOY] Expanding the compressed workspace")
+		if err := expandWorkspace(dc.Deployment.ProjectName); err != nil {
+			return fmt.Errorf("failed to expand workspace: %v", err)
+		}
+	}
+	return nil
+}
+
+// sourceStage fills the workspace with the code to deploy
+func (d *DockerSetup) sourceStage(ctx context.Context, dc *DeployContext) error {
+	deployment := dc.Deployment
+	dc.Log(fmt.Sprintf("[DEPLOY] %s", dc.source.describe()))
+	if err := dc.source.fetch(dc.WorkDir); err != nil {
+		return err
+	}
+	if git, ok := dc.source.(*gitSource); ok && git.remote != deployment.GitURL {
+		dc.Log(fmt.Sprintf("[DEPLOY] %s is unavailable, cloned from mirror %s", deployment.GitURL, git.remote))
+	}
+
+	// Remember the exact commit so it can be promoted to another environment
+	var commit string
+	if deployment.GitURL != "" {
+		if deployment.Commit != "" {
+			dc.Log(fmt.Sprintf("[DEPLOY] Checking out commit %s", deployment.Commit))
+			if err := d.checkoutCommit(dc.WorkDir, deployment.Commit); err != nil {
+				return fmt.Errorf("failed to check out commit: %v", err)
+			}
+		}
+		// After the checkout, so submodules match the deployed commit
+		if deployment.Submodules {
+			if !hasSubmodules(dc.WorkDir) {
+				dc.Log("[GIT] submodules is set but the repository has no .gitmodules")
+			} else if err := d.updateSubmodules(dc.WorkDir, dc.source.(*gitSource).remote, dc.Log); err != nil {
+				return err
+			}
+		}
+		if wantsLFS(deployment, dc.WorkDir) {
+			if err := d.pullLFS(dc.WorkDir, dc.Log); err != nil {
+				return err
+			}
+		}
+		var err error
+		if commit, err = d.headCommit(dc.WorkDir); err != nil {
+			dc.Log(fmt.Sprintf("[DEPLOY] Could not read the deployed commit: %v", err))
+		}
 	}
 
+	if err := UpdateProjectState(deployment.ProjectName, func(state *ProjectState) {
+		state.Commit = commit
+		state.UploadSHA256 = ""
+		if deployment.Upload != nil {
+			state.UploadSHA256 = deployment.Upload.SHA256
+		}
+	}); err != nil {
+		return fmt.Errorf("failed to save project state: %v", err)
+	}
+	return nil
+}
+
+// dockerfileStage makes sure the workspace has a Dockerfile
+func (d *DockerSetup) dockerfileStage(ctx context.Context, dc *DeployContext) error {
+	// Prebuilt images are pulled, not built
+	if dc.Deployment.Image != "" {
+		return nil
+	}
 	// Create Dockerfile if it doesn't exist
-	sendLog("[DEPLOY] Ensuring Dockerfile exists")
-	if err := d.ensureDockerfile(workDir); err != nil {
-		return nil, fmt.Errorf("failed to create Dockerfile: %v", err)
+	dc.Log("[DEPLOY] Ensuring Dockerfile exists")
+	path, source, err := d.ensureDockerfile(dc.WorkDir, dc.Deployment, dc.Log)
+	if err != nil {
+		return fmt.Errorf("failed to create Dockerfile: %v", err)
+	}
+	if dc.Deployment.DockerfilePath != "" && source != DockerfileOverride && path != dc.Deployment.DockerfilePath {
+		dc.Log(fmt.Sprintf("[DEPLOY] Warning: dockerfile_path %s does not exist, using %s Dockerfile at the repository root",
+			dc.Deployment.DockerfilePath, source))
+	}
+	if dc.Deployment.BuildTarget != "" && source == DockerfileGenerated {
+		dc.Log(fmt.Sprintf("[DEPLOY] Warning: the generated Dockerfile has no stage %s, building it without a target", dc.Deployment.BuildTarget))
+	}
+	if dc.Deployment.RunAsRoot && source != DockerfileGenerated {
+		dc.Log(fmt.Sprintf("[DEPLOY] Warning: run_as_root only applies to generated Dockerfiles, the %s Dockerfile picks its own user", source))
 	}
+	return nil
+}
 
+// composeStage writes the project's docker-compose.yml
+func (d *DockerSetup) composeStage(ctx context.Context, dc *DeployContext) error {
 	// Create docker-compose.yml
-	sendLog("[DEPLOY] Creating docker-compose.yml")
-	if err := d.createDockerCompose(workDir, deployment); err != nil {
-		return nil, fmt.Errorf("failed to create docker-compose.yml: %v", err)
+	dc.Log("[DEPLOY] Creating docker-compose.yml")
+	if err := d.createDockerCompose(dc.WorkDir, dc.Deployment, dc.DeployID); err != nil {
+		return fmt.Errorf("failed to create docker-compose.yml: %v", err)
 	}
+	return nil
+}
+
+// buildStage builds and starts the containers and runs the post-deploy hook
+func (d *DockerSetup) buildStage(ctx context.Context, dc *DeployContext) error {
+	deployment := &dc.Deployment
 
 	// Build and run the container
-	sendLog("[DEPLOY] Building and running containers")
-	if err := d.buildAndRun(workDir, deployment); err != nil {
-		return nil, fmt.Errorf("failed to build and run: %v", err)
+	dc.Log("[DEPLOY] Building and running containers")
+	// The port is normally still held from the port stage, or published by
+	// the project's previous containers. If the hold was lost, make sure it
+	// is still free right before compose binds it.
+	defer func() { releasePort(deployment.Port) }()
+	if !portHeld(deployment.Port) && !d.projectPublishesPort(deployment.ProjectName, deployment.Port) &&
+		!d.isPortAvailable(deployment.Port) {
+		if err := d.reassignPort(dc.WorkDir, deployment, dc.DeployID, dc.Log); err != nil {
+			return err
+		}
+	}
+	auth := d.registryAuth(*deployment)
+	if deployment.Image != "" {
+		auth = d.pullAuth(*deployment)
+	}
+	if auth != nil {
+		logout, err := d.registryLogin(auth, dc.Log)
+		if err != nil {
+			return fmt.Errorf("failed to authenticate with the registry: %v", err)
+		}
+		defer logout()
+	}
+	if deployment.Platform != "" && deployment.Platform != hostPlatform() {
+		dc.Log(fmt.Sprintf("[DEPLOY] Targeting %s on a %s host, which needs QEMU emulation for the build and to run",
+			deployment.Platform, hostPlatform()))
 	}
+	buildStarted := time.Now()
+	err := d.buildAndRun(dc.WorkDir, *deployment, dc.Log)
+	if err != nil && isPortInUse(err) {
+		// Lost the race for the port anyway, retry once on a fresh one
+		if err := d.reassignPort(dc.WorkDir, deployment, dc.DeployID, dc.Log); err != nil {
+			return err
+		}
+		err = d.buildAndRun(dc.WorkDir, *deployment, dc.Log)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to build and run: %v", err)
+	}
+	dc.BuildTime = time.Since(buildStarted)
+	dc.Log(fmt.Sprintf("[DEPLOY] Build and start took %s", dc.BuildTime.Round(time.Millisecond)))
 
-	// Configure Nginx reverse proxy
-	sendLog("[DEPLOY] Configuring Nginx reverse proxy")
-	if err := d.configureNginx(deployment); err != nil {
-		return nil, fmt.Errorf("failed to configure nginx: %v", err)
+	if deployment.PostDeployCmd != "" {
+		if err := d.runHook(dc.WorkDir, serviceName(*deployment), "post-deploy", deployment.PostDeployCmd, dc.Log); err != nil {
+			dc.Log(fmt.Sprintf("[HOOK] Warning: %v", err))
+		}
 	}
+	return nil
+}
 
-	sendLog("[DEPLOY] Deployment completed successfully!")
-	fmt.Println(&DeploymentResult{
-		Status: "success",
-		URL:    fmt.Sprintf("https://%s.localhost", deployment.ProjectName),
-		Port:   deployment.Port,
-	})
+// proxyStage exposes the app through the selected proxy
+func (d *DockerSetup) proxyStage(ctx context.Context, dc *DeployContext) error {
+	deployment := dc.Deployment
 
-	return &DeploymentResult{
+	switch deployment.Proxy {
+	case ProxyNone:
+		dc.Log("[DEPLOY] Proxy disabled, exposing the app directly on its host port")
+	case ProxyTraefik:
+		dc.Log(fmt.Sprintf("[DEPLOY] Routed by Traefik labels on network %s", d.Traefik.Network))
+	default:
+		dc.Log("[DEPLOY] Configuring Nginx reverse proxy")
+	}
+
+	proxy := d.reverseProxy(deployment.Proxy)
+	if err := proxy.Configure(deployment); err != nil {
+		return fmt.Errorf("failed to configure %s: %v", deployment.Proxy, err)
+	}
+	dc.URL = d.buildDeploymentURL(deployment)
+	return nil
+}
+
+// finalizeStage cleans up after the build and records the deployed spec
+func (d *DockerSetup) finalizeStage(ctx context.Context, dc *DeployContext) error {
+	deployment := dc.Deployment
+
+	// Archive the build before cleanup can remove superseded local images
+	d.archiveImage(deployment, dc.DeployID, dc.Log)
+
+	// Remove superseded images and leftovers of this project's builds
+	if !deployment.SkipCleanup {
+		d.cleanupAfterDeploy(deployment.ProjectName, dc.Log)
+	}
+
+	if err := saveDeployedSpec(deployment); err != nil {
+		dc.Log(fmt.Sprintf("[DEPLOY] Failed to save deployment state: %v", err))
+	}
+
+	if d.CompressWorkspaces {
+		dc.Log("[DEPLOY] Compressing the workspace")
+		if err := compressWorkspace(deployment.ProjectName); err != nil {
+			dc.Log(fmt.Sprintf("[DEPLOY] Failed to compress workspace: %v", err))
+		}
+	}
+
+	dc.Log("[DEPLOY] Deployment completed successfully!")
+	dc.Result = &DeploymentResult{
 		Status: "success",
-		URL:    fmt.Sprintf("https://%s.localhost", deployment.ProjectName),
+		URL:    dc.URL,
 		Port:   deployment.Port,
-	}, nil
+		Note:   d.rootlessNote(deployment),
+	}
+	if git, ok := dc.source.(*gitSource); ok {
+		dc.Result.GitRemote = newRedactor(deployment)(git.remote)
+	}
+	dc.Result.BuildMs = dc.BuildTime.Milliseconds()
+	dc.Result.Scan = dc.Scan
+	return nil
 }
 
 func (d *DockerSetup) cloneRepository(gitURL, workDir string) error {
@@ -131,105 +766,456 @@ func (d *DockerSetup) cloneRepository(gitURL, workDir string) error {
 
 	// Check if directory exists
 	if _, err := os.Stat(workDir); err == nil {
-		fmt.Printf("[GIT] Directory exists, removing it first...\n")
-		if err := os.RemoveAll(workDir); err != nil {
+		fmt.Printf("[GIT] Directory exists, clearing it first...\n")
+		if err := clearWorkspace(workDir); err != nil {
 			return fmt.Errorf("failed to clean existing directory: %v", err)
 		}
 	}
 
 	// Create fresh directory
-	if err := os.MkdirAll(filepath.Dir(workDir), 0755); err != nil {
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return fmt.Errorf("failed to create workspace directory: %v", err)
+	}
+
+	// git refuses to clone into a non-empty directory, and the workspace keeps
+	// its logs, so clone next to it and move the checkout in
+	dir, err := stateDir()
+	if err != nil {
+		return err
+	}
+	cloneDir := filepath.Join(dir, "clones", filepath.Base(workDir))
+	if err := os.RemoveAll(cloneDir); err != nil {
+		return fmt.Errorf("failed to clean clone directory: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(cloneDir), 0755); err != nil {
 		return fmt.Errorf("failed to create parent directory: %v", err)
 	}
+	defer os.RemoveAll(cloneDir)
 
-	cmd := exec.Command("git", "clone", gitURL, workDir)
+	cmd := exec.Command("git", "clone", "--", gitURL, cloneDir)
+	// LFS objects are fetched afterwards by git lfs pull, with progress in the deploy log
+	cmd.Env = append(os.Environ(), "GIT_LFS_SKIP_SMUDGE=1")
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	if err := cmd.Run(); err != nil {
+	if err := d.runner.Run(cmd); err != nil {
 		return fmt.Errorf("git clone failed: %v", err)
 	}
 
+	entries, err := os.ReadDir(cloneDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if keptInWorkspace(entry.Name()) {
+			continue // Never let the repository clobber our logs
+		}
+		if err := os.Rename(filepath.Join(cloneDir, entry.Name()), filepath.Join(workDir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to move checkout into workspace: %v", err)
+		}
+	}
+
 	fmt.Printf("[GIT] Repository cloned successfully\n")
 	return nil
 }
 
-func (d *DockerSetup) ensureDockerfile(workDir string) error {
+// clearWorkspace removes everything in the workspace except our logs
+func clearWorkspace(workDir string) error {
+	entries, err := os.ReadDir(workDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if keptInWorkspace(entry.Name()) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(workDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureDockerfile makes sure the Dockerfile picked by dockerfileFor is in
+// the workspace and returns its path and source
+func (d *DockerSetup) ensureDockerfile(workDir string, deployment Deployment, sendLog func(string)) (string, string, error) {
+	project := deployment.ProjectName
+	path, source, err := dockerfileFor(workDir, deployment)
+	if err != nil {
+		return "", "", err
+	}
 	dockerfilePath := filepath.Join(workDir, "Dockerfile")
-	if _, err := os.Stat(dockerfilePath); os.IsNotExist(err) {
-		// Create a default Dockerfile for React applications
-		dockerfile := `FROM node:16-alpine
+
+	switch source {
+	case DockerfileOverride:
+		overridePath, err := dockerfileOverridePath(project)
+		if err != nil {
+			return "", "", err
+		}
+		override, err := os.ReadFile(overridePath)
+		if err != nil {
+			return "", "", err
+		}
+		if err := os.WriteFile(dockerfilePath, override, 0644); err != nil {
+			return "", "", err
+		}
+	case DockerfileGenerated:
+		// Create a default Dockerfile for React applications. The npm cache
+		// lives in a BuildKit cache mount, so it survives the COPY
+		// invalidating the install layer.
+		npmCache := ""
+		if !deployment.NoCache {
+			npmCache = buildCacheMount(project, "npm", "/root/.npm")
+		}
+		// serve runs as an unprivileged user unless run_as_root is set. It
+		// only reads the build output, so that is made world readable
+		// rather than handed over to the user.
+		user := `RUN addgroup -S app && adduser -S -G app app && chmod -R a+rX /app/build
+USER app
+`
+		if deployment.RunAsRoot {
+			user = ""
+		}
+		dockerfile := fmt.Sprintf(`FROM node:16-alpine
 WORKDIR /app
 COPY package*.json ./
-RUN npm install
+RUN %[1]snpm install
 COPY . .
-RUN npm run build
+RUN %[1]snpm run build
 EXPOSE 8080
-RUN npm install -g serve
-CMD ["serve", "-s", "build", "-l", "8080"]`
-		return os.WriteFile(dockerfilePath, []byte(dockerfile), 0644)
+RUN %[1]snpm install -g serve
+%[2]sCMD ["serve", "-s", "build", "-l", "8080"]`, npmCache, user)
+		if err := os.WriteFile(dockerfilePath, []byte(dockerfile), 0644); err != nil {
+			return "", "", err
+		}
+		if err := ensureDockerignore(workDir, sendLog); err != nil {
+			return "", "", err
+		}
+	}
+	return path, source, setDockerfileSource(project, source)
+}
+
+// buildCacheMount renders a BuildKit cache mount for a RUN instruction. The
+// cache is scoped per project, so projects don't evict each other's
+// packages.
+func buildCacheMount(project, cache, target string) string {
+	return fmt.Sprintf("--mount=type=cache,id=erebrus-%s-%s,target=%s ", composeProjectName(project), cache, target)
+}
+
+// buildKitEnv enables BuildKit for docker compose builds, which cache
+// mounts need
+func buildKitEnv() []string {
+	return append(os.Environ(), "DOCKER_BUILDKIT=1", "COMPOSE_DOCKER_CLI_BUILD=1")
+}
+
+// setDockerfileSource records where the project's Dockerfile came from
+func setDockerfileSource(project, source string) error {
+	return UpdateProjectState(project, func(state *ProjectState) {
+		state.DockerfileSource = source
+	})
+}
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// validateEnvVars rejects variable names that can't be rendered into compose
+func validateEnvVars(envVars map[string]string) error {
+	for name := range envVars {
+		if !envNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid environment variable name: %q", name)
+		}
 	}
 	return nil
 }
 
-func (d *DockerSetup) createDockerCompose(workDir string, deployment Deployment) error {
+// imageRepository is the image name builds of a project are tagged under
+func imageRepository(project string) string {
+	return "erebrus/" + composeProjectName(project)
+}
+
+func (d *DockerSetup) createDockerCompose(workDir string, deployment Deployment, imageTag string) error {
 	template := `services:
-  app:
-    build: .
-    ports:
-      - "%s:%s"
+  %[18]s:
+%[17]s    image: "%[3]s"
+    labels:
+      %[1]s: "%[2]s"
+%[13]s    ports:
+      - "%[4]s:%[5]s"
     environment:
-      PORT: "%s"
-    restart: always
-    networks:
-      - deployment-network
-
+      PORT: "%[6]s"
+%[7]s    restart: %[16]s
+%[9]s%[10]s    networks:
+%[11]s%[12]s
 networks:
-  deployment-network:
-    external: true`
+  %[8]s:
+    external: true
+%[15]s%[14]s`
+
+	hostPort := deployment.Port
+	if deployment.BindLocalhost {
+		hostPort = "127.0.0.1:" + deployment.Port
+	}
+
+	// The app reaches extra services over the compose project's default network
+	networks := []string{d.networkName()}
+	if len(deployment.Services) > 0 {
+		networks = append(networks, "default")
+	}
+
+	// With Traefik the app carries routing labels and joins Traefik's network
+	traefikLabels, traefikNetworkDef := "", ""
+	if deployment.Proxy == ProxyTraefik {
+		traefikLabels = d.traefikLabels(deployment)
+		networks = append(networks, d.Traefik.Network)
+		traefikNetworkDef = fmt.Sprintf("  %s:\n    external: true\n", d.Traefik.Network)
+	}
+
+	// Stack members reach their siblings by member name on the stack network
+	stackNetwork, stackNetworkDef := "", ""
+	if deployment.Stack != "" {
+		stackNetwork = d.stackNetworkName(deployment.Stack)
+		stackNetworkDef = fmt.Sprintf("  %s:\n    external: true\n", stackNetwork)
+	}
+
+	// Secrets are only decrypted here, into env files outside the workspace
+	// that the compose file references instead of carrying the values
+	deployment, err := decryptedSecrets(deployment)
+	if err != nil {
+		return err
+	}
+	envFiles := map[string]map[string]string{serviceName(deployment): deployment.EnvVars}
+	for _, service := range deployment.Services {
+		envFiles[service.Name] = service.EnvVars
+	}
+	envFilePaths, err := writeEnvFiles(deployment.ProjectName, envFiles)
+	if err != nil {
+		return err
+	}
+
+	// Prebuilt images are pulled, everything else is built from the workspace
+	build, dockerfile, target := "", "", ""
+	if deployment.Image == "" {
+		var source string
+		var err error
+		dockerfile, source, err = dockerfileFor(workDir, deployment)
+		if err != nil {
+			return err
+		}
+		if deployment.BuildTarget != "" && source != DockerfileGenerated {
+			target = deployment.BuildTarget
+		}
+		build = "    build:\n      context: .\n"
+		if dockerfile != "Dockerfile" {
+			build += fmt.Sprintf("      dockerfile: \"%s\"\n", dockerfile)
+		}
+		if target != "" {
+			build += fmt.Sprintf("      target: \"%s\"\n", target)
+		}
+		build += fmt.Sprintf("      labels:\n        %s: \"%s\"\n", projectLabel, deployment.ProjectName)
+	}
+	build = composePlatform(deployment.Platform) + build
+
+	composePath := filepath.Join(workDir, "docker-compose.yml")
+	if d.ComposeTemplate != nil {
+		compose, err := d.renderComposeTemplate(ComposeTemplateData{
+			Deployment:   deployment,
+			Service:      serviceName(deployment),
+			Image:        deployImage(deployment, imageTag),
+			Build:        deployment.Image == "",
+			Dockerfile:   dockerfile,
+			Target:       target,
+			HostPort:     hostPort,
+			AppPort:      "8080",
+			Network:      d.networkName(),
+			Restart:      restartPolicy(deployment),
+			EnvFile:      envFilePaths[serviceName(deployment)],
+			ProjectLabel: projectLabel,
+			StackNetwork: stackNetwork,
+			StackAlias:   stackMember(deployment),
+		})
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(composePath, compose, 0644)
+	}
 
 	compose := fmt.Sprintf(template,
-		deployment.Port,
+		projectLabel,
+		deployment.ProjectName,
+		deployImage(deployment, imageTag),
+		hostPort,
 		"8080", // internal port
 		"8080", // environment variable PORT
+		composeEnvFile(envFilePaths[serviceName(deployment)]),
+		d.networkName(),
+		composeHealthcheck(deployment.Healthcheck),
+		composeDependsOn(deployment.DependsOn),
+		composeAppNetworks(networks, stackNetwork, stackMember(deployment)),
+		composeServices(deployment.Services, deployment.ProjectName, restartPolicy(deployment), envFilePaths),
+		traefikLabels,
+		stackNetworkDef,
+		traefikNetworkDef,
+		restartPolicy(deployment),
+		build,
+		serviceName(deployment),
 	)
 
-	return os.WriteFile(filepath.Join(workDir, "docker-compose.yml"), []byte(compose), 0644)
+	return os.WriteFile(composePath, []byte(compose), 0644)
 }
 
-func (d *DockerSetup) buildAndRun(workDir string, deployment Deployment) error {
+func (d *DockerSetup) buildAndRun(workDir string, deployment Deployment, sendLog func(string)) error {
 	// Stop and remove only this project's previous deployment if it exists
 	fmt.Printf("[DOCKER] Cleaning up existing deployment for %s\n", deployment.ProjectName)
-	cleanupCmd := exec.Command("docker", "compose", "down", "-v")
+	cleanupCmd := d.composeCmd("down", "-v")
 	cleanupCmd.Dir = workDir
 	cleanupCmd.Stdout = os.Stdout
 	cleanupCmd.Stderr = os.Stderr
-	cleanupCmd.Run() // Ignore errors as containers might not exist
+	d.runner.Run(cleanupCmd) // Ignore errors as containers might not exist
 
 	// Create network if it doesn't exist
-	fmt.Printf("[DOCKER] Ensuring deployment network exists\n")
-	networkCmd := exec.Command("docker", "network", "create", "deployment-network")
-	networkCmd.Stdout = os.Stdout
-	networkCmd.Stderr = os.Stderr
-	networkCmd.Run() // Ignore error if network already exists
-
-	// Build and run using docker compose
-	fmt.Printf("[DOCKER] Building and starting containers\n")
-	cmd := exec.Command("docker", "compose", "up", "--build", "-d")
+	if err := d.ensureNetwork(); err != nil {
+		return err
+	}
+	if deployment.Stack != "" {
+		if err := d.ensureNamedNetwork(d.stackNetworkName(deployment.Stack)); err != nil {
+			return err
+		}
+	}
+
+	// Prebuilt images are pulled rather than built
+	if deployment.Image != "" {
+		fmt.Printf("[DOCKER] Pulling %s\n", deployment.Image)
+		sendLog(fmt.Sprintf("[DEPLOY] Pulling image %s", deployment.Image))
+		if err := d.streamCommand(d.composeInCmd(workDir, "pull", serviceName(deployment)), "[PULL]", sendLog); err != nil {
+			return fmt.Errorf("failed to pull image: %v", err)
+		}
+	}
+
+	// Build first so the pre-deploy hook runs against the new image, the
+	// port stays held for the whole build, and no_cache works as compose
+	// up can't skip the cache
+	if deployment.Image == "" {
+		fmt.Printf("[DOCKER] Building images\n")
+		args := []string{"build"}
+		if deployment.NoCache {
+			sendLog("[DEPLOY] no_cache is set, building without the build cache")
+			args = append(args, "--no-cache")
+		}
+		var buildStderr bytes.Buffer
+		buildCmd := d.composeCmd(args...)
+		buildCmd.Dir = workDir
+		buildCmd.Env = buildKitEnv()
+		buildCmd.Stdout = os.Stdout
+		buildCmd.Stderr = io.MultiWriter(os.Stderr, &buildStderr)
+		if err := d.runner.Run(buildCmd); err != nil {
+			return buildFailure(newCommandError(strings.Join(buildCmd.Args, " "), err, buildStderr.Bytes()), sendLog)
+		}
+	}
+	if deployment.PreDeployCmd != "" {
+		if err := d.runHook(workDir, serviceName(deployment), "pre-deploy", deployment.PreDeployCmd, sendLog); err != nil {
+			return err
+		}
+	}
+
+	// Hand the held port over to the containers
+	fmt.Printf("[DOCKER] Starting containers\n")
+	releasePort(deployment.Port)
+	var stderr bytes.Buffer
+	// Orphans are removed so a renamed service doesn't keep holding the port
+	cmd := d.composeCmd("up", "--no-build", "-d", "--remove-orphans")
 	cmd.Dir = workDir
+	cmd.Env = buildKitEnv()
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+	if err := d.runner.Run(cmd); err != nil {
+		return buildFailure(newCommandError(strings.Join(cmd.Args, " "), err, stderr.Bytes()), sendLog)
+	}
+	return nil
+}
+
+// isPortInUse reports whether a compose failure was caused by the host port
+// being taken
+func isPortInUse(err error) bool {
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	return strings.Contains(cmdErr.Output, "port is already allocated") ||
+		strings.Contains(cmdErr.Output, "address already in use")
+}
+
+// reassignPort moves a deployment to the next free port and regenerates its
+// compose file
+func (d *DockerSetup) reassignPort(workDir string, deployment *Deployment, deployID string, sendLog func(string)) error {
+	forgetPort(deployment.Port, deployment.ProjectName)
+	newPort := d.claimPort("", PortMapping{
+		ProjectName: deployment.ProjectName,
+		GitURL:      deployment.GitURL,
+	})
+	sendLog(fmt.Sprintf("[DEPLOY] Port %s was taken during the build, assigning port %s for project %s",
+		deployment.Port, newPort, deployment.ProjectName))
+	deployment.Port = newPort
+	if err := d.createDockerCompose(workDir, *deployment, deployID); err != nil {
+		return fmt.Errorf("failed to create docker-compose.yml: %v", err)
+	}
+	return nil
+}
+
+// defaultNetworkName is the shared docker network deployments join
+const defaultNetworkName = "deployment-network"
+
+// networkName returns the configured deployment network
+func (d *DockerSetup) networkName() string {
+	if d.NetworkName == "" {
+		return defaultNetworkName
+	}
+	return d.NetworkName
+}
+
+// ensureNetwork creates the deployment network if it doesn't exist. The
+// compose file marks it external, so compose up can't succeed without it.
+func (d *DockerSetup) ensureNetwork() error {
+	return d.ensureNamedNetwork(d.networkName())
+}
+
+// ensureNamedNetwork creates a docker network if it doesn't exist
+func (d *DockerSetup) ensureNamedNetwork(name string) error {
+	networkMutex.Lock()
+	defer networkMutex.Unlock()
+
+	fmt.Printf("[DOCKER] Ensuring deployment network %s exists\n", name)
+	if err := d.runner.Run(exec.Command("docker", "network", "inspect", name)); err == nil {
+		return nil
+	}
+
+	output, err := d.combinedOutput(exec.Command("docker", "network", "create", name))
+	if err == nil {
+		return nil
+	}
+	// Another deploy may have created it in the meantime
+	if d.runner.Run(exec.Command("docker", "network", "inspect", name)) == nil {
+		return nil
+	}
+	return fmt.Errorf("failed to create docker network %s: %v: %s", name, err, strings.TrimSpace(string(output)))
 }
 
 func (d *DockerSetup) configureNginx(deployment Deployment) error {
-	configTemplate := `server {
-    listen 80;
-    listen 443 ssl;
-    server_name %s.localhost;
+	config, err := d.nginxConfig(deployment)
+	if err != nil {
+		return err
+	}
+	if err := d.writeErrorPage(deployment); err != nil {
+		return err
+	}
+	return d.installNginxConfig(deployment.ProjectName, config)
+}
 
-    ssl_certificate /etc/nginx/ssl/server.crt;
-    ssl_certificate_key /etc/nginx/ssl/server.key;
+// nginxConfig renders the reverse proxy site of a deployment
+func (d *DockerSetup) nginxConfig(deployment Deployment) (string, error) {
+	configTemplate := `server {
+%s    server_name %s;
+%s
+    ssl_certificate %s;
+    ssl_certificate_key %s;
     ssl_trusted_certificate /etc/nginx/ssl/ca.crt;
     
     ssl_protocols TLSv1.2 TLSv1.3;
@@ -239,7 +1225,7 @@ func (d *DockerSetup) configureNginx(deployment Deployment) error {
     ssl_session_timeout 1d;
     ssl_session_cache shared:SSL:50m;
     ssl_session_tickets off;
-    
+%s
     # HSTS (uncomment if you're sure)
     # add_header Strict-Transport-Security "max-age=63072000" always;
 
@@ -247,21 +1233,11 @@ func (d *DockerSetup) configureNginx(deployment Deployment) error {
     if ($scheme != "https") {
         return 301 https://$host$request_uri;
     }
-
+%s
     location / {
-        proxy_pass http://localhost:%s;
-        proxy_http_version 1.1;
-        proxy_set_header Upgrade $http_upgrade;
-        proxy_set_header Connection 'upgrade';
-        proxy_set_header Host $host;
-        proxy_cache_bypass $http_upgrade;
-        
-        proxy_set_header X-Real-IP $remote_addr;
-        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
-        proxy_set_header X-Forwarded-Proto $scheme;
-        
+%s
         # Add CORS headers
-        add_header 'Access-Control-Allow-Origin' '*' always;
+%s
         add_header 'Access-Control-Allow-Methods' 'GET, POST, OPTIONS' always;
         add_header 'Access-Control-Allow-Headers' 'DNT,User-Agent,X-Requested-With,If-Modified-Since,Cache-Control,Content-Type,Range,Authorization' always;
         add_header 'Access-Control-Expose-Headers' 'Content-Length,Content-Range' always;
@@ -276,51 +1252,242 @@ func (d *DockerSetup) configureNginx(deployment Deployment) error {
     }
 }`
 
-	config := fmt.Sprintf(configTemplate, deployment.ProjectName, deployment.Port)
-	configPath := fmt.Sprintf("/etc/nginx/sites-available/%s", deployment.ProjectName)
-	symlinkPath := fmt.Sprintf("/etc/nginx/sites-enabled/%s", deployment.ProjectName)
+	serverName, certPath, keyPath, err := d.nginxServerTLS(deployment)
+	if err != nil {
+		return "", err
+	}
+
+	listenHTTP2 := ""
+	if deployment.ProxyProtocol == ProtocolHTTP2 || deployment.ProxyProtocol == ProtocolGRPC {
+		listenHTTP2 = " http2"
+	}
+	upstream := nginxAllowIPs(deployment.AllowIPs) + nginxUpstream(deployment)
+	headers := nginxCORSOrigin(deployment.CORSOrigins) + nginxHeaders(deployment.Headers)
+	assets := ""
+	if deployment.ProxyProtocol != ProtocolGRPC {
+		assets = nginxAssetCaching(deployment, upstream+headers)
+	}
+	assets += nginxErrorPage(deployment)
+	return fmt.Sprintf(configTemplate, nginxListen(listenHTTP2), serverName, nginxLogging(deployment.ProjectName), certPath, keyPath,
+		nginxCompression(deployment), assets,
+		upstream, headers), nil
+}
+
+// nginxServerTLS returns the server_name and certificate paths for a deployment
+func (d *DockerSetup) nginxServerTLS(deployment Deployment) (string, string, string, error) {
+	label := hostLabel(deployment)
+	serverName := fmt.Sprintf("%s.localhost", label)
+	certPath := "/etc/nginx/ssl/server.crt"
+	keyPath := "/etc/nginx/ssl/server.key"
+	// The shared certificate only covers *.localhost, so wildcard subdomains
+	// and environments, served on <env>.<project>.localhost, get their own
+	if deployment.WildcardSubdomain || deployment.Environment != "" {
+		if deployment.WildcardSubdomain {
+			serverName = fmt.Sprintf("*.%[1]s.localhost %[1]s.localhost", label)
+		}
+		var err error
+		if certPath, keyPath, err = d.generateWildcardCertificate(deployment.ProjectName, label); err != nil {
+			return "", "", "", fmt.Errorf("failed to generate certificate: %v", err)
+		}
+	}
+	return serverName, certPath, keyPath, nil
+}
+
+// nginxMutex serializes changes to the shared nginx config, so a deploy's
+// nginx -t never sees another deploy's half-installed site
+var nginxMutex sync.Mutex
+
+// installNginxConfig writes a site config, enables it and reloads nginx
+func (d *DockerSetup) installNginxConfig(project, config string) error {
+	nginxMutex.Lock()
+	defer nginxMutex.Unlock()
+
+	if err := d.writeNginxSite(project, config); err != nil {
+		return err
+	}
+	return d.testAndReloadNginx(project)
+}
+
+// writeNginxSite writes and enables a site config without reloading nginx.
+// The caller holds nginxMutex.
+func (d *DockerSetup) writeNginxSite(project, config string) error {
+	// Sites log in a format defined outside of them
+	if err := d.ensureNginxLogging(); err != nil {
+		return err
+	}
+
+	configPath := fmt.Sprintf("/etc/nginx/sites-available/%s", project)
+	symlinkPath := fmt.Sprintf("/etc/nginx/sites-enabled/%s", project)
 
-	// Write config using sudo
-	tmpFile := fmt.Sprintf("/tmp/nginx_%s", deployment.ProjectName)
+	// Write config as root
+	tmpFile := fmt.Sprintf("/tmp/nginx_%s", project)
 	if err := os.WriteFile(tmpFile, []byte(config), 0644); err != nil {
 		return fmt.Errorf("failed to write temporary config: %v", err)
 	}
 
-	// Move file to nginx directory using sudo
-	if err := exec.Command("sudo", "mv", tmpFile, configPath).Run(); err != nil {
+	// Move file to nginx directory as root
+	if err := d.runElevated("mv", tmpFile, configPath); err != nil {
 		return fmt.Errorf("failed to move nginx config: %v", err)
 	}
 
 	// Remove existing symlink if it exists
-	exec.Command("sudo", "rm", "-f", symlinkPath).Run()
+	d.runElevated("rm", "-f", symlinkPath)
 
-	// Create symlink using sudo
-	if err := exec.Command("sudo", "ln", "-s", configPath, symlinkPath).Run(); err != nil {
+	// Create symlink as root
+	if err := d.runElevated("ln", "-s", configPath, symlinkPath); err != nil {
 		return fmt.Errorf("failed to create nginx symlink: %v", err)
 	}
+	return nil
+}
 
-	// Test and reload nginx
-	if err := exec.Command("sudo", "nginx", "-t").Run(); err != nil {
-		return fmt.Errorf("nginx configuration test failed: %v", err)
+// testAndReloadNginx checks the config and reloads nginx. If nginx rejects
+// it, the sites of the given projects are disabled rather than left enabled
+// for the next reload. The caller holds nginxMutex.
+func (d *DockerSetup) testAndReloadNginx(projects ...string) error {
+	if err := d.runElevated("nginx", "-t"); err != nil {
+		// Exit code 1 means nginx rejected the config
+		if code, ok := ExitCode(err); ok && code == 1 {
+			for _, project := range projects {
+				d.runElevated("rm", "-f", fmt.Sprintf("/etc/nginx/sites-enabled/%s", project))
+			}
+			return fmt.Errorf("nginx rejected the generated config: %s", err.(*CommandError).Output)
+		}
+		return fmt.Errorf("nginx configuration test failed: %w", err)
 	}
 
-	if err := exec.Command("sudo", "systemctl", "reload", "nginx").Run(); err != nil {
+	if err := d.runElevated("systemctl", "reload", "nginx"); err != nil {
 		return fmt.Errorf("failed to reload nginx: %v", err)
 	}
 
 	return nil
 }
 
-// Improve isPortAvailable to check both Docker and system ports
-func isPortAvailable(port string) bool {
+// removeNginxConfig disables and deletes a project's nginx site
+func (d *DockerSetup) removeNginxConfig(project string) error {
+	nginxMutex.Lock()
+	defer nginxMutex.Unlock()
+
+	configPath := fmt.Sprintf("/etc/nginx/sites-available/%s", project)
+	symlinkPath := fmt.Sprintf("/etc/nginx/sites-enabled/%s", project)
+	if err := d.runElevated("rm", "-f", symlinkPath, configPath); err != nil {
+		return fmt.Errorf("failed to remove nginx config: %v", err)
+	}
+	if err := d.runElevated("rm", "-rf", filepath.Join(errorPageRoot, project)); err != nil {
+		return fmt.Errorf("failed to remove error page: %v", err)
+	}
+	if err := d.runElevated("systemctl", "reload", "nginx"); err != nil {
+		return fmt.Errorf("failed to reload nginx: %v", err)
+	}
+	return nil
+}
+
+var corsOriginPattern = regexp.MustCompile(`^https?://[a-zA-Z0-9.-]+(:[0-9]+)?$`)
+
+// validateCORSOrigins ensures every origin is a plain scheme://host[:port]
+// so it can be embedded in the nginx config safely
+func validateCORSOrigins(origins []string) error {
+	for _, origin := range origins {
+		if !corsOriginPattern.MatchString(origin) {
+			return fmt.Errorf("invalid CORS origin: %q", origin)
+		}
+	}
+	return nil
+}
+
+// nginxCORSOrigin renders the directives choosing the Access-Control-Allow-Origin
+// value: a wildcard when no origins are configured, otherwise the request
+// origin echoed back only when it is in the allowed list
+func nginxCORSOrigin(origins []string) string {
+	if len(origins) == 0 {
+		return "        add_header 'Access-Control-Allow-Origin' '*' always;"
+	}
+
+	quoted := make([]string, len(origins))
+	for i, origin := range origins {
+		quoted[i] = regexp.QuoteMeta(origin)
+	}
+	return fmt.Sprintf(`        set $cors_origin "";
+        if ($http_origin ~* "^(%s)$") {
+            set $cors_origin $http_origin;
+        }
+        add_header 'Access-Control-Allow-Origin' $cors_origin always;
+        add_header 'Vary' 'Origin' always;`, strings.Join(quoted, "|"))
+}
+
+// isPortAvailable checks both Docker and system ports
+func (d *DockerSetup) isPortAvailable(port string) bool {
 	// Check if Docker is using the port
-	dockerCmd := fmt.Sprintf("docker ps --format '{{.Ports}}' | grep ':%s->'", port)
-	dockerErr := exec.Command("sh", "-c", dockerCmd).Run()
+	if d.dockerPublishesPort(port) {
+		return false
+	}
+
+	// Check if the system is using the port. A port only taken on one
+	// address family still clashes.
+	return canBind("tcp4", "0.0.0.0:"+port) && (!ipv6Enabled || canBind("tcp6", "[::]:"+port))
+}
 
-	// Check if system is using the port
-	netstatCmd := fmt.Sprintf("netstat -tuln | grep LISTEN | grep :%s", port)
-	netstatErr := exec.Command("sh", "-c", netstatCmd).Run()
+// dockerPublishesPort reports whether a running container publishes the host
+// port on any address. If docker can't be queried the port is treated as
+// taken rather than risk a clash.
+func (d *DockerSetup) dockerPublishesPort(port string) bool {
+	published, err := d.containersPublish(port)
+	return published || err != nil
+}
+
+// projectPublishesPort reports whether the project's own running containers
+// publish the host port, which a redeploy takes over
+func (d *DockerSetup) projectPublishesPort(project, port string) bool {
+	published, err := d.containersPublish(port, "--filter", "label=com.docker.compose.project="+composeProjectName(project))
+	return published && err == nil
+}
+
+// containersPublish reports whether a running container matching the docker
+// ps filters publishes the host port
+func (d *DockerSetup) containersPublish(port string, filters ...string) (bool, error) {
+	wanted, err := strconv.Atoi(port)
+	if err != nil {
+		return false, err
+	}
+	args := append(append([]string{"ps"}, filters...), "--format", "{{.Ports}}")
+	out, err := d.runner.Output(exec.Command("docker", args...))
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		for _, published := range parsePublishedPorts(line) {
+			if wanted >= published[0] && wanted <= published[1] {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
 
-	// Port is available if both commands return errors (port not found)
-	return dockerErr != nil && netstatErr != nil
+// parsePublishedPorts returns the host port ranges in a docker ps Ports
+// column, e.g. "0.0.0.0:3000->8080/tcp, :::3000->8080/tcp" or
+// "127.0.0.1:5000-5001->5000-5001/tcp". Exposed but unpublished ports such as
+// "8080/tcp" are skipped.
+func parsePublishedPorts(ports string) [][2]int {
+	var ranges [][2]int
+	for _, mapping := range strings.Split(ports, ",") {
+		host, _, found := strings.Cut(strings.TrimSpace(mapping), "->")
+		if !found {
+			continue
+		}
+		// The host address may be IPv4, bare IPv6 (:::3000) or bracketed ([::]:3000)
+		hostPort := host[strings.LastIndex(host, ":")+1:]
+		low, high, isRange := strings.Cut(hostPort, "-")
+		first, err := strconv.Atoi(low)
+		if err != nil {
+			continue
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(high); err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, [2]int{first, last})
+	}
+	return ranges
 }
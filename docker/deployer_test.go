@@ -0,0 +1,39 @@
+package docker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePublishedPorts(t *testing.T) {
+	tests := []struct {
+		name  string
+		ports string
+		want  [][2]int
+	}{
+		{"empty", "", nil},
+		{"exposed only", "8080/tcp", nil},
+		{"ipv4", "0.0.0.0:3000->8080/tcp", [][2]int{{3000, 3000}}},
+		{"localhost", "127.0.0.1:3001->8080/tcp", [][2]int{{3001, 3001}}},
+		{"bare ipv6", ":::3000->8080/tcp", [][2]int{{3000, 3000}}},
+		{"bracketed ipv6", "[::]:3002->8080/tcp", [][2]int{{3002, 3002}}},
+		{"range", "127.0.0.1:5000-5001->5000-5001/tcp", [][2]int{{5000, 5001}}},
+		{
+			"ipv4 and ipv6",
+			"0.0.0.0:3000->8080/tcp, :::3000->8080/tcp",
+			[][2]int{{3000, 3000}, {3000, 3000}},
+		},
+		{
+			"multiple mappings",
+			"0.0.0.0:80->80/tcp, 0.0.0.0:443->443/tcp, 9000/tcp",
+			[][2]int{{80, 80}, {443, 443}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parsePublishedPorts(tt.ports); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePublishedPorts(%q) = %v, want %v", tt.ports, got, tt.want)
+			}
+		})
+	}
+}
@@ -5,14 +5,107 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"text/template"
+	"time"
 )
 
 // DockerSetup handles the installation and configuration of Docker
-type DockerSetup struct{}
+type DockerSetup struct {
+	// LogRetentionBytes caps the compressed deploy logs kept per project,
+	// zero keeps everything
+	LogRetentionBytes int64
+
+	// NetworkName is the docker network deployments join, so several managers
+	// on one host don't share it
+	NetworkName string
+
+	// DefaultProxy is used by deployments that don't choose a proxy
+	DefaultProxy string
+	// PublicHost is the address in URLs of deployments without a proxy
+	PublicHost string
+	// Traefik configures routing for deployments using the traefik proxy
+	Traefik TraefikConfig
+	// DockerVersion pins the docker-ce apt version and ComposeVersion the
+	// docker-compose release tag Install fetches; empty installs the latest
+	DockerVersion  string
+	ComposeVersion string
+	// LocalPathRoot is the directory local_path deployments must be under,
+	// empty disables them
+	LocalPathRoot string
+	// MaxExtractBytes and MaxExtractEntries cap the size and entry count an
+	// uploaded archive may expand to, zero using the defaults
+	MaxExtractBytes   int64
+	MaxExtractEntries int
+	// Registry is used by builds of deployments without their own registry
+	// credentials, nil builds anonymously
+	Registry *RegistryAuth
+	// Rootless avoids sudo entirely, for use with rootless docker. Only
+	// proxies that need no root on the host are allowed.
+	Rootless bool
+
+	// Webhooks receive a JSON POST for every crash, OOM kill or restart of a
+	// managed container
+	Webhooks []string
+
+	// LocalRegistry archives every successful build in a registry:2
+	// container on this host, so rollbacks survive image pruning
+	LocalRegistry bool
+
+	// PushRegistry receives the images of deployments with push set, nil
+	// when pushing is not configured
+	PushRegistry *PushRegistry
+
+	// ComposeTemplate replaces the built-in docker-compose.yml when set
+	ComposeTemplate *template.Template
+
+	// ExecPolicy restricts the commands POST /deployments/{project}/exec
+	// may run in deployed containers
+	ExecPolicy ExecPolicy
+
+	// ProjectDeployLog tees each run's log to the workspace deploy.log,
+	// replacing the previous run's
+	ProjectDeployLog bool
+	// CompressWorkspaces packs the source checkout after a successful
+	// build; it is expanded again on the next deploy
+	CompressWorkspaces bool
+
+	// ImageRetention is how many of a project's images are kept for rollback
+	ImageRetention int
+	// BuildCacheMaxAge prunes build cache older than this after deploys,
+	// zero disables pruning
+	BuildCacheMaxAge time.Duration
+
+	// composeCommand is the detected compose invocation, see DetectCompose
+	composeCommand []string
+
+	watchdog  *watchdog
+	lifecycle *lifecycleMonitor
+	jobs      *jobQueue
+	runner    CommandRunner
+	executor  Executor
+	elevation string
+}
 
 // NewDockerSetup creates a new DockerSetup instance
 func NewDockerSetup() *DockerSetup {
-	return &DockerSetup{}
+	return NewDockerSetupWithRunner(execRunner{})
+}
+
+// NewDockerSetupWithRunner creates a DockerSetup issuing its commands through
+// runner, e.g. a RecordingRunner in tests. Its Executor runs on runner too.
+func NewDockerSetupWithRunner(runner CommandRunner) *DockerSetup {
+	return &DockerSetup{
+		runner:   runner,
+		executor: runnerExecutor{runner: runner},
+		jobs:     newJobQueue(),
+		lifecycle: &lifecycleMonitor{
+			counters: make(map[string]*LifecycleCounters),
+		},
+		watchdog: &watchdog{
+			containers:   make(map[string]*containerWatch),
+			crashLooping: make(map[string]bool),
+		},
+	}
 }
 
 // ExecuteCommand runs a shell command and logs output in real-time
@@ -25,62 +118,11 @@ func (d *DockerSetup) ExecuteCommand(command string) error {
 	fmt.Printf("\n[COMMAND] Executing: %s\n", command)
 
 	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = prefixWriter{prefix: "[STDOUT] "}
+	cmd.Stderr = prefixWriter{prefix: "[STDERR] "}
 
-	// Set up pipes for stdout and stderr
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stdout pipe: %v", err)
-	}
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stderr pipe: %v", err)
-	}
-
-	// Start the command
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start command: %v", err)
-	}
-
-	// Create a channel to signal when we're done reading output
-	done := make(chan bool)
-
-	// Read stdout in a goroutine
-	go func() {
-		buffer := make([]byte, 1024)
-		for {
-			n, err := stdout.Read(buffer)
-			if n > 0 {
-				fmt.Printf("[STDOUT] %s", buffer[:n])
-			}
-			if err != nil {
-				break
-			}
-		}
-		done <- true
-	}()
-
-	// Read stderr in a goroutine
-	go func() {
-		buffer := make([]byte, 1024)
-		for {
-			n, err := stderr.Read(buffer)
-			if n > 0 {
-				fmt.Printf("[STDERR] %s", buffer[:n])
-			}
-			if err != nil {
-				break
-			}
-		}
-		done <- true
-	}()
-
-	// Wait for both stdout and stderr to be fully read
-	<-done
-	<-done
-
-	// Wait for the command to complete
-	if err := cmd.Wait(); err != nil {
-		return fmt.Errorf("command failed: %v", err)
+	if err := d.runner.Run(cmd); err != nil {
+		return newCommandError(command, err, nil)
 	}
 
 	fmt.Printf("[COMMAND] Completed successfully\n")
@@ -111,8 +153,8 @@ func (d *DockerSetup) Install() error {
 	// Execute kernel updates
 	for _, step := range kernelSteps {
 		fmt.Printf("\nExecuting: %s\n", step.description)
-		if err := d.ExecuteCommand(step.command); err != nil {
-			return fmt.Errorf("%s failed: %v", step.description, err)
+		if err := d.executeStep(step.command); err != nil {
+			return fmt.Errorf("%s failed: %w", step.description, err)
 		}
 	}
 
@@ -134,6 +176,7 @@ func (d *DockerSetup) Install() error {
 	dockerSteps := []struct {
 		description string
 		command     string
+		run         func() error // steps done in Go rather than the shell
 	}{
 		{
 			description: "Installing required packages",
@@ -153,7 +196,7 @@ func (d *DockerSetup) Install() error {
 		},
 		{
 			description: "Installing Docker Engine",
-			command:     "DEBIAN_FRONTEND=noninteractive apt-get install -y docker-ce docker-ce-cli containerd.io",
+			command:     "DEBIAN_FRONTEND=noninteractive apt-get install -y " + d.dockerPackages(),
 		},
 		{
 			description: "Setting up Docker group",
@@ -165,7 +208,7 @@ func (d *DockerSetup) Install() error {
 		},
 		{
 			description: "Installing Docker Compose",
-			command:     `sudo curl -L "https://github.com/docker/compose/releases/latest/download/docker-compose-$(uname -s)-$(uname -m)" -o /usr/local/bin/docker-compose && sudo chmod +x /usr/local/bin/docker-compose`,
+			run:         d.installCompose,
 		},
 		{
 			description: "Setting correct permissions for Docker socket",
@@ -180,11 +223,39 @@ func (d *DockerSetup) Install() error {
 	// Execute Docker installation steps
 	for _, step := range dockerSteps {
 		fmt.Printf("\nExecuting: %s\n", step.description)
-		if err := d.ExecuteCommand(step.command); err != nil {
-			return fmt.Errorf("%s failed: %v", step.description, err)
+		run := step.run
+		if run == nil {
+			run = func() error { return d.executeStep(step.command) }
+		}
+		if err := run(); err != nil {
+			return fmt.Errorf("%s failed: %w", step.description, err)
 		}
 	}
 
+	if err := d.verifyVersions(); err != nil {
+		return err
+	}
+
+	if err := d.DetectCompose(); err != nil {
+		return err
+	}
+
 	fmt.Println("\nDocker setup completed successfully!")
 	return nil
 }
+
+// aptLockRetryDelay is how long to wait before retrying an apt step that
+// failed, typically because another apt process held the dpkg lock
+const aptLockRetryDelay = 15 * time.Second
+
+// executeStep runs an installer step, retrying apt commands once when they
+// exit with code 100 (apt's generic failure, usually a held lock)
+func (d *DockerSetup) executeStep(command string) error {
+	err := d.ExecuteCommand(command)
+	if code, ok := ExitCode(err); ok && code == 100 && strings.Contains(command, "apt-get") {
+		fmt.Printf("[SYSTEM] apt-get exited with code 100, retrying in %s\n", aptLockRetryDelay)
+		time.Sleep(aptLockRetryDelay)
+		err = d.ExecuteCommand(command)
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var buildTargetPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,127}$`)
+
+// validateDockerfileOptions checks dockerfile_path stays inside the
+// workspace and build_target is a valid stage name
+func validateDockerfileOptions(deployment Deployment) error {
+	if deployment.DockerfilePath == "" && deployment.BuildTarget == "" {
+		return nil
+	}
+	if deployment.Static || deployment.Image != "" {
+		return fmt.Errorf("dockerfile_path and build_target only apply to images built from a Dockerfile")
+	}
+	if path := deployment.DockerfilePath; path != "" {
+		clean := filepath.Clean(path)
+		if filepath.IsAbs(path) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) ||
+			strings.ContainsAny(path, "\"\n\r") {
+			return fmt.Errorf("dockerfile_path must be a file inside the repository: %q", path)
+		}
+	}
+	if deployment.BuildTarget != "" && !buildTargetPattern.MatchString(deployment.BuildTarget) {
+		return fmt.Errorf("invalid build_target: %q", deployment.BuildTarget)
+	}
+	return nil
+}
+
+// dockerfileFor returns the Dockerfile a build uses, relative to the
+// workspace, and where it comes from. An override stored through the
+// artifacts API wins, then dockerfile_path, then a Dockerfile at the root;
+// otherwise one is generated at the root.
+func dockerfileFor(workDir string, deployment Deployment) (string, string, error) {
+	if overridePath, err := dockerfileOverridePath(deployment.ProjectName); err == nil {
+		if _, err := os.Stat(overridePath); err == nil {
+			return "Dockerfile", DockerfileOverride, nil
+		}
+	}
+
+	if deployment.DockerfilePath != "" {
+		path := filepath.Join(workDir, deployment.DockerfilePath)
+		if _, err := os.Stat(path); err == nil {
+			// A symlink in the repository must not point the build elsewhere
+			resolved, err := filepath.EvalSymlinks(path)
+			if err != nil {
+				return "", "", err
+			}
+			root, err := filepath.EvalSymlinks(workDir)
+			if err != nil {
+				return "", "", err
+			}
+			if rel, err := filepath.Rel(root, resolved); err != nil || strings.HasPrefix(rel, "..") {
+				return "", "", fmt.Errorf("dockerfile_path %q resolves outside the repository", deployment.DockerfilePath)
+			}
+			return deployment.DockerfilePath, DockerfileFromRepository, nil
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(workDir, "Dockerfile")); err == nil {
+		return "Dockerfile", DockerfileFromRepository, nil
+	}
+	return "Dockerfile", DockerfileGenerated, nil
+}
@@ -0,0 +1,103 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// commonDockerignore keeps VCS data, secrets and our own logs out of every
+// generated build context
+var commonDockerignore = []string{".git", ".env", "*.log", logsDirName, deployLogName}
+
+// runtimeDockerignore lists what each runtime rebuilds inside the image or
+// never needs there, keyed by detectLanguage
+var runtimeDockerignore = map[string][]string{
+	"node":   {"node_modules", "build", "dist", ".next", "coverage", ".npm"},
+	"python": {"__pycache__", "*.pyc", ".venv", "venv", ".pytest_cache", ".mypy_cache"},
+	"go":     {"bin"},
+	"ruby":   {".bundle", "vendor/bundle", "tmp"},
+	"java":   {"target", "build", ".gradle"},
+	"rust":   {"target"},
+	"php":    {"vendor"},
+}
+
+// ensureDockerignore keeps dependencies, VCS data, build output and our deploy
+// logs out of the build context of a generated Dockerfile, tuned to the
+// app's runtime. An existing .dockerignore is left alone.
+func ensureDockerignore(workDir string, sendLog func(string)) error {
+	dockerignorePath := filepath.Join(workDir, ".dockerignore")
+	if _, err := os.Stat(dockerignorePath); !os.IsNotExist(err) {
+		return nil
+	}
+
+	language := detectLanguage(workDir)
+	patterns := append(append([]string{}, commonDockerignore...), runtimeDockerignore[language]...)
+	if err := os.WriteFile(dockerignorePath, []byte(strings.Join(patterns, "\n")+"\n"), 0644); err != nil {
+		return err
+	}
+
+	runtime := language
+	if runtime == "" {
+		runtime = "unknown"
+	}
+	before, after := contextSizes(workDir, patterns)
+	sendLog(fmt.Sprintf("[DEPLOY] Generated .dockerignore for runtime %s, build context %s -> %s",
+		runtime, formatBytes(before), formatBytes(after)))
+	return nil
+}
+
+// contextSizes returns the size of a build context without and with the
+// ignore patterns applied. Patterns match a path or any of its parents,
+// which covers the patterns we generate.
+func contextSizes(workDir string, patterns []string) (int64, int64) {
+	var before, after int64
+	filepath.Walk(workDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		before += info.Size()
+		rel, err := filepath.Rel(workDir, path)
+		if err != nil || !ignoredByDockerignore(filepath.ToSlash(rel), patterns) {
+			after += info.Size()
+		}
+		return nil
+	})
+	return before, after
+}
+
+// ignoredByDockerignore reports whether rel or one of its parent
+// directories matches a pattern
+func ignoredByDockerignore(rel string, patterns []string) bool {
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		prefix := strings.Join(parts[:i+1], "/")
+		for _, pattern := range patterns {
+			if matched, _ := filepath.Match(pattern, prefix); matched {
+				return true
+			}
+			// Patterns without a slash also match by name, like **/<pattern>
+			if !strings.Contains(pattern, "/") {
+				if matched, _ := filepath.Match(pattern, parts[i]); matched {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// formatBytes renders a byte count with a binary unit, e.g. 12.3 MiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,73 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// How privileged commands are run, detected by DetectElevation
+const (
+	ElevationRoot = "root" // already root, commands run as is
+	ElevationSudo = "sudo" // passwordless sudo is available
+	ElevationNone = "none" // no way to elevate
+)
+
+// elevatedOperations lists what needs root, for the startup error when
+// elevation isn't available
+var elevatedOperations = []string{
+	"installing nginx and openssl with apt-get",
+	"copying certificates into /etc/nginx/ssl",
+	"writing nginx sites and reloading nginx",
+	"publishing static sites to " + staticRoot,
+	"writing error pages to " + errorPageRoot,
+}
+
+// DetectElevation works out whether privileged commands need a sudo prefix
+func (d *DockerSetup) DetectElevation() string {
+	switch {
+	case os.Geteuid() == 0:
+		d.elevation = ElevationRoot
+	case d.runner.Run(exec.Command("sudo", "-n", "true")) == nil:
+		d.elevation = ElevationSudo
+	default:
+		d.elevation = ElevationNone
+	}
+	fmt.Printf("[SYSTEM] Privileged commands run as: %s\n", d.elevation)
+	return d.elevation
+}
+
+// CheckElevation fails when privileged commands can't be run, naming the
+// operations that need them
+func (d *DockerSetup) CheckElevation() error {
+	if d.elevation != ElevationNone {
+		return nil
+	}
+	return fmt.Errorf("not running as root and passwordless sudo is unavailable; these operations need it:\n  - %s\nrun as root, allow passwordless sudo, or set EREBRUS_ROOTLESS=true",
+		strings.Join(elevatedOperations, "\n  - "))
+}
+
+// elevatedArgs prefixes a command with sudo unless already root
+func (d *DockerSetup) elevatedArgs(name string, args ...string) []string {
+	command := append([]string{name}, args...)
+	if d.elevation == ElevationRoot {
+		return command
+	}
+	return append([]string{"sudo"}, command...)
+}
+
+// runElevated runs a command as root
+func (d *DockerSetup) runElevated(name string, args ...string) error {
+	command := d.elevatedArgs(name, args...)
+	return d.runCommand(command[0], command[1:]...)
+}
+
+// Elevate prefixes a shell command for ExecuteCommand with sudo unless
+// already root
+func (d *DockerSetup) Elevate(command string) string {
+	if d.elevation == ElevationRoot {
+		return command
+	}
+	return "sudo " + command
+}
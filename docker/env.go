@@ -0,0 +1,178 @@
+package docker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"erebrusvps/websocket"
+)
+
+// EnvPatch sets and unsets environment variables of a deployed app
+type EnvPatch struct {
+	Set   map[string]string `json:"set,omitempty"`
+	Unset []string          `json:"unset,omitempty"`
+	// Signal, e.g. HUP, is sent to the app instead of recreating its
+	// container, for apps that reload their config on a signal. A running
+	// process keeps the environment it started with, so a signal can't be
+	// combined with a patch changing any value.
+	Signal string `json:"signal,omitempty"`
+}
+
+// reloadSignals are the signals an env patch may send; anything that would
+// stop the app is left to the regular lifecycle
+var reloadSignals = map[string]bool{"HUP": true, "USR1": true, "USR2": true}
+
+// validateReloadSignal accepts HUP, USR1 and USR2, with or without SIG
+func validateReloadSignal(signal string) (string, error) {
+	name := strings.TrimPrefix(strings.ToUpper(signal), "SIG")
+	if !reloadSignals[name] {
+		return "", fmt.Errorf("invalid signal %q, expected HUP, USR1 or USR2", signal)
+	}
+	return name, nil
+}
+
+// UpdateEnv applies an env patch to a deployed project without rebuilding:
+// the compose file is regenerated against the current image and compose
+// recreates the app container. With patch.Signal set the container is only
+// signaled, and the patch must leave the env as it is. It returns the
+// resulting env, masked.
+func (d *DockerSetup) UpdateEnv(project string, patch EnvPatch) (map[string]string, error) {
+	if err := validateEnvVars(patch.Set); err != nil {
+		return nil, err
+	}
+	if err := ValidateSecretValues(Deployment{EnvVars: patch.Set}); err != nil {
+		return nil, err
+	}
+	if patch.Signal != "" {
+		var err error
+		if patch.Signal, err = validateReloadSignal(patch.Signal); err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range patch.Unset {
+		if !envNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid environment variable name: %q", name)
+		}
+	}
+
+	// Wait for a running deploy rather than racing it over the compose file
+	unlock := d.jobs.lockProject(project)
+	defer unlock()
+
+	state, err := LoadProjectState(project)
+	if err != nil {
+		return nil, err
+	}
+	if state.Deployment == nil {
+		return nil, fmt.Errorf("%s has no successful deployment", project)
+	}
+	if state.Deployment.Static {
+		return nil, fmt.Errorf("static deployments have no container environment")
+	}
+	if patch.Signal != "" {
+		changed, err := envPatchChanges(*state.Deployment, patch)
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			return nil, fmt.Errorf("a running process keeps the environment it started with, so SIG%s can't apply env changes; update without a signal to recreate the container", patch.Signal)
+		}
+	}
+	workDir, err := workspaceDir(project)
+	if err != nil {
+		return nil, err
+	}
+	imageTag, err := deployedImageTag(workDir, *state.Deployment)
+	if err != nil {
+		return nil, err
+	}
+
+	spec := *state.Deployment
+	spec.EnvVars = make(map[string]string)
+	for name, value := range state.Deployment.EnvVars {
+		spec.EnvVars[name] = value
+	}
+	for name, value := range patch.Set {
+		spec.EnvVars[name] = value
+	}
+	for _, name := range patch.Unset {
+		delete(spec.EnvVars, name)
+	}
+
+	// Mask both the old and new values in anything we log
+	redactOld, redactNew := newRedactor(*state.Deployment), newRedactor(spec)
+	redact := func(line string) string { return redactOld(redactNew(line)) }
+	if patch.Signal != "" {
+		if output, err := d.combinedOutput(d.composeInCmd(workDir, "kill", "-s", patch.Signal, serviceName(spec))); err != nil {
+			return nil, fmt.Errorf("failed to send SIG%s: %v: %s", patch.Signal, err, redact(strings.TrimSpace(string(output))))
+		}
+		message := fmt.Sprintf("[ENV] Sent SIG%s to %s", patch.Signal, project)
+		websocket.Logger.SendProjectLog(project, message)
+		fmt.Println(message)
+		return redactedEnv(spec.EnvVars), nil
+	}
+
+	// Regenerating from the previous spec puts its compose and env files
+	// back, so they match what runs
+	restore := func() {
+		if err := d.createDockerCompose(workDir, *state.Deployment, imageTag); err != nil {
+			fmt.Printf("[ENV] Failed to restore compose file of %s: %v\n", project, err)
+		}
+	}
+	if err := d.createDockerCompose(workDir, spec, imageTag); err != nil {
+		restore()
+		return nil, fmt.Errorf("failed to create compose file: %v", err)
+	}
+	if output, err := d.combinedOutput(d.composeInCmd(workDir, "up", "-d", "--no-build")); err != nil {
+		restore()
+		d.composeIn(workDir, "up", "-d", "--no-build")
+		return nil, fmt.Errorf("failed to recreate containers: %v: %s", err, redact(strings.TrimSpace(string(output))))
+	}
+
+	if err := UpdateProjectState(project, func(state *ProjectState) {
+		state.Deployment = &spec
+	}); err != nil {
+		return nil, err
+	}
+
+	message := fmt.Sprintf("[ENV] Updated environment of %s", project)
+	if len(patch.Set) > 0 {
+		message += fmt.Sprintf(", set %s", strings.Join(sortedNames(patch.Set), ", "))
+	}
+	if len(patch.Unset) > 0 {
+		message += fmt.Sprintf(", unset %s", strings.Join(patch.Unset, ", "))
+	}
+	websocket.Logger.SendProjectLog(project, message)
+	fmt.Println(message)
+	return redactedEnv(spec.EnvVars), nil
+}
+
+// envPatchChanges reports whether a patch would change the deployment's env,
+// comparing against the decrypted values
+func envPatchChanges(deployment Deployment, patch EnvPatch) (bool, error) {
+	current, err := decryptedSecrets(deployment)
+	if err != nil {
+		return false, err
+	}
+	for name, value := range patch.Set {
+		if old, ok := current.EnvVars[name]; !ok || old != value {
+			return true, nil
+		}
+	}
+	for _, name := range patch.Unset {
+		if _, ok := current.EnvVars[name]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func sortedNames(envVars map[string]string) []string {
+	names := make([]string, 0, len(envVars))
+	for name := range envVars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
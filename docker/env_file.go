@@ -0,0 +1,71 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// envFileDir returns the directory holding a project's env files. It sits
+// with the manager's state rather than in the workspace, so secrets never
+// end up in a build context.
+func envFileDir(project string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "env", project), nil
+}
+
+// envFileEscaper escapes a value for a double quoted env file entry: compose
+// expands \\, \" and \n there and interpolates $ unless doubled
+var envFileEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "$", "$$")
+
+// writeEnvFiles replaces a project's env files with one per service that has
+// env vars, readable by the owner only, and returns their paths by service
+func writeEnvFiles(project string, services map[string]map[string]string) (map[string]string, error) {
+	dir, err := envFileDir(project)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to clear env files: %v", err)
+	}
+	paths := make(map[string]string)
+	for service, envVars := range services {
+		if len(envVars) == 0 {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("failed to create env file directory: %v", err)
+		}
+		var b strings.Builder
+		for _, name := range sortedNames(envVars) {
+			fmt.Fprintf(&b, "%s=\"%s\"\n", name, envFileEscaper.Replace(envVars[name]))
+		}
+		path := filepath.Join(dir, service+".env")
+		if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+			return nil, fmt.Errorf("failed to write env file: %v", err)
+		}
+		paths[service] = path
+	}
+	return paths, nil
+}
+
+// removeEnvFiles deletes a project's env files
+func removeEnvFiles(project string) error {
+	dir, err := envFileDir(project)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// composeEnvFile renders a service's env_file entry, empty without one
+func composeEnvFile(path string) string {
+	if path == "" {
+		return ""
+	}
+	return fmt.Sprintf("    env_file:\n      - %s\n", composeQuote(path))
+}
@@ -0,0 +1,67 @@
+package docker
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// deployTestApp deploys a locally built app with the given env, so it has an
+// image tag UpdateEnv can recreate it from
+func deployTestApp(t *testing.T, d *DockerSetup, project string, envVars map[string]string) {
+	t.Helper()
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "Dockerfile"), []byte("FROM scratch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d.LocalPathRoot = filepath.Dir(source)
+	if _, err := d.DeployProject(Deployment{ProjectName: project, LocalPath: source, Proxy: ProxyNone, EnvVars: envVars}); err != nil {
+		t.Fatalf("DeployProject: %v", err)
+	}
+}
+
+func TestUpdateEnvSignalRejectsChanges(t *testing.T) {
+	d, runner := newTestSetup(t, 43600)
+	deployTestApp(t, d, "api", map[string]string{"MODE": "a"})
+
+	for _, patch := range []EnvPatch{
+		{Set: map[string]string{"MODE": "b"}, Signal: "HUP"},
+		{Set: map[string]string{"NEW": "x"}, Signal: "HUP"},
+		{Unset: []string{"MODE"}, Signal: "HUP"},
+	} {
+		if _, err := d.UpdateEnv("api", patch); err == nil || !strings.Contains(err.Error(), "can't apply env changes") {
+			t.Errorf("got %v for %+v, want the change rejected", err, patch)
+		}
+	}
+	assertNoCommand(t, runner.Commands(), "docker compose kill")
+
+	// Only signaling, or re-setting the same value, sends the signal
+	if _, err := d.UpdateEnv("api", EnvPatch{Set: map[string]string{"MODE": "a"}, Signal: "sighup"}); err != nil {
+		t.Fatalf("UpdateEnv: %v", err)
+	}
+	assertCommands(t, runner.Commands(), []string{"docker compose kill -s HUP app"})
+}
+
+func TestUpdateEnvWaitsForDeploy(t *testing.T) {
+	d, runner := newTestSetup(t, 43610)
+	deployTestApp(t, d, "api", nil)
+
+	unlock := d.jobs.lockProject("api")
+	done := make(chan error)
+	go func() {
+		_, err := d.UpdateEnv("api", EnvPatch{Set: map[string]string{"MODE": "b"}})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("UpdateEnv finished with %v while a deploy held the project", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	if err := <-done; err != nil {
+		t.Fatalf("UpdateEnv: %v", err)
+	}
+	assertCommands(t, runner.Commands(), []string{"docker compose up -d --no-build"})
+}
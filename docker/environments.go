@@ -0,0 +1,158 @@
+package docker
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+var (
+	environmentPattern = regexp.MustCompile(`^[a-z0-9]{1,16}$`)
+	commitPattern      = regexp.MustCompile(`^[0-9a-f]{7,40}$`)
+)
+
+// ValidateEnvironment rejects environment names that can't be used in
+// project names and hostnames
+func ValidateEnvironment(environment string) error {
+	if environment != "" && !environmentPattern.MatchString(environment) {
+		return fmt.Errorf("invalid environment %q: use up to 16 lowercase letters and digits", environment)
+	}
+	return nil
+}
+
+// EnvironmentProjectName namespaces a project per environment, so staging
+// and prod of the same repository get their own workspace, containers,
+// port and state
+func EnvironmentProjectName(project, environment string) string {
+	if environment == "" {
+		return project
+	}
+	return project + "-" + environment
+}
+
+// checkEnvironmentName rejects a project name shared with another
+// environment. Project app in staging and a plain project called
+// app-staging resolve to the same name, so a plain project may not end in
+// -<environment> for an environment in use, and an environment may not take
+// over a name deployed outside it.
+func checkEnvironmentName(project, environment string) error {
+	state, err := LoadProjectState(project)
+	if err != nil {
+		return err
+	}
+	if state.Deployment != nil {
+		if state.Environment != environment {
+			return fmt.Errorf("project name %s is already taken by a deployment outside environment %q", project, environment)
+		}
+		return nil
+	}
+	if environment != "" {
+		return nil
+	}
+	environments, err := knownEnvironments()
+	if err != nil {
+		return err
+	}
+	for _, known := range environments {
+		if strings.HasSuffix(project, "-"+known) {
+			return fmt.Errorf("invalid project name %s: names ending in -%s are reserved for the %s environment", project, known, known)
+		}
+	}
+	return nil
+}
+
+// knownEnvironments lists the environments projects have been deployed to
+func knownEnvironments() ([]string, error) {
+	projects, err := store.Projects()
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var environments []string
+	for _, project := range projects {
+		state, err := LoadProjectState(project)
+		if err != nil || state.Environment == "" || seen[state.Environment] {
+			continue
+		}
+		seen[state.Environment] = true
+		environments = append(environments, state.Environment)
+	}
+	return environments, nil
+}
+
+// logicalProject returns the project a deployment belongs to, without its
+// environment suffix
+func logicalProject(project, environment string) string {
+	if environment == "" {
+		return project
+	}
+	return strings.TrimSuffix(project, "-"+environment)
+}
+
+// hostLabel is the hostname label a deployment is served under, e.g.
+// staging.app for the staging environment of app
+func hostLabel(deployment Deployment) string {
+	if deployment.Environment == "" {
+		return deployment.ProjectName
+	}
+	return deployment.Environment + "." + logicalProject(deployment.ProjectName, deployment.Environment)
+}
+
+// checkoutCommit pins a fresh clone to a specific commit
+func (d *DockerSetup) checkoutCommit(workDir, commit string) error {
+	if !commitPattern.MatchString(commit) {
+		return fmt.Errorf("invalid commit %q", commit)
+	}
+	return d.runCommand("git", "-C", workDir, "checkout", "--detach", commit)
+}
+
+// headCommit returns the commit checked out in a workspace
+func (d *DockerSetup) headCommit(workDir string) (string, error) {
+	out, err := d.runner.Output(exec.Command("git", "-C", workDir, "rev-parse", "HEAD"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// PromotionSpec returns the deployment that promotes a project from one
+// environment to another: the target keeps its own settings when it has
+// been deployed before, but is built from the exact commit running in the
+// source environment
+func PromotionSpec(project, from, to string) (Deployment, error) {
+	if from == to {
+		return Deployment{}, fmt.Errorf("cannot promote %s to itself", project)
+	}
+	for _, environment := range []string{from, to} {
+		if err := ValidateEnvironment(environment); err != nil {
+			return Deployment{}, err
+		}
+	}
+
+	source, err := LoadProjectState(EnvironmentProjectName(project, from))
+	if err != nil {
+		return Deployment{}, err
+	}
+	if source.Deployment == nil {
+		return Deployment{}, fmt.Errorf("%s has no successful deployment in environment %q", project, from)
+	}
+	if source.Commit == "" || source.Deployment.GitURL == "" {
+		return Deployment{}, fmt.Errorf("%s in environment %q was not deployed from git", project, from)
+	}
+
+	spec := *source.Deployment
+	if target, err := LoadProjectState(EnvironmentProjectName(project, to)); err == nil && target.Deployment != nil {
+		spec = *target.Deployment
+	}
+	spec.ProjectName = project
+	spec.Environment = to
+	spec.GitURL = source.Deployment.GitURL
+	spec.GitMirrors = source.Deployment.GitMirrors
+	spec.Submodules = source.Deployment.Submodules
+	spec.Commit = source.Commit
+	spec.LocalPath = ""
+	// A promoted commit is pinned, so it can't follow the branch
+	spec.RedeployCron = ""
+	return spec, nil
+}
@@ -0,0 +1,41 @@
+package docker
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestEnvironmentNamesDontCollide(t *testing.T) {
+	d, _ := newTestSetup(t, 43700)
+
+	// A plain project holding the name of app's staging environment
+	if _, err := d.DeployProject(Deployment{ProjectName: "app-staging", Image: "nginx:1.27", Proxy: ProxyNone}); err != nil {
+		t.Fatalf("DeployProject: %v", err)
+	}
+	_, err := d.DeployProject(Deployment{ProjectName: EnvironmentProjectName("app", "staging"), Environment: "staging", Image: "nginx:1.27", Proxy: ProxyNone})
+	if err == nil || !strings.Contains(err.Error(), "already taken") {
+		t.Fatalf("got %v deploying app to staging over the plain app-staging, want it rejected", err)
+	}
+
+	// Once staging is in use, plain projects can't take its names
+	if _, err := d.DeployProject(Deployment{ProjectName: EnvironmentProjectName("api", "staging"), Environment: "staging", Image: "nginx:1.27", Proxy: ProxyNone}); err != nil {
+		t.Fatalf("DeployProject: %v", err)
+	}
+	if err := d.ValidateDeployment(Deployment{ProjectName: "web-staging", Image: "nginx:1.27", Proxy: ProxyNone}); err == nil || !strings.Contains(err.Error(), "reserved for the staging environment") {
+		t.Errorf("got %v for a plain web-staging, want the name rejected", err)
+	}
+	if err := d.ValidateDeployment(Deployment{ProjectName: "api-staging", Image: "nginx:1.27", Proxy: ProxyNone}); err == nil {
+		t.Error("plain deploy accepted over api's staging environment")
+	}
+
+	// Existing deployments keep redeploying under their own names
+	for _, deployment := range []Deployment{
+		{ProjectName: "app-staging", Image: "nginx:1.27", Proxy: ProxyNone},
+		{ProjectName: "api-staging", Environment: "staging", Image: "nginx:1.27", Proxy: ProxyNone},
+		{ProjectName: "web-prod", Image: "nginx:1.27", Proxy: ProxyNone},
+	} {
+		if err := d.ValidateDeployment(deployment); err != nil {
+			t.Errorf("ValidateDeployment(%s in %q): %v", deployment.ProjectName, deployment.Environment, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// errorPageRoot holds the error pages of proxied deployments, one directory
+// per project. It is apart from staticRoot, whose directories mark static
+// deployments.
+const errorPageRoot = "/var/www/erebrus-errors"
+
+// errorPageName is the file nginx serves for upstream errors
+const errorPageName = "maintenance.html"
+
+// maxErrorPageSize bounds a custom error page
+const maxErrorPageSize = 256 * 1024
+
+// defaultErrorPage is served when error_page is set without custom content
+const defaultErrorPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Back soon</title>
+<style>
+  body { font-family: system-ui, sans-serif; background: #f5f5f7; color: #1d1d1f; display: flex; align-items: center; justify-content: center; min-height: 100vh; margin: 0; }
+  main { text-align: center; padding: 2rem; }
+  h1 { font-size: 1.75rem; margin-bottom: 0.5rem; }
+  p { color: #6e6e73; }
+</style>
+</head>
+<body>
+<main>
+<h1>We'll be right back</h1>
+<p>This app is being updated or restarted. Please try again in a moment.</p>
+</main>
+</body>
+</html>
+`
+
+// wantsErrorPage reports whether a deployment serves its own page when the
+// app is down
+func wantsErrorPage(deployment Deployment) bool {
+	return deployment.ErrorPage || deployment.ErrorPageHTML != ""
+}
+
+// validateErrorPage checks the error page can be served by nginx in front
+// of the app
+func validateErrorPage(deployment Deployment) error {
+	if !wantsErrorPage(deployment) {
+		return nil
+	}
+	if deployment.Static {
+		return fmt.Errorf("error pages are not supported for static deployments, they have no upstream to fail")
+	}
+	if deployment.Proxy != ProxyNginx {
+		return fmt.Errorf("error pages are only supported with proxy %q", ProxyNginx)
+	}
+	if deployment.ProxyProtocol == ProtocolGRPC {
+		return fmt.Errorf("error pages are not supported for grpc apps")
+	}
+	if len(deployment.ErrorPageHTML) > maxErrorPageSize {
+		return fmt.Errorf("error_page_html is larger than %d bytes", maxErrorPageSize)
+	}
+	return nil
+}
+
+// nginxErrorPage serves the project's page for 502, 503 and 504 responses
+// nginx generates when the app is down or restarting
+func nginxErrorPage(deployment Deployment) string {
+	if !wantsErrorPage(deployment) {
+		return ""
+	}
+	return fmt.Sprintf(`
+    error_page 502 503 504 /%[1]s;
+    location = /%[1]s {
+        root %[2]s;
+        internal;
+    }
+`, errorPageName, filepath.Join(errorPageRoot, deployment.ProjectName))
+}
+
+// writeErrorPage installs a deployment's error page, the default one when
+// no content was given
+func (d *DockerSetup) writeErrorPage(deployment Deployment) error {
+	if !wantsErrorPage(deployment) {
+		return nil
+	}
+	content := deployment.ErrorPageHTML
+	if content == "" {
+		content = defaultErrorPage
+	}
+
+	tmpFile := filepath.Join(os.TempDir(), "erebrus_error_"+deployment.ProjectName)
+	if err := os.WriteFile(tmpFile, []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write temporary error page: %v", err)
+	}
+	dir := filepath.Join(errorPageRoot, deployment.ProjectName)
+	if err := d.runElevated("mkdir", "-p", dir); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	if err := d.runElevated("mv", tmpFile, filepath.Join(dir, errorPageName)); err != nil {
+		os.Remove(tmpFile)
+		return fmt.Errorf("failed to install error page: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+// CommandError is returned when an external command exits unsuccessfully.
+// ExitCode is -1 when the process did not exit normally (e.g. killed).
+type CommandError struct {
+	Command  string
+	ExitCode int
+	Output   string
+	Err      error
+}
+
+func (e *CommandError) Error() string {
+	if e.ExitCode >= 0 {
+		return fmt.Sprintf("command failed with exit code %d: %v", e.ExitCode, e.Err)
+	}
+	return fmt.Sprintf("command failed: %v", e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// newCommandError wraps a command failure, extracting the exit code when available
+func newCommandError(command string, err error, output []byte) *CommandError {
+	cmdErr := &CommandError{Command: command, ExitCode: -1, Output: string(output), Err: err}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		cmdErr.ExitCode = exitErr.ExitCode()
+	}
+	return cmdErr
+}
+
+// ExitCode returns the exit code of a failed command anywhere in err's chain
+func ExitCode(err error) (int, bool) {
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) && cmdErr.ExitCode >= 0 {
+		return cmdErr.ExitCode, true
+	}
+	return 0, false
+}
@@ -0,0 +1,66 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// Deployment event types recorded in the event history
+const (
+	EventDeploy   = "deploy"
+	EventRedeploy = "redeploy"
+	EventEnv      = "env"
+	EventExec     = "exec"
+	EventImport   = "import"
+)
+
+// Event is a single management operation performed on a deployment
+type Event struct {
+	Timestamp  time.Time `json:"timestamp"`
+	Type       string    `json:"type"`
+	Actor      string    `json:"actor"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"duration_ms"`
+	// BuildMs is the part of a deploy spent building and starting containers
+	BuildMs int64 `json:"build_ms,omitempty"`
+	// DeployID and Sequence identify the deployment a deploy event records,
+	// DeployID also the run of an exec event
+	DeployID string `json:"deploy_id,omitempty"`
+	Sequence uint64 `json:"sequence,omitempty"`
+	// Command and ExitCode record what an exec event ran
+	Command  []string `json:"command,omitempty"`
+	ExitCode *int     `json:"exit_code,omitempty"`
+}
+
+// RecordEvent appends an event to the project's append-only event log
+func RecordEvent(project string, event Event) error {
+	return store.AppendEvents(project, []Event{event})
+}
+
+// appendEventLines appends an exported JSON lines event log to the
+// project's history, skipping lines that don't parse
+func appendEventLines(project string, lines []byte) error {
+	var events []Event
+	for _, line := range bytes.Split(lines, []byte("\n")) {
+		var event Event
+		if err := json.Unmarshal(line, &event); err == nil {
+			events = append(events, event)
+		}
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	return store.AppendEvents(project, events)
+}
+
+// ListEvents returns every recorded event for a project, oldest first
+func ListEvents(project string) ([]Event, error) {
+	return store.Events(project)
+}
+
+// HasEvents reports whether a project has any recorded history
+func HasEvents(project string) bool {
+	return store.HasEvents(project)
+}
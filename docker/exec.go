@@ -0,0 +1,271 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"erebrusvps/websocket"
+)
+
+const (
+	// defaultExecTimeout and maxExecTimeout bound one-off commands
+	defaultExecTimeout = 5 * time.Minute
+	maxExecTimeout     = 30 * time.Minute
+	// maxExecOutput caps the stdout and stderr returned for a command, the
+	// full output is still streamed
+	maxExecOutput = 1 << 20
+)
+
+// ExecPolicy restricts the commands that may be run in deployed containers.
+// Entries match the program name, the first element of the command; the
+// policy never looks at the arguments. Shells and wrappers such as env or
+// busybox run whatever their arguments say, so once the policy restricts
+// anything they are rejected unless Allow names them.
+type ExecPolicy struct {
+	// Allow, when not empty, is the only programs that may run
+	Allow []string
+	// Deny lists programs that may never run
+	Deny []string
+}
+
+// execWrappers are programs that run another program or a script given in
+// their arguments, which would get around the policy
+var execWrappers = map[string]bool{
+	"sh": true, "bash": true, "dash": true, "ash": true, "zsh": true, "ksh": true,
+	"csh": true, "tcsh": true, "fish": true,
+	"env": true, "busybox": true, "toybox": true, "xargs": true, "nice": true,
+	"nohup": true, "timeout": true, "setsid": true, "stdbuf": true, "chroot": true,
+	"sudo": true, "su": true, "doas": true, "runuser": true, "ionice": true,
+	"taskset": true, "script": true, "flock": true, "watch": true, "time": true,
+}
+
+// check rejects commands the policy doesn't permit
+func (p ExecPolicy) check(command []string) error {
+	program := filepath.Base(command[0])
+	for _, denied := range p.Deny {
+		if program == denied {
+			return fmt.Errorf("%s is not allowed", program)
+		}
+	}
+	if len(p.Allow) == 0 && len(p.Deny) == 0 {
+		return nil
+	}
+	for _, allowed := range p.Allow {
+		if program == allowed {
+			return nil
+		}
+	}
+	if execWrappers[program] {
+		return fmt.Errorf("%s runs arbitrary commands and must be allowed explicitly", program)
+	}
+	if len(p.Allow) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s is not allowed, allowed programs: %s", program, strings.Join(p.Allow, ", "))
+}
+
+// ExecRequest is a one-off command to run in a deployed app
+type ExecRequest struct {
+	Command []string `json:"command"`
+	// Timeout in seconds, 300 when zero
+	Timeout int `json:"timeout,omitempty"`
+	// Service defaults to the deployment's app service
+	Service string `json:"service,omitempty"`
+}
+
+// ExecResult is the outcome of a one-off command
+type ExecResult struct {
+	// ExecID tags the command's lines on /ws and can be followed with
+	// /ws?deploy_id=<id>
+	ExecID string `json:"exec_id"`
+	// Mode is exec for a running service, run for a one-off container
+	Mode     string `json:"mode"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	ExitCode int    `json:"exit_code"`
+	TimedOut bool   `json:"timed_out,omitempty"`
+	// Truncated is set when output beyond maxExecOutput was dropped
+	Truncated  bool  `json:"truncated,omitempty"`
+	DurationMs int64 `json:"duration_ms"`
+}
+
+// validate checks the request against the policy and fills in defaults
+func (r *ExecRequest) validate(policy ExecPolicy) (time.Duration, error) {
+	if len(r.Command) == 0 || r.Command[0] == "" {
+		return 0, fmt.Errorf("command is required")
+	}
+	for _, arg := range r.Command {
+		if strings.ContainsRune(arg, 0) {
+			return 0, fmt.Errorf("command arguments must not contain NUL bytes")
+		}
+	}
+	if err := policy.check(r.Command); err != nil {
+		return 0, err
+	}
+	if r.Timeout < 0 {
+		return 0, fmt.Errorf("timeout must not be negative")
+	}
+	timeout := time.Duration(r.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = defaultExecTimeout
+	}
+	if timeout > maxExecTimeout {
+		return 0, fmt.Errorf("timeout must be at most %d seconds", int(maxExecTimeout.Seconds()))
+	}
+	return timeout, nil
+}
+
+// execService resolves the service a command runs in, the app's by default.
+// Only services of the deployment are accepted, so the name can never be
+// taken by compose as one of its own options.
+func execService(deployment Deployment, service string) (string, error) {
+	if service == "" || service == serviceName(deployment) {
+		return serviceName(deployment), nil
+	}
+	if serviceNamePattern.MatchString(service) {
+		for _, extra := range deployment.Services {
+			if extra.Name == service {
+				return service, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("unknown service %q", service)
+}
+
+// Exec runs a one-off command in a project's app service: exec'd into the
+// running container, or in a fresh container when the service is stopped.
+// Output is streamed to /ws as it is produced and returned once the command
+// exits. A non-zero exit code is reported in the result, not as an error.
+func (d *DockerSetup) Exec(project string, req ExecRequest) (*ExecResult, error) {
+	timeout, err := req.validate(d.ExecPolicy)
+	if err != nil {
+		return nil, err
+	}
+	state, err := LoadProjectState(project)
+	if err != nil {
+		return nil, err
+	}
+	if state.Deployment == nil {
+		return nil, fmt.Errorf("%s has no successful deployment", project)
+	}
+	if state.Deployment.Static {
+		return nil, fmt.Errorf("%s is a static site and has no containers", project)
+	}
+	workDir, err := workspaceDir(project)
+	if err != nil {
+		return nil, err
+	}
+	service, err := execService(*state.Deployment, req.Service)
+	if err != nil {
+		return nil, err
+	}
+
+	execID := newDeployID()
+	result := &ExecResult{ExecID: execID, Mode: "exec"}
+	redact := newRedactor(*state.Deployment)
+	sendLog := func(message string) {
+		message = redact(fmt.Sprintf("[%s] %s", execID, message))
+		websocket.Logger.SendSessionLog(execID, project, message)
+		fmt.Println(message)
+	}
+	defer websocket.Logger.EndSession(execID)
+
+	args := []string{"exec", "-T", service}
+	containerName := ""
+	if !d.serviceRunning(workDir, service) {
+		// Name the one-off container so it can be removed on timeout
+		result.Mode = "run"
+		containerName = fmt.Sprintf("%s-exec-%s", composeProjectName(project), execID)
+		args = []string{"run", "--rm", "-T", "--name", containerName, service}
+	}
+	cmd := d.composeInCmd(workDir, append(args, req.Command...)...)
+	sendLog(fmt.Sprintf("[EXEC] Running %q in %s (%s)", strings.Join(req.Command, " "), service, result.Mode))
+
+	stdoutReader, stdoutWriter := io.Pipe()
+	stderrReader, stderrWriter := io.Pipe()
+	cmd.Stdout, cmd.Stderr = stdoutWriter, stderrWriter
+	started := time.Now()
+	wait, err := d.runner.Start(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start command: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() {
+		err := wait()
+		stdoutWriter.Close()
+		stderrWriter.Close()
+		exited <- err
+	}()
+
+	var stdout, stderr execOutput
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go stdout.collect(stdoutReader, "[EXEC]", sendLog, &readers)
+	go stderr.collect(stderrReader, "[EXEC] stderr:", sendLog, &readers)
+
+	select {
+	case err = <-exited:
+	case <-time.After(timeout):
+		result.TimedOut = true
+		sendLog(fmt.Sprintf("[EXEC] Timed out after %s, stopping the command", timeout))
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+		// Killing the compose client leaves a run container behind
+		if containerName != "" {
+			d.runCommand("docker", "rm", "-f", containerName)
+		}
+		err = <-exited
+	}
+	readers.Wait()
+
+	result.DurationMs = time.Since(started).Milliseconds()
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+	result.Truncated = stdout.truncated || stderr.truncated
+	if err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, fmt.Errorf("command failed: %v", err)
+		}
+		result.ExitCode = exitErr.ExitCode()
+	}
+	sendLog(fmt.Sprintf("[EXEC] Exited with code %d after %dms", result.ExitCode, result.DurationMs))
+	return result, nil
+}
+
+// serviceRunning reports whether a compose service has a running container
+func (d *DockerSetup) serviceRunning(workDir, service string) bool {
+	out, err := d.runner.Output(d.composeInCmd(workDir, "ps", "--status", "running", "-q", service))
+	return err == nil && strings.TrimSpace(string(out)) != ""
+}
+
+// execOutput keeps the first maxExecOutput bytes of a stream
+type execOutput struct {
+	strings.Builder
+	truncated bool
+}
+
+// collect streams lines from r to sendLog while keeping a capped copy
+func (o *execOutput) collect(r io.Reader, tag string, sendLog func(string), done *sync.WaitGroup) {
+	defer done.Done()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxExecOutput)
+	for scanner.Scan() {
+		line := scanner.Text()
+		sendLog(fmt.Sprintf("%s %s", tag, line))
+		if o.Len()+len(line)+1 > maxExecOutput {
+			o.truncated = true
+			continue
+		}
+		o.WriteString(line)
+		o.WriteByte('\n')
+	}
+	// Drain so the command never blocks on a full pipe
+	io.Copy(io.Discard, r)
+}
@@ -0,0 +1,52 @@
+package docker
+
+import "testing"
+
+func TestExecPolicyCheck(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  ExecPolicy
+		command []string
+		wantErr bool
+	}{
+		{name: "no policy", command: []string{"sh", "-c", "rm -rf /data"}},
+		{name: "allowed", policy: ExecPolicy{Allow: []string{"rails"}}, command: []string{"rails", "db:migrate"}},
+		{name: "allowed by path", policy: ExecPolicy{Allow: []string{"rails"}}, command: []string{"/usr/local/bin/rails", "db:migrate"}},
+		{name: "not allowed", policy: ExecPolicy{Allow: []string{"rails"}}, command: []string{"rake"}, wantErr: true},
+		{name: "denied", policy: ExecPolicy{Deny: []string{"rm"}}, command: []string{"rm", "-rf", "/data"}, wantErr: true},
+		{name: "not denied", policy: ExecPolicy{Deny: []string{"rm"}}, command: []string{"ls", "/data"}},
+		{name: "shell around a denied program", policy: ExecPolicy{Deny: []string{"rm"}}, command: []string{"sh", "-c", "rm -rf /data"}, wantErr: true},
+		{name: "env wrapper", policy: ExecPolicy{Deny: []string{"rm"}}, command: []string{"/usr/bin/env", "rm", "-rf", "/data"}, wantErr: true},
+		{name: "busybox wrapper", policy: ExecPolicy{Allow: []string{"rails"}}, command: []string{"busybox", "rm", "-rf", "/data"}, wantErr: true},
+		{name: "shell allowed explicitly", policy: ExecPolicy{Allow: []string{"sh"}}, command: []string{"sh", "-c", "echo hi"}},
+		{name: "shell allowed but denied", policy: ExecPolicy{Allow: []string{"bash"}, Deny: []string{"bash"}}, command: []string{"bash"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.check(tt.command); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExecRejectsUnknownService(t *testing.T) {
+	d, runner := newTestSetup(t, 43800)
+	if _, err := d.DeployProject(Deployment{ProjectName: "web", Image: "nginx:1.27", Proxy: ProxyNone,
+		Services: []Service{{Name: "db", Image: "postgres:16"}}}); err != nil {
+		t.Fatalf("DeployProject: %v", err)
+	}
+
+	for _, service := range []string{"--volume=/:/host", "--privileged", "-T", "cache"} {
+		_, err := d.Exec("web", ExecRequest{Service: service, Command: []string{"app", "sh", "-c", "id"}})
+		if err == nil {
+			t.Errorf("service %q accepted", service)
+		}
+	}
+	assertNoCommand(t, runner.Commands(), "docker compose exec")
+	assertNoCommand(t, runner.Commands(), "docker compose run")
+
+	if service, err := execService(Deployment{Services: []Service{{Name: "db"}}}, "db"); err != nil || service != "db" {
+		t.Errorf("got %q, %v for an extra service, want db", service, err)
+	}
+}
@@ -0,0 +1,170 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// gitRemoteTimeout bounds git ls-remote, which otherwise waits on
+// unresponsive hosts for minutes
+const gitRemoteTimeout = 30 * time.Second
+
+// scpLikeGitURL matches the user@host:path form of ssh URLs
+var scpLikeGitURL = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^/-][^\s]*$`)
+
+// ValidateGitURL accepts http(s), ssh and git URLs plus the scp-like ssh
+// form. Everything else is refused, notably URLs git would parse as an
+// option and transports like ext:: that run commands.
+func ValidateGitURL(gitURL string) error {
+	if gitURL == "" || strings.HasPrefix(gitURL, "-") || strings.ContainsAny(gitURL, " \t\r\n") {
+		return fmt.Errorf("invalid git URL: %q", gitURL)
+	}
+	if scpLikeGitURL.MatchString(gitURL) {
+		return nil
+	}
+	u, err := url.Parse(gitURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid git URL: %q", gitURL)
+	}
+	switch u.Scheme {
+	case "https", "http", "ssh", "git":
+		return nil
+	default:
+		return fmt.Errorf("unsupported git URL scheme %q, expected https, http, ssh or git", u.Scheme)
+	}
+}
+
+// WithGitCredentials puts a username and password or token into an
+// http(s) git URL
+func WithGitCredentials(gitURL, username, password string) (string, error) {
+	if username == "" && password == "" {
+		return gitURL, nil
+	}
+	u, err := url.Parse(gitURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return "", fmt.Errorf("credentials can only be used with http(s) git URLs")
+	}
+	if username == "" {
+		// Hosts accept tokens under any username
+		username = "git"
+	}
+	u.User = url.UserPassword(username, password)
+	return u.String(), nil
+}
+
+// gitRemoteCmd builds a git ls-remote of gitURL. Arguments starting with -
+// are passed as options, the rest as refs.
+func gitRemoteCmd(ctx context.Context, gitURL string, args ...string) *exec.Cmd {
+	lsRemote := []string{"ls-remote"}
+	var refs []string
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			lsRemote = append(lsRemote, arg)
+		} else {
+			refs = append(refs, arg)
+		}
+	}
+	lsRemote = append(append(lsRemote, "--", gitURL), refs...)
+	cmd := exec.CommandContext(ctx, "git", lsRemote...)
+	// Fail instead of prompting for credentials or unknown host keys
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_SSH_COMMAND=ssh -o BatchMode=yes")
+	return cmd
+}
+
+// GitRemoteInfo describes a repository as seen by git ls-remote
+type GitRemoteInfo struct {
+	Reachable     bool     `json:"reachable"`
+	DefaultBranch string   `json:"default_branch,omitempty"`
+	Branches      []string `json:"branches"`
+	// Error explains why the repository is unreachable
+	Error string `json:"error,omitempty"`
+}
+
+// CheckGitRemote lists a repository's branches without cloning it
+func (d *DockerSetup) CheckGitRemote(gitURL string) (*GitRemoteInfo, error) {
+	redact := newRedactor(Deployment{GitURL: gitURL})
+	if err := ValidateGitURL(gitURL); err != nil {
+		return nil, fmt.Errorf("%s", redact(err.Error()))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gitRemoteTimeout)
+	defer cancel()
+	cmd := gitRemoteCmd(ctx, gitURL, "--symref", "HEAD", "refs/heads/*")
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	info := &GitRemoteInfo{Branches: []string{}}
+	out, err := d.runner.Output(cmd)
+	if err != nil {
+		reason := strings.TrimSpace(stderr.String())
+		if ctx.Err() != nil {
+			reason = fmt.Sprintf("timed out after %s", gitRemoteTimeout)
+		} else if reason == "" {
+			reason = err.Error()
+		}
+		info.Error = redact(reason)
+		return info, nil
+	}
+
+	info.Reachable = true
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			continue
+		}
+		if fields[1] == "HEAD" && strings.HasPrefix(fields[0], "ref: refs/heads/") {
+			info.DefaultBranch = strings.TrimPrefix(fields[0], "ref: refs/heads/")
+		} else if strings.HasPrefix(fields[1], "refs/heads/") {
+			info.Branches = append(info.Branches, strings.TrimPrefix(fields[1], "refs/heads/"))
+		}
+	}
+	sort.Strings(info.Branches)
+	return info, nil
+}
+
+// RepointSpec returns the spec redeploying a git project from a new
+// repository URL, e.g. after the repository moved. The new remote must be
+// reachable. The project keeps its name and, with it, its port and URL.
+func (d *DockerSetup) RepointSpec(project, gitURL string) (Deployment, error) {
+	redact := newRedactor(Deployment{GitURL: gitURL})
+	if err := ValidateGitURL(gitURL); err != nil {
+		return Deployment{}, fmt.Errorf("%s", redact(err.Error()))
+	}
+	state, err := LoadProjectState(project)
+	if err != nil {
+		return Deployment{}, err
+	}
+	if state.Deployment == nil {
+		return Deployment{}, fmt.Errorf("%s has no successful deployment", project)
+	}
+	if state.Deployment.GitURL == "" {
+		return Deployment{}, fmt.Errorf("%s was not deployed from git", project)
+	}
+	if normalizeGitURL(state.Deployment.GitURL) == normalizeGitURL(gitURL) {
+		return Deployment{}, fmt.Errorf("%s is already deployed from that repository", project)
+	}
+
+	info, err := d.CheckGitRemote(gitURL)
+	if err != nil {
+		return Deployment{}, err
+	}
+	if !info.Reachable {
+		return Deployment{}, fmt.Errorf("repository is not reachable: %s", info.Error)
+	}
+
+	spec := *state.Deployment
+	// serveDeployment adds the environment suffix back
+	spec.ProjectName = logicalProject(spec.ProjectName, spec.Environment)
+	spec.GitURL = gitURL
+	// The checkout's origin still names the old repository, which would
+	// get a unique name suffixed; the deploy clones afresh under this one
+	spec.UniqueName = false
+	return spec, nil
+}
@@ -0,0 +1,46 @@
+package docker
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var headerNamePattern = regexp.MustCompile(`^[A-Za-z0-9-]{1,64}$`)
+
+// maxHeaderValueLength bounds a custom header value; a long CSP fits easily
+const maxHeaderValueLength = 4096
+
+// validateHeaders ensures custom headers can be embedded in a single quoted
+// nginx add_header without ending the string or the directive
+func validateHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		if !headerNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid header name: %q", name)
+		}
+		if len(value) > maxHeaderValueLength {
+			return fmt.Errorf("header %s is longer than %d bytes", name, maxHeaderValueLength)
+		}
+		if strings.ContainsAny(value, `'\`) || strings.IndexFunc(value, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+			return fmt.Errorf("invalid value for header %s: quotes, backslashes and control characters are not allowed", name)
+		}
+	}
+	return nil
+}
+
+// nginxHeaders renders custom headers as add_header directives, sorted so
+// the config only changes when the headers do
+func nginxHeaders(headers map[string]string) string {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&b, "\n        add_header '%s' '%s' always;", name, headers[name])
+	}
+	return b.String()
+}
@@ -0,0 +1,41 @@
+package docker
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxHookLength caps the size of a hook command
+const maxHookLength = 4096
+
+// validateHook rejects hook commands that don't fit on a single line. Hooks
+// are handed to sh -c inside the app container as a single argument and never
+// pass through a shell on the host.
+func validateHook(name, command string) error {
+	if len(command) > maxHookLength {
+		return fmt.Errorf("%s is longer than %d bytes", name, maxHookLength)
+	}
+	if strings.ContainsAny(command, "\x00\r\n") {
+		return fmt.Errorf("%s must be a single line command", name)
+	}
+	return nil
+}
+
+// runHook runs a hook command in the app service, streaming its output.
+// Pre-deploy hooks use a one-off container since the app is not running yet,
+// post-deploy hooks exec into the running container.
+func (d *DockerSetup) runHook(workDir, service, stage, command string, sendLog func(string)) error {
+	args := []string{"exec", "-T", service, "sh", "-c", command}
+	if stage == "pre-deploy" {
+		args = []string{"run", "--rm", "-T", service, "sh", "-c", command}
+	}
+	sendLog(fmt.Sprintf("[HOOK] Running %s hook", stage))
+
+	cmd := d.composeCmd(args...)
+	cmd.Dir = workDir
+	if err := d.streamCommand(cmd, "[HOOK]", sendLog); err != nil {
+		return fmt.Errorf("%s hook failed: %v", stage, err)
+	}
+	sendLog(fmt.Sprintf("[HOOK] %s hook finished", stage))
+	return nil
+}
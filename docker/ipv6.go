@@ -0,0 +1,41 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+)
+
+// ipv6Enabled adds IPv6 listeners to nginx sites and checks ports on IPv6
+// too. It is off on hosts without IPv6, where nginx would refuse [::].
+var ipv6Enabled = true
+
+// EnableIPv6 turns IPv6 support on or off. It must be called before any
+// deployment is served.
+func EnableIPv6(enabled bool) {
+	ipv6Enabled = enabled
+}
+
+// HostSupportsIPv6 reports whether the host can listen on IPv6
+func HostSupportsIPv6() bool {
+	return canBind("tcp6", "[::1]:0")
+}
+
+// canBind reports whether a TCP listener can be opened on addr
+func canBind(network, addr string) bool {
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// nginxListen renders a site's listen directives, with extra appended to
+// the TLS ones (e.g. " http2")
+func nginxListen(extra string) string {
+	listen := fmt.Sprintf("    listen 80;\n    listen 443 ssl%s;\n", extra)
+	if ipv6Enabled {
+		listen += fmt.Sprintf("    listen [::]:80;\n    listen [::]:443 ssl%s;\n", extra)
+	}
+	return listen
+}
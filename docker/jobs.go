@@ -0,0 +1,246 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job states reported by ListJobs
+const (
+	JobQueued    = "queued"
+	JobRunning   = "running"
+	JobSucceeded = "succeeded"
+	JobFailed    = "failed"
+)
+
+// maxFinishedJobs bounds how many finished jobs are kept for lookups by ID
+const maxFinishedJobs = 100
+
+// Job is a deployment waiting for or holding a deploy slot
+type Job struct {
+	ID       string `json:"id"`
+	Sequence uint64 `json:"sequence,omitempty"`
+	Project  string `json:"project"`
+	State    string `json:"state"`
+	// Position is the 1-based place in the queue of a queued job
+	Position   int        `json:"position,omitempty"`
+	QueuedAt   time.Time  `json:"queued_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+
+	ready chan struct{}
+}
+
+// jobQueue runs deployments in arrival order, at most limit at a time
+type jobQueue struct {
+	mutex    sync.Mutex
+	limit    int
+	running  int
+	pending  []*Job
+	jobs     map[string]*Job
+	finished []string
+	// projects serializes everything that changes a project's containers
+	projects map[string]*sync.Mutex
+}
+
+func newJobQueue() *jobQueue {
+	return &jobQueue{jobs: make(map[string]*Job), projects: make(map[string]*sync.Mutex)}
+}
+
+// lockProject waits until nothing else changes the project's containers,
+// returning the function releasing it
+func (q *jobQueue) lockProject(project string) func() {
+	q.mutex.Lock()
+	lock, ok := q.projects[project]
+	if !ok {
+		lock = &sync.Mutex{}
+		q.projects[project] = lock
+	}
+	q.mutex.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// ErrProjectBusy is returned by operations that won't wait for a project's
+// deploy or another operation on it to finish
+var ErrProjectBusy = errors.New("project is busy")
+
+// tryLockProjects locks several projects for an operation that can't wait,
+// failing when any of them has a deploy queued or running or is locked.
+// Locks are taken in name order so two such operations can't deadlock.
+func (q *jobQueue) tryLockProjects(projects ...string) (func(), error) {
+	projects = append([]string(nil), projects...)
+	sort.Strings(projects)
+	var locked []*sync.Mutex
+	unlock := func() {
+		for i := len(locked) - 1; i >= 0; i-- {
+			locked[i].Unlock()
+		}
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, project := range projects {
+		lock, ok := q.projects[project]
+		if !ok {
+			lock = &sync.Mutex{}
+			q.projects[project] = lock
+		}
+		if !lock.TryLock() {
+			unlock()
+			return nil, fmt.Errorf("%w: %s is locked by another operation", ErrProjectBusy, project)
+		}
+		locked = append(locked, lock)
+		for _, job := range q.jobs {
+			if job.Project == project && (job.State == JobQueued || job.State == JobRunning) {
+				unlock()
+				return nil, fmt.Errorf("%w: %s has a deploy in progress", ErrProjectBusy, project)
+			}
+		}
+	}
+	return unlock, nil
+}
+
+// add registers a job, queued until a slot is free
+func (q *jobQueue) add(id string, sequence uint64, project string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	job := &Job{ID: id, Sequence: sequence, Project: project, State: JobQueued, QueuedAt: time.Now().UTC(), ready: make(chan struct{})}
+	q.jobs[id] = job
+	if q.limit <= 0 || q.running < q.limit {
+		q.start(job)
+		return
+	}
+	q.pending = append(q.pending, job)
+}
+
+// start marks a job running, the caller holds the mutex
+func (q *jobQueue) start(job *Job) {
+	now := time.Now().UTC()
+	q.running++
+	job.State = JobRunning
+	job.StartedAt = &now
+	close(job.ready)
+}
+
+// wait blocks until the job holds a slot, reporting its position while queued
+func (q *jobQueue) wait(id string, queued func(position int)) {
+	q.mutex.Lock()
+	job := q.jobs[id]
+	position := q.position(job)
+	q.mutex.Unlock()
+
+	if position > 0 && queued != nil {
+		queued(position)
+	}
+	<-job.ready
+}
+
+// finish releases the job's slot to the next queued job
+func (q *jobQueue) finish(id string, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	job := q.jobs[id]
+	now := time.Now().UTC()
+	job.FinishedAt = &now
+	job.State = JobSucceeded
+	if err != nil {
+		job.State = JobFailed
+		job.Error = err.Error()
+	}
+
+	q.running--
+	if len(q.pending) > 0 && (q.limit <= 0 || q.running < q.limit) {
+		next := q.pending[0]
+		q.pending = q.pending[1:]
+		q.start(next)
+	}
+
+	q.finished = append(q.finished, id)
+	if len(q.finished) > maxFinishedJobs {
+		delete(q.jobs, q.finished[0])
+		q.finished = q.finished[1:]
+	}
+}
+
+// active reports whether a deployment of the project is queued or running
+func (q *jobQueue) active(project string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, job := range q.jobs {
+		if job.Project == project && (job.State == JobQueued || job.State == JobRunning) {
+			return true
+		}
+	}
+	return false
+}
+
+// position returns the 1-based queue position of a job, 0 when not queued
+func (q *jobQueue) position(job *Job) int {
+	for i, pending := range q.pending {
+		if pending == job {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// snapshot copies a job with its current position, the caller holds the mutex
+func (q *jobQueue) snapshot(job *Job) Job {
+	copied := *job
+	copied.Position = q.position(job)
+	return copied
+}
+
+// ListJobs returns the running deployments followed by the queued ones in
+// the order they will start
+func (d *DockerSetup) ListJobs() []Job {
+	d.jobs.mutex.Lock()
+	defer d.jobs.mutex.Unlock()
+
+	jobs := []Job{}
+	for _, job := range d.jobs.jobs {
+		if job.State == JobRunning {
+			jobs = append(jobs, d.jobs.snapshot(job))
+		}
+	}
+	sortJobs(jobs)
+	for _, job := range d.jobs.pending {
+		jobs = append(jobs, d.jobs.snapshot(job))
+	}
+	return jobs
+}
+
+// GetJob returns a queued, running or recently finished deployment
+func (d *DockerSetup) GetJob(id string) (Job, bool) {
+	d.jobs.mutex.Lock()
+	defer d.jobs.mutex.Unlock()
+
+	job, ok := d.jobs.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return d.jobs.snapshot(job), true
+}
+
+// SetMaxConcurrentDeploys limits how many deployments run at once, zero is
+// unlimited. It applies to jobs queued from now on.
+func (d *DockerSetup) SetMaxConcurrentDeploys(limit int) {
+	d.jobs.mutex.Lock()
+	defer d.jobs.mutex.Unlock()
+	d.jobs.limit = limit
+}
+
+// sortJobs orders jobs by when they started
+func sortJobs(jobs []Job) {
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].StartedAt.Before(*jobs[j].StartedAt)
+	})
+}
@@ -0,0 +1,96 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// usesLFS reports whether any .gitattributes in the checkout routes files
+// through the LFS filter
+func usesLFS(workDir string) bool {
+	found := false
+	filepath.Walk(workDir, func(path string, info os.FileInfo, err error) error {
+		switch {
+		case err != nil:
+			return nil
+		case info.IsDir() && info.Name() == ".git":
+			return filepath.SkipDir
+		case !info.IsDir() && info.Name() == ".gitattributes" && hasLFSFilter(path):
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found
+}
+
+// hasLFSFilter reports whether a .gitattributes file sets filter=lfs
+func hasLFSFilter(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, attr := range strings.Fields(line) {
+			if attr == "filter=lfs" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wantsLFS decides whether to fetch LFS objects, honouring an explicit lfs
+// setting on the deployment and detecting LFS use otherwise
+func wantsLFS(deployment Deployment, workDir string) bool {
+	if deployment.LFS != nil {
+		return *deployment.LFS
+	}
+	return usesLFS(workDir)
+}
+
+// ensureGitLFS makes sure git-lfs is available, installing it when it is
+// missing and packages can be installed
+func (d *DockerSetup) ensureGitLFS(sendLog func(string)) error {
+	if err := d.runCommand("git", "lfs", "version"); err == nil {
+		return nil
+	}
+	if d.Rootless {
+		return fmt.Errorf("the repository uses Git LFS but git-lfs is not installed, install it on the host or deploy with \"lfs\": false")
+	}
+
+	sendLog("[LFS] git-lfs is not installed, installing it")
+	if err := d.runElevated("env", "DEBIAN_FRONTEND=noninteractive", "apt-get", "install", "-y", "git-lfs"); err != nil {
+		return fmt.Errorf("the repository uses Git LFS but installing git-lfs failed: %v", err)
+	}
+	if err := d.runCommand("git", "lfs", "version"); err != nil {
+		return fmt.Errorf("the repository uses Git LFS but git-lfs is still unavailable after installing it: %v", err)
+	}
+	return nil
+}
+
+// pullLFS replaces LFS pointer files in the checkout with their content
+func (d *DockerSetup) pullLFS(workDir string, sendLog func(string)) error {
+	if err := d.ensureGitLFS(sendLog); err != nil {
+		return err
+	}
+
+	sendLog("[LFS] Fetching Git LFS objects")
+	cmd := exec.Command("git", "lfs", "pull")
+	cmd.Dir = workDir
+	if err := d.streamCommand(cmd, "[LFS]", sendLog); err != nil {
+		return fmt.Errorf("git lfs pull failed: %v", err)
+	}
+	return nil
+}
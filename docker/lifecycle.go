@@ -0,0 +1,180 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sync"
+	"time"
+
+	"erebrusvps/websocket"
+)
+
+// lifecycleReconnectDelay is how long the event follower waits before
+// reattaching after docker events exits, e.g. on a daemon restart
+const lifecycleReconnectDelay = 5 * time.Second
+
+// Container lifecycle events reported for managed projects
+const (
+	LifecycleDie     = "die"
+	LifecycleOOM     = "oom"
+	LifecycleRestart = "restart"
+)
+
+// LifecycleCounters counts lifecycle events of a project's containers since
+// the manager started
+type LifecycleCounters struct {
+	Die       int        `json:"die"`
+	OOM       int        `json:"oom"`
+	Restart   int        `json:"restart"`
+	LastEvent *time.Time `json:"last_event,omitempty"`
+}
+
+// LifecycleEvent is sent to the notification webhooks
+type LifecycleEvent struct {
+	Event     string    `json:"event"`
+	Project   string    `json:"project"`
+	Container string    `json:"container"`
+	ExitCode  string    `json:"exit_code,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// dockerEvent mirrors the fields of docker events --format '{{json .}}'
+type dockerEvent struct {
+	Action string `json:"Action"`
+	Actor  struct {
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+	Time int64 `json:"time"`
+}
+
+type lifecycleMonitor struct {
+	mutex    sync.Mutex
+	counters map[string]*LifecycleCounters
+}
+
+// webhookClient posts lifecycle events, a slow receiver must not pile up
+// goroutines
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// StartLifecycleMonitor follows docker events for containers of managed
+// projects, reattaching whenever the stream ends
+func (d *DockerSetup) StartLifecycleMonitor() {
+	go func() {
+		for {
+			if err := d.followLifecycleEvents(); err != nil {
+				fmt.Printf("[LIFECYCLE] Event stream ended: %v, reconnecting in %s\n", err, lifecycleReconnectDelay)
+			}
+			time.Sleep(lifecycleReconnectDelay)
+		}
+	}()
+}
+
+func (d *DockerSetup) followLifecycleEvents() error {
+	cmd := exec.Command("docker", "events",
+		"--filter", "type=container",
+		"--filter", "label="+projectLabel,
+		"--filter", "event="+LifecycleDie,
+		"--filter", "event="+LifecycleOOM,
+		"--filter", "event="+LifecycleRestart,
+		"--format", "{{json .}}")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		var event dockerEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue
+		}
+		d.handleLifecycleEvent(event)
+	}
+	return cmd.Wait()
+}
+
+// handleLifecycleEvent counts an event and reports it. A die with exit code
+// 0 or 143 (SIGTERM) is a normal stop, e.g. by a redeploy, and is ignored.
+func (d *DockerSetup) handleLifecycleEvent(event dockerEvent) {
+	attributes := event.Actor.Attributes
+	project := attributes[projectLabel]
+	exitCode := attributes["exitCode"]
+	if project == "" || (event.Action == LifecycleDie && (exitCode == "0" || exitCode == "143")) {
+		return
+	}
+
+	when := time.Unix(event.Time, 0).UTC()
+	d.lifecycle.mutex.Lock()
+	counters, ok := d.lifecycle.counters[project]
+	if !ok {
+		counters = &LifecycleCounters{}
+		d.lifecycle.counters[project] = counters
+	}
+	switch event.Action {
+	case LifecycleDie:
+		counters.Die++
+	case LifecycleOOM:
+		counters.OOM++
+	case LifecycleRestart:
+		counters.Restart++
+	}
+	counters.LastEvent = &when
+	d.lifecycle.mutex.Unlock()
+
+	lifecycleEvent := LifecycleEvent{
+		Event:     event.Action,
+		Project:   project,
+		Container: attributes["name"],
+		ExitCode:  exitCode,
+		Time:      when,
+	}
+	message := fmt.Sprintf("[LIFECYCLE] Project %s: container %s %s", project, lifecycleEvent.Container, event.Action)
+	if exitCode != "" {
+		message += fmt.Sprintf(" (exit code %s)", exitCode)
+	}
+	websocket.Logger.SendProjectLog(project, message)
+	fmt.Println(message)
+	d.notifyWebhooks(lifecycleEvent)
+}
+
+// notifyWebhooks posts an event to every configured webhook in the background
+func (d *DockerSetup) notifyWebhooks(event LifecycleEvent) {
+	if len(d.Webhooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	for _, url := range d.Webhooks {
+		go func(url string) {
+			resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+			if err != nil {
+				fmt.Printf("[LIFECYCLE] Webhook %s failed: %v\n", url, err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				fmt.Printf("[LIFECYCLE] Webhook %s returned %s\n", url, resp.Status)
+			}
+		}(url)
+	}
+}
+
+// LifecycleCounts returns the lifecycle counters of every project with events
+func (d *DockerSetup) LifecycleCounts() map[string]LifecycleCounters {
+	d.lifecycle.mutex.Lock()
+	defer d.lifecycle.mutex.Unlock()
+	counts := make(map[string]LifecycleCounters, len(d.lifecycle.counters))
+	for project, counters := range d.lifecycle.counters {
+		counts[project] = *counters
+	}
+	return counts
+}
@@ -0,0 +1,281 @@
+package docker
+
+import (
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// localRegistryContainer runs registry:2 with its data in a named volume
+	localRegistryContainer = "erebrus-registry"
+	localRegistryVolume    = "erebrus-registry"
+	// LocalRegistryPort is where the local registry listens, on loopback only
+	LocalRegistryPort = "5000"
+)
+
+// localRegistryHost prefixes images in the local registry. Docker talks
+// plain HTTP to registries on loopback, so no certificate is needed.
+const localRegistryHost = "localhost:" + LocalRegistryPort
+
+// localRegistryMutex serializes pushes with garbage collection, which is unsafe
+// while uploads are in flight
+var localRegistryMutex sync.Mutex
+
+// EnsureLocalRegistry starts the local registry container, creating it on
+// first use
+func (d *DockerSetup) EnsureLocalRegistry() error {
+	out, err := d.runner.Output(exec.Command("docker", "inspect", "--format", "{{.State.Running}}", localRegistryContainer))
+	if err == nil {
+		if strings.TrimSpace(string(out)) == "true" {
+			return nil
+		}
+		fmt.Println("[REGISTRY] Starting the local registry")
+		if output, err := d.combinedOutput(exec.Command("docker", "start", localRegistryContainer)); err != nil {
+			return fmt.Errorf("failed to start %s: %v: %s", localRegistryContainer, err, strings.TrimSpace(string(output)))
+		}
+		return nil
+	}
+
+	fmt.Println("[REGISTRY] Creating the local registry")
+	output, err := d.combinedOutput(exec.Command("docker", "run", "-d",
+		"--name", localRegistryContainer,
+		"--restart", "unless-stopped",
+		"-p", "127.0.0.1:"+LocalRegistryPort+":5000",
+		"-v", localRegistryVolume+":/var/lib/registry",
+		"-e", "REGISTRY_STORAGE_DELETE_ENABLED=true",
+		"registry:2"))
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %v: %s", localRegistryContainer, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// localRegistryImage is the reference a project's build is archived under
+func localRegistryImage(project, tag string) string {
+	return fmt.Sprintf("%s/%s:%s", localRegistryHost, composeProjectName(project), tag)
+}
+
+// localRegistryTag returns the tag of an image in the local registry, false
+// for other images
+func localRegistryTag(project, image string) (string, bool) {
+	prefix := fmt.Sprintf("%s/%s:", localRegistryHost, composeProjectName(project))
+	if !strings.HasPrefix(image, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(image, prefix), true
+}
+
+// archiveImage pushes a successful build to the local registry, tagged with
+// its commit or, for sources without one, the deploy ID, and drops the
+// project's tags beyond the retention count. Failures are logged but never
+// fail the deployment.
+func (d *DockerSetup) archiveImage(deployment Deployment, deployID string, sendLog func(string)) {
+	if !d.LocalRegistry || deployment.Static || deployment.Image != "" {
+		return
+	}
+	state, err := LoadProjectState(deployment.ProjectName)
+	if err != nil {
+		sendLog(fmt.Sprintf("[REGISTRY] Failed to load project state: %v", err))
+		return
+	}
+	tag := state.Commit
+	if tag == "" {
+		tag = deployID
+	}
+
+	localRegistryMutex.Lock()
+	defer localRegistryMutex.Unlock()
+
+	remote := localRegistryImage(deployment.ProjectName, tag)
+	sendLog(fmt.Sprintf("[REGISTRY] Archiving the image as %s", remote))
+	if err := d.runCommand("docker", "tag", deployImage(deployment, deployID), remote); err != nil {
+		sendLog(fmt.Sprintf("[REGISTRY] Failed to tag image: %v", err))
+		return
+	}
+	defer d.runCommand("docker", "rmi", remote)
+	if err := d.streamCommand(exec.Command("docker", "push", remote), "[REGISTRY]", sendLog); err != nil {
+		sendLog(fmt.Sprintf("[REGISTRY] Failed to push image: %v", err))
+		return
+	}
+
+	var expired []string
+	if err := UpdateProjectState(deployment.ProjectName, func(state *ProjectState) {
+		tags := []string{}
+		for _, existing := range state.RegistryTags {
+			if existing != tag {
+				tags = append(tags, existing)
+			}
+		}
+		tags = append(tags, tag)
+		keep := d.ImageRetention
+		if keep < 1 {
+			keep = 1
+		}
+		if len(tags) > keep {
+			expired = tags[:len(tags)-keep]
+			tags = tags[len(tags)-keep:]
+		}
+		state.RegistryTags = tags
+	}); err != nil {
+		sendLog(fmt.Sprintf("[REGISTRY] Failed to record the archived image: %v", err))
+		return
+	}
+
+	if len(expired) > 0 {
+		sendLog(fmt.Sprintf("[REGISTRY] Removing %d archived images beyond the retention count", len(expired)))
+		if err := d.deleteRegistryTags(deployment.ProjectName, expired); err != nil {
+			sendLog(fmt.Sprintf("[REGISTRY] Failed to remove old archived images: %v", err))
+		}
+	}
+}
+
+// manifestAccept lists the manifest types registry:2 stores for docker and
+// BuildKit builds
+var manifestAccept = strings.Join([]string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}, ", ")
+
+// manifestDigest resolves a tag in the local registry to its manifest digest
+func manifestDigest(project, tag string) (string, error) {
+	req, err := http.NewRequest(http.MethodHead, fmt.Sprintf("http://%s/v2/%s/manifests/%s", localRegistryHost, composeProjectName(project), tag), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", manifestAccept)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s for tag %s", resp.Status, tag)
+	}
+	return resp.Header.Get("Docker-Content-Digest"), nil
+}
+
+// deleteRegistryTags removes tags from the local registry and garbage
+// collects their layers. The registry deletes manifests rather than tags,
+// so a manifest still tagged by a kept build is left alone. The caller
+// holds localRegistryMutex.
+func (d *DockerSetup) deleteRegistryTags(project string, tags []string) error {
+	state, err := LoadProjectState(project)
+	if err != nil {
+		return err
+	}
+	kept := make(map[string]bool)
+	for _, tag := range state.RegistryTags {
+		if digest, err := manifestDigest(project, tag); err == nil {
+			kept[digest] = true
+		}
+	}
+
+	for _, tag := range tags {
+		digest, err := manifestDigest(project, tag)
+		if err != nil || kept[digest] {
+			continue
+		}
+		req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s/v2/%s/manifests/%s", localRegistryHost, composeProjectName(project), digest), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return fmt.Errorf("failed to delete %s: %v", tag, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNotFound {
+			return fmt.Errorf("failed to delete %s: unexpected status %s", tag, resp.Status)
+		}
+	}
+
+	output, err := d.combinedOutput(exec.Command("docker", "exec", localRegistryContainer,
+		"registry", "garbage-collect", "--delete-untagged", "/etc/docker/registry/config.yml"))
+	if err != nil {
+		return fmt.Errorf("registry garbage collection failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// RollbackSpec returns the spec redeploying a project from an image archived
+// in the local registry. An empty tag rolls back to the build archived
+// before the one running now.
+func (d *DockerSetup) RollbackSpec(project, tag string) (Deployment, error) {
+	if !d.LocalRegistry {
+		return Deployment{}, fmt.Errorf("rollback needs the local registry, set EREBRUS_LOCAL_REGISTRY=true")
+	}
+	state, err := LoadProjectState(project)
+	if err != nil {
+		return Deployment{}, err
+	}
+	if state.Deployment == nil {
+		return Deployment{}, fmt.Errorf("%s has no successful deployment", project)
+	}
+	if len(state.RegistryTags) == 0 {
+		return Deployment{}, fmt.Errorf("%s has no archived images", project)
+	}
+
+	if tag == "" {
+		current, ok := localRegistryTag(project, state.Deployment.Image)
+		if !ok {
+			current = state.RegistryTags[len(state.RegistryTags)-1]
+		}
+		for i, archived := range state.RegistryTags {
+			if archived == current && i > 0 {
+				tag = state.RegistryTags[i-1]
+			}
+		}
+		if tag == "" {
+			return Deployment{}, fmt.Errorf("%s has no earlier archived image", project)
+		}
+	}
+	found := false
+	for _, archived := range state.RegistryTags {
+		found = found || archived == tag
+	}
+	if !found {
+		return Deployment{}, fmt.Errorf("%s has no archived image tagged %q", project, tag)
+	}
+
+	spec := *state.Deployment
+	// serveDeployment adds the environment suffix back
+	spec.ProjectName = logicalProject(spec.ProjectName, spec.Environment)
+	spec.Image = localRegistryImage(project, tag)
+	spec.GitURL = ""
+	spec.GitMirrors = nil
+	spec.Commit = ""
+	spec.LocalPath = ""
+	spec.Upload = nil
+	spec.LFS = nil
+	spec.Submodules = false
+	spec.Push = false
+	spec.NoCache = false
+	// A scheduled redeploy would replace the rolled back build
+	spec.RedeployCron = ""
+	// The hook ran when the archived build was first deployed
+	spec.PreDeployCmd = ""
+	return spec, nil
+}
+
+// localRegistryBytes returns the disk space used by the local registry
+func (d *DockerSetup) localRegistryBytes() (uint64, error) {
+	out, err := d.runner.Output(exec.Command("docker", "exec", localRegistryContainer, "du", "-sk", "/var/lib/registry"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure the local registry: %v", err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("unexpected du output: %q", out)
+	}
+	kilobytes, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected du output: %q", out)
+	}
+	return kilobytes * 1024, nil
+}
@@ -0,0 +1,233 @@
+package docker
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// logsDirName is the workspace subdirectory holding per-run deploy logs.
+// It survives re-clones of the repository.
+const logsDirName = "logs"
+
+// deployLogName is the log of a project's most recent run, kept at the
+// workspace root. Each new run moves the previous one to the logs directory.
+const deployLogName = "deploy.log"
+
+var deployIDPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+// deployLog writes one deployment run's log lines to disk, both to the
+// run's own file and, when enabled, to the project's deploy.log
+type deployLog struct {
+	mutex   sync.Mutex
+	file    *os.File
+	rolling *os.File
+}
+
+// keptInWorkspace reports whether a top level workspace entry holds our logs
+// and must survive re-clones and uploads
+func keptInWorkspace(name string) bool {
+	return name == logsDirName || name == deployLogName
+}
+
+func logsDir(project string) (string, error) {
+	workDir, err := workspaceDir(project)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(workDir, logsDirName), nil
+}
+
+// openDeployLog creates the log file for a deployment run
+func (d *DockerSetup) openDeployLog(project, deployID string) (*deployLog, error) {
+	dir, err := logsDir(project)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create logs directory: %v", err)
+	}
+	file, err := os.OpenFile(filepath.Join(dir, deployID+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create log file: %v", err)
+	}
+
+	l := &deployLog{file: file}
+	if d.ProjectDeployLog {
+		if l.rolling, err = openProjectDeployLog(filepath.Dir(dir)); err != nil {
+			fmt.Printf("[LOGS] Project deploy log disabled for %s: %v\n", project, err)
+		}
+	}
+	return l, nil
+}
+
+// openProjectDeployLog starts a fresh workspace deploy.log for a new run,
+// keeping the previous run's as logs/deploy.log.1
+func openProjectDeployLog(workDir string) (*os.File, error) {
+	path := filepath.Join(workDir, deployLogName)
+	if _, err := os.Stat(path); err == nil {
+		if err := os.Rename(path, filepath.Join(workDir, logsDirName, deployLogName+".1")); err != nil {
+			return nil, fmt.Errorf("failed to rotate %s: %v", deployLogName, err)
+		}
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+}
+
+// write appends a line; it is a no-op when the log could not be opened
+func (l *deployLog) write(line string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	fmt.Fprintln(l.file, line)
+	if l.rolling != nil {
+		fmt.Fprintf(l.rolling, "%s %s\n", time.Now().UTC().Format(time.RFC3339), line)
+	}
+}
+
+// finishDeployLog closes the log, compresses it and enforces the retention cap
+func (d *DockerSetup) finishDeployLog(l *deployLog, project string) {
+	if l == nil {
+		return
+	}
+	l.mutex.Lock()
+	path := l.file.Name()
+	l.file.Close()
+	if l.rolling != nil {
+		l.rolling.Close()
+	}
+	l.mutex.Unlock()
+
+	if err := gzipFile(path); err != nil {
+		fmt.Printf("[LOGS] Failed to compress %s: %v\n", path, err)
+		return
+	}
+	if err := d.pruneDeployLogs(project); err != nil {
+		fmt.Printf("[LOGS] Failed to prune logs for %s: %v\n", project, err)
+	}
+}
+
+// gzipFile replaces path with path.gz
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// pruneDeployLogs deletes the oldest compressed logs until the project is
+// within the retention cap
+func (d *DockerSetup) pruneDeployLogs(project string) error {
+	if d.LogRetentionBytes <= 0 {
+		return nil
+	}
+	dir, err := logsDir(project)
+	if err != nil {
+		return err
+	}
+	matches, err := filepath.Glob(filepath.Join(dir, "*.log.gz"))
+	if err != nil {
+		return err
+	}
+
+	type logEntry struct {
+		path string
+		info os.FileInfo
+	}
+	var entries []logEntry
+	var total int64
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, logEntry{path, info})
+		total += info.Size()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].info.ModTime().Before(entries[j].info.ModTime())
+	})
+
+	// Always keep the newest log, even when it alone exceeds the cap
+	for i := 0; total > d.LogRetentionBytes && i < len(entries)-1; i++ {
+		if err := os.Remove(entries[i].path); err != nil {
+			return err
+		}
+		total -= entries[i].info.Size()
+	}
+	return nil
+}
+
+// OpenDeployLog returns a reader over a run's log, decompressing finished runs
+func OpenDeployLog(project, deployID string) (io.ReadCloser, error) {
+	if !deployIDPattern.MatchString(deployID) {
+		return nil, fmt.Errorf("invalid deployment id: %q", deployID)
+	}
+	dir, err := logsDir(project)
+	if err != nil {
+		return nil, err
+	}
+
+	// A run that is still in progress has not been compressed yet
+	if file, err := os.Open(filepath.Join(dir, deployID+".log")); err == nil {
+		return file, nil
+	}
+
+	file, err := os.Open(filepath.Join(dir, deployID+".log.gz"))
+	if err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read compressed log: %v", err)
+	}
+	return &gzipReadCloser{Reader: gz, file: file}, nil
+}
+
+// gzipReadCloser closes both the gzip stream and the underlying file
+type gzipReadCloser struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g *gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// OpenProjectLog returns a reader over the project's deploy.log, the log of
+// its most recent run
+func OpenProjectLog(project string) (io.ReadCloser, error) {
+	workDir, err := workspaceDir(project)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(workDir, deployLogName))
+}
@@ -0,0 +1,591 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"erebrusvps/websocket"
+)
+
+// exportFormatVersion is bumped whenever the layout of export archives changes
+const exportFormatVersion = 1
+
+// minPassphraseLength keeps export passphrases from being trivially guessed
+const minPassphraseLength = 12
+
+// Import outcomes reported per project
+const (
+	ImportImported = "imported"
+	ImportSkipped  = "skipped"
+	ImportFailed   = "failed"
+)
+
+// ExportManifest is the manifest.json at the root of an export archive
+type ExportManifest struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exported_at"`
+	Projects   []string  `json:"projects"`
+	// Sources is set when workspace sources were included
+	Sources bool `json:"sources"`
+	// Salt and Iterations derive the key the deployment specs are sealed
+	// with from the passphrase
+	Salt       []byte `json:"salt"`
+	Iterations int    `json:"iterations"`
+}
+
+// ExportOptions controls what an export contains
+type ExportOptions struct {
+	// Passphrase encrypts the deployment specs, which hold env vars and
+	// credentials
+	Passphrase string
+	// Sources adds each project's workspace source. Without it only git
+	// and image deployments can be rebuilt on import.
+	Sources bool
+}
+
+// ImportResult is the outcome of importing one project
+type ImportResult struct {
+	Project string `json:"project"`
+	Status  string `json:"status"`
+	URL     string `json:"url,omitempty"`
+	Port    string `json:"port,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func validatePassphrase(passphrase string) error {
+	if len(passphrase) < minPassphraseLength {
+		return fmt.Errorf("passphrase must be at least %d characters", minPassphraseLength)
+	}
+	return nil
+}
+
+// Export writes a tar.gz of every deployed project for moving to another
+// host: the project state with secrets redacted, the full deployment spec
+// encrypted with the passphrase, the event history, the nginx config for
+// reference, a Dockerfile override and, optionally, the workspace source.
+func (d *DockerSetup) Export(w io.Writer, opts ExportOptions) error {
+	if err := validatePassphrase(opts.Passphrase); err != nil {
+		return err
+	}
+	projects, err := ListProjects()
+	if err != nil {
+		return err
+	}
+
+	manifest := ExportManifest{
+		Version:    exportFormatVersion,
+		ExportedAt: time.Now().UTC(),
+		Projects:   []string{},
+		Sources:    opts.Sources,
+		Salt:       make([]byte, 16),
+		Iterations: passphraseIterations,
+	}
+	if _, err := rand.Read(manifest.Salt); err != nil {
+		return err
+	}
+	key := passphraseKey(opts.Passphrase, manifest.Salt, manifest.Iterations)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, project := range projects {
+		state, err := LoadProjectState(project)
+		if err != nil {
+			return err
+		}
+		if state.Deployment == nil {
+			continue
+		}
+		if err := d.exportProject(tw, project, state, key, opts.Sources); err != nil {
+			return fmt.Errorf("failed to export %s: %v", project, err)
+		}
+		manifest.Projects = append(manifest.Projects, project)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, "manifest.json", data); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func (d *DockerSetup) exportProject(tw *tar.Writer, project string, state *ProjectState, key []byte, sources bool) error {
+	dir := "projects/" + project + "/"
+
+	// The export is sealed with its own passphrase and must not depend on
+	// this host's secret key
+	plain, err := decryptedSecrets(*state.Deployment)
+	if err != nil {
+		return err
+	}
+	spec, err := json.Marshal(plain)
+	if err != nil {
+		return err
+	}
+	sealed, err := seal(key, spec)
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, dir+"deployment.sealed", sealed); err != nil {
+		return err
+	}
+
+	redacted := *state
+	deployment := state.Deployment.Redacted()
+	redacted.Deployment = &deployment
+	data, err := json.MarshalIndent(redacted, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, dir+"state.json", data); err != nil {
+		return err
+	}
+
+	if events, err := ListEvents(project); err == nil && len(events) > 0 {
+		var lines bytes.Buffer
+		encoder := json.NewEncoder(&lines)
+		for _, event := range events {
+			if err := encoder.Encode(event); err != nil {
+				return err
+			}
+		}
+		if err := writeTarFile(tw, dir+"events.jsonl", lines.Bytes()); err != nil {
+			return err
+		}
+	}
+	if path, err := dockerfileOverridePath(project); err == nil {
+		if err := writeTarFileFrom(tw, dir+"Dockerfile.override", path); err != nil {
+			return err
+		}
+	}
+	if artifacts, err := GetArtifacts(project); err == nil && artifacts.NginxConfig != "" {
+		if err := writeTarFile(tw, dir+"nginx.conf", []byte(artifacts.NginxConfig)); err != nil {
+			return err
+		}
+	}
+
+	if !sources || state.Deployment.Image != "" {
+		return nil
+	}
+	return exportSource(tw, dir+"source.tar.gz", project, state)
+}
+
+// exportSource adds a project's workspace source as a nested tar.gz in the
+// format source uploads use, expanding a compressed workspace on the way.
+// Files the deployer generates are left out.
+func exportSource(tw *tar.Writer, name, project string, state *ProjectState) error {
+	workDir, err := workspaceDir(project)
+	if err != nil {
+		return err
+	}
+	stateRoot, err := stateDir()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(stateRoot, "export-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	entries, err := os.ReadDir(workDir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, entry := range entries {
+		switch entry.Name() {
+		case "docker-compose.yml", workspaceArchiveName:
+			continue
+		case "Dockerfile":
+			if state.DockerfileSource != DockerfileFromRepository {
+				continue
+			}
+		}
+		if !keptInWorkspace(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+
+	gz := gzip.NewWriter(tmp)
+	source := tar.NewWriter(gz)
+	if err := appendWorkspace(source, workDir, names); err != nil {
+		return err
+	}
+	if state.WorkspaceCompressed {
+		if err := appendArchive(source, filepath.Join(workDir, workspaceArchiveName)); err != nil {
+			return err
+		}
+	}
+	if err := source.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return writeTarFileFrom(tw, name, tmp.Name())
+}
+
+// appendWorkspace adds the named workspace entries to tw, regular files and
+// directories only, as source uploads can't hold anything else
+func appendWorkspace(tw *tar.Writer, workDir string, names []string) error {
+	for _, name := range names {
+		err := filepath.Walk(filepath.Join(workDir, name), func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && !info.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(workDir, path)
+			if err != nil {
+				return err
+			}
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return err
+			}
+			header.Name = filepath.ToSlash(rel)
+			if err := tw.WriteHeader(header); err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			src, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+			_, err = io.Copy(tw, src)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to archive %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// appendArchive copies the regular files and directories of a tar.gz into tw
+func appendArchive(tw *tar.Writer, archivePath string) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg && header.Typeflag != tar.TypeDir {
+			continue
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// writeTarFileFrom adds a file from disk, skipping it when it doesn't exist
+func writeTarFileFrom(tw *tar.Writer, name, path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// Import restores the projects of an export archive and rebuilds them one
+// at a time. Projects already deployed on this host are skipped. Ports are
+// assigned afresh, git sources are cloned again and other sources are
+// unpacked from the archive. A wrong passphrase fails the import before
+// anything is changed.
+func (d *DockerSetup) Import(r io.Reader, passphrase string) ([]ImportResult, error) {
+	stateRoot, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(stateRoot, 0755); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(stateRoot, "import-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	if err := extractImport(r, dir); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("not an export archive: manifest.json is missing")
+	}
+	var manifest ExportManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest.json: %v", err)
+	}
+	if manifest.Version != exportFormatVersion {
+		return nil, fmt.Errorf("unsupported export version %d, expected %d", manifest.Version, exportFormatVersion)
+	}
+	if manifest.Iterations < 1 || len(manifest.Salt) == 0 {
+		return nil, fmt.Errorf("manifest.json has no key derivation parameters")
+	}
+
+	// Open every spec before touching anything, so a wrong passphrase
+	// changes nothing
+	key := passphraseKey(passphrase, manifest.Salt, manifest.Iterations)
+	specs := make(map[string]Deployment)
+	for _, project := range manifest.Projects {
+		if err := ValidateProjectName(project); err != nil {
+			return nil, err
+		}
+		sealed, err := os.ReadFile(filepath.Join(dir, "projects", project, "deployment.sealed"))
+		if err != nil {
+			return nil, fmt.Errorf("%s has no deployment spec", project)
+		}
+		spec, err := unseal(key, sealed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %v", project, err)
+		}
+		var deployment Deployment
+		if err := json.Unmarshal(spec, &deployment); err != nil {
+			return nil, fmt.Errorf("failed to parse the spec of %s: %v", project, err)
+		}
+		if err := ValidateSecretValues(deployment); err != nil {
+			return nil, fmt.Errorf("invalid spec of %s: %v", project, err)
+		}
+		specs[project] = deployment
+	}
+
+	results := []ImportResult{}
+	for _, project := range manifest.Projects {
+		result := d.importProject(project, specs[project], filepath.Join(dir, "projects", project))
+		message := fmt.Sprintf("[IMPORT] %s: %s", project, result.Status)
+		if result.Error != "" {
+			message += ": " + result.Error
+		}
+		websocket.Logger.SendProjectLog(project, message)
+		fmt.Println(message)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// importProject restores and rebuilds a single exported project
+func (d *DockerSetup) importProject(project string, spec Deployment, dir string) ImportResult {
+	result := ImportResult{Project: project}
+	fail := func(err error) ImportResult {
+		result.Status = ImportFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	if existing, err := LoadProjectState(project); err != nil {
+		return fail(err)
+	} else if existing.Deployment != nil {
+		result.Status = ImportSkipped
+		result.Error = "already deployed on this host"
+		return result
+	}
+
+	sourcePath := filepath.Join(dir, "source.tar.gz")
+	_, sourceErr := os.Stat(sourcePath)
+	haveSource := sourceErr == nil
+	if _, ok := localRegistryTag(project, spec.Image); ok {
+		return fail(fmt.Errorf("it runs %s from the old host's local registry, redeploy it from source instead", spec.Image))
+	}
+	if spec.GitURL == "" && spec.Image == "" {
+		if _, err := os.Stat(spec.LocalPath); spec.LocalPath == "" || err != nil {
+			if !haveSource {
+				return fail(fmt.Errorf("the export has no source for it, export with sources=true"))
+			}
+			file, err := os.Open(sourcePath)
+			if err != nil {
+				return fail(err)
+			}
+			upload, err := StageUpload(file)
+			file.Close()
+			if err != nil {
+				return fail(err)
+			}
+			spec.LocalPath = ""
+			spec.Upload = upload
+		}
+	}
+
+	// The old host's port may be taken here
+	spec.Port = d.getNextAvailablePort()
+
+	if err := restoreImportedState(project, dir); err != nil {
+		if spec.Upload != nil {
+			os.Remove(spec.Upload.Path)
+		}
+		return fail(err)
+	}
+
+	started := time.Now()
+	deployed, err := d.DeployProject(spec)
+	event := Event{
+		Timestamp:  started.UTC(),
+		Type:       EventImport,
+		Actor:      "import",
+		Result:     "success",
+		DurationMs: time.Since(started).Milliseconds(),
+	}
+	if deployed != nil {
+		event.BuildMs = deployed.BuildMs
+		event.DeployID = deployed.DeployID
+		event.Sequence = deployed.Sequence
+	}
+	if err != nil {
+		event.Result = "failure"
+		event.Error = err.Error()
+	}
+	if recordErr := RecordEvent(project, event); recordErr != nil {
+		fmt.Printf("[EVENTS] Failed to record %s event for %s: %v\n", EventImport, project, recordErr)
+	}
+	if err != nil {
+		return fail(err)
+	}
+	result.Status = ImportImported
+	result.URL = deployed.URL
+	result.Port = deployed.Port
+	return result
+}
+
+// restoreImportedState brings over a project's owner, event history and
+// Dockerfile override before it is rebuilt
+func restoreImportedState(project, dir string) error {
+	if data, err := os.ReadFile(filepath.Join(dir, "state.json")); err == nil {
+		var exported ProjectState
+		if err := json.Unmarshal(data, &exported); err != nil {
+			return fmt.Errorf("failed to parse state.json: %v", err)
+		}
+		if err := UpdateProjectState(project, func(state *ProjectState) {
+			state.Owner = exported.Owner
+		}); err != nil {
+			return err
+		}
+	}
+
+	if events, err := os.ReadFile(filepath.Join(dir, "events.jsonl")); err == nil {
+		if err := appendEventLines(project, events); err != nil {
+			return err
+		}
+	}
+
+	if override, err := os.ReadFile(filepath.Join(dir, "Dockerfile.override")); err == nil {
+		path, err := dockerfileOverridePath(project)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, override, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractImport unpacks an export archive into dir
+func extractImport(r io.Reader, dir string) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("archive is not gzip compressed: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		target, err := archiveEntryPath(dir, header.Name)
+		if err != nil {
+			return err
+		}
+		if target == "" || header.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return fmt.Errorf("failed to extract %s: %w", header.Name, err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+-- Project state as the JSON the file store kept, with the fields looked up
+-- across projects copied out
+CREATE TABLE deployments (
+	project    TEXT PRIMARY KEY,
+	state      TEXT NOT NULL,
+	owner      TEXT NOT NULL DEFAULT '',
+	updated_at TEXT NOT NULL
+);
+
+-- Host ports published by deployed projects
+CREATE TABLE ports (
+	port    TEXT PRIMARY KEY,
+	project TEXT NOT NULL
+);
+
+-- IDs of the API keys that own projects; keys themselves stay in the config
+CREATE TABLE api_keys (
+	key_id     TEXT PRIMARY KEY,
+	first_seen TEXT NOT NULL
+);
+
+-- One row per deployment sequence number handed out, filled in once the
+-- deploy records its event
+CREATE TABLE deployment_runs (
+	sequence   INTEGER PRIMARY KEY AUTOINCREMENT,
+	project    TEXT NOT NULL DEFAULT '',
+	deploy_id  TEXT NOT NULL DEFAULT '',
+	result     TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL
+);
+
+-- Each project's append-only event history
+CREATE TABLE audit_events (
+	id      INTEGER PRIMARY KEY AUTOINCREMENT,
+	project TEXT NOT NULL,
+	event   TEXT NOT NULL
+);
+CREATE INDEX audit_events_project ON audit_events (project, id);
+
+-- Markers of one-time jobs such as the JSON state import
+CREATE TABLE meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
@@ -0,0 +1,49 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// projectGitURL returns the origin URL of an existing project's checkout
+func (d *DockerSetup) projectGitURL(project string) (string, bool) {
+	workDir, err := workspaceDir(project)
+	if err != nil {
+		return "", false
+	}
+	out, err := d.runner.Output(exec.Command("git", "-C", workDir, "remote", "get-url", "origin"))
+	if err != nil {
+		return "", false
+	}
+	return strings.TrimSpace(string(out)), true
+}
+
+// normalizeGitURL makes equivalent spellings of a repository URL compare equal
+func normalizeGitURL(gitURL string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(strings.TrimSpace(gitURL), "/"), ".git")
+}
+
+// ResolveProjectName returns the name a deployment will be deployed under.
+// With UniqueName set, a name already used by a different repository gets a
+// short hash of the git URL appended so the two don't overwrite each other.
+func (d *DockerSetup) ResolveProjectName(deployment Deployment) string {
+	if !deployment.UniqueName {
+		return deployment.ProjectName
+	}
+	existing, ok := d.projectGitURL(deployment.ProjectName)
+	if !ok {
+		return deployment.ProjectName
+	}
+	// A checkout cloned from a mirror is still the same repository
+	for _, gitURL := range append([]string{deployment.GitURL}, deployment.GitMirrors...) {
+		if normalizeGitURL(existing) == normalizeGitURL(gitURL) {
+			return deployment.ProjectName
+		}
+	}
+
+	sum := sha256.Sum256([]byte(normalizeGitURL(deployment.GitURL)))
+	return fmt.Sprintf("%s-%s", deployment.ProjectName, hex.EncodeToString(sum[:])[:6])
+}
@@ -0,0 +1,225 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// networkMutex keeps deploys from creating the deployment network while it
+// is being recreated
+var networkMutex sync.Mutex
+
+// appService is the default compose service of the deployed app, the only
+// one that joins the deployment network
+const appService = "app"
+
+// serviceName returns the compose service the app runs as
+func serviceName(deployment Deployment) string {
+	if deployment.ServiceName != "" {
+		return deployment.ServiceName
+	}
+	return appService
+}
+
+// NetworkInfo describes the deployment network and what is attached to it
+type NetworkInfo struct {
+	Name       string             `json:"name"`
+	ID         string             `json:"id"`
+	Driver     string             `json:"driver"`
+	Subnets    []string           `json:"subnets"`
+	Containers []NetworkContainer `json:"containers"`
+}
+
+// NetworkContainer is a container attached to the deployment network
+type NetworkContainer struct {
+	Name string `json:"name"`
+	// Project is the managed deployment the container belongs to, empty for
+	// containers started outside of the manager
+	Project     string `json:"project,omitempty"`
+	IPv4Address string `json:"ipv4_address,omitempty"`
+	IPv6Address string `json:"ipv6_address,omitempty"`
+}
+
+// NetworkRecreateReport lists the containers reattached to the recreated network
+type NetworkRecreateReport struct {
+	Network    string            `json:"network"`
+	Reattached []string          `json:"reattached"`
+	Failed     map[string]string `json:"failed,omitempty"`
+}
+
+// networkInspect is the part of docker network inspect we use
+type networkInspect struct {
+	Name   string `json:"Name"`
+	ID     string `json:"Id"`
+	Driver string `json:"Driver"`
+	IPAM   struct {
+		Config []struct {
+			Subnet string `json:"Subnet"`
+		} `json:"Config"`
+	} `json:"IPAM"`
+	Containers map[string]struct {
+		Name        string `json:"Name"`
+		IPv4Address string `json:"IPv4Address"`
+		IPv6Address string `json:"IPv6Address"`
+	} `json:"Containers"`
+}
+
+// composeProjects maps compose project names back to managed projects
+func composeProjects() map[string]string {
+	projects := make(map[string]string)
+	names, err := ListProjects()
+	if err != nil {
+		return projects
+	}
+	for _, project := range names {
+		projects[composeProjectName(project)] = project
+	}
+	return projects
+}
+
+// InspectNetwork returns the deployment network with the containers attached to it
+func (d *DockerSetup) InspectNetwork() (*NetworkInfo, error) {
+	output, err := d.runner.Output(exec.Command("docker", "network", "inspect", d.networkName()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect network %s: %v", d.networkName(), err)
+	}
+	var inspected []networkInspect
+	if err := json.Unmarshal(output, &inspected); err != nil || len(inspected) == 0 {
+		return nil, fmt.Errorf("unexpected docker network inspect output: %v", err)
+	}
+	network := inspected[0]
+
+	info := &NetworkInfo{
+		Name:       network.Name,
+		ID:         network.ID,
+		Driver:     network.Driver,
+		Subnets:    []string{},
+		Containers: []NetworkContainer{},
+	}
+	for _, config := range network.IPAM.Config {
+		info.Subnets = append(info.Subnets, config.Subnet)
+	}
+
+	owners := d.networkContainerProjects()
+	for _, container := range network.Containers {
+		info.Containers = append(info.Containers, NetworkContainer{
+			Name:        container.Name,
+			Project:     owners[container.Name],
+			IPv4Address: container.IPv4Address,
+			IPv6Address: container.IPv6Address,
+		})
+	}
+	sort.Slice(info.Containers, func(i, j int) bool {
+		return info.Containers[i].Name < info.Containers[j].Name
+	})
+	return info, nil
+}
+
+// networkContainerProjects maps the names of containers attached to the
+// deployment network to the managed project they belong to
+func (d *DockerSetup) networkContainerProjects() map[string]string {
+	owners := make(map[string]string)
+	output, err := d.runner.Output(exec.Command("docker", "ps", "-a",
+		"--filter", "network="+d.networkName(),
+		"--format", `{{.Names}}	{{.Label "com.docker.compose.project"}}`))
+	if err != nil {
+		return owners
+	}
+	projects := composeProjects()
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) == 2 && projects[fields[1]] != "" {
+			owners[fields[0]] = projects[fields[1]]
+		}
+	}
+	return owners
+}
+
+// networkMembers returns the containers that belong on the deployment
+// network: those attached now, running or not, plus the app containers of
+// every managed project, which may have lost the network. App containers are
+// found by the project label only they carry, whatever their service name. The value is the
+// alias to reattach with, so compose service names keep resolving.
+func (d *DockerSetup) networkMembers() (map[string]string, error) {
+	members := make(map[string]string)
+	format := `{{.Names}}	{{.Label "com.docker.compose.project"}}	{{.Label "com.docker.compose.service"}}`
+
+	attached, err := d.runner.Output(exec.Command("docker", "ps", "-a",
+		"--filter", "network="+d.networkName(), "--format", format))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list attached containers: %v", err)
+	}
+	apps, err := d.runner.Output(exec.Command("docker", "ps", "-a",
+		"--filter", "label="+projectLabel, "--format", format))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deployment containers: %v", err)
+	}
+
+	projects := composeProjects()
+	for _, line := range strings.Split(strings.TrimSpace(string(attached)), "\n") {
+		if fields := strings.Split(line, "\t"); len(fields) == 3 && fields[0] != "" {
+			members[fields[0]] = fields[2]
+		}
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(apps)), "\n") {
+		if fields := strings.Split(line, "\t"); len(fields) == 3 && projects[fields[1]] != "" {
+			members[fields[0]] = fields[2]
+		}
+	}
+	return members, nil
+}
+
+// RecreateNetwork removes and recreates the deployment network, then
+// reattaches the containers that belong on it
+func (d *DockerSetup) RecreateNetwork() (*NetworkRecreateReport, error) {
+	networkMutex.Lock()
+	defer networkMutex.Unlock()
+
+	network := d.networkName()
+	members, err := d.networkMembers()
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("[NETWORK] Recreating %s with %d containers\n", network, len(members))
+	if d.runner.Run(exec.Command("docker", "network", "inspect", network)) == nil {
+		for container := range members {
+			// Not every known container is attached; those fail harmlessly
+			d.runner.Run(exec.Command("docker", "network", "disconnect", "-f", network, container))
+		}
+		if output, err := d.combinedOutput(exec.Command("docker", "network", "rm", network)); err != nil {
+			return nil, fmt.Errorf("failed to remove network %s: %v: %s", network, err, strings.TrimSpace(string(output)))
+		}
+	}
+	if output, err := d.combinedOutput(exec.Command("docker", "network", "create", network)); err != nil {
+		return nil, fmt.Errorf("failed to create network %s: %v: %s", network, err, strings.TrimSpace(string(output)))
+	}
+
+	report := &NetworkRecreateReport{Network: network, Reattached: []string{}}
+	names := make([]string, 0, len(members))
+	for container := range members {
+		names = append(names, container)
+	}
+	sort.Strings(names)
+	for _, container := range names {
+		args := []string{"network", "connect"}
+		if alias := members[container]; alias != "" {
+			args = append(args, "--alias", alias)
+		}
+		args = append(args, network, container)
+		if output, err := d.combinedOutput(exec.Command("docker", args...)); err != nil {
+			if report.Failed == nil {
+				report.Failed = make(map[string]string)
+			}
+			report.Failed[container] = strings.TrimSpace(string(output))
+			fmt.Printf("[NETWORK] Failed to reattach %s: %v\n", container, err)
+			continue
+		}
+		report.Reattached = append(report.Reattached, container)
+	}
+	return report, nil
+}
@@ -0,0 +1,83 @@
+package docker
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// DefaultAssetPattern matches the fingerprinted files bundlers emit, e.g.
+// main.1a2b3c4d.js from webpack or /assets/index-BxY3kZ9a.js from Vite
+const DefaultAssetPattern = `(\.[0-9a-f]{8,}\.|^/assets/.+-[A-Za-z0-9_-]{8}\.)(js|mjs|css|woff2?|ttf|png|jpe?g|gif|svg|webp|avif|ico)$`
+
+// compressibleTypes are compressed on the fly. text/html is always
+// included by nginx and listing it again makes nginx -t warn.
+const compressibleTypes = "text/plain text/css text/xml text/javascript application/javascript application/json application/xml application/manifest+json application/wasm image/svg+xml"
+
+// validateAssetCaching rejects asset patterns that can't be embedded in a
+// quoted nginx location
+func validateAssetCaching(deployment Deployment) error {
+	pattern := deployment.AssetPattern
+	if pattern == "" {
+		return nil
+	}
+	if strings.ContainsAny(pattern, "\"\n;") || strings.HasSuffix(pattern, `\`) {
+		return fmt.Errorf("invalid asset_pattern %q", pattern)
+	}
+	if _, err := regexp.Compile(pattern); err != nil {
+		return fmt.Errorf("invalid asset_pattern %q: %v", pattern, err)
+	}
+	return nil
+}
+
+// brotliAvailable reports whether an nginx brotli module is enabled, as
+// installed by the libnginx-mod-http-brotli-* packages
+func brotliAvailable() bool {
+	matches, _ := filepath.Glob("/etc/nginx/modules-enabled/*brotli*")
+	return len(matches) > 0
+}
+
+// nginxCompression renders gzip, and brotli when the module is loaded,
+// unless the deployment turned compression off
+func nginxCompression(deployment Deployment) string {
+	if deployment.Compression != nil && !*deployment.Compression {
+		return ""
+	}
+	config := fmt.Sprintf(`
+    # Compression
+    gzip on;
+    gzip_vary on;
+    gzip_proxied any;
+    gzip_comp_level 5;
+    gzip_min_length 256;
+    gzip_types %s;
+`, compressibleTypes)
+	if brotliAvailable() {
+		config += fmt.Sprintf(`    brotli on;
+    brotli_comp_level 5;
+    brotli_min_length 256;
+    brotli_types %s;
+`, compressibleTypes)
+	}
+	return config
+}
+
+// nginxAssetCaching renders a location marking fingerprinted assets as
+// immutable. body serves the request, as location / does.
+func nginxAssetCaching(deployment Deployment, body string) string {
+	if deployment.AssetCaching != nil && !*deployment.AssetCaching {
+		return ""
+	}
+	pattern := deployment.AssetPattern
+	if pattern == "" {
+		pattern = DefaultAssetPattern
+	}
+	return fmt.Sprintf(`
+    # Fingerprinted assets never change, let browsers keep them
+    location ~* "%s" {
+%s
+        add_header Cache-Control "public, max-age=31536000, immutable" always;
+    }
+`, pattern, body)
+}
@@ -0,0 +1,58 @@
+package docker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errBuildOutOfMemory replaces the generic failure of a build the kernel
+// killed for lack of memory
+var errBuildOutOfMemory = errors.New("build ran out of memory; consider enabling swap or reducing parallelism")
+
+// oomMarkers are what docker and BuildKit print when a build step is
+// OOM-killed
+var oomMarkers = []string{
+	"exit code: 137",
+	"exit code 137",
+	"signal: killed",
+	"cannot allocate memory",
+	"out of memory",
+	"resourceexhausted",
+}
+
+// isOutOfMemory reports whether a failed build was killed for lack of memory
+func isOutOfMemory(err error) bool {
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	if cmdErr.ExitCode == 137 {
+		return true
+	}
+	output := strings.ToLower(cmdErr.Output)
+	for _, marker := range oomMarkers {
+		if strings.Contains(output, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildFailure turns an OOM-killed build into errBuildOutOfMemory, logging
+// the host's memory and swap so the fix is obvious
+func buildFailure(err error, sendLog func(string)) error {
+	if !isOutOfMemory(err) {
+		return err
+	}
+	var stats SystemStats
+	if readMemInfo(&stats) == nil {
+		swap := "no swap"
+		if stats.SwapTotalBytes > 0 {
+			swap = formatBytes(int64(stats.SwapTotalBytes)) + " of swap"
+		}
+		sendLog(fmt.Sprintf("[DEPLOY] The build was killed for lack of memory, the host has %s of memory and %s",
+			formatBytes(int64(stats.MemoryTotalBytes)), swap))
+	}
+	return fmt.Errorf("%w: %w", errBuildOutOfMemory, err)
+}
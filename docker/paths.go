@@ -0,0 +1,69 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FallbackBaseDir holds workspaces and certificates when no base dir is
+// configured and the home directory can't be determined, as under systemd
+// with DynamicUser
+const FallbackBaseDir = "/var/lib/erebrus"
+
+var (
+	baseDirOverride string
+	fallbackOnce    sync.Once
+)
+
+// SetBaseDir makes dir hold workspaces and certificates instead of the home
+// directory. It must be called before anything is deployed.
+func SetBaseDir(dir string) {
+	baseDirOverride = dir
+}
+
+// BaseDir returns the directory holding deployments/ and certs/: the
+// configured base dir, else the home directory, else FallbackBaseDir
+func BaseDir() string {
+	if baseDirOverride != "" {
+		return baseDirOverride
+	}
+	homeDir, err := os.UserHomeDir()
+	if err == nil {
+		return homeDir
+	}
+	fallbackOnce.Do(func() {
+		fmt.Printf("[SERVER] Home directory unavailable (%v), using %s\n", err, FallbackBaseDir)
+	})
+	return FallbackBaseDir
+}
+
+// CertDir returns the directory holding the CA and management certificates
+func CertDir() string {
+	return filepath.Join(BaseDir(), "certs")
+}
+
+// deploymentsRoot returns the directory holding every project workspace
+func deploymentsRoot() (string, error) {
+	return filepath.Join(BaseDir(), "deployments"), nil
+}
+
+// workspaceDir returns the directory a project is cloned and built in
+func workspaceDir(project string) (string, error) {
+	root, err := deploymentsRoot()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, project), nil
+}
+
+// stateDir returns the directory holding the manager's own bookkeeping files.
+// It lives next to the workspaces but cannot clash with a valid project name.
+func stateDir() (string, error) {
+	root, err := deploymentsRoot()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, ".erebrus"), nil
+}
@@ -0,0 +1,99 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DeployContext carries a deployment through the pipeline stages
+type DeployContext struct {
+	Deployment Deployment
+	DeployID   string
+	// WorkDir is the project workspace, set by the workspace stage
+	WorkDir string
+	// URL is where the app is reachable, set by the proxy stage
+	URL string
+	// Result ends the pipeline early when set by a stage
+	Result *DeploymentResult
+	// Log sends a line to the deploy's websocket session and log file
+	Log func(string)
+	// Fresh is set when the project has no successful deployment, so
+	// everything a failed deploy created can be removed
+	Fresh bool
+	// BuildTime is how long building and starting the containers took,
+	// set by the build stage
+	BuildTime time.Duration
+	// Scan is the image scan summary, set by the scan stage
+	Scan *ScanSummary
+
+	source sourceFetcher
+}
+
+// Stage is one step of a deployment. Rollback undoes what Run did and is
+// called in reverse order for completed stages when a later stage fails.
+type Stage interface {
+	Name() string
+	Run(ctx context.Context, dc *DeployContext) error
+	Rollback(ctx context.Context) error
+}
+
+// funcStage adapts a pair of functions to the Stage interface
+type funcStage struct {
+	name     string
+	run      func(ctx context.Context, dc *DeployContext) error
+	rollback func(ctx context.Context) error
+}
+
+func (s *funcStage) Name() string {
+	return s.name
+}
+
+func (s *funcStage) Run(ctx context.Context, dc *DeployContext) error {
+	return s.run(ctx, dc)
+}
+
+func (s *funcStage) Rollback(ctx context.Context) error {
+	if s.rollback == nil {
+		return nil
+	}
+	return s.rollback(ctx)
+}
+
+// runPipeline runs stages in order, logging progress and timing. When a
+// stage fails or ctx is cancelled, the stages already run are rolled back.
+func runPipeline(ctx context.Context, stages []Stage, dc *DeployContext) error {
+	var completed []Stage
+	for i, stage := range stages {
+		if err := ctx.Err(); err != nil {
+			rollbackStages(completed, dc)
+			return fmt.Errorf("deployment cancelled before %s: %v", stage.Name(), err)
+		}
+
+		dc.Log(fmt.Sprintf("[PIPELINE] Stage %d/%d: %s", i+1, len(stages), stage.Name()))
+		started := time.Now()
+		err := stage.Run(ctx, dc)
+		completed = append(completed, stage)
+		if err != nil {
+			dc.Log(fmt.Sprintf("[PIPELINE] Stage %s failed after %s", stage.Name(), time.Since(started).Round(time.Millisecond)))
+			rollbackStages(completed, dc)
+			return err
+		}
+		dc.Log(fmt.Sprintf("[PIPELINE] Stage %s done in %s", stage.Name(), time.Since(started).Round(time.Millisecond)))
+
+		if dc.Result != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+// rollbackStages undoes stages in reverse order. Rollback runs even when the
+// deploy was cancelled, so it gets a fresh context.
+func rollbackStages(stages []Stage, dc *DeployContext) {
+	for i := len(stages) - 1; i >= 0; i-- {
+		if err := stages[i].Rollback(context.Background()); err != nil {
+			dc.Log(fmt.Sprintf("[PIPELINE] Rollback of %s failed: %v", stages[i].Name(), err))
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordStage returns a stage appending its runs and rollbacks to calls
+func recordStage(name string, calls *[]string, err error) Stage {
+	return &funcStage{
+		name: name,
+		run: func(ctx context.Context, dc *DeployContext) error {
+			*calls = append(*calls, "run "+name)
+			return err
+		},
+		rollback: func(ctx context.Context) error {
+			*calls = append(*calls, "rollback "+name)
+			return nil
+		},
+	}
+}
+
+func discardLog(string) {}
+
+func TestRunPipelineRunsStagesInOrder(t *testing.T) {
+	var calls []string
+	stages := []Stage{recordStage("a", &calls, nil), recordStage("b", &calls, nil), recordStage("c", &calls, nil)}
+
+	if err := runPipeline(context.Background(), stages, &DeployContext{Log: discardLog}); err != nil {
+		t.Fatalf("runPipeline: %v", err)
+	}
+	if want := []string{"run a", "run b", "run c"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got %v, want %v", calls, want)
+	}
+}
+
+func TestRunPipelineRollsBackInReverseOrder(t *testing.T) {
+	var calls []string
+	failure := errors.New("build failed")
+	stages := []Stage{
+		recordStage("a", &calls, nil),
+		recordStage("b", &calls, nil),
+		recordStage("c", &calls, failure),
+		recordStage("d", &calls, nil),
+	}
+
+	if err := runPipeline(context.Background(), stages, &DeployContext{Log: discardLog}); err != failure {
+		t.Fatalf("got error %v, want %v", err, failure)
+	}
+	// The failed stage is rolled back too, it may have done part of its work
+	want := []string{"run a", "run b", "run c", "rollback c", "rollback b", "rollback a"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Errorf("got %v, want %v", calls, want)
+	}
+}
+
+func TestRunPipelineStopsWhenCancelled(t *testing.T) {
+	var calls []string
+	ctx, cancel := context.WithCancel(context.Background())
+	stages := []Stage{
+		recordStage("a", &calls, nil),
+		&funcStage{name: "b", run: func(ctx context.Context, dc *DeployContext) error {
+			calls = append(calls, "run b")
+			cancel()
+			return nil
+		}},
+		recordStage("c", &calls, nil),
+	}
+
+	err := runPipeline(ctx, stages, &DeployContext{Log: discardLog})
+	if err == nil || !strings.Contains(err.Error(), "cancelled before c") {
+		t.Fatalf("got error %v, want the deployment cancelled before c", err)
+	}
+	if want := []string{"run a", "run b", "rollback a"}; !reflect.DeepEqual(calls, want) {
+		t.Errorf("got %v, want %v", calls, want)
+	}
+}
+
+func TestRunPipelinePassesContextBetweenStages(t *testing.T) {
+	var seen []string
+	stages := []Stage{
+		&funcStage{name: "workspace", run: func(ctx context.Context, dc *DeployContext) error {
+			dc.WorkDir = "/srv/app"
+			return nil
+		}},
+		&funcStage{name: "proxy", run: func(ctx context.Context, dc *DeployContext) error {
+			seen = append(seen, dc.WorkDir)
+			dc.URL = "http://" + dc.Deployment.ProjectName + ".example.com"
+			return nil
+		}},
+		&funcStage{name: "finalize", run: func(ctx context.Context, dc *DeployContext) error {
+			seen = append(seen, dc.URL)
+			dc.Result = &DeploymentResult{URL: dc.URL}
+			return nil
+		}},
+		&funcStage{name: "unreached", run: func(ctx context.Context, dc *DeployContext) error {
+			t.Error("a stage ran after the result was set")
+			return nil
+		}},
+	}
+
+	dc := &DeployContext{Deployment: Deployment{ProjectName: "app"}, Log: discardLog}
+	if err := runPipeline(context.Background(), stages, dc); err != nil {
+		t.Fatalf("runPipeline: %v", err)
+	}
+	if want := []string{"/srv/app", "http://app.example.com"}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("later stages saw %v, want %v", seen, want)
+	}
+	if dc.Result == nil || dc.Result.URL != "http://app.example.com" {
+		t.Errorf("got result %+v", dc.Result)
+	}
+}
+
+// TestDeployStagesOnFixture runs the real stages against a fixture repo,
+// failing the container start so the completed stages are rolled back
+func TestDeployStagesOnFixture(t *testing.T) {
+	d, runner := newTestSetup(t, 43150)
+	source := t.TempDir()
+	if err := os.WriteFile(filepath.Join(source, "Dockerfile"), []byte("FROM scratch\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d.LocalPathRoot = filepath.Dir(source)
+	runner.Errors["docker compose up --no-build -d --remove-orphans"] = errors.New("exit status 1")
+
+	var logs []string
+	_, err := d.deploy(context.Background(), Deployment{ProjectName: "fixture", LocalPath: source, Proxy: ProxyNone}, "d1", func(line string) {
+		logs = append(logs, line)
+	})
+	if err == nil {
+		t.Fatal("deploy succeeded, want the container start failure")
+	}
+
+	var stages []string
+	for _, line := range logs {
+		if _, name, ok := strings.Cut(line, "[PIPELINE] Stage "); ok && strings.Contains(name, ": ") {
+			stages = append(stages, name[strings.Index(name, ": ")+2:])
+		}
+	}
+	if want := []string{"validate", "port", "workspace", "source", "dockerfile", "compose", "build"}; !reflect.DeepEqual(stages, want) {
+		t.Errorf("got stages %v, want %v", stages, want)
+	}
+
+	assertCommands(t, runner.Commands(), []string{
+		"docker compose build",
+		"docker compose up --no-build -d --remove-orphans",
+		"docker compose down --remove-orphans",
+	})
+	dir, err := workspaceDir("fixture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "Dockerfile")); !os.IsNotExist(err) {
+		t.Errorf("workspace of the failed fresh deploy was not cleared: %v", err)
+	}
+	if portHeld("43150") {
+		t.Error("port of the failed deploy is still held")
+	}
+}
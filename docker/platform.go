@@ -0,0 +1,39 @@
+package docker
+
+import (
+	"fmt"
+	"regexp"
+	"runtime"
+)
+
+// platformPattern matches os/arch with an optional variant, e.g.
+// linux/amd64 or linux/arm/v7
+var platformPattern = regexp.MustCompile(`^[a-z0-9]+/[a-z0-9_]+(/[a-z0-9]+)?$`)
+
+// validatePlatform checks the platform is one docker can parse
+func validatePlatform(deployment Deployment) error {
+	if deployment.Platform == "" {
+		return nil
+	}
+	if deployment.Static {
+		return fmt.Errorf("platform is not supported for static deployments, they have no image")
+	}
+	if !platformPattern.MatchString(deployment.Platform) {
+		return fmt.Errorf("invalid platform %q, expected os/arch such as linux/amd64 or linux/arm64", deployment.Platform)
+	}
+	return nil
+}
+
+// hostPlatform is the platform images are built and pulled for by default
+func hostPlatform() string {
+	return "linux/" + runtime.GOARCH
+}
+
+// composePlatform renders the app service's platform, which compose applies
+// to both the build and the pull. Empty leaves docker on the host platform.
+func composePlatform(platform string) string {
+	if platform == "" {
+		return ""
+	}
+	return fmt.Sprintf("    platform: \"%s\"\n", platform)
+}
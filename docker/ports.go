@@ -0,0 +1,137 @@
+package docker
+
+import (
+	"fmt"
+	mathrand "math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	// portsMutex guards usedPorts and portHolds
+	portsMutex sync.Mutex
+	// portHolds are listeners keeping claimed ports bound until the
+	// deployment's container takes them over
+	portHolds = make(map[string][]net.Listener)
+)
+
+// maxPortBackoff caps the jittered wait after losing a port to another process
+const maxPortBackoff = 50 * time.Millisecond
+
+// holdPort binds a port on every address family deployments publish on, so
+// nothing else can take it between choosing it and compose binding it
+func holdPort(port string) bool {
+	listener, err := net.Listen("tcp4", "0.0.0.0:"+port)
+	if err != nil {
+		return false
+	}
+	listeners := []net.Listener{listener}
+	if ipv6Enabled {
+		listener, err := net.Listen("tcp6", "[::]:"+port)
+		if err != nil {
+			listeners[0].Close()
+			return false
+		}
+		listeners = append(listeners, listener)
+	}
+	portHolds[port] = listeners
+	return true
+}
+
+// releasePort closes the listeners holding a port, right before the
+// container binds it or when the deployment gives the port up
+func releasePort(port string) {
+	portsMutex.Lock()
+	defer portsMutex.Unlock()
+	for _, listener := range portHolds[port] {
+		listener.Close()
+	}
+	delete(portHolds, port)
+}
+
+// portHeld reports whether a port is still held for a deployment
+func portHeld(port string) bool {
+	portsMutex.Lock()
+	defer portsMutex.Unlock()
+	return portHolds[port] != nil
+}
+
+// claimPort reserves the requested port for a deployment, or the next free
+// one when it is reserved, in use or empty, and holds it until released. A
+// port the project's running containers publish is kept without a hold, as
+// they hand it over on redeploy. Ports are probed without portsMutex, which
+// is only taken to re-check and record the claim.
+func (d *DockerSetup) claimPort(requested string, mapping PortMapping) string {
+	if requested != "" {
+		if d.projectPublishesPort(mapping.ProjectName, requested) {
+			if recordPort(requested, mapping, false) {
+				return requested
+			}
+		} else if d.isPortAvailable(requested) && recordPort(requested, mapping, true) {
+			return requested
+		}
+	}
+	return d.nextAvailablePort(func(port string) bool {
+		return recordPort(port, mapping, true)
+	})
+}
+
+// recordPort assigns a port to a deployment, binding it with hold set, unless
+// it was reserved, assigned to another project or bound since it was probed.
+// Any other port the project had is released.
+func recordPort(port string, mapping PortMapping, hold bool) bool {
+	portsMutex.Lock()
+	defer portsMutex.Unlock()
+	if current, ok := usedPorts[port]; ok && (current.Reserved || current.ProjectName != mapping.ProjectName) {
+		return false
+	}
+	if hold && !holdPort(port) {
+		return false
+	}
+	for stale, current := range usedPorts {
+		if stale != port && !current.Reserved && current.ProjectName == mapping.ProjectName {
+			delete(usedPorts, stale)
+		}
+	}
+	mapping.Port = port
+	usedPorts[port] = mapping
+	return true
+}
+
+// forgetPort drops a project's claim on a port
+func forgetPort(port, project string) {
+	releasePort(port)
+	portsMutex.Lock()
+	defer portsMutex.Unlock()
+	if mapping, ok := usedPorts[port]; ok && mapping.ProjectName == project {
+		delete(usedPorts, port)
+	}
+}
+
+// nextAvailablePort scans for a port neither assigned nor bound. With claim
+// set the port is only returned once claim takes it; a port that checks free
+// but can't be claimed was just taken by another deploy or process, so the
+// scan backs off for a jittered moment to let competing scans spread out.
+func (d *DockerSetup) nextAvailablePort(claim func(port string) bool) string {
+	attempts := 0
+	for port := startingPort; ; port++ {
+		portStr := fmt.Sprintf("%d", port)
+		// Check if port is used by our deployments and system
+		portsMutex.Lock()
+		_, assigned := usedPorts[portStr]
+		portsMutex.Unlock()
+		if assigned || !d.isPortAvailable(portStr) {
+			continue
+		}
+		if claim == nil || claim(portStr) {
+			return portStr
+		}
+		attempts++
+		backoff := time.Duration(attempts) * 5 * time.Millisecond
+		if backoff > maxPortBackoff {
+			backoff = maxPortBackoff
+		}
+		time.Sleep(backoff/2 + time.Duration(mathrand.Int63n(int64(backoff/2)+1)))
+	}
+}
@@ -0,0 +1,81 @@
+package docker
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestClaimPortConcurrently(t *testing.T) {
+	d, _ := newTestSetup(t, 43900)
+	t.Cleanup(func() {
+		portsMutex.Lock()
+		usedPorts = make(map[string]PortMapping)
+		portsMutex.Unlock()
+	})
+
+	ports := make([]string, 8)
+	var claims sync.WaitGroup
+	for i := range ports {
+		claims.Add(1)
+		go func(i int) {
+			defer claims.Done()
+			ports[i] = d.claimPort("43900", PortMapping{ProjectName: fmt.Sprintf("app%d", i)})
+		}(i)
+	}
+	claims.Wait()
+
+	seen := make(map[string]bool)
+	for _, port := range ports {
+		if seen[port] {
+			t.Errorf("port %s claimed twice: %v", port, ports)
+		}
+		seen[port] = true
+		if !portHeld(port) {
+			t.Errorf("port %s claimed but not held", port)
+		}
+		releasePort(port)
+	}
+	if !seen["43900"] {
+		t.Errorf("no deploy got the requested port 43900: %v", ports)
+	}
+}
+
+func TestRedeployKeepsItsPort(t *testing.T) {
+	d, runner := newTestSetup(t, 43910)
+	t.Cleanup(func() {
+		portsMutex.Lock()
+		usedPorts = make(map[string]PortMapping)
+		portsMutex.Unlock()
+	})
+
+	first, err := d.DeployProject(Deployment{ProjectName: "web", Image: "nginx:1.27", Proxy: ProxyNone})
+	if err != nil {
+		t.Fatalf("DeployProject: %v", err)
+	}
+	// The running app now publishes its port
+	published := []byte("0.0.0.0:" + first.Port + "->8080/tcp, :::" + first.Port + "->8080/tcp\n")
+	runner.Outputs["docker ps --format {{.Ports}}"] = published
+	runner.Outputs["docker ps --filter label=com.docker.compose.project=web --format {{.Ports}}"] = published
+
+	second, err := d.DeployProject(Deployment{ProjectName: "web", Image: "nginx:1.27", Proxy: ProxyNone, Port: first.Port})
+	if err != nil {
+		t.Fatalf("DeployProject: %v", err)
+	}
+	if second.Port != first.Port {
+		t.Errorf("redeploy moved from port %s to %s", first.Port, second.Port)
+	}
+
+	// A port change releases the old one
+	third, err := d.DeployProject(Deployment{ProjectName: "web", Image: "nginx:1.27", Proxy: ProxyNone, Port: "43950"})
+	if err != nil {
+		t.Fatalf("DeployProject: %v", err)
+	}
+	portsMutex.Lock()
+	defer portsMutex.Unlock()
+	for port, mapping := range usedPorts {
+		if mapping.ProjectName == "web" && port != third.Port {
+			t.Errorf("stale port %s still assigned to web", port)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// PreflightCheck is the outcome of one preflight check
+type PreflightCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// PreflightReport tells whether a deployment would get past the checks
+// that don't need a build
+type PreflightReport struct {
+	Deployable bool             `json:"deployable"`
+	Checks     []PreflightCheck `json:"checks"`
+	// Commit is the commit the repository resolved to
+	Commit string `json:"commit,omitempty"`
+	// Dockerfile is where the Dockerfile would come from: repository,
+	// override or generated
+	Dockerfile string `json:"dockerfile,omitempty"`
+	// Language is the app's language, guessed from its manifest files
+	Language string `json:"language,omitempty"`
+	Port     string `json:"port,omitempty"`
+}
+
+func (r *PreflightReport) check(name string, err error, detail string) bool {
+	check := PreflightCheck{Name: name, OK: err == nil, Detail: detail}
+	if err != nil {
+		check.Detail = err.Error()
+		r.Deployable = false
+	}
+	r.Checks = append(r.Checks, check)
+	return err == nil
+}
+
+// languageMarkers maps manifest files to the language they imply, in the
+// order they are checked
+var languageMarkers = []struct {
+	file     string
+	language string
+}{
+	{"package.json", "node"},
+	{"go.mod", "go"},
+	{"requirements.txt", "python"},
+	{"pyproject.toml", "python"},
+	{"Gemfile", "ruby"},
+	{"pom.xml", "java"},
+	{"build.gradle", "java"},
+	{"Cargo.toml", "rust"},
+	{"composer.json", "php"},
+}
+
+// detectLanguage guesses an app's language from its manifest files
+func detectLanguage(dir string) string {
+	for _, marker := range languageMarkers {
+		if _, err := os.Stat(filepath.Join(dir, marker.file)); err == nil {
+			return marker.language
+		}
+	}
+	return ""
+}
+
+// Preflight runs the cheap checks of a deploy: the spec is valid, the source
+// can be fetched, a Dockerfile exists or can be generated and the port is
+// free. Git sources are cloned into a temporary directory that is removed
+// afterwards; nothing is built and no project state is written.
+func (d *DockerSetup) Preflight(deployment Deployment) *PreflightReport {
+	report := &PreflightReport{Deployable: true, Checks: []PreflightCheck{}}
+
+	source, err := d.validateDeployment(&deployment)
+	if !report.check("spec", err, "") {
+		return report
+	}
+
+	// Local paths are inspected in place, git sources in a scratch clone
+	var dir string
+	switch fetcher := source.(type) {
+	case *gitSource:
+		scratch, err := os.MkdirTemp("", "erebrus-preflight-")
+		if !report.check("clone", err, "") {
+			return report
+		}
+		defer os.RemoveAll(scratch)
+		err = fetcher.fetch(scratch)
+		if err == nil && deployment.Commit != "" {
+			err = d.checkoutCommit(scratch, deployment.Commit)
+		}
+		detail := fmt.Sprintf("cloned %s", newRedactor(deployment)(fetcher.remote))
+		if !report.check("clone", err, detail) {
+			return report
+		}
+		report.Commit, _ = d.headCommit(scratch)
+		dir = scratch
+	case *localSource:
+		report.check("source", nil, fmt.Sprintf("local directory %s", fetcher.path))
+		dir = fetcher.path
+	default:
+		report.check("source", nil, source.describe())
+	}
+
+	if dir != "" {
+		report.Language = detectLanguage(dir)
+		if deployment.Static {
+			report.check("build", nil, "static site")
+		} else if deployment.Image == "" {
+			report.Dockerfile, err = preflightDockerfile(dir, deployment)
+			report.check("dockerfile", err, report.Dockerfile)
+		}
+	}
+
+	if auth := d.registryAuth(deployment); auth != nil && !deployment.Static {
+		logout, err := d.registryLogin(auth, func(string) {})
+		if err == nil {
+			logout()
+		}
+		report.check("registry", err, "logged in to the registry")
+	}
+
+	if !deployment.Static {
+		report.Port = deployment.Port
+		switch {
+		case report.Port == "":
+			report.Port = d.getNextAvailablePort()
+			report.check("port", nil, fmt.Sprintf("port %s would be assigned", report.Port))
+		case isPortReserved(report.Port), !d.isPortAvailable(report.Port):
+			requested := report.Port
+			report.Port = d.getNextAvailablePort()
+			report.check("port", nil, fmt.Sprintf("port %s is taken, port %s would be assigned", requested, report.Port))
+		default:
+			report.check("port", nil, fmt.Sprintf("port %s is available", report.Port))
+		}
+	}
+	return report
+}
+
+// preflightDockerfile returns where a deploy would take the Dockerfile from,
+// failing when none exists and the app isn't one we can generate one for
+func preflightDockerfile(dir string, deployment Deployment) (string, error) {
+	path, source, err := dockerfileFor(dir, deployment)
+	if err != nil {
+		return "", err
+	}
+	if deployment.DockerfilePath != "" && source != DockerfileOverride && path != deployment.DockerfilePath {
+		return "", fmt.Errorf("dockerfile_path %s does not exist", deployment.DockerfilePath)
+	}
+	if source != DockerfileGenerated {
+		return source, nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, "package.json")); err == nil {
+		return DockerfileGenerated, nil
+	}
+	if language := detectLanguage(dir); language != "" {
+		return "", fmt.Errorf("no Dockerfile, and one can only be generated for node apps, not %s", language)
+	}
+	return "", fmt.Errorf("no Dockerfile, and no package.json to generate one from")
+}
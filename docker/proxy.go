@@ -0,0 +1,206 @@
+package docker
+
+import (
+	"fmt"
+	"net"
+)
+
+// Reverse proxy modes a deployment can be exposed through
+const (
+	ProxyNginx   = "nginx"
+	ProxyTraefik = "traefik"
+	ProxyNone    = "none"
+)
+
+// ValidateProxy rejects unknown proxy modes
+func ValidateProxy(proxy string) error {
+	switch proxy {
+	case ProxyNginx, ProxyTraefik, ProxyNone:
+		return nil
+	}
+	return fmt.Errorf("unknown proxy %q", proxy)
+}
+
+// ReverseProxy exposes deployed apps to the outside world
+type ReverseProxy interface {
+	// Configure routes traffic for a deployment to its app
+	Configure(deployment Deployment) error
+	// Remove drops whatever Configure set up for a project
+	Remove(project string) error
+}
+
+// reverseProxy returns the implementation of a proxy mode
+func (d *DockerSetup) reverseProxy(mode string) ReverseProxy {
+	switch mode {
+	case ProxyNone:
+		return &directProxy{d: d}
+	case ProxyTraefik:
+		return &traefikProxy{d: d}
+	default:
+		return &nginxProxy{d: d}
+	}
+}
+
+// nginxProxy writes a site per project into the system nginx
+type nginxProxy struct {
+	d *DockerSetup
+}
+
+func (p *nginxProxy) Configure(deployment Deployment) error {
+	return p.d.configureNginx(deployment)
+}
+
+func (p *nginxProxy) Remove(project string) error {
+	return p.d.removeNginxConfig(project)
+}
+
+// traefikProxy relies on the labels rendered into the compose file, so
+// there is nothing to configure or remove outside the containers
+type traefikProxy struct {
+	d *DockerSetup
+}
+
+func (p *traefikProxy) Configure(deployment Deployment) error {
+	return nil
+}
+
+func (p *traefikProxy) Remove(project string) error {
+	return nil
+}
+
+// directProxy exposes the app on its host port without a proxy
+type directProxy struct {
+	d *DockerSetup
+}
+
+func (p *directProxy) Configure(deployment Deployment) error {
+	return nil
+}
+
+func (p *directProxy) Remove(project string) error {
+	return nil
+}
+
+// proxyFor returns the proxy a deployment uses, falling back to the server default
+func (d *DockerSetup) proxyFor(deployment Deployment) string {
+	if deployment.Proxy != "" {
+		return deployment.Proxy
+	}
+	if d.DefaultProxy != "" {
+		return d.DefaultProxy
+	}
+	return ProxyNginx
+}
+
+// buildDeploymentURL returns the address a deployment is actually reachable
+// on. Nginx and Traefik terminate TLS, so their URLs are https on the
+// routed host; a custom domain only applies to Traefik, as nginx serves
+// <host label>.localhost. Without a proxy the app is plain http on its host
+// port.
+func (d *DockerSetup) buildDeploymentURL(deployment Deployment) string {
+	switch d.proxyFor(deployment) {
+	case ProxyNone:
+		return fmt.Sprintf("http://%s", net.JoinHostPort(d.hostAddress(), deployment.Port))
+	case ProxyTraefik:
+		return fmt.Sprintf("https://%s", deploymentDomain(deployment))
+	default:
+		return fmt.Sprintf("https://%s.localhost", hostLabel(deployment))
+	}
+}
+
+// hostAddress returns the address deployments without a proxy are reached on
+func (d *DockerSetup) hostAddress() string {
+	if d.PublicHost != "" {
+		return d.PublicHost
+	}
+	// No packets are sent; dialing UDP just selects the outbound interface
+	conn, err := net.Dial("udp", "8.8.8.8:80")
+	if err != nil {
+		return "localhost"
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
+// Protocols the proxy can speak to a deployed app
+const (
+	ProtocolHTTP1 = "http1"
+	ProtocolHTTP2 = "http2"
+	ProtocolGRPC  = "grpc"
+)
+
+// validateProxyProtocol rejects unknown protocols and ones the selected
+// proxy can't honour
+func validateProxyProtocol(deployment Deployment) error {
+	switch deployment.ProxyProtocol {
+	case "", ProtocolHTTP1:
+		return nil
+	case ProtocolHTTP2, ProtocolGRPC:
+		if deployment.Proxy == ProxyNone {
+			return fmt.Errorf("proxy_protocol %q needs a proxy", deployment.ProxyProtocol)
+		}
+		if deployment.Static {
+			return fmt.Errorf("proxy_protocol %q is not supported for static deployments", deployment.ProxyProtocol)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown proxy_protocol %q", deployment.ProxyProtocol)
+}
+
+// validateWebSocketApp rejects websocket_app where there is no proxied
+// HTTP connection to tune
+func validateWebSocketApp(deployment Deployment) error {
+	if !deployment.WebSocketApp {
+		return nil
+	}
+	if deployment.Static {
+		return fmt.Errorf("websocket_app is not supported for static deployments")
+	}
+	if deployment.ProxyProtocol == ProtocolGRPC {
+		return fmt.Errorf("websocket_app can't be combined with proxy_protocol %q", ProtocolGRPC)
+	}
+	return nil
+}
+
+// nginxUpstream renders the location directives passing requests to the
+// app. nginx only speaks HTTP/1.1 to plain upstreams, so http2 only changes
+// the client side; grpc uses grpc_pass over h2c.
+func nginxUpstream(deployment Deployment) string {
+	if deployment.ProxyProtocol == ProtocolGRPC {
+		return fmt.Sprintf(`        grpc_pass grpc://localhost:%s;
+        grpc_set_header Host $host;
+        grpc_set_header X-Real-IP $remote_addr;
+        grpc_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        grpc_set_header X-Forwarded-Proto $scheme;
+`, deployment.Port)
+	}
+	return fmt.Sprintf(`        proxy_pass http://localhost:%s;
+        proxy_http_version 1.1;
+        proxy_set_header Upgrade $http_upgrade;
+        proxy_set_header Connection 'upgrade';
+        proxy_set_header Host $host;
+        proxy_cache_bypass $http_upgrade;
+        
+        proxy_set_header X-Real-IP $remote_addr;
+        proxy_set_header X-Forwarded-For $proxy_add_x_forwarded_for;
+        proxy_set_header X-Forwarded-Proto $scheme;
+%s        `, deployment.Port, nginxWebSocketTuning(deployment))
+}
+
+// websocketTimeout is how long nginx keeps an idle upstream connection of a
+// WebSocket app open, instead of its 60 second default
+const websocketTimeout = "1h"
+
+// nginxWebSocketTuning keeps long lived connections of WebSocket apps open
+// and unbuffered
+func nginxWebSocketTuning(deployment Deployment) string {
+	if !deployment.WebSocketApp {
+		return ""
+	}
+	return fmt.Sprintf(`
+        # Long lived WebSocket connections
+        proxy_read_timeout %[1]s;
+        proxy_send_timeout %[1]s;
+        proxy_buffering off;
+`, websocketTimeout)
+}
@@ -0,0 +1,88 @@
+package docker
+
+import "testing"
+
+func TestBuildDeploymentURL(t *testing.T) {
+	tests := []struct {
+		name         string
+		publicHost   string
+		defaultProxy string
+		deployment   Deployment
+		want         string
+	}{
+		{
+			name:       "no proxy on an IP",
+			publicHost: "203.0.113.7",
+			deployment: Deployment{ProjectName: "app", Port: "3000", Proxy: ProxyNone},
+			want:       "http://203.0.113.7:3000",
+		},
+		{
+			name:       "no proxy on an IPv6 address",
+			publicHost: "2001:db8::7",
+			deployment: Deployment{ProjectName: "app", Port: "3000", Proxy: ProxyNone},
+			want:       "http://[2001:db8::7]:3000",
+		},
+		{
+			name:       "no proxy on a hostname with a custom port",
+			publicHost: "vps.example.com",
+			deployment: Deployment{ProjectName: "app", Port: "8443", Proxy: ProxyNone},
+			want:       "http://vps.example.com:8443",
+		},
+		{
+			name:       "no proxy ignores the domain",
+			publicHost: "203.0.113.7",
+			deployment: Deployment{ProjectName: "app", Port: "3000", Domain: "app.example.com", Proxy: ProxyNone},
+			want:       "http://203.0.113.7:3000",
+		},
+		{
+			name:       "nginx",
+			deployment: Deployment{ProjectName: "app", Port: "3000", Proxy: ProxyNginx},
+			want:       "https://app.localhost",
+		},
+		{
+			name:       "nginx ignores the domain and port",
+			deployment: Deployment{ProjectName: "app", Port: "8443", Domain: "app.example.com", Proxy: ProxyNginx},
+			want:       "https://app.localhost",
+		},
+		{
+			name:       "nginx environment",
+			deployment: Deployment{ProjectName: "app-staging", Environment: "staging", Proxy: ProxyNginx},
+			want:       "https://staging.app.localhost",
+		},
+		{
+			name:       "traefik domain",
+			deployment: Deployment{ProjectName: "app", Port: "3000", Domain: "app.example.com", Proxy: ProxyTraefik},
+			want:       "https://app.example.com",
+		},
+		{
+			name:       "traefik without a domain",
+			deployment: Deployment{ProjectName: "app", Proxy: ProxyTraefik},
+			want:       "https://app.localhost",
+		},
+		{
+			name:       "traefik environment without a domain",
+			deployment: Deployment{ProjectName: "app-staging", Environment: "staging", Proxy: ProxyTraefik},
+			want:       "https://staging.app.localhost",
+		},
+		{
+			name:         "default proxy applies when none is set",
+			publicHost:   "203.0.113.7",
+			defaultProxy: ProxyNone,
+			deployment:   Deployment{ProjectName: "app", Port: "3000"},
+			want:         "http://203.0.113.7:3000",
+		},
+		{
+			name:       "nginx without any default",
+			deployment: Deployment{ProjectName: "app", Port: "3000"},
+			want:       "https://app.localhost",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := &DockerSetup{PublicHost: tt.publicHost, DefaultProxy: tt.defaultProxy}
+			if got := d.buildDeploymentURL(tt.deployment); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
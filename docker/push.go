@@ -0,0 +1,171 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// PushRegistry is where images of deployments with push set are pushed to
+type PushRegistry struct {
+	// Repository prefixes pushed images, e.g. ghcr.io/acme/erebrus
+	Repository string
+	// Auth logs in for pushes and for pulling pushed images back
+	Auth *RegistryAuth
+}
+
+var (
+	pushRepositoryPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9._:-]*[a-z0-9])?(/[a-z0-9]([a-z0-9._-]*[a-z0-9])?)*$`)
+	imageReferencePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9._:/-]*[a-z0-9])?(:[A-Za-z0-9_][A-Za-z0-9_.-]{0,127})?(@sha256:[0-9a-f]{64})?$`)
+)
+
+// ValidatePushRegistry checks the repository can prefix image names
+func ValidatePushRegistry(registry *PushRegistry) error {
+	if registry == nil {
+		return nil
+	}
+	if !pushRepositoryPattern.MatchString(registry.Repository) {
+		return fmt.Errorf("invalid repository: %q", registry.Repository)
+	}
+	return ValidateRegistryAuth(registry.Auth)
+}
+
+// validateImage checks push and image against the rest of the deployment
+func (d *DockerSetup) validateImage(deployment Deployment) error {
+	if deployment.Push && d.PushRegistry == nil {
+		return fmt.Errorf("push needs a registry, set EREBRUS_PUSH_REPOSITORY")
+	}
+	if deployment.Push && (deployment.Static || deployment.Image != "") {
+		return fmt.Errorf("push only applies to images built from source")
+	}
+	if deployment.Image == "" {
+		return nil
+	}
+	if !imageReferencePattern.MatchString(deployment.Image) {
+		return fmt.Errorf("invalid image reference: %q", deployment.Image)
+	}
+	if deployment.Static {
+		return fmt.Errorf("image can't be combined with static")
+	}
+	if deployment.PreDeployCmd != "" {
+		return fmt.Errorf("pre_deploy_cmd is not supported for image deployments")
+	}
+	return nil
+}
+
+// remoteImage is the reference a deploy's image is pushed under
+func (d *DockerSetup) remoteImage(project, deployID string) string {
+	return fmt.Sprintf("%s/%s:%s", d.PushRegistry.Repository, composeProjectName(project), deployID)
+}
+
+// deployImage is the image the app service runs: the pulled image of image
+// deployments, otherwise the local build tagged with the deploy ID
+func deployImage(deployment Deployment, deployID string) string {
+	if deployment.Image != "" {
+		return deployment.Image
+	}
+	return imageRepository(deployment.ProjectName) + ":" + deployID
+}
+
+// pullAuth returns the credentials used to pull an image deployment's image:
+// its own, the push registry's for images pushed there, or the server-wide ones
+func (d *DockerSetup) pullAuth(deployment Deployment) *RegistryAuth {
+	if deployment.Registry == nil && d.PushRegistry != nil && d.PushRegistry.Auth != nil &&
+		strings.HasPrefix(deployment.Image, d.PushRegistry.Repository+"/") {
+		return d.PushRegistry.Auth
+	}
+	return d.registryAuth(deployment)
+}
+
+// pushStage tags the freshly built image for the push registry and pushes
+// it, recording the remote reference so it can be deployed elsewhere
+func (d *DockerSetup) pushStage(ctx context.Context, dc *DeployContext) error {
+	deployment := dc.Deployment
+	if !deployment.Push {
+		return nil
+	}
+
+	local := deployImage(deployment, dc.DeployID)
+	remote := d.remoteImage(deployment.ProjectName, dc.DeployID)
+	if auth := d.PushRegistry.Auth; auth != nil {
+		logout, err := d.registryLogin(auth, dc.Log)
+		if err != nil {
+			return fmt.Errorf("failed to authenticate with the push registry: %v", err)
+		}
+		defer logout()
+	}
+
+	dc.Log(fmt.Sprintf("[PUSH] Pushing %s", remote))
+	if err := d.runCommand("docker", "tag", local, remote); err != nil {
+		return fmt.Errorf("failed to tag image: %v", err)
+	}
+	// The remote tag is only needed for the push
+	defer d.runCommand("docker", "rmi", remote)
+	if err := d.streamCommand(exec.Command("docker", "push", remote), "[PUSH]", dc.Log); err != nil {
+		return fmt.Errorf("failed to push image: %v", err)
+	}
+
+	if err := UpdateProjectState(deployment.ProjectName, func(state *ProjectState) {
+		state.PushedImages = append(state.PushedImages, remote)
+	}); err != nil {
+		dc.Log(fmt.Sprintf("[PUSH] Failed to record the pushed image: %v", err))
+	}
+	dc.Log(fmt.Sprintf("[PUSH] Pushed %s", remote))
+	return nil
+}
+
+// imageSource deploys a prebuilt image, so the workspace only holds the
+// generated compose file
+type imageSource struct {
+	image string
+}
+
+func (s *imageSource) describe() string {
+	return fmt.Sprintf("Deploying image: %s", s.image)
+}
+
+func (s *imageSource) fetch(workDir string) error {
+	if err := clearWorkspace(workDir); err != nil {
+		return fmt.Errorf("failed to clear workspace: %v", err)
+	}
+	return nil
+}
+
+// LocalImage is a build of a project still present on this host
+type LocalImage struct {
+	Tag       string `json:"tag"`
+	ID        string `json:"id"`
+	CreatedAt string `json:"created_at"`
+}
+
+// ProjectImages lists a project's local builds and the images pushed for it
+type ProjectImages struct {
+	Local  []LocalImage `json:"local"`
+	Pushed []string     `json:"pushed"`
+}
+
+// ListImages returns a project's local and pushed image tags
+func (d *DockerSetup) ListImages(project string) (*ProjectImages, error) {
+	state, err := LoadProjectState(project)
+	if err != nil {
+		return nil, err
+	}
+	out, err := d.runner.Output(exec.Command("docker", "images", imageRepository(project),
+		"--format", "{{.Tag}}\t{{.ID}}\t{{.CreatedAt}}"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %v", err)
+	}
+
+	images := &ProjectImages{Local: []LocalImage{}, Pushed: []string{}}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if fields := strings.SplitN(line, "\t", 3); len(fields) == 3 {
+			images.Local = append(images.Local, LocalImage{Tag: fields[0], ID: fields[1], CreatedAt: fields[2]})
+		}
+	}
+	if state.PushedImages != nil {
+		images.Pushed = state.PushedImages
+	}
+	return images, nil
+}
@@ -0,0 +1,109 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ReconcileReport lists what a reconcile pass found and repaired
+type ReconcileReport struct {
+	Checked  int               `json:"checked"`
+	Repaired []string          `json:"repaired"`
+	Failed   map[string]string `json:"failed,omitempty"`
+}
+
+// StartReconciler repairs drifted nginx configs now and then on every
+// interval. A zero interval only runs the startup pass.
+func (d *DockerSetup) StartReconciler(interval time.Duration) {
+	go func() {
+		d.logReconcile()
+		if interval <= 0 {
+			return
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			d.logReconcile()
+		}
+	}()
+}
+
+func (d *DockerSetup) logReconcile() {
+	report, err := d.ReconcileNginx()
+	if err != nil {
+		fmt.Printf("[RECONCILE] Failed: %v\n", err)
+		return
+	}
+	if len(report.Repaired) > 0 {
+		fmt.Printf("[RECONCILE] Restored nginx config for %v\n", report.Repaired)
+	}
+	for project, reason := range report.Failed {
+		fmt.Printf("[RECONCILE] Could not restore %s: %s\n", project, reason)
+	}
+}
+
+// ReconcileNginx regenerates the nginx site of every nginx deployment whose
+// config is missing from sites-enabled, using the stored deployment spec,
+// and reloads nginx once if anything was restored
+func (d *DockerSetup) ReconcileNginx() (*ReconcileReport, error) {
+	report := &ReconcileReport{Repaired: []string{}}
+	if d.Rootless {
+		return report, nil
+	}
+	projects, err := ListProjects()
+	if err != nil {
+		return nil, err
+	}
+
+	nginxMutex.Lock()
+	defer nginxMutex.Unlock()
+
+	for _, project := range projects {
+		state, err := LoadProjectState(project)
+		if err != nil || state.Deployment == nil || d.proxyFor(*state.Deployment) != ProxyNginx {
+			continue
+		}
+		report.Checked++
+		if _, err := os.Stat(filepath.Join("/etc/nginx/sites-enabled", project)); err == nil {
+			continue
+		}
+
+		if err := d.restoreNginxSite(*state.Deployment); err != nil {
+			if report.Failed == nil {
+				report.Failed = make(map[string]string)
+			}
+			report.Failed[project] = err.Error()
+			continue
+		}
+		report.Repaired = append(report.Repaired, project)
+	}
+
+	if len(report.Repaired) == 0 {
+		return report, nil
+	}
+	if err := d.testAndReloadNginx(report.Repaired...); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// restoreNginxSite writes a deployment's site back without reloading nginx.
+// The caller holds nginxMutex.
+func (d *DockerSetup) restoreNginxSite(deployment Deployment) error {
+	var config string
+	var err error
+	if deployment.Static {
+		config, err = d.staticNginxConfig(deployment, filepath.Join(staticRoot, deployment.ProjectName))
+	} else {
+		config, err = d.nginxConfig(deployment)
+		if err == nil {
+			err = d.writeErrorPage(deployment)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return d.writeNginxSite(deployment.ProjectName, config)
+}
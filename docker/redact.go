@@ -0,0 +1,91 @@
+package docker
+
+import (
+	"net/url"
+	"strings"
+)
+
+// minSecretLength avoids masking short values like "1" or "on" everywhere in a log
+const minSecretLength = 4
+
+// newRedactor returns a function masking the deployment's secrets (env var
+// values of the app and its services, registry and git credentials) in a
+// log line. Stored values are decrypted to
+// be found, ones that can't be are masked as stored.
+func newRedactor(deployment Deployment) func(string) string {
+	var pairs []string
+	secret := func(value string) {
+		if plain, err := decryptSecret(value); err == nil {
+			value = plain
+		}
+		if len(value) >= minSecretLength {
+			pairs = append(pairs, value, "****")
+		}
+	}
+	for _, value := range deployment.EnvVars {
+		secret(value)
+	}
+	for _, service := range deployment.Services {
+		for _, value := range service.EnvVars {
+			secret(value)
+		}
+	}
+	if deployment.Registry != nil {
+		secret(deployment.Registry.Password)
+	}
+	for _, gitURL := range append([]string{deployment.GitURL}, deployment.GitMirrors...) {
+		if u, err := url.Parse(gitURL); err == nil && u.User != nil {
+			pairs = append(pairs, u.User.String(), "****")
+			if password, ok := u.User.Password(); ok && len(password) >= minSecretLength {
+				pairs = append(pairs, password, "****")
+			}
+		}
+	}
+
+	if len(pairs) == 0 {
+		return func(line string) string { return line }
+	}
+	return strings.NewReplacer(pairs...).Replace
+}
+
+// redactedEnv returns a copy of env vars with every value masked
+func redactedEnv(envVars map[string]string) map[string]string {
+	if envVars == nil {
+		return nil
+	}
+	masked := make(map[string]string, len(envVars))
+	for name := range envVars {
+		masked[name] = "****"
+	}
+	return masked
+}
+
+// Redacted returns a copy of the deployment safe to show or export, with env
+// var values, git and registry credentials masked
+func (deployment Deployment) Redacted() Deployment {
+	deployment.EnvVars = redactedEnv(deployment.EnvVars)
+	redact := newRedactor(deployment)
+	deployment.GitURL = redact(deployment.GitURL)
+	if deployment.GitMirrors != nil {
+		mirrors := make([]string, len(deployment.GitMirrors))
+		for i, mirror := range deployment.GitMirrors {
+			mirrors[i] = redact(mirror)
+		}
+		deployment.GitMirrors = mirrors
+	}
+	if deployment.Registry != nil {
+		registry := *deployment.Registry
+		registry.Password = "****"
+		deployment.Registry = &registry
+	}
+
+	services := make([]Service, len(deployment.Services))
+	for i, service := range deployment.Services {
+		service.EnvVars = redactedEnv(service.EnvVars)
+		services[i] = service
+	}
+	if deployment.Services != nil {
+		deployment.Services = services
+	}
+	return deployment
+}
@@ -0,0 +1,174 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"erebrusvps/websocket"
+)
+
+// redeployTick is how often the scheduler looks for projects due a check
+const redeployTick = time.Minute
+
+// minRedeployInterval keeps schedules from hammering git hosts
+const minRedeployInterval = time.Minute
+
+// parseRedeploySchedule turns a redeploy_cron value into an interval. It
+// accepts the @hourly, @daily and @every <duration> descriptors of cron
+// as well as a bare duration such as 15m.
+func parseRedeploySchedule(schedule string) (time.Duration, error) {
+	var interval time.Duration
+	var err error
+	switch value := strings.TrimSpace(schedule); {
+	case value == "@hourly":
+		interval = time.Hour
+	case value == "@daily":
+		interval = 24 * time.Hour
+	case strings.HasPrefix(value, "@every "):
+		interval, err = time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(value, "@every ")))
+	default:
+		interval, err = time.ParseDuration(value)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("invalid redeploy_cron %q, expected @hourly, @daily, @every <duration> or a duration", schedule)
+	}
+	if interval < minRedeployInterval {
+		return 0, fmt.Errorf("redeploy_cron %q is too frequent, the minimum is %s", schedule, minRedeployInterval)
+	}
+	return interval, nil
+}
+
+// validateRedeploySchedule only allows schedules on deployments that track
+// a branch, where the remote can move
+func validateRedeploySchedule(deployment Deployment) error {
+	if deployment.RedeployCron == "" {
+		return nil
+	}
+	if deployment.GitURL == "" {
+		return fmt.Errorf("redeploy_cron can only be set for git deployments")
+	}
+	if deployment.Commit != "" {
+		return fmt.Errorf("redeploy_cron cannot be combined with a pinned commit")
+	}
+	_, err := parseRedeploySchedule(deployment.RedeployCron)
+	return err
+}
+
+// StartRedeployScheduler redeploys projects with a redeploy_cron whenever
+// the remote branch has moved past the deployed commit
+func (d *DockerSetup) StartRedeployScheduler() {
+	go func() {
+		lastChecked := make(map[string]time.Time)
+		ticker := time.NewTicker(redeployTick)
+		defer ticker.Stop()
+		for range ticker.C {
+			d.checkScheduledRedeploys(lastChecked, time.Now())
+		}
+	}()
+}
+
+func (d *DockerSetup) checkScheduledRedeploys(lastChecked map[string]time.Time, now time.Time) {
+	projects, err := ListProjects()
+	if err != nil {
+		fmt.Printf("[SCHEDULE] Failed to list projects: %v\n", err)
+		return
+	}
+	for _, project := range projects {
+		state, err := LoadProjectState(project)
+		if err != nil || state.Deployment == nil || state.Deployment.RedeployCron == "" {
+			delete(lastChecked, project)
+			continue
+		}
+		interval, err := parseRedeploySchedule(state.Deployment.RedeployCron)
+		if err != nil || now.Sub(lastChecked[project]) < interval {
+			continue
+		}
+		if d.jobs.active(project) {
+			continue
+		}
+		lastChecked[project] = now
+		d.redeployIfChanged(project, state)
+	}
+}
+
+// redeployIfChanged compares the remote HEAD with the deployed commit and
+// queues a redeploy of the stored spec when they differ
+func (d *DockerSetup) redeployIfChanged(project string, state *ProjectState) {
+	spec := *state.Deployment
+	redact := newRedactor(spec)
+	remote, err := d.remoteHeadCommit(spec)
+	if err != nil {
+		fmt.Printf("[SCHEDULE] Failed to check %s: %v\n", project, redact(err.Error()))
+		return
+	}
+	if remote == state.Commit {
+		return
+	}
+
+	message := fmt.Sprintf("[SCHEDULE] %s moved from %s to %s, redeploying", project, shortCommit(state.Commit), shortCommit(remote))
+	websocket.Logger.SendProjectLog(project, message)
+	fmt.Println(message)
+
+	started := time.Now()
+	deployID, _ := d.StartDeployment(spec, func(result *DeploymentResult, err error) {
+		event := Event{
+			Timestamp:  started.UTC(),
+			Type:       EventRedeploy,
+			Actor:      "scheduler",
+			Result:     "success",
+			DurationMs: time.Since(started).Milliseconds(),
+		}
+		if result != nil {
+			event.BuildMs = result.BuildMs
+			event.DeployID = result.DeployID
+			event.Sequence = result.Sequence
+		}
+		message := fmt.Sprintf("[SCHEDULE] Redeployed %s", project)
+		if err != nil {
+			event.Result = "failure"
+			event.Error = err.Error()
+			message = fmt.Sprintf("[SCHEDULE] Redeploy of %s failed: %v", project, err)
+		}
+		websocket.Logger.SendProjectLog(project, message)
+		fmt.Println(message)
+		if recordErr := RecordEvent(project, event); recordErr != nil {
+			fmt.Printf("[EVENTS] Failed to record %s event for %s: %v\n", EventRedeploy, project, recordErr)
+		}
+	})
+	websocket.Logger.SendProjectLog(project, fmt.Sprintf("[SCHEDULE] Follow the redeploy of %s on /ws?deploy_id=%s", project, deployID))
+}
+
+// remoteHeadCommit returns the commit HEAD points to on the deployment's
+// remote, falling back to its mirrors
+func (d *DockerSetup) remoteHeadCommit(deployment Deployment) (string, error) {
+	var lastErr error
+	for _, gitURL := range append([]string{deployment.GitURL}, deployment.GitMirrors...) {
+		ctx, cancel := context.WithTimeout(context.Background(), gitRemoteTimeout)
+		out, err := d.runner.Output(gitRemoteCmd(ctx, gitURL, "HEAD"))
+		cancel()
+		if err != nil {
+			lastErr = fmt.Errorf("git ls-remote %s failed: %v", gitURL, err)
+			continue
+		}
+		fields := strings.Fields(string(out))
+		if len(fields) == 0 {
+			lastErr = fmt.Errorf("%s has no HEAD", gitURL)
+			continue
+		}
+		return fields[0], nil
+	}
+	return "", lastErr
+}
+
+// shortCommit abbreviates a commit for log lines
+func shortCommit(commit string) string {
+	if commit == "" {
+		return "an unknown commit"
+	}
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
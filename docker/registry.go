@@ -0,0 +1,85 @@
+package docker
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// RegistryAuth holds credentials for pulling private base images during a
+// build. An empty Server means Docker Hub.
+type RegistryAuth struct {
+	Server   string `json:"server,omitempty"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// registryMutex serializes authenticated builds, since docker keeps one
+// login per registry in a shared config and a logout affects every build
+var registryMutex sync.Mutex
+
+// registryAuth returns the credentials a deployment builds with, its own or
+// the server-wide ones
+func (d *DockerSetup) registryAuth(deployment Deployment) *RegistryAuth {
+	if deployment.Registry != nil {
+		return deployment.Registry
+	}
+	return d.Registry
+}
+
+// ValidateRegistryAuth checks that credentials are complete and the server
+// can't be mistaken for a flag
+func ValidateRegistryAuth(auth *RegistryAuth) error {
+	if auth == nil {
+		return nil
+	}
+	if auth.Username == "" || auth.Password == "" {
+		return fmt.Errorf("registry credentials need both a username and a password")
+	}
+	if strings.HasPrefix(auth.Server, "-") || strings.ContainsAny(auth.Server, " \t\n") {
+		return fmt.Errorf("invalid registry server: %q", auth.Server)
+	}
+	return nil
+}
+
+// registryLogin logs docker in to the registry and returns the matching
+// logout. The password is passed on stdin so it never shows up in process
+// listings or logs. The lock is held until logout.
+func (d *DockerSetup) registryLogin(auth *RegistryAuth, sendLog func(string)) (func(), error) {
+	server := auth.Server
+	if server == "" {
+		server = "Docker Hub"
+	}
+	registryMutex.Lock()
+
+	sendLog(fmt.Sprintf("[REGISTRY] Logging in to %s as %s", server, auth.Username))
+	args := []string{"login", "--username", auth.Username, "--password-stdin"}
+	if auth.Server != "" {
+		args = append(args, auth.Server)
+	}
+	password, err := decryptSecret(auth.Password)
+	if err != nil {
+		registryMutex.Unlock()
+		return nil, fmt.Errorf("registry password: %v", err)
+	}
+	cmd := exec.Command("docker", args...)
+	cmd.Stdin = strings.NewReader(password)
+	if output, err := d.combinedOutput(cmd); err != nil {
+		registryMutex.Unlock()
+		return nil, newCommandError("docker login", err, output)
+	}
+
+	return func() {
+		defer registryMutex.Unlock()
+		args := []string{"logout"}
+		if auth.Server != "" {
+			args = append(args, auth.Server)
+		}
+		if err := d.runCommand("docker", args...); err != nil {
+			sendLog(fmt.Sprintf("[REGISTRY] Warning: logout from %s failed: %v", server, err))
+			return
+		}
+		sendLog(fmt.Sprintf("[REGISTRY] Logged out of %s", server))
+	}, nil
+}
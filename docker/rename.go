@@ -0,0 +1,207 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+)
+
+// composeImagePattern finds the app image tag in a generated compose file
+var composeImagePattern = regexp.MustCompile(`image: "[^":]+:([0-9a-f]+)"`)
+
+// RenameProject moves a deployed project to a new name: workspace, compose
+// project, image tag, proxy config, port registry and state. The new stack
+// is started from the existing image without a rebuild. Until the new name
+// is serving, the old one is left intact and restarted on failure, so a
+// failed rename leaves the project working under its old name. It fails
+// with ErrProjectBusy while either name has a deploy in progress.
+func (d *DockerSetup) RenameProject(oldName, newName string) error {
+	if err := ValidateProjectName(newName); err != nil {
+		return err
+	}
+	if err := checkEnvironmentName(newName, ""); err != nil {
+		return err
+	}
+	unlock, err := d.jobs.tryLockProjects(oldName, newName)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	state, err := LoadProjectState(oldName)
+	if err != nil {
+		return err
+	}
+	if state.Deployment == nil {
+		return fmt.Errorf("%s has no successful deployment to rename", oldName)
+	}
+	if state.Deployment.Static {
+		return fmt.Errorf("renaming static deployments is not supported, redeploy under the new name instead")
+	}
+	oldDir, err := workspaceDir(oldName)
+	if err != nil {
+		return err
+	}
+	newDir, err := workspaceDir(newName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(newDir); err == nil {
+		return fmt.Errorf("project %s already exists", newName)
+	}
+
+	imageTag, err := deployedImageTag(oldDir, *state.Deployment)
+	if err != nil {
+		return err
+	}
+
+	spec := *state.Deployment
+	spec.ProjectName = newName
+	spec.Environment = ""
+
+	// Prepare the new workspace and image tag while the old stack keeps running
+	if err := os.MkdirAll(newDir, 0755); err != nil {
+		return fmt.Errorf("failed to create workspace: %v", err)
+	}
+	if err := copyTree(oldDir, newDir); err != nil {
+		os.RemoveAll(newDir)
+		return fmt.Errorf("failed to copy workspace: %v", err)
+	}
+	if err := d.createDockerCompose(newDir, spec, imageTag); err != nil {
+		os.RemoveAll(newDir)
+		removeEnvFiles(newName)
+		return fmt.Errorf("failed to create compose file: %v", err)
+	}
+	// Built images are retagged under the new name, prebuilt ones are used as is
+	if imageTag != "" {
+		if err := d.runCommand("docker", "tag", imageRepository(oldName)+":"+imageTag, imageRepository(newName)+":"+imageTag); err != nil {
+			os.RemoveAll(newDir)
+			removeEnvFiles(newName)
+			return fmt.Errorf("failed to tag image: %v", err)
+		}
+	}
+
+	// From here on a failure restarts the old stack
+	restore := func(cause error) error {
+		d.composeIn(newDir, "down")
+		d.reverseProxy(spec.Proxy).Remove(newName)
+		if imageTag != "" {
+			d.runCommand("docker", "rmi", imageRepository(newName)+":"+imageTag)
+		}
+		os.RemoveAll(newDir)
+		removeEnvFiles(newName)
+		if err := d.composeIn(oldDir, "up", "-d", "--no-build"); err != nil {
+			return fmt.Errorf("%v (restarting %s also failed: %v)", cause, oldName, err)
+		}
+		return cause
+	}
+
+	if err := d.composeIn(oldDir, "down"); err != nil {
+		return restore(fmt.Errorf("failed to stop %s: %v", oldName, err))
+	}
+	if err := d.composeIn(newDir, "up", "-d", "--no-build"); err != nil {
+		return restore(fmt.Errorf("failed to start %s: %v", newName, err))
+	}
+	if err := d.reverseProxy(spec.Proxy).Configure(spec); err != nil {
+		return restore(fmt.Errorf("failed to configure proxy: %v", err))
+	}
+
+	// The new name is serving, remove every trace of the old one
+	d.reverseProxy(state.Deployment.Proxy).Remove(oldName)
+	if err := moveProjectRecords(oldName, newName, spec); err != nil {
+		fmt.Printf("[RENAME] Failed to move state of %s: %v\n", oldName, err)
+	}
+	portsMutex.Lock()
+	if mapping, ok := usedPorts[spec.Port]; ok && mapping.ProjectName == oldName {
+		mapping.ProjectName = newName
+		usedPorts[spec.Port] = mapping
+	}
+	portsMutex.Unlock()
+	if imageTag != "" {
+		d.runCommand("docker", "rmi", imageRepository(oldName)+":"+imageTag)
+	}
+	if err := os.RemoveAll(oldDir); err != nil {
+		fmt.Printf("[RENAME] Failed to remove old workspace %s: %v\n", oldDir, err)
+	}
+	if err := removeEnvFiles(oldName); err != nil {
+		fmt.Printf("[RENAME] Failed to remove env files of %s: %v\n", oldName, err)
+	}
+	fmt.Printf("[RENAME] Renamed %s to %s\n", oldName, newName)
+	return nil
+}
+
+// deployedImageTag returns the tag of the app image built for a deployment,
+// read from its workspace's generated compose file. Prebuilt images are
+// pulled under their own name and have none.
+func deployedImageTag(workDir string, deployment Deployment) (string, error) {
+	if deployment.Image != "" {
+		return "", nil
+	}
+	compose, err := os.ReadFile(filepath.Join(workDir, "docker-compose.yml"))
+	if err != nil {
+		return "", fmt.Errorf("failed to read compose file: %v", err)
+	}
+	match := composeImagePattern.FindSubmatch(compose)
+	if match == nil {
+		return "", fmt.Errorf("no image tag found in %s", filepath.Join(workDir, "docker-compose.yml"))
+	}
+	return string(match[1]), nil
+}
+
+// composeInCmd builds a compose command run in a workspace
+func (d *DockerSetup) composeInCmd(workDir string, args ...string) *exec.Cmd {
+	cmd := d.composeCmd(args...)
+	cmd.Dir = workDir
+	return cmd
+}
+
+// composeIn runs a compose command against a workspace
+func (d *DockerSetup) composeIn(workDir string, args ...string) error {
+	cmd := d.composeInCmd(workDir, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return d.runner.Run(cmd)
+}
+
+// moveProjectRecords moves the state, event log and Dockerfile override of a
+// project to its new name
+func moveProjectRecords(oldName, newName string, spec Deployment) error {
+	state, err := LoadProjectState(oldName)
+	if err != nil {
+		return err
+	}
+	state.Deployment = &spec
+	state.Environment = ""
+	if err := UpdateProjectState(newName, func(s *ProjectState) { *s = *state }); err != nil {
+		return err
+	}
+	if err := store.DeleteProject(oldName); err != nil {
+		return err
+	}
+	if err := store.MoveEvents(oldName, newName); err != nil {
+		return err
+	}
+
+	oldPath, err := dockerfileOverridePath(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := dockerfileOverridePath(newName)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(oldPath); err == nil {
+		if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(oldPath, newPath); err != nil {
+			return err
+		}
+	}
+	if overridePath, err := dockerfileOverridePath(oldName); err == nil {
+		os.Remove(filepath.Dir(overridePath))
+	}
+	return nil
+}
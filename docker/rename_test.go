@@ -0,0 +1,45 @@
+package docker
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRenameProjectWhileBusy(t *testing.T) {
+	d, runner := newTestSetup(t, 44000)
+	deployTestApp(t, d, "api", nil)
+
+	// A deploy holding either name makes the rename fail instead of racing it
+	for _, project := range []string{"api", "web"} {
+		unlock := d.jobs.lockProject(project)
+		if err := d.RenameProject("api", "web"); !errors.Is(err, ErrProjectBusy) {
+			t.Errorf("got %v renaming while %s is locked, want ErrProjectBusy", err, project)
+		}
+		unlock()
+	}
+	d.jobs.add("queued", 0, "api")
+	if err := d.RenameProject("api", "web"); !errors.Is(err, ErrProjectBusy) {
+		t.Errorf("got %v renaming with a deploy queued, want ErrProjectBusy", err)
+	}
+	d.jobs.finish("queued", nil)
+	assertNoCommand(t, runner.Commands(), "docker tag")
+
+	if err := d.RenameProject("api", "web"); err != nil {
+		t.Fatalf("RenameProject: %v", err)
+	}
+	assertCommands(t, runner.Commands(), []string{"docker compose down", "docker compose up -d --no-build"})
+}
+
+func TestRenameImageDeployment(t *testing.T) {
+	d, runner := newTestSetup(t, 44010)
+	if _, err := d.DeployProject(Deployment{ProjectName: "cache", Image: "redis:7", Proxy: ProxyNone}); err != nil {
+		t.Fatalf("DeployProject: %v", err)
+	}
+
+	if err := d.RenameProject("cache", "store"); err != nil {
+		t.Fatalf("RenameProject: %v", err)
+	}
+	assertNoCommand(t, runner.Commands(), "docker tag")
+	assertNoCommand(t, runner.Commands(), "docker rmi erebrus/")
+	assertCommands(t, runner.Commands(), []string{"docker compose down", "docker compose up -d --no-build"})
+}
@@ -0,0 +1,142 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Retention policies applied when a new project would exceed the
+// deployment limit
+const (
+	RetentionReject = "reject"
+	RetentionEvict  = "evict-lru"
+)
+
+// EventEvict is recorded for a project removed to make room for another
+const EventEvict = "evict"
+
+// ValidateRetentionPolicy rejects unknown retention policies
+func ValidateRetentionPolicy(policy string) error {
+	switch policy {
+	case RetentionReject, RetentionEvict:
+		return nil
+	}
+	return fmt.Errorf("unknown retention policy %q, expected %s or %s", policy, RetentionReject, RetentionEvict)
+}
+
+// busy reports whether a project has a deploy queued or running
+func (q *jobQueue) busy(project string) bool {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, job := range q.jobs {
+		if job.Project == project && (job.State == JobQueued || job.State == JobRunning) {
+			return true
+		}
+	}
+	return false
+}
+
+// EvictLeastRecentlyUsed removes the idle project of owner whose last
+// successful deploy is the oldest, never one of keep. Projects that never
+// deployed successfully go first. It returns the evicted project.
+func (d *DockerSetup) EvictLeastRecentlyUsed(owner string, keep ...string) (string, error) {
+	projects, err := ListProjects()
+	if err != nil {
+		return "", err
+	}
+
+	var oldest string
+	var oldestAt time.Time
+	for _, project := range projects {
+		if slices.Contains(keep, project) || d.jobs.busy(project) {
+			continue
+		}
+		state, err := LoadProjectState(project)
+		if err != nil || state.Owner != owner {
+			continue
+		}
+		if oldest == "" || state.DeployedAt.Before(oldestAt) {
+			oldest, oldestAt = project, state.DeployedAt
+		}
+	}
+	if oldest == "" {
+		return "", fmt.Errorf("no idle deployment to evict")
+	}
+
+	started := time.Now()
+	fmt.Printf("[RETENTION] Evicting %s, last deployed %s, to make room for %s\n", oldest, oldestAt.Format(time.RFC3339), strings.Join(keep, ", "))
+	err = d.removeProject(oldest)
+	event := Event{
+		Timestamp:  started.UTC(),
+		Type:       EventEvict,
+		Actor:      "retention",
+		Result:     "success",
+		DurationMs: time.Since(started).Milliseconds(),
+	}
+	if err != nil {
+		event.Result = "failure"
+		event.Error = err.Error()
+	}
+	if recordErr := RecordEvent(oldest, event); recordErr != nil {
+		fmt.Printf("[EVENTS] Failed to record %s event for %s: %v\n", EventEvict, oldest, recordErr)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to evict %s: %v", oldest, err)
+	}
+	return oldest, nil
+}
+
+// removeProject tears a project down: its containers, images, proxy
+// config, published site, port and workspace. The event log is kept.
+func (d *DockerSetup) removeProject(project string) error {
+	workDir, err := workspaceDir(project)
+	if err != nil {
+		return err
+	}
+	state, err := LoadProjectState(project)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join(workDir, "docker-compose.yml")); err == nil {
+		if err := d.composeIn(workDir, "down", "--remove-orphans"); err != nil {
+			return fmt.Errorf("failed to stop containers: %v", err)
+		}
+	}
+	if state.Proxy != "" {
+		if err := d.reverseProxy(state.Proxy).Remove(project); err != nil {
+			fmt.Printf("[RETENTION] Failed to remove proxy config of %s: %v\n", project, err)
+		}
+	}
+	if state.Deployment != nil && state.Deployment.Static {
+		if err := d.runElevated("rm", "-rf", filepath.Join(staticRoot, project)); err != nil {
+			fmt.Printf("[RETENTION] Failed to remove site of %s: %v\n", project, err)
+		}
+	}
+	if out, err := d.runner.Output(exec.Command("docker", "images", "-q", imageRepository(project))); err == nil {
+		for _, id := range strings.Fields(string(out)) {
+			d.runner.Run(exec.Command("docker", "rmi", "-f", id))
+		}
+	}
+
+	portsMutex.Lock()
+	for port, mapping := range usedPorts {
+		if mapping.ProjectName == project {
+			delete(usedPorts, port)
+		}
+	}
+	portsMutex.Unlock()
+	if err := os.RemoveAll(workDir); err != nil {
+		return fmt.Errorf("failed to remove workspace: %v", err)
+	}
+	if err := removeEnvFiles(project); err != nil {
+		fmt.Printf("[RETENTION] Failed to remove env files of %s: %v\n", project, err)
+	}
+	store.DeleteProject(project)
+	return nil
+}
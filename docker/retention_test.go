@@ -0,0 +1,40 @@
+package docker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEvictLeastRecentlyUsedOnlyEvictsOwnProjects(t *testing.T) {
+	d, _ := newTestSetup(t, 43200)
+	deployed := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, project := range []string{"theirs", "old", "new"} {
+		testWorkspace(t, project)
+		owner := "mine"
+		if project == "theirs" {
+			owner = "other"
+		}
+		deployedAt := deployed.Add(time.Duration(i) * time.Hour)
+		if err := UpdateProjectState(project, func(state *ProjectState) {
+			state.Owner = owner
+			state.DeployedAt = deployedAt
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	evicted, err := d.EvictLeastRecentlyUsed("mine", "incoming")
+	if err != nil {
+		t.Fatalf("EvictLeastRecentlyUsed: %v", err)
+	}
+	if evicted != "old" {
+		t.Errorf("evicted %s, want old, the least recently deployed project of the owner", evicted)
+	}
+
+	if evicted, err := d.EvictLeastRecentlyUsed("mine", "new"); err == nil {
+		t.Errorf("evicted %s, want none as the owner's last project is kept", evicted)
+	}
+	if _, err := d.EvictLeastRecentlyUsed("nobody"); err == nil {
+		t.Error("evicted a project of another owner")
+	}
+}
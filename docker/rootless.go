@@ -0,0 +1,32 @@
+package docker
+
+import "fmt"
+
+// checkRootless rejects deployments that need root on the host when the
+// deployer runs rootless. Without sudo there is no system nginx to write
+// sites into, so apps are exposed on their high host port or through a
+// user-space proxy such as Traefik.
+func (d *DockerSetup) checkRootless(deployment Deployment) error {
+	if !d.Rootless {
+		return nil
+	}
+	if deployment.Proxy == ProxyNginx {
+		return fmt.Errorf("proxy %q needs root, use %q or %q in rootless mode", ProxyNginx, ProxyTraefik, ProxyNone)
+	}
+	if deployment.WildcardSubdomain {
+		return fmt.Errorf("wildcard certificates are installed into the system nginx and are not available in rootless mode")
+	}
+	return nil
+}
+
+// rootlessNote tells the client how a rootless deployment is expected to be
+// reached, since no proxy is configured on its behalf
+func (d *DockerSetup) rootlessNote(deployment Deployment) string {
+	if !d.Rootless {
+		return ""
+	}
+	if deployment.Proxy == ProxyTraefik {
+		return fmt.Sprintf("rootless: routed by a user-run Traefik on network %s", d.Traefik.Network)
+	}
+	return fmt.Sprintf("rootless: app published on host port %s, put your own reverse proxy in front of it", deployment.Port)
+}
@@ -0,0 +1,180 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// CommandRunner executes the external commands issued by DockerSetup, so
+// they can be swapped out when testing the deployer without docker, git or
+// nginx on the machine
+type CommandRunner interface {
+	// Run runs cmd to completion
+	Run(cmd *exec.Cmd) error
+	// Output runs cmd and returns its standard output
+	Output(cmd *exec.Cmd) ([]byte, error)
+	// Start starts cmd and returns a function waiting for it to exit
+	Start(cmd *exec.Cmd) (wait func() error, err error)
+}
+
+// CommandResult is what a command run through an Executor wrote and how
+// it exited
+type CommandResult struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+}
+
+// Executor runs a program with its arguments until it exits or ctx is done.
+// A command exiting unsuccessfully returns a CommandError along with what
+// it wrote.
+type Executor interface {
+	Run(ctx context.Context, name string, args ...string) (CommandResult, error)
+}
+
+// runnerExecutor is the Executor of a DockerSetup. It runs commands through
+// the DockerSetup's CommandRunner, so a RecordingRunner records and scripts
+// them like any other command.
+type runnerExecutor struct {
+	runner CommandRunner
+}
+
+func (e runnerExecutor) Run(ctx context.Context, name string, args ...string) (CommandResult, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := e.runner.Run(cmd)
+	result := CommandResult{Stdout: stdout.Bytes(), Stderr: stderr.Bytes()}
+	if err != nil {
+		cmdErr := newCommandError(strings.Join(cmd.Args, " "), err, append(stdout.Bytes(), stderr.Bytes()...))
+		result.ExitCode = cmdErr.ExitCode
+		return result, cmdErr
+	}
+	return result, nil
+}
+
+// execRunner runs commands for real through os/exec
+type execRunner struct{}
+
+func (execRunner) Run(cmd *exec.Cmd) error {
+	return cmd.Run()
+}
+
+func (execRunner) Output(cmd *exec.Cmd) ([]byte, error) {
+	return cmd.Output()
+}
+
+func (execRunner) Start(cmd *exec.Cmd) (func() error, error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Wait, nil
+}
+
+// RecordingRunner is a fake CommandRunner that records the command lines it
+// is given instead of running them. Errors and Outputs are keyed by the
+// command line, e.g. "git clone <url> <dir>".
+type RecordingRunner struct {
+	Errors  map[string]error
+	Outputs map[string][]byte
+
+	mu       sync.Mutex
+	commands []string
+}
+
+// Commands returns the command lines run so far, in order
+func (r *RecordingRunner) Commands() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.commands...)
+}
+
+func (r *RecordingRunner) record(cmd *exec.Cmd) string {
+	line := strings.Join(cmd.Args, " ")
+	r.mu.Lock()
+	r.commands = append(r.commands, line)
+	r.mu.Unlock()
+	return line
+}
+
+func (r *RecordingRunner) Run(cmd *exec.Cmd) error {
+	return r.finish(cmd, r.record(cmd))
+}
+
+// finish writes the scripted output of a command line and returns its error
+func (r *RecordingRunner) finish(cmd *exec.Cmd, line string) error {
+	if output := r.Outputs[line]; cmd.Stdout != nil && len(output) > 0 {
+		cmd.Stdout.Write(output)
+	}
+	return r.Errors[line]
+}
+
+func (r *RecordingRunner) Output(cmd *exec.Cmd) ([]byte, error) {
+	line := r.record(cmd)
+	return r.Outputs[line], r.Errors[line]
+}
+
+// Start records the command straight away and writes its output when waited
+// for, as the caller may only start reading a pipe after Start returns
+func (r *RecordingRunner) Start(cmd *exec.Cmd) (func() error, error) {
+	line := r.record(cmd)
+	return func() error { return r.finish(cmd, line) }, nil
+}
+
+// prefixWriter prints everything written to it with a prefix
+type prefixWriter struct {
+	prefix string
+}
+
+func (w prefixWriter) Write(p []byte) (int, error) {
+	fmt.Printf("%s%s", w.prefix, p)
+	return len(p), nil
+}
+
+// combinedOutput runs cmd and returns its stdout and stderr interleaved
+func (d *DockerSetup) combinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	err := d.runner.Run(cmd)
+	return output.Bytes(), err
+}
+
+// runCommand runs a command through the executor, returning a CommandError
+// carrying its output on failure
+func (d *DockerSetup) runCommand(name string, args ...string) error {
+	_, err := d.executor.Run(context.Background(), name, args...)
+	return err
+}
+
+// streamCommand runs a command, sending each line of its combined output to
+// sendLog under tag
+func (d *DockerSetup) streamCommand(cmd *exec.Cmd, tag string, sendLog func(string)) error {
+	reader, writer := io.Pipe()
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	wait, err := d.runner.Start(cmd)
+	if err != nil {
+		return err
+	}
+	go func() {
+		writer.CloseWithError(wait())
+	}()
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		sendLog(fmt.Sprintf("%s %s", tag, scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		io.Copy(io.Discard, reader) // let the command finish if scanning stopped early
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExecuteCommandRecordsInstallSteps(t *testing.T) {
+	runner := &RecordingRunner{}
+	d := NewDockerSetupWithRunner(runner)
+
+	for _, command := range []string{"apt-get update", "systemctl enable docker"} {
+		if err := d.ExecuteCommand(command); err != nil {
+			t.Fatalf("ExecuteCommand(%q): %v", command, err)
+		}
+	}
+	want := []string{
+		"sh -c DEBIAN_FRONTEND=noninteractive apt-get -y update",
+		"sh -c systemctl enable docker",
+	}
+	if got := runner.Commands(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got commands %q, want %q", got, want)
+	}
+}
+
+func TestExecuteCommandFailure(t *testing.T) {
+	runner := &RecordingRunner{Errors: map[string]error{"sh -c false": errors.New("exit status 1")}}
+	d := NewDockerSetupWithRunner(runner)
+
+	err := d.ExecuteCommand("false")
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.Command != "false" {
+		t.Fatalf("got %v, want a CommandError for false", err)
+	}
+}
+
+func TestRunCommandKeepsOutputOfFailure(t *testing.T) {
+	runner := &RecordingRunner{
+		Errors:  map[string]error{"git clone https://example.com/app.git /tmp/app": errors.New("exit status 128")},
+		Outputs: map[string][]byte{"git clone https://example.com/app.git /tmp/app": []byte("fatal: repository not found\n")},
+	}
+	d := NewDockerSetupWithRunner(runner)
+
+	err := d.runCommand("git", "clone", "https://example.com/app.git", "/tmp/app")
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || !strings.Contains(cmdErr.Output, "repository not found") {
+		t.Fatalf("got %v, want a CommandError carrying git's output", err)
+	}
+	if err := d.runCommand("git", "fetch"); err != nil {
+		t.Errorf("unscripted command failed: %v", err)
+	}
+}
+
+func TestVerifyVersions(t *testing.T) {
+	tests := []struct {
+		name    string
+		docker  string
+		compose string
+		outputs map[string][]byte
+		errors  map[string]error
+		wantErr string
+	}{
+		{name: "unpinned"},
+		{
+			name: "pins match", docker: "5:24.0.7-1~ubuntu.22.04~jammy", compose: "v2.24.0",
+			outputs: map[string][]byte{
+				"docker version --format {{.Server.Version}}": []byte("24.0.7\n"),
+				"docker-compose version --short":              []byte("2.24.0\n"),
+			},
+		},
+		{
+			name: "docker differs", docker: "24.0.7",
+			outputs: map[string][]byte{"docker version --format {{.Server.Version}}": []byte("25.0.1\n")},
+			wantErr: "docker 25.0.1 is installed but 24.0.7 was requested",
+		},
+		{
+			name: "compose missing", compose: "v2.24.0",
+			errors:  map[string]error{"docker-compose version --short": errors.New("executable file not found")},
+			wantErr: "failed to read docker-compose version",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDockerSetupWithRunner(&RecordingRunner{Outputs: tt.outputs, Errors: tt.errors})
+			d.DockerVersion, d.ComposeVersion = tt.docker, tt.compose
+			err := d.verifyVersions()
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("verifyVersions: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExecutorRecordsThroughRunner(t *testing.T) {
+	runner := &RecordingRunner{Outputs: map[string][]byte{"docker version --format {{.Server.Version}}": []byte("24.0.7\n")}}
+	d := NewDockerSetupWithRunner(runner)
+
+	result, err := d.executor.Run(context.Background(), "docker", "version", "--format", "{{.Server.Version}}")
+	if err != nil || string(result.Stdout) != "24.0.7\n" {
+		t.Fatalf("got %q, %v, want the scripted output", result.Stdout, err)
+	}
+	if want := []string{"docker version --format {{.Server.Version}}"}; !reflect.DeepEqual(runner.Commands(), want) {
+		t.Errorf("got commands %q, want %q", runner.Commands(), want)
+	}
+}
+
+func TestExecutorRunsCommands(t *testing.T) {
+	executor := runnerExecutor{runner: execRunner{}}
+
+	result, err := executor.Run(context.Background(), "sh", "-c", "echo out; echo err >&2; exit 3")
+	var cmdErr *CommandError
+	if !errors.As(err, &cmdErr) || cmdErr.ExitCode != 3 {
+		t.Fatalf("got %v, want a CommandError with exit code 3", err)
+	}
+	if string(result.Stdout) != "out\n" || string(result.Stderr) != "err\n" || result.ExitCode != 3 {
+		t.Errorf("got %+v, want out, err and exit code 3", result)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := executor.Run(ctx, "sh", "-c", "exit 0"); err == nil {
+		t.Error("command ran after its context was cancelled")
+	}
+}
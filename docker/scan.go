@@ -0,0 +1,120 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// scanSeverities are trivy's severity levels, lowest first
+var scanSeverities = []string{"UNKNOWN", "LOW", "MEDIUM", "HIGH", "CRITICAL"}
+
+// defaultScanThreshold is the lowest severity that fails a scanned deploy
+const defaultScanThreshold = "CRITICAL"
+
+// ScanSummary is the outcome of scanning a deployment's image
+type ScanSummary struct {
+	Image string `json:"image"`
+	// Counts holds the number of vulnerabilities found per severity
+	Counts    map[string]int `json:"counts"`
+	Threshold string         `json:"threshold"`
+	Passed    bool           `json:"passed"`
+	// Skipped explains why no scan ran
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// validateScan rejects unknown severity thresholds
+func validateScan(deployment Deployment) error {
+	if deployment.ScanThreshold == "" {
+		return nil
+	}
+	if !deployment.ScanImage {
+		return fmt.Errorf("scan_threshold needs scan_image")
+	}
+	if severityRank(deployment.ScanThreshold) < 0 {
+		return fmt.Errorf("invalid scan_threshold %q, expected one of %s", deployment.ScanThreshold, strings.Join(scanSeverities, ", "))
+	}
+	return nil
+}
+
+// severityRank returns the position of a severity in scanSeverities, -1
+// when unknown to us
+func severityRank(severity string) int {
+	for i, known := range scanSeverities {
+		if strings.EqualFold(severity, known) {
+			return i
+		}
+	}
+	return -1
+}
+
+// trivyReport is the part of trivy's JSON output we use
+type trivyReport struct {
+	Results []struct {
+		Vulnerabilities []struct {
+			Severity string `json:"Severity"`
+		} `json:"Vulnerabilities"`
+	} `json:"Results"`
+}
+
+// scanStage runs trivy against the freshly built image before the app is
+// exposed, failing the deploy on vulnerabilities at or above the threshold
+func (d *DockerSetup) scanStage(ctx context.Context, dc *DeployContext) error {
+	deployment := dc.Deployment
+	if !deployment.ScanImage {
+		return nil
+	}
+
+	threshold := strings.ToUpper(deployment.ScanThreshold)
+	if threshold == "" {
+		threshold = defaultScanThreshold
+	}
+	image := deployImage(deployment, dc.DeployID)
+	summary := &ScanSummary{Image: image, Counts: make(map[string]int), Threshold: threshold}
+	dc.Scan = summary
+
+	if _, err := exec.LookPath("trivy"); err != nil {
+		summary.Skipped = "trivy is not installed"
+		dc.Log("[SCAN] Warning: trivy is not installed, skipping the image scan")
+		return nil
+	}
+
+	dc.Log(fmt.Sprintf("[SCAN] Scanning %s for vulnerabilities", image))
+	cmd := exec.Command("trivy", "image", "--quiet", "--format", "json", image)
+	cmd.Stderr = os.Stderr
+	output, err := d.runner.Output(cmd)
+	if err != nil {
+		return fmt.Errorf("image scan failed: %v", err)
+	}
+	var report trivyReport
+	if err := json.Unmarshal(output, &report); err != nil {
+		return fmt.Errorf("failed to parse trivy report: %v", err)
+	}
+
+	blocking := 0
+	for _, result := range report.Results {
+		for _, vulnerability := range result.Vulnerabilities {
+			severity := strings.ToUpper(vulnerability.Severity)
+			summary.Counts[severity]++
+			if severityRank(severity) >= severityRank(threshold) {
+				blocking++
+			}
+		}
+	}
+
+	counts := make([]string, 0, len(scanSeverities))
+	for i := len(scanSeverities) - 1; i >= 0; i-- {
+		counts = append(counts, fmt.Sprintf("%s: %d", scanSeverities[i], summary.Counts[scanSeverities[i]]))
+	}
+	dc.Log(fmt.Sprintf("[SCAN] %s", strings.Join(counts, ", ")))
+
+	if blocking > 0 {
+		return fmt.Errorf("image scan found %d vulnerabilities at or above %s", blocking, threshold)
+	}
+	summary.Passed = true
+	dc.Log(fmt.Sprintf("[SCAN] No vulnerabilities at or above %s", threshold))
+	return nil
+}
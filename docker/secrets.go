@@ -0,0 +1,310 @@
+package docker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// encryptedPrefix marks a stored value encrypted under a secret key, followed
+// by the key's ID and the base64 of the nonce and ciphertext
+const encryptedPrefix = "enc:v1:"
+
+// secretKey is a key stored secrets are encrypted with, derived from a
+// master key in the key file
+type secretKey struct {
+	id  string
+	key []byte
+}
+
+var (
+	// secretKeys holds the current key first, then retired keys that are
+	// only used to decrypt values written before a rotation finished
+	secretKeys     []secretKey
+	secretKeyPath  string
+	secretKeyMutex sync.RWMutex
+)
+
+// DefaultSecretKeyPath is where the master key is kept: under /etc when
+// running as root, the user's config directory otherwise
+func DefaultSecretKeyPath() string {
+	if os.Geteuid() != 0 {
+		if dir, err := os.UserConfigDir(); err == nil {
+			return filepath.Join(dir, "erebrusvps", "secret.key")
+		}
+	}
+	return "/etc/erebrusvps/secret.key"
+}
+
+// deriveSecretKey turns a master key into the AES-256 key for stored
+// secrets, so the master key itself never encrypts anything
+func deriveSecretKey(master []byte) secretKey {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte("erebrusvps stored secrets"))
+	key := mac.Sum(nil)
+	sum := sha256.Sum256(key)
+	return secretKey{id: hex.EncodeToString(sum[:4]), key: key}
+}
+
+// LoadSecretKey reads the master key file that env vars and registry
+// passwords are encrypted with in the project state, generating it with
+// mode 0600 on first run. Until it is loaded secrets are stored in clear.
+func LoadSecretKey(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		master := make([]byte, 32)
+		if _, err := rand.Read(master); err != nil {
+			return err
+		}
+		data = []byte(hex.EncodeToString(master) + "\n")
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("failed to create secret key directory: %v", err)
+		}
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			return fmt.Errorf("failed to write secret key: %v", err)
+		}
+		fmt.Printf("[SECRETS] Generated a new secret key in %s\n", path)
+	} else if err != nil {
+		return fmt.Errorf("failed to read secret key: %v", err)
+	}
+
+	keys, err := parseSecretKeys(data)
+	if err != nil {
+		return fmt.Errorf("invalid secret key file %s: %v", path, err)
+	}
+	secretKeyMutex.Lock()
+	defer secretKeyMutex.Unlock()
+	secretKeys = keys
+	secretKeyPath = path
+	return nil
+}
+
+// parseSecretKeys reads hex master keys, one per line, current key first
+func parseSecretKeys(data []byte) ([]secretKey, error) {
+	var keys []secretKey
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		master, err := hex.DecodeString(line)
+		if err != nil || len(master) < 32 {
+			return nil, fmt.Errorf("keys must be at least 32 bytes, hex encoded")
+		}
+		keys = append(keys, deriveSecretKey(master))
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no key found")
+	}
+	return keys, nil
+}
+
+// encryptSecret encrypts a value under the current key. Values are left in
+// clear when no key is loaded, and ciphertext as it is: requests can't carry
+// the prefix, see ValidateSecretValues.
+func encryptSecret(value string) (string, error) {
+	secretKeyMutex.RLock()
+	defer secretKeyMutex.RUnlock()
+	if len(secretKeys) == 0 || strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	sealed, err := seal(secretKeys[0].key, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + secretKeys[0].id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret reverses encryptSecret, passing values stored in clear
+// through unchanged
+func decryptSecret(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %v", err)
+	}
+
+	secretKeyMutex.RLock()
+	defer secretKeyMutex.RUnlock()
+	for _, key := range secretKeys {
+		if key.id == id {
+			plaintext, err := unseal(key.key, sealed)
+			if err != nil {
+				return "", fmt.Errorf("failed to decrypt a stored secret: %v", err)
+			}
+			return string(plaintext), nil
+		}
+	}
+	return "", fmt.Errorf("stored secret was encrypted with key %s, which is not in the secret key file", id)
+}
+
+// ValidateSecretValues rejects secrets given in a request that start with
+// the prefix of stored ciphertext, as they would be mistaken for one. Specs
+// rebuilt from saved state do hold ciphertext and are not checked.
+func ValidateSecretValues(deployment Deployment) error {
+	_, err := mapSecrets(&deployment, func(value string) (string, error) {
+		if strings.HasPrefix(value, encryptedPrefix) {
+			return "", fmt.Errorf("secret values must not start with %q", encryptedPrefix)
+		}
+		return value, nil
+	})
+	return err
+}
+
+// mapSecrets applies convert to the secret fields of a deployment, which is
+// copied first so the caller's maps are never changed
+func mapSecrets(deployment *Deployment, convert func(string) (string, error)) (*Deployment, error) {
+	if deployment == nil {
+		return nil, nil
+	}
+	copied := *deployment
+	convertEnv := func(envVars map[string]string) (map[string]string, error) {
+		if envVars == nil {
+			return nil, nil
+		}
+		converted := make(map[string]string, len(envVars))
+		for name, value := range envVars {
+			var err error
+			if converted[name], err = convert(value); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		}
+		return converted, nil
+	}
+
+	var err error
+	if copied.EnvVars, err = convertEnv(deployment.EnvVars); err != nil {
+		return nil, err
+	}
+	if deployment.Services != nil {
+		copied.Services = make([]Service, len(deployment.Services))
+		for i, service := range deployment.Services {
+			if service.EnvVars, err = convertEnv(service.EnvVars); err != nil {
+				return nil, err
+			}
+			copied.Services[i] = service
+		}
+	}
+	if deployment.Registry != nil {
+		registry := *deployment.Registry
+		if registry.Password, err = convert(registry.Password); err != nil {
+			return nil, fmt.Errorf("registry password: %v", err)
+		}
+		copied.Registry = &registry
+	}
+	return &copied, nil
+}
+
+// decryptedSecrets returns a copy of a deployment with its secrets in clear.
+// Only compose generation, registry login, log redaction and sealed exports
+// need them; everywhere else the spec stays encrypted.
+func decryptedSecrets(deployment Deployment) (Deployment, error) {
+	decrypted, err := mapSecrets(&deployment, decryptSecret)
+	if err != nil {
+		return Deployment{}, fmt.Errorf("failed to decrypt secrets of %s: %v", deployment.ProjectName, err)
+	}
+	return *decrypted, nil
+}
+
+// RotateSecretKey generates a new master key and re-encrypts every stored
+// secret under it. The new key is added to the key file before anything is
+// re-encrypted and the old one dropped only afterwards, so an interrupted
+// rotation leaves every value readable. Returns how many projects were
+// re-encrypted.
+func RotateSecretKey() (int, error) {
+	secretKeyMutex.RLock()
+	path := secretKeyPath
+	secretKeyMutex.RUnlock()
+	if path == "" {
+		return 0, fmt.Errorf("no secret key is loaded")
+	}
+
+	// Hold the state lock so no state is written under the old key meanwhile
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	current, err := os.ReadFile(path)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read secret key: %v", err)
+	}
+	master := make([]byte, 32)
+	if _, err := rand.Read(master); err != nil {
+		return 0, err
+	}
+	newKey := hex.EncodeToString(master) + "\n"
+	if err := writeSecretKeyFile(path, []byte(newKey+string(current))); err != nil {
+		return 0, err
+	}
+	if err := reloadSecretKeys(path); err != nil {
+		return 0, err
+	}
+
+	projects, err := store.Projects()
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	for _, project := range projects {
+		state, err := loadProjectState(project)
+		if err != nil {
+			return rotated, fmt.Errorf("failed to read %s: %v", project, err)
+		}
+		if state.Deployment == nil {
+			continue
+		}
+		// Already encrypted values are saved as they are, so decrypt first
+		if state.Deployment, err = mapSecrets(state.Deployment, decryptSecret); err != nil {
+			return rotated, fmt.Errorf("failed to decrypt %s: %v", project, err)
+		}
+		if err := saveProjectState(project, state); err != nil {
+			return rotated, fmt.Errorf("failed to re-encrypt %s: %v", project, err)
+		}
+		rotated++
+	}
+
+	if err := writeSecretKeyFile(path, []byte(newKey)); err != nil {
+		return rotated, err
+	}
+	if err := reloadSecretKeys(path); err != nil {
+		return rotated, err
+	}
+	fmt.Printf("[SECRETS] Rotated the secret key, re-encrypted %d projects\n", rotated)
+	return rotated, nil
+}
+
+func reloadSecretKeys(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	keys, err := parseSecretKeys(data)
+	if err != nil {
+		return err
+	}
+	secretKeyMutex.Lock()
+	secretKeys = keys
+	secretKeyMutex.Unlock()
+	return nil
+}
+
+// writeSecretKeyFile replaces the key file atomically
+func writeSecretKeyFile(path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write secret key: %v", err)
+	}
+	return os.Rename(tmpPath, path)
+}
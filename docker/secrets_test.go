@@ -0,0 +1,102 @@
+package docker
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestSecretKey loads a fresh secret key for the test, unloading it after
+func loadTestSecretKey(t *testing.T) {
+	t.Helper()
+	if err := LoadSecretKey(filepath.Join(t.TempDir(), "secret.key")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		secretKeyMutex.Lock()
+		secretKeys, secretKeyPath = nil, ""
+		secretKeyMutex.Unlock()
+	})
+}
+
+func TestDeploySecretsStayOutOfComposeAndState(t *testing.T) {
+	d, _ := newTestSetup(t, 43500)
+	loadTestSecretKey(t)
+
+	const token = "s3cr3t-token-value"
+	_, err := d.DeployProject(Deployment{
+		ProjectName: "web",
+		Image:       "nginx:1.27",
+		Proxy:       ProxyNone,
+		EnvVars:     map[string]string{"API_TOKEN": token, "GREETING": "say \"hi\" to $USER"},
+		Services:    []Service{{Name: "db", Image: "postgres:16", EnvVars: map[string]string{"POSTGRES_PASSWORD": token}}},
+	})
+	if err != nil {
+		t.Fatalf("DeployProject: %v", err)
+	}
+
+	compose, err := os.ReadFile(filepath.Join(testWorkspace(t, "web"), "docker-compose.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(compose), token) {
+		t.Errorf("compose file holds a secret:\n%s", compose)
+	}
+	envDir, err := envFileDir("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for service, want := range map[string]string{
+		"app": "API_TOKEN=\"" + token + "\"\nGREETING=\"say \\\"hi\\\" to $$USER\"\n",
+		"db":  "POSTGRES_PASSWORD=\"" + token + "\"\n",
+	} {
+		path := filepath.Join(envDir, service+".env")
+		if !strings.Contains(string(compose), "    env_file:\n      - \""+path+"\"\n") {
+			t.Errorf("compose file doesn't reference %s:\n%s", path, compose)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := info.Mode().Perm(); mode != 0600 {
+			t.Errorf("%s has mode %o, want 600", path, mode)
+		}
+		if data, _ := os.ReadFile(path); string(data) != want {
+			t.Errorf("%s holds %q, want %q", path, data, want)
+		}
+	}
+
+	state, err := LoadProjectState("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := state.Deployment.EnvVars["API_TOKEN"]; !strings.HasPrefix(value, encryptedPrefix) {
+		t.Errorf("loaded state holds API_TOKEN as %q, want it encrypted", value)
+	}
+	if value := state.Deployment.Services[0].EnvVars["POSTGRES_PASSWORD"]; !strings.HasPrefix(value, encryptedPrefix) {
+		t.Errorf("loaded state holds POSTGRES_PASSWORD as %q, want it encrypted", value)
+	}
+
+	if err := d.removeProject("web"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(envDir); !os.IsNotExist(err) {
+		t.Errorf("env files left after removing the project: %v", err)
+	}
+}
+
+func TestValidateSecretValues(t *testing.T) {
+	for _, deployment := range []Deployment{
+		{EnvVars: map[string]string{"TOKEN": encryptedPrefix + "abc:Zm9v"}},
+		{Services: []Service{{Name: "db", EnvVars: map[string]string{"PASSWORD": encryptedPrefix}}}},
+		{Registry: &RegistryAuth{Username: "me", Password: encryptedPrefix + "x"}},
+	} {
+		if err := ValidateSecretValues(deployment); err == nil {
+			t.Errorf("accepted %+v carrying the ciphertext prefix", deployment)
+		}
+	}
+	if err := ValidateSecretValues(Deployment{EnvVars: map[string]string{"TOKEN": "enc:v2 is fine"}}); err != nil {
+		t.Errorf("rejected a plain value: %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+package docker
+
+// nextDeploySequence returns the next deployment sequence number, never
+// reused across restarts
+func nextDeploySequence() (uint64, error) {
+	return store.NextSequence()
+}
+
+// DeployIDForSequence returns the deploy ID a project's deployment with the
+// given sequence number ran under, from the event history
+func DeployIDForSequence(project string, sequence uint64) (string, bool) {
+	events, err := ListEvents(project)
+	if err != nil {
+		return "", false
+	}
+	for _, event := range events {
+		if event.Sequence == sequence && event.DeployID != "" {
+			return event.DeployID, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,205 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// sourceFetcher fills a project's workspace with the code to deploy
+type sourceFetcher interface {
+	// describe is logged before fetching
+	describe() string
+	fetch(workDir string) error
+}
+
+// sourceFor picks the fetcher for a deployment's source. Exactly one of
+// git_url, local_path, image or an uploaded archive must be set.
+func (d *DockerSetup) sourceFor(deployment Deployment) (sourceFetcher, error) {
+	var sources []sourceFetcher
+	if deployment.GitURL != "" {
+		sources = append(sources, &gitSource{d: d, urls: append([]string{deployment.GitURL}, deployment.GitMirrors...)})
+	}
+	if deployment.LocalPath != "" {
+		path, err := d.checkLocalPath(deployment.LocalPath)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, &localSource{path: path})
+	}
+	if deployment.Upload != nil {
+		sources = append(sources, &uploadSource{d: d, upload: deployment.Upload})
+	}
+	if deployment.Image != "" {
+		sources = append(sources, &imageSource{image: deployment.Image})
+	}
+
+	switch len(sources) {
+	case 0:
+		return nil, fmt.Errorf("a deployment needs a git_url, local_path, image or uploaded archive")
+	case 1:
+		return sources[0], nil
+	default:
+		return nil, fmt.Errorf("git_url, local_path, image and uploaded archives are mutually exclusive")
+	}
+}
+
+// gitSource clones a repository, trying its mirrors in order when the
+// primary URL fails
+type gitSource struct {
+	d    *DockerSetup
+	urls []string
+	// remote is the URL the clone succeeded from
+	remote string
+}
+
+func (s *gitSource) describe() string {
+	if len(s.urls) > 1 {
+		return fmt.Sprintf("Cloning repository: %s (%d mirrors)", s.urls[0], len(s.urls)-1)
+	}
+	return fmt.Sprintf("Cloning repository: %s", s.urls[0])
+}
+
+func (s *gitSource) fetch(workDir string) error {
+	var failures []string
+	for _, url := range s.urls {
+		err := s.d.cloneRepository(url, workDir)
+		if err == nil {
+			s.remote = url
+			return nil
+		}
+		fmt.Printf("[GIT] Clone from %s failed: %v\n", url, err)
+		failures = append(failures, err.Error())
+	}
+	return fmt.Errorf("failed to clone repository: %s", strings.Join(failures, "; "))
+}
+
+// uploadSource extracts a staged archive
+type uploadSource struct {
+	d      *DockerSetup
+	upload *Upload
+}
+
+func (s *uploadSource) describe() string {
+	return fmt.Sprintf("Extracting uploaded archive (sha256 %s)", s.upload.SHA256)
+}
+
+func (s *uploadSource) fetch(workDir string) error {
+	if err := extractUpload(s.upload.Path, workDir, s.d.extractLimits()); err != nil {
+		return fmt.Errorf("failed to extract upload: %v", err)
+	}
+	return nil
+}
+
+// localSource copies a directory already on the host, leaving it in place
+// so redeploys copy from it again
+type localSource struct {
+	path string
+}
+
+func (s *localSource) describe() string {
+	return fmt.Sprintf("Copying local directory: %s", s.path)
+}
+
+func (s *localSource) fetch(workDir string) error {
+	if err := clearWorkspace(workDir); err != nil {
+		return fmt.Errorf("failed to clear workspace: %v", err)
+	}
+	if err := copyTree(s.path, workDir); err != nil {
+		return fmt.Errorf("failed to copy %s: %v", s.path, err)
+	}
+	return nil
+}
+
+// checkLocalPath resolves a local_path and refuses directories outside
+// LocalPathRoot or owned by another user
+func (d *DockerSetup) checkLocalPath(path string) (string, error) {
+	if d.LocalPathRoot == "" {
+		return "", fmt.Errorf("local_path deployments are disabled, set EREBRUS_LOCAL_PATH_ROOT to enable them")
+	}
+	root, err := filepath.EvalSymlinks(d.LocalPathRoot)
+	if err != nil {
+		return "", fmt.Errorf("invalid local path root: %v", err)
+	}
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("local_path must be absolute: %q", path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("invalid local_path: %v", err)
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("local_path %q is outside %s", path, d.LocalPathRoot)
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return "", fmt.Errorf("invalid local_path: %v", err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("local_path %q is not a directory", path)
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return "", fmt.Errorf("local_path %q is owned by another user", path)
+	}
+	return resolved, nil
+}
+
+// copyTree copies src into dst, keeping symlinks as links and skipping our
+// top level logs so the run logs aren't overwritten
+func copyTree(src, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		if keptInWorkspace(rel) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		default:
+			return nil // sockets, devices and pipes aren't part of a build
+		}
+	})
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
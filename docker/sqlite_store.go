@@ -0,0 +1,392 @@
+package docker
+
+import (
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// migrations are the schema changes applied in name order when a database
+// is opened, each recorded in schema_migrations once applied
+//
+//go:embed migrations/*.sql
+var migrations embed.FS
+
+// jsonImportKey marks in the meta table that the JSON state files were
+// imported, or that there were none to import
+const jsonImportKey = "json_state_imported"
+
+// sqliteStore keeps state in an SQLite database. Project state is stored as
+// the same JSON the file store writes, with its port and owner copied into
+// the ports and api_keys tables.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// sqlExecer is what a statement runs on: the database or a transaction
+type sqlExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// OpenSQLiteStore opens the state database at path, state.db in the state
+// directory when empty, applies pending migrations and, on first use,
+// imports the state kept in JSON files by earlier versions
+func OpenSQLiteStore(path string) (Store, error) {
+	return openSQLiteStore(path)
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	if path == "" {
+		dir, err := stateDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(dir, "state.db")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %v", err)
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state database: %v", err)
+	}
+	// A single connection serializes writers instead of failing them busy
+	db.SetMaxOpenConns(1)
+	s := &sqliteStore{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to restrict state database: %v", err)
+	}
+	if err := s.importJSONState(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// migrate applies the embedded migrations not yet recorded, each in its own
+// transaction
+func (s *sqliteStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    TEXT PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`); err != nil {
+		return fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+	entries, err := fs.ReadDir(migrations, "migrations")
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		version, ok := strings.CutSuffix(entry.Name(), ".sql")
+		if !ok {
+			continue
+		}
+		var applied bool
+		if err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM schema_migrations WHERE version = ?)`, version).Scan(&applied); err != nil {
+			return fmt.Errorf("failed to read schema_migrations: %v", err)
+		}
+		if applied {
+			continue
+		}
+		script, err := migrations.ReadFile("migrations/" + entry.Name())
+		if err != nil {
+			return err
+		}
+		err = s.inTx(func(tx *sql.Tx) error {
+			if _, err := tx.Exec(string(script)); err != nil {
+				return err
+			}
+			_, err := tx.Exec(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, version, storeTimestamp())
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %s: %v", version, err)
+		}
+		fmt.Printf("[STATE] Applied migration %s\n", version)
+	}
+	return nil
+}
+
+// importJSONState copies the project state, event logs and deploy sequence
+// of the file store into the database in one transaction, once. The files
+// are left in place.
+func (s *sqliteStore) importJSONState() error {
+	var imported bool
+	if err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM meta WHERE key = ?)`, jsonImportKey).Scan(&imported); err != nil {
+		return fmt.Errorf("failed to read meta: %v", err)
+	}
+	if imported {
+		return nil
+	}
+
+	files := &fileStore{}
+	projects, err := files.Projects()
+	if err != nil {
+		return err
+	}
+	states := make(map[string]*ProjectState, len(projects))
+	for _, project := range projects {
+		if states[project], err = files.LoadProject(project); err != nil {
+			return fmt.Errorf("failed to import state of %s: %v", project, err)
+		}
+	}
+	histories, err := jsonEventHistories(files)
+	if err != nil {
+		return err
+	}
+	var sequence uint64
+	path, err := sequencePath()
+	if err != nil {
+		return err
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		if sequence, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return fmt.Errorf("corrupt deploy sequence in %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read deploy sequence: %v", err)
+	}
+
+	err = s.inTx(func(tx *sql.Tx) error {
+		for project, state := range states {
+			if err := saveProjectRow(tx, project, state); err != nil {
+				return err
+			}
+		}
+		for project, events := range histories {
+			if err := appendEventRows(tx, project, events); err != nil {
+				return err
+			}
+		}
+		// Numbering carries on after the last sequence handed out
+		if sequence > 0 {
+			if _, err := tx.Exec(`INSERT INTO deployment_runs (sequence, created_at) VALUES (?, ?)`, sequence, storeTimestamp()); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(`INSERT INTO meta (key, value) VALUES (?, ?)`, jsonImportKey, storeTimestamp())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to import JSON state: %v", err)
+	}
+	if len(states) > 0 || len(histories) > 0 {
+		fmt.Printf("[STATE] Imported %d projects and %d event logs from the JSON state files\n", len(states), len(histories))
+	}
+	return nil
+}
+
+// jsonEventHistories reads every event log kept by the file store
+func jsonEventHistories(files *fileStore) (map[string][]Event, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "events"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list event logs: %v", err)
+	}
+	histories := make(map[string][]Event)
+	for _, entry := range entries {
+		project, ok := strings.CutSuffix(entry.Name(), ".jsonl")
+		if !ok || entry.IsDir() {
+			continue
+		}
+		if histories[project], err = files.Events(project); err != nil {
+			return nil, fmt.Errorf("failed to import events of %s: %v", project, err)
+		}
+	}
+	return histories, nil
+}
+
+// inTx runs fn in a transaction, committed when fn succeeds
+func (s *sqliteStore) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// storeTimestamp is the time recorded with rows, in UTC
+func storeTimestamp() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+func (s *sqliteStore) LoadProject(project string) (*ProjectState, error) {
+	state := &ProjectState{}
+	var data string
+	err := s.db.QueryRow(`SELECT state FROM deployments WHERE project = ?`, project).Scan(&data)
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read project state: %v", err)
+	}
+	if err := json.Unmarshal([]byte(data), state); err != nil {
+		return nil, fmt.Errorf("failed to parse project state: %v", err)
+	}
+	return state, nil
+}
+
+func (s *sqliteStore) SaveProject(project string, state *ProjectState) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return saveProjectRow(tx, project, state)
+	})
+}
+
+// saveProjectRow writes a project's state along with its port and owner
+func saveProjectRow(tx sqlExecer, project string, state *ProjectState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO deployments (project, state, owner, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT (project) DO UPDATE SET state = excluded.state, owner = excluded.owner, updated_at = excluded.updated_at`,
+		project, string(data), state.Owner, storeTimestamp()); err != nil {
+		return fmt.Errorf("failed to write project state: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM ports WHERE project = ?`, project); err != nil {
+		return fmt.Errorf("failed to write project port: %v", err)
+	}
+	if state.Deployment != nil && state.Deployment.Port != "" {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO ports (port, project) VALUES (?, ?)`, state.Deployment.Port, project); err != nil {
+			return fmt.Errorf("failed to write project port: %v", err)
+		}
+	}
+	if state.Owner != "" {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO api_keys (key_id, first_seen) VALUES (?, ?)`, state.Owner, storeTimestamp()); err != nil {
+			return fmt.Errorf("failed to record project owner: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) DeleteProject(project string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`DELETE FROM deployments WHERE project = ?`, project); err != nil {
+			return fmt.Errorf("failed to remove project state: %v", err)
+		}
+		if _, err := tx.Exec(`DELETE FROM ports WHERE project = ?`, project); err != nil {
+			return fmt.Errorf("failed to remove project port: %v", err)
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStore) Projects() ([]string, error) {
+	rows, err := s.db.Query(`SELECT project FROM deployments ORDER BY project`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list project state: %v", err)
+	}
+	defer rows.Close()
+	var projects []string
+	for rows.Next() {
+		var project string
+		if err := rows.Scan(&project); err != nil {
+			return nil, err
+		}
+		projects = append(projects, project)
+	}
+	return projects, rows.Err()
+}
+
+func (s *sqliteStore) AppendEvents(project string, events []Event) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		return appendEventRows(tx, project, events)
+	})
+}
+
+// appendEventRows adds events to a project's history, filling in the run of
+// each deploy event's sequence number
+func appendEventRows(tx sqlExecer, project string, events []Event) error {
+	for _, event := range events {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO audit_events (project, event) VALUES (?, ?)`, project, string(data)); err != nil {
+			return fmt.Errorf("failed to write event: %v", err)
+		}
+		if event.Sequence == 0 {
+			continue
+		}
+		if _, err := tx.Exec(`UPDATE deployment_runs SET project = ?, deploy_id = ?, result = ? WHERE sequence = ?`,
+			project, event.DeployID, event.Result, event.Sequence); err != nil {
+			return fmt.Errorf("failed to record deployment run: %v", err)
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) Events(project string) ([]Event, error) {
+	rows, err := s.db.Query(`SELECT event FROM audit_events WHERE project = ? ORDER BY id`, project)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read events: %v", err)
+	}
+	defer rows.Close()
+	events := []Event{}
+	for rows.Next() {
+		var data string
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var event Event
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, fmt.Errorf("failed to parse event: %v", err)
+		}
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (s *sqliteStore) HasEvents(project string) bool {
+	var found bool
+	err := s.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM audit_events WHERE project = ?)`, project).Scan(&found)
+	return err == nil && found
+}
+
+func (s *sqliteStore) MoveEvents(oldName, newName string) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		if _, err := tx.Exec(`UPDATE audit_events SET project = ? WHERE project = ?`, newName, oldName); err != nil {
+			return fmt.Errorf("failed to move events: %v", err)
+		}
+		if _, err := tx.Exec(`UPDATE deployment_runs SET project = ? WHERE project = ?`, newName, oldName); err != nil {
+			return fmt.Errorf("failed to move deployment runs: %v", err)
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStore) NextSequence() (uint64, error) {
+	result, err := s.db.Exec(`INSERT INTO deployment_runs (created_at) VALUES (?)`, storeTimestamp())
+	if err != nil {
+		return 0, fmt.Errorf("failed to write deploy sequence: %v", err)
+	}
+	sequence, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to write deploy sequence: %v", err)
+	}
+	return uint64(sequence), nil
+}
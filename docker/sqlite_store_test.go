@@ -0,0 +1,191 @@
+package docker
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// openTestSQLiteStore opens a state database in the test's state directory
+func openTestSQLiteStore(t *testing.T) *sqliteStore {
+	t.Helper()
+	s, err := openSQLiteStore("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.db.Close() })
+	return s
+}
+
+func TestSQLiteStoreProjects(t *testing.T) {
+	newTestSetup(t, 44100)
+	s := openTestSQLiteStore(t)
+
+	if state, err := s.LoadProject("app"); err != nil || !reflect.DeepEqual(state, &ProjectState{}) {
+		t.Fatalf("got %+v, %v for a project never saved, want an empty state", state, err)
+	}
+	saved := &ProjectState{Owner: "key1", Commit: "abc123", Deployment: &Deployment{ProjectName: "app", Port: "3000", EnvVars: map[string]string{"A": "1"}}}
+	if err := s.SaveProject("app", saved); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := s.LoadProject("app"); err != nil || !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("got %+v, %v, want %+v", loaded, err, saved)
+	}
+	if projects, err := s.Projects(); err != nil || !reflect.DeepEqual(projects, []string{"app"}) {
+		t.Errorf("got projects %v, %v, want [app]", projects, err)
+	}
+	var project, keyID string
+	if err := s.db.QueryRow(`SELECT project FROM ports WHERE port = '3000'`).Scan(&project); err != nil || project != "app" {
+		t.Errorf("got port 3000 held by %q, %v, want app", project, err)
+	}
+	if err := s.db.QueryRow(`SELECT key_id FROM api_keys`).Scan(&keyID); err != nil || keyID != "key1" {
+		t.Errorf("got owner key %q, %v, want key1", keyID, err)
+	}
+
+	if err := s.DeleteProject("app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteProject("app"); err != nil {
+		t.Errorf("deleting a missing project: %v", err)
+	}
+	if projects, err := s.Projects(); err != nil || len(projects) != 0 {
+		t.Errorf("got projects %v, %v after deleting, want none", projects, err)
+	}
+	var ports int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM ports`).Scan(&ports); err != nil || ports != 0 {
+		t.Errorf("got %d ports, %v after deleting, want none", ports, err)
+	}
+}
+
+func TestSQLiteStoreEvents(t *testing.T) {
+	newTestSetup(t, 44110)
+	s := openTestSQLiteStore(t)
+
+	if s.HasEvents("app") {
+		t.Error("project without history has events")
+	}
+	sequence, err := s.NextSequence()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendEvents("app", []Event{{Type: EventDeploy, DeployID: "d1", Sequence: sequence, Result: "success"}, {Type: EventRedeploy, DeployID: "d2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendEvents("app", []Event{{Type: EventEnv}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MoveEvents("app", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if s.HasEvents("app") {
+		t.Error("history still under the old name after moving it")
+	}
+
+	events, err := s.Events("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	if want := []string{EventDeploy, EventRedeploy, EventEnv}; !reflect.DeepEqual(types, want) {
+		t.Errorf("got events %v, want %v in order", types, want)
+	}
+	var project, deployID string
+	if err := s.db.QueryRow(`SELECT project, deploy_id FROM deployment_runs WHERE sequence = ?`, sequence).Scan(&project, &deployID); err != nil || project != "web" || deployID != "d1" {
+		t.Errorf("got run %d of %q as %q, %v, want web's d1", sequence, project, deployID, err)
+	}
+}
+
+func TestSQLiteStoreNextSequence(t *testing.T) {
+	newTestSetup(t, 44120)
+	s := openTestSQLiteStore(t)
+	for want := uint64(1); want <= 3; want++ {
+		if got, err := s.NextSequence(); err != nil || got != want {
+			t.Fatalf("got %d, %v, want %d", got, err, want)
+		}
+	}
+}
+
+func TestSQLiteStoreMigratesOnce(t *testing.T) {
+	newTestSetup(t, 44130)
+	s := openTestSQLiteStore(t)
+	if err := s.SaveProject("app", &ProjectState{Commit: "abc123"}); err != nil {
+		t.Fatal(err)
+	}
+	s.db.Close()
+
+	// Reopening applies nothing twice and keeps what was stored
+	s = openTestSQLiteStore(t)
+	entries, err := os.ReadDir("migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var applied int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied); err != nil || applied != len(entries) {
+		t.Errorf("got %d migrations recorded, %v, want %d", applied, err, len(entries))
+	}
+	if state, err := s.LoadProject("app"); err != nil || state.Commit != "abc123" {
+		t.Errorf("got %+v, %v after reopening, want the saved state", state, err)
+	}
+}
+
+func TestSQLiteStoreImportsJSONState(t *testing.T) {
+	newTestSetup(t, 44140)
+	files := &fileStore{}
+	saved := &ProjectState{Owner: "key1", Deployment: &Deployment{ProjectName: "app", Port: "3000"}}
+	if err := files.SaveProject("app", saved); err != nil {
+		t.Fatal(err)
+	}
+	if err := files.AppendEvents("app", []Event{{Type: EventDeploy, DeployID: "d1"}}); err != nil {
+		t.Fatal(err)
+	}
+	// History outlives a removed project's state
+	if err := files.AppendEvents("gone", []Event{{Type: EventExec}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		if _, err := files.NextSequence(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := openTestSQLiteStore(t)
+	if loaded, err := s.LoadProject("app"); err != nil || !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("got %+v, %v, want the imported %+v", loaded, err, saved)
+	}
+	for project, want := range map[string]string{"app": EventDeploy, "gone": EventExec} {
+		if events, err := s.Events(project); err != nil || len(events) != 1 || events[0].Type != want {
+			t.Errorf("got %s events %+v, %v, want one %s", project, events, err, want)
+		}
+	}
+	if got, err := s.NextSequence(); err != nil || got != 8 {
+		t.Errorf("got sequence %d, %v after importing 7, want 8", got, err)
+	}
+
+	// The files are kept but never imported again
+	if err := files.SaveProject("late", &ProjectState{}); err != nil {
+		t.Fatal(err)
+	}
+	s.db.Close()
+	s = openTestSQLiteStore(t)
+	if projects, err := s.Projects(); err != nil || !reflect.DeepEqual(projects, []string{"app"}) {
+		t.Errorf("got projects %v, %v after reopening, want only the first import", projects, err)
+	}
+	path, err := projectStatePath("app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("JSON state removed by the import: %v", err)
+	}
+	info, err := os.Stat(filepath.Join(filepath.Dir(filepath.Dir(path)), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("state.db has mode %o, want 600", mode)
+	}
+}
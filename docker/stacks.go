@@ -0,0 +1,524 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Stack member outcomes reported in a StackResult
+const (
+	StackMemberDeployed = "deployed"
+	StackMemberFailed   = "failed"
+	StackMemberSkipped  = "skipped"
+	StackMemberRemoved  = "removed"
+)
+
+// Stack is a group of projects deployed together on a shared network, e.g.
+// a frontend, an api and a worker built from separate repositories
+type Stack struct {
+	Name string `json:"name"`
+	// Deployments are the members, named by their project_name. Each is
+	// deployed as project <stack>-<member> and reachable from its siblings
+	// at http://<member>:8080.
+	Deployments []Deployment `json:"deployments"`
+	// Links lists the members each member depends on, which are deployed
+	// before it, e.g. {"frontend":["api"]}
+	Links map[string][]string `json:"links,omitempty"`
+}
+
+// stackRecord is what is remembered about a stack, the member specs living
+// in each member's project state
+type stackRecord struct {
+	Name string `json:"name"`
+	// Members are in deploy order
+	Members   []string            `json:"members"`
+	Links     map[string][]string `json:"links,omitempty"`
+	UpdatedAt time.Time           `json:"updated_at"`
+}
+
+// StackMemberResult is the outcome of one member of a stack operation
+type StackMemberResult struct {
+	Member  string            `json:"member"`
+	Project string            `json:"project"`
+	Status  string            `json:"status"`
+	Result  *DeploymentResult `json:"result,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// StackResult is the combined outcome of a stack operation. Members deployed
+// before a failure keep running; the ones after it are skipped.
+type StackResult struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Network string `json:"network"`
+	// FailedMember is the member that failed, empty on success
+	FailedMember string              `json:"failed_member,omitempty"`
+	Members      []StackMemberResult `json:"members"`
+}
+
+// StackStatus is the current status of every member of a stack
+type StackStatus struct {
+	Name    string              `json:"name"`
+	Network string              `json:"network"`
+	Links   map[string][]string `json:"links,omitempty"`
+	Members []StackMemberStatus `json:"members"`
+}
+
+// StackMemberStatus is the status of one stack member
+type StackMemberStatus struct {
+	Member string `json:"member"`
+	DeploymentStatus
+}
+
+// StackDeployFunc is called after each member deploy, e.g. to record an event
+type StackDeployFunc func(project string, started time.Time, result *DeploymentResult, err error)
+
+var (
+	stacksMutex sync.Mutex
+	// stacksBusy are the stacks an operation is running on
+	stacksBusy = make(map[string]bool)
+)
+
+func stackPath(name string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "stacks", name+".json"), nil
+}
+
+// stackNetworkName is the docker network a stack's members share
+func (d *DockerSetup) stackNetworkName(stack string) string {
+	return d.networkName() + "-" + stack
+}
+
+// stackMember returns a stack member's name, its project name without the
+// stack prefix, or "" outside a stack
+func stackMember(deployment Deployment) string {
+	if deployment.Stack == "" {
+		return ""
+	}
+	return strings.TrimPrefix(deployment.ProjectName, deployment.Stack+"-")
+}
+
+// validateStackMember checks a deployment's stack matches its project name
+func validateStackMember(deployment Deployment) error {
+	if deployment.Stack == "" {
+		return nil
+	}
+	if err := ValidateProjectName(deployment.Stack); err != nil {
+		return fmt.Errorf("invalid stack: %v", err)
+	}
+	if !strings.HasPrefix(deployment.ProjectName, deployment.Stack+"-") || !serviceNamePattern.MatchString(stackMember(deployment)) {
+		return fmt.Errorf("stack members must be named %s-<member>", deployment.Stack)
+	}
+	if deployment.Environment != "" {
+		return fmt.Errorf("stack members can't be deployed as an environment")
+	}
+	return nil
+}
+
+// composeAppNetworks renders the networks the app service joins. In a stack
+// the long syntax is needed to give the app its member name as an alias on
+// the stack network.
+func composeAppNetworks(networks []string, stackNetwork, alias string) string {
+	var b strings.Builder
+	for _, network := range networks {
+		if stackNetwork == "" {
+			fmt.Fprintf(&b, "      - %s\n", network)
+		} else {
+			fmt.Fprintf(&b, "      %s: {}\n", network)
+		}
+	}
+	if stackNetwork != "" {
+		fmt.Fprintf(&b, "      %s:\n        aliases:\n          - %s\n", stackNetwork, alias)
+	}
+	return b.String()
+}
+
+// stackEnvName is the env var a sibling's address is injected as, e.g.
+// API_URL for the member api
+func stackEnvName(member string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(member)) + "_URL"
+}
+
+// StackDeployments validates a stack and returns its member deployments in
+// dependency order, named <stack>-<member>, with the internal address of
+// every sibling added to their env vars unless already set
+func StackDeployments(stack Stack) ([]Deployment, error) {
+	if err := ValidateProjectName(stack.Name); err != nil {
+		return nil, fmt.Errorf("invalid stack name: %v", err)
+	}
+	if len(stack.Deployments) == 0 {
+		return nil, fmt.Errorf("a stack needs at least one deployment")
+	}
+
+	members := make(map[string]Deployment, len(stack.Deployments))
+	var names []string
+	for _, deployment := range stack.Deployments {
+		member := deployment.ProjectName
+		if !serviceNamePattern.MatchString(member) {
+			return nil, fmt.Errorf("invalid member name %q, use lowercase letters, digits, - and _", member)
+		}
+		if _, exists := members[member]; exists {
+			return nil, fmt.Errorf("member %s is listed twice", member)
+		}
+		if deployment.Environment != "" {
+			return nil, fmt.Errorf("member %s: stack members can't be deployed as an environment", member)
+		}
+		if deployment.UniqueName {
+			return nil, fmt.Errorf("member %s: unique_name is not supported in a stack", member)
+		}
+		members[member] = deployment
+		names = append(names, member)
+	}
+	for member, dependencies := range stack.Links {
+		if _, ok := members[member]; !ok {
+			return nil, fmt.Errorf("links name %s, which is not a member", member)
+		}
+		for _, dependency := range dependencies {
+			if _, ok := members[dependency]; !ok {
+				return nil, fmt.Errorf("%s links to %s, which is not a member", member, dependency)
+			}
+		}
+	}
+
+	order, err := stackOrder(names, stack.Links)
+	if err != nil {
+		return nil, err
+	}
+
+	deployments := make([]Deployment, 0, len(order))
+	for _, member := range order {
+		deployment := members[member]
+		env := make(map[string]string, len(deployment.EnvVars)+len(members))
+		for _, sibling := range names {
+			if sibling != member && !members[sibling].Static {
+				env[stackEnvName(sibling)] = fmt.Sprintf("http://%s:8080", sibling)
+			}
+		}
+		for name, value := range deployment.EnvVars {
+			env[name] = value
+		}
+		deployment.EnvVars = env
+		deployment.ProjectName = stack.Name + "-" + member
+		deployment.Stack = stack.Name
+		if err := ValidateProjectName(deployment.ProjectName); err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, deployment)
+	}
+	return deployments, nil
+}
+
+// stackOrder sorts members so each comes after the members it links to,
+// keeping the listed order otherwise
+func stackOrder(names []string, links map[string][]string) ([]string, error) {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	marks := make(map[string]int, len(names))
+	var order []string
+	var visit func(member string, path []string) error
+	visit = func(member string, path []string) error {
+		switch marks[member] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("links form a cycle: %s", strings.Join(append(path, member), " -> "))
+		}
+		marks[member] = visiting
+		for _, dependency := range links[member] {
+			if err := visit(dependency, append(path, member)); err != nil {
+				return err
+			}
+		}
+		marks[member] = done
+		order = append(order, member)
+		return nil
+	}
+	for _, member := range names {
+		if err := visit(member, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// lockStack marks a stack busy so only one operation runs on it at a time
+func lockStack(name string) error {
+	stacksMutex.Lock()
+	defer stacksMutex.Unlock()
+	if stacksBusy[name] {
+		return fmt.Errorf("stack %s is busy with another operation", name)
+	}
+	stacksBusy[name] = true
+	return nil
+}
+
+func unlockStack(name string) {
+	stacksMutex.Lock()
+	defer stacksMutex.Unlock()
+	delete(stacksBusy, name)
+}
+
+func loadStack(name string) (*stackRecord, error) {
+	path, err := stackPath(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("stack %s does not exist", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stack: %v", err)
+	}
+	record := &stackRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, fmt.Errorf("failed to parse stack: %v", err)
+	}
+	return record, nil
+}
+
+func saveStack(record *stackRecord) error {
+	path, err := stackPath(record.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create stacks directory: %v", err)
+	}
+	record.UpdatedAt = time.Now().UTC()
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write stack: %v", err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ListStacks returns the names of all stacks
+func ListStacks() ([]string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "stacks"))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stacks: %v", err)
+	}
+	stacks := []string{}
+	for _, entry := range entries {
+		if name, ok := strings.CutSuffix(entry.Name(), ".json"); ok && !entry.IsDir() {
+			stacks = append(stacks, name)
+		}
+	}
+	sort.Strings(stacks)
+	return stacks, nil
+}
+
+// StackProjects returns the project names of a stack's members
+func StackProjects(name string) ([]string, error) {
+	record, err := loadStack(name)
+	if err != nil {
+		return nil, err
+	}
+	projects := make([]string, len(record.Members))
+	for i, member := range record.Members {
+		projects[i] = name + "-" + member
+	}
+	return projects, nil
+}
+
+// DeployStack deploys a stack's members one at a time in dependency order.
+// The first failure stops the rollout: members already deployed are left
+// running and the rest are skipped. Members left out of a redeclared stack
+// are not removed.
+func (d *DockerSetup) DeployStack(stack Stack, deployed StackDeployFunc) (*StackResult, error) {
+	deployments, err := StackDeployments(stack)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockStack(stack.Name); err != nil {
+		return nil, err
+	}
+	defer unlockStack(stack.Name)
+
+	record := &stackRecord{Name: stack.Name, Links: stack.Links}
+	if existing, err := loadStack(stack.Name); err == nil {
+		record.Members = existing.Members
+	}
+	for _, deployment := range deployments {
+		member := stackMember(deployment)
+		known := false
+		for _, existing := range record.Members {
+			known = known || existing == member
+		}
+		if !known {
+			record.Members = append(record.Members, member)
+		}
+	}
+	if err := saveStack(record); err != nil {
+		return nil, err
+	}
+
+	fmt.Printf("[STACK] Deploying stack %s: %d members\n", stack.Name, len(deployments))
+	return d.rollOutStack(stack.Name, deployments, deployed), nil
+}
+
+// RedeployStack redeploys every member of a stack from its last deployed
+// spec, in dependency order
+func (d *DockerSetup) RedeployStack(name string, deployed StackDeployFunc) (*StackResult, error) {
+	if err := lockStack(name); err != nil {
+		return nil, err
+	}
+	defer unlockStack(name)
+	record, err := loadStack(name)
+	if err != nil {
+		return nil, err
+	}
+	order, err := stackOrder(record.Members, record.Links)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every member must be redeployable before any of them is touched
+	var deployments []Deployment
+	for _, member := range order {
+		project := name + "-" + member
+		state, err := LoadProjectState(project)
+		if err == nil && state.Deployment == nil {
+			err = fmt.Errorf("%s was never deployed successfully", project)
+		}
+		if err == nil && state.Deployment.GitURL == "" && state.Deployment.LocalPath == "" && state.Deployment.Image == "" {
+			err = fmt.Errorf("%s was deployed from an upload, redeploy it with a new upload", project)
+		}
+		if err != nil {
+			result := &StackResult{Name: name, Status: StackMemberFailed, Network: d.stackNetworkName(name), FailedMember: member}
+			for _, other := range order {
+				status := StackMemberResult{Member: other, Project: name + "-" + other, Status: StackMemberSkipped}
+				if other == member {
+					status.Status = StackMemberFailed
+					status.Error = err.Error()
+				}
+				result.Members = append(result.Members, status)
+			}
+			return result, nil
+		}
+		deployments = append(deployments, *state.Deployment)
+	}
+
+	fmt.Printf("[STACK] Redeploying stack %s: %d members\n", name, len(deployments))
+	return d.rollOutStack(name, deployments, deployed), nil
+}
+
+// rollOutStack deploys members in order, stopping at the first failure
+func (d *DockerSetup) rollOutStack(name string, deployments []Deployment, deployed StackDeployFunc) *StackResult {
+	result := &StackResult{Name: name, Status: StackMemberDeployed, Network: d.stackNetworkName(name)}
+	for _, deployment := range deployments {
+		member := StackMemberResult{Member: stackMember(deployment), Project: deployment.ProjectName}
+		if result.FailedMember != "" {
+			member.Status = StackMemberSkipped
+			result.Members = append(result.Members, member)
+			continue
+		}
+
+		started := time.Now()
+		deployResult, err := d.DeployProject(deployment)
+		if deployed != nil {
+			deployed(deployment.ProjectName, started, deployResult, err)
+		}
+		member.Result = deployResult
+		member.Status = StackMemberDeployed
+		if err != nil {
+			member.Status = StackMemberFailed
+			member.Error = err.Error()
+			result.Status = StackMemberFailed
+			result.FailedMember = member.Member
+			fmt.Printf("[STACK] Member %s of stack %s failed, skipping the rest: %v\n", member.Member, name, err)
+		}
+		result.Members = append(result.Members, member)
+	}
+	return result
+}
+
+// GetStackStatus returns the status of every member of a stack
+func (d *DockerSetup) GetStackStatus(name string) (*StackStatus, error) {
+	record, err := loadStack(name)
+	if err != nil {
+		return nil, err
+	}
+	status := &StackStatus{Name: name, Network: d.stackNetworkName(name), Links: record.Links, Members: []StackMemberStatus{}}
+	for _, member := range record.Members {
+		status.Members = append(status.Members, StackMemberStatus{
+			Member:           member,
+			DeploymentStatus: d.projectStatus(name + "-" + member),
+		})
+	}
+	return status, nil
+}
+
+// TeardownStack removes every member of a stack in reverse dependency
+// order, then the stack's network. Members that fail to be removed are
+// reported and the stack kept so the teardown can be retried.
+func (d *DockerSetup) TeardownStack(name string) (*StackResult, error) {
+	if err := lockStack(name); err != nil {
+		return nil, err
+	}
+	defer unlockStack(name)
+	record, err := loadStack(name)
+	if err != nil {
+		return nil, err
+	}
+	order, err := stackOrder(record.Members, record.Links)
+	if err != nil {
+		order = record.Members
+	}
+
+	result := &StackResult{Name: name, Status: StackMemberRemoved, Network: d.stackNetworkName(name)}
+	for i := len(order) - 1; i >= 0; i-- {
+		member := StackMemberResult{Member: order[i], Project: name + "-" + order[i], Status: StackMemberRemoved}
+		if d.jobs.busy(member.Project) {
+			err = fmt.Errorf("%s is being deployed", member.Project)
+		} else {
+			err = d.removeProject(member.Project)
+		}
+		if err != nil {
+			member.Status = StackMemberFailed
+			member.Error = err.Error()
+			result.Status = StackMemberFailed
+			if result.FailedMember == "" {
+				result.FailedMember = member.Member
+			}
+		}
+		result.Members = append(result.Members, member)
+	}
+	if result.FailedMember != "" {
+		return result, nil
+	}
+
+	if out, err := d.combinedOutput(exec.Command("docker", "network", "rm", result.Network)); err != nil && !strings.Contains(string(out), "not found") {
+		fmt.Printf("[STACK] Failed to remove network %s: %v: %s\n", result.Network, err, strings.TrimSpace(string(out)))
+	}
+	if path, err := stackPath(name); err == nil {
+		os.Remove(path)
+	}
+	fmt.Printf("[STACK] Removed stack %s\n", name)
+	return result, nil
+}
@@ -0,0 +1,94 @@
+package docker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Dockerfile sources recorded in the project state
+const (
+	DockerfileFromRepository = "repository"
+	DockerfileGenerated      = "generated"
+	DockerfileOverride       = "override"
+)
+
+// ProjectState is what the manager remembers about a project between deploys
+type ProjectState struct {
+	// DockerfileSource says where the Dockerfile of the last deploy came from
+	DockerfileSource string `json:"dockerfile_source,omitempty"`
+	// Proxy is the proxy mode of the last deploy, so teardown only removes
+	// proxy config that was actually written
+	Proxy string `json:"proxy,omitempty"`
+	// Deployment is the spec of the last successful deploy
+	Deployment *Deployment `json:"deployment,omitempty"`
+	// DeployedAt is when the last successful deploy finished
+	DeployedAt time.Time `json:"deployed_at,omitempty"`
+	// Owner is the ID of the API key that created the project
+	Owner string `json:"owner,omitempty"`
+	// Environment is the environment the project is deployed as, its name
+	// then ends in -<environment>
+	Environment string `json:"environment,omitempty"`
+	// Commit is the git commit of the last deploy
+	Commit string `json:"commit,omitempty"`
+	// UploadSHA256 is the hash of the last uploaded source archive, empty
+	// for projects deployed from git
+	UploadSHA256 string `json:"upload_sha256,omitempty"`
+	// WorkspaceCompressed is set while the source checkout is packed into
+	// workspace.tar.gz
+	WorkspaceCompressed bool `json:"workspace_compressed,omitempty"`
+	// PushedImages are the remote references of images pushed for the
+	// project, oldest first
+	PushedImages []string `json:"pushed_images,omitempty"`
+	// RegistryTags are the tags of the project's builds archived in the
+	// local registry, oldest first
+	RegistryTags []string `json:"registry_tags,omitempty"`
+}
+
+var stateMutex sync.Mutex
+
+// LoadProjectState returns a project's saved state, empty if none was
+// saved. Secrets in the deployment spec stay encrypted; decryptedSecrets
+// reveals them where they are used.
+func LoadProjectState(project string) (*ProjectState, error) {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	return loadProjectState(project)
+}
+
+func loadProjectState(project string) (*ProjectState, error) {
+	return store.LoadProject(project)
+}
+
+// UpdateProjectState applies update to a project's state and saves it
+func UpdateProjectState(project string, update func(*ProjectState)) error {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	state, err := loadProjectState(project)
+	if err != nil {
+		return err
+	}
+	update(state)
+	return saveProjectState(project, state)
+}
+
+// saveProjectState stores a project's state with its secrets encrypted, the
+// caller holding stateMutex. Values already encrypted are kept as they are.
+func saveProjectState(project string, state *ProjectState) error {
+	stored := *state
+	var err error
+	stored.Deployment, err = mapSecrets(state.Deployment, encryptSecret)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt project state: %v", err)
+	}
+	return store.SaveProject(project, &stored)
+}
+
+// saveDeployedSpec records the spec of a successful deploy
+func saveDeployedSpec(deployment Deployment) error {
+	return UpdateProjectState(deployment.ProjectName, func(state *ProjectState) {
+		state.Deployment = &deployment
+		state.DeployedAt = time.Now().UTC()
+	})
+}
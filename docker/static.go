@@ -0,0 +1,151 @@
+package docker
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// staticRoot is where nginx serves static deployments from
+const staticRoot = "/var/www/erebrus"
+
+// staticOutputDirs are checked in order for the built site
+var staticOutputDirs = []string{"dist", "build", "public"}
+
+// deployStatic builds the site if needed, publishes it under the nginx root
+// and configures nginx to serve the files directly
+func (d *DockerSetup) deployStatic(workDir string, deployment Deployment, sendLog func(string)) (*DeploymentResult, error) {
+	if _, err := os.Stat(filepath.Join(workDir, "package.json")); err == nil {
+		sendLog("[STATIC] Building site in a throwaway container")
+		if err := d.buildStaticSite(workDir, deployment); err != nil {
+			return nil, fmt.Errorf("failed to build static site: %v", err)
+		}
+	}
+
+	outputDir, err := findStaticOutput(workDir)
+	if err != nil {
+		return nil, err
+	}
+
+	siteRoot := filepath.Join(staticRoot, deployment.ProjectName)
+	sendLog(fmt.Sprintf("[STATIC] Publishing %s to %s", outputDir, siteRoot))
+	if err := d.publishStaticSite(outputDir, siteRoot); err != nil {
+		return nil, fmt.Errorf("failed to publish static site: %v", err)
+	}
+
+	sendLog("[DEPLOY] Configuring Nginx to serve static files")
+	if err := d.configureStaticNginx(deployment, siteRoot); err != nil {
+		return nil, fmt.Errorf("failed to configure nginx: %v", err)
+	}
+
+	if err := saveDeployedSpec(deployment); err != nil {
+		sendLog(fmt.Sprintf("[DEPLOY] Failed to save deployment state: %v", err))
+	}
+
+	sendLog("[DEPLOY] Deployment completed successfully!")
+	return &DeploymentResult{
+		Status: "success",
+		URL:    d.buildDeploymentURL(deployment),
+	}, nil
+}
+
+// buildStaticSite runs the npm build in a container that is removed
+// afterwards. The npm cache is kept in a per-project volume unless no_cache
+// is set.
+func (d *DockerSetup) buildStaticSite(workDir string, deployment Deployment) error {
+	args := []string{"run", "--rm", "-v", workDir + ":/app", "-w", "/app"}
+	if !deployment.NoCache {
+		args = append(args, "-v", fmt.Sprintf("erebrus-%s-npm:/root/.npm", composeProjectName(deployment.ProjectName)))
+	}
+	args = append(args, "node:16-alpine", "sh", "-c", "npm install && npm run build")
+	cmd := exec.Command("docker", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return d.runner.Run(cmd)
+}
+
+// findStaticOutput returns the directory holding the built site, falling back
+// to the repository root when it contains an index.html
+func findStaticOutput(workDir string) (string, error) {
+	for _, dir := range staticOutputDirs {
+		path := filepath.Join(workDir, dir)
+		if _, err := os.Stat(filepath.Join(path, "index.html")); err == nil {
+			return path, nil
+		}
+	}
+	if _, err := os.Stat(filepath.Join(workDir, "index.html")); err == nil {
+		return workDir, nil
+	}
+	return "", fmt.Errorf("no index.html found in %v or the repository root", staticOutputDirs)
+}
+
+// publishStaticSite replaces the served copy of the site with the new build
+func (d *DockerSetup) publishStaticSite(outputDir, siteRoot string) error {
+	commands := [][]string{
+		{"rm", "-rf", siteRoot},
+		{"mkdir", "-p", siteRoot},
+		{"cp", "-r", outputDir + "/.", siteRoot},
+		{"rm", "-rf", filepath.Join(siteRoot, ".git"), filepath.Join(siteRoot, logsDirName), filepath.Join(siteRoot, deployLogName)},
+	}
+	for _, args := range commands {
+		if err := d.runElevated(args[0], args[1:]...); err != nil {
+			return fmt.Errorf("%v failed: %v", args, err)
+		}
+	}
+	return nil
+}
+
+func (d *DockerSetup) configureStaticNginx(deployment Deployment, siteRoot string) error {
+	config, err := d.staticNginxConfig(deployment, siteRoot)
+	if err != nil {
+		return err
+	}
+	return d.installNginxConfig(deployment.ProjectName, config)
+}
+
+// staticNginxConfig renders the site serving a static deployment's files
+func (d *DockerSetup) staticNginxConfig(deployment Deployment, siteRoot string) (string, error) {
+	configTemplate := `server {
+%s    server_name %s;
+%s
+    ssl_certificate %s;
+    ssl_certificate_key %s;
+    ssl_trusted_certificate /etc/nginx/ssl/ca.crt;
+    
+    ssl_protocols TLSv1.2 TLSv1.3;
+    ssl_ciphers ECDHE-ECDSA-AES128-GCM-SHA256:ECDHE-RSA-AES128-GCM-SHA256:ECDHE-ECDSA-AES256-GCM-SHA384:ECDHE-RSA-AES256-GCM-SHA384:ECDHE-ECDSA-CHACHA20-POLY1305:ECDHE-RSA-CHACHA20-POLY1305:DHE-RSA-AES128-GCM-SHA256:DHE-RSA-AES256-GCM-SHA384;
+    ssl_prefer_server_ciphers off;
+    
+    ssl_session_timeout 1d;
+    ssl_session_cache shared:SSL:50m;
+    ssl_session_tickets off;
+%s
+    # Redirect HTTP to HTTPS
+    if ($scheme != "https") {
+        return 301 https://$host$request_uri;
+    }
+
+    root %s;
+    index index.html;
+%s
+    location / {
+%s        # Fall back to index.html for client side routing
+        try_files $uri $uri/ /index.html;
+
+        # Add CORS headers
+%s
+    }
+}`
+
+	serverName, certPath, keyPath, err := d.nginxServerTLS(deployment)
+	if err != nil {
+		return "", err
+	}
+
+	access := nginxAllowIPs(deployment.AllowIPs)
+	headers := nginxCORSOrigin(deployment.CORSOrigins) + nginxHeaders(deployment.Headers)
+	assets := nginxAssetCaching(deployment, access+"        try_files $uri =404;\n"+headers)
+	return fmt.Sprintf(configTemplate, nginxListen(""), serverName, nginxLogging(deployment.ProjectName), certPath, keyPath, nginxCompression(deployment),
+		siteRoot, assets, access, headers), nil
+}
@@ -0,0 +1,284 @@
+package docker
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ErrProjectNotRunning is returned when a project has no running containers
+var ErrProjectNotRunning = errors.New("project is not running")
+
+// ContainerStats is a single container's resource usage snapshot
+type ContainerStats struct {
+	Container        string  `json:"container"`
+	Name             string  `json:"name"`
+	CPUPercent       float64 `json:"cpu_percent"`
+	MemoryUsageBytes uint64  `json:"memory_usage_bytes"`
+	MemoryLimitBytes uint64  `json:"memory_limit_bytes"`
+	MemoryPercent    float64 `json:"memory_percent"`
+	NetworkRxBytes   uint64  `json:"network_rx_bytes"`
+	NetworkTxBytes   uint64  `json:"network_tx_bytes"`
+	BlockReadBytes   uint64  `json:"block_read_bytes"`
+	BlockWriteBytes  uint64  `json:"block_write_bytes"`
+	PIDs             int     `json:"pids"`
+}
+
+// SystemStats aggregates usage across every managed deployment and the host
+type SystemStats struct {
+	LoadAverage          [3]float64                  `json:"load_average"`
+	MemoryTotalBytes     uint64                      `json:"memory_total_bytes"`
+	MemoryAvailableBytes uint64                      `json:"memory_available_bytes"`
+	SwapTotalBytes       uint64                      `json:"swap_total_bytes"`
+	CPUPercent           float64                     `json:"cpu_percent"`
+	MemoryUsageBytes     uint64                      `json:"memory_usage_bytes"`
+	Deployments          map[string][]ContainerStats `json:"deployments"`
+	// Lifecycle counts crashes, OOM kills and restarts per project
+	Lifecycle map[string]LifecycleCounters `json:"lifecycle"`
+	// RegistryBytes is the disk used by the local registry, absent when it
+	// is disabled or unavailable
+	RegistryBytes *uint64 `json:"registry_bytes,omitempty"`
+}
+
+// dockerStatsLine mirrors the fields docker prints with --format '{{json .}}'
+type dockerStatsLine struct {
+	Container string `json:"Container"`
+	Name      string `json:"Name"`
+	CPUPerc   string `json:"CPUPerc"`
+	MemUsage  string `json:"MemUsage"`
+	MemPerc   string `json:"MemPerc"`
+	NetIO     string `json:"NetIO"`
+	BlockIO   string `json:"BlockIO"`
+	PIDs      string `json:"PIDs"`
+}
+
+var projectNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// ValidateProjectName rejects names that are unsafe to use in paths and commands
+func ValidateProjectName(name string) error {
+	if !projectNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return fmt.Errorf("invalid project name: %q", name)
+	}
+	return nil
+}
+
+// composeProjectName returns the name docker compose derives from the workspace directory
+func composeProjectName(project string) string {
+	return regexp.MustCompile(`[^a-z0-9_-]`).ReplaceAllString(strings.ToLower(project), "")
+}
+
+// projectContainers lists the running containers belonging to a project's compose stack
+func projectContainers(project string) ([]string, error) {
+	out, err := exec.Command("docker", "ps",
+		"--filter", "label=com.docker.compose.project="+composeProjectName(project),
+		"--format", "{{.Names}}").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// GetProjectStats returns a point-in-time resource usage snapshot for a project's containers
+func (d *DockerSetup) GetProjectStats(project string) ([]ContainerStats, error) {
+	containers, err := projectContainers(project)
+	if err != nil {
+		return nil, err
+	}
+	if len(containers) == 0 {
+		return nil, ErrProjectNotRunning
+	}
+	return containerStats(containers)
+}
+
+// GetSystemStats returns host load and memory plus usage of every managed deployment
+func (d *DockerSetup) GetSystemStats() (*SystemStats, error) {
+	stats := &SystemStats{Deployments: make(map[string][]ContainerStats), Lifecycle: d.LifecycleCounts()}
+
+	if err := readLoadAverage(stats); err != nil {
+		return nil, err
+	}
+	if err := readMemInfo(stats); err != nil {
+		return nil, err
+	}
+
+	if d.LocalRegistry {
+		if size, err := d.localRegistryBytes(); err == nil {
+			stats.RegistryBytes = &size
+		}
+	}
+
+	projects, err := ListProjects()
+	if err != nil {
+		return nil, err
+	}
+	for _, project := range projects {
+		projectStats, err := d.GetProjectStats(project)
+		if errors.Is(err, ErrProjectNotRunning) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		stats.Deployments[project] = projectStats
+		for _, container := range projectStats {
+			stats.CPUPercent += container.CPUPercent
+			stats.MemoryUsageBytes += container.MemoryUsageBytes
+		}
+	}
+	return stats, nil
+}
+
+// ListProjects returns the names of all projects with a workspace
+func ListProjects() ([]string, error) {
+	root, err := deploymentsRoot()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deployments: %v", err)
+	}
+
+	var projects []string
+	for _, entry := range entries {
+		if entry.IsDir() && ValidateProjectName(entry.Name()) == nil {
+			projects = append(projects, entry.Name())
+		}
+	}
+	return projects, nil
+}
+
+func containerStats(containers []string) ([]ContainerStats, error) {
+	args := append([]string{"stats", "--no-stream", "--format", "{{json .}}"}, containers...)
+	out, err := exec.Command("docker", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("docker stats failed: %v", err)
+	}
+
+	var stats []ContainerStats
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line == "" {
+			continue
+		}
+		var raw dockerStatsLine
+		if err := json.Unmarshal([]byte(line), &raw); err != nil {
+			return nil, fmt.Errorf("failed to parse docker stats output: %v", err)
+		}
+		stats = append(stats, parseStatsLine(raw))
+	}
+	return stats, nil
+}
+
+// parseStatsLine converts docker's human formatted values into numbers
+func parseStatsLine(raw dockerStatsLine) ContainerStats {
+	stats := ContainerStats{
+		Container:     raw.Container,
+		Name:          raw.Name,
+		CPUPercent:    parsePercent(raw.CPUPerc),
+		MemoryPercent: parsePercent(raw.MemPerc),
+	}
+	stats.MemoryUsageBytes, stats.MemoryLimitBytes = parseSizePair(raw.MemUsage)
+	stats.NetworkRxBytes, stats.NetworkTxBytes = parseSizePair(raw.NetIO)
+	stats.BlockReadBytes, stats.BlockWriteBytes = parseSizePair(raw.BlockIO)
+	stats.PIDs, _ = strconv.Atoi(strings.TrimSpace(raw.PIDs))
+	return stats
+}
+
+func parsePercent(value string) float64 {
+	percent, _ := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64)
+	return percent
+}
+
+// parseSizePair parses values such as "1.5MiB / 1.944GiB"
+func parseSizePair(value string) (uint64, uint64) {
+	parts := strings.SplitN(value, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0
+	}
+	return parseSize(parts[0]), parseSize(parts[1])
+}
+
+var sizeUnits = map[string]float64{
+	"b":   1,
+	"kb":  1e3,
+	"mb":  1e6,
+	"gb":  1e9,
+	"tb":  1e12,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+	"tib": 1 << 40,
+}
+
+var sizePattern = regexp.MustCompile(`^([0-9.]+)\s*([a-zA-Z]*)$`)
+
+// parseSize parses docker's decimal (kB, MB) and binary (KiB, MiB) sizes into bytes
+func parseSize(value string) uint64 {
+	match := sizePattern.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return 0
+	}
+	number, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0
+	}
+	unit := strings.ToLower(match[2])
+	if unit == "" {
+		unit = "b"
+	}
+	multiplier, ok := sizeUnits[unit]
+	if !ok {
+		return 0
+	}
+	return uint64(number * multiplier)
+}
+
+func readLoadAverage(stats *SystemStats) error {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return fmt.Errorf("failed to read load average: %v", err)
+	}
+	fields := strings.Fields(string(data))
+	for i := 0; i < 3 && i < len(fields); i++ {
+		stats.LoadAverage[i], _ = strconv.ParseFloat(fields[i], 64)
+	}
+	return nil
+}
+
+func readMemInfo(stats *SystemStats) error {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return fmt.Errorf("failed to read memory info: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+		kb, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			stats.MemoryTotalBytes = kb * 1024
+		case "MemAvailable:":
+			stats.MemoryAvailableBytes = kb * 1024
+		case "SwapTotal:":
+			stats.SwapTotalBytes = kb * 1024
+		}
+	}
+	return scanner.Err()
+}
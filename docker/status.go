@@ -0,0 +1,107 @@
+package docker
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Deployment states reported by ListDeployments
+const (
+	StatusRunning = "running"
+	StatusStopped = "stopped"
+	StatusStatic  = "static"
+)
+
+// DeploymentStatus summarises a managed deployment
+type DeploymentStatus struct {
+	Project      string `json:"project"`
+	Status       string `json:"status"`
+	CrashLooping bool   `json:"crash_looping"`
+	// UploadSHA256 identifies the archive of upload-based projects, which
+	// need a new upload to redeploy
+	UploadSHA256 string `json:"upload_sha256,omitempty"`
+	// Owner is the ID of the API key that created the project
+	Owner string `json:"owner,omitempty"`
+	// Environment and Commit are set for deployments of an environment
+	Environment string `json:"environment,omitempty"`
+	Commit      string `json:"commit,omitempty"`
+	// WorkspaceCompressed is set when the source is packed to save disk
+	WorkspaceCompressed bool `json:"workspace_compressed,omitempty"`
+	// AllowIPs is the active allowlist, empty when the app is open to all
+	AllowIPs []string `json:"allow_ips,omitempty"`
+	// Environments lists the per-environment deployments of a logical project
+	Environments []DeploymentStatus `json:"environments,omitempty"`
+}
+
+// ListDeployments returns the current status of every managed deployment.
+// Environment deployments are grouped under their logical project.
+func (d *DockerSetup) ListDeployments() ([]DeploymentStatus, error) {
+	projects, err := ListProjects()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := []DeploymentStatus{}
+	var environments []DeploymentStatus
+	for _, project := range projects {
+		status := d.projectStatus(project)
+		if status.Environment != "" {
+			environments = append(environments, status)
+			continue
+		}
+		statuses = append(statuses, status)
+	}
+
+	groups := make(map[string]int)
+	for i, status := range statuses {
+		groups[status.Project] = i
+	}
+	envOnly := make(map[string]bool)
+	for _, status := range environments {
+		logical := logicalProject(status.Project, status.Environment)
+		i, ok := groups[logical]
+		if !ok {
+			i = len(statuses)
+			groups[logical] = i
+			envOnly[logical] = true
+			statuses = append(statuses, DeploymentStatus{Project: logical, Status: StatusStopped})
+		}
+		group := &statuses[i]
+		group.Environments = append(group.Environments, status)
+
+		// A group with only environments deployed reflects their health
+		if envOnly[logical] {
+			if status.CrashLooping {
+				group.Status = StatusCrashLooping
+				group.CrashLooping = true
+			} else if group.Status == StatusStopped {
+				group.Status = status.Status
+			}
+		}
+	}
+	return statuses, nil
+}
+
+// projectStatus returns the current status of one deployment
+func (d *DockerSetup) projectStatus(project string) DeploymentStatus {
+	status := DeploymentStatus{Project: project, Status: StatusStopped}
+	if d.IsCrashLooping(project) {
+		status.Status = StatusCrashLooping
+		status.CrashLooping = true
+	} else if containers, err := projectContainers(project); err == nil && len(containers) > 0 {
+		status.Status = StatusRunning
+	} else if _, err := os.Stat(filepath.Join(staticRoot, project)); err == nil {
+		status.Status = StatusStatic
+	}
+	if state, err := LoadProjectState(project); err == nil {
+		status.UploadSHA256 = state.UploadSHA256
+		status.Environment = state.Environment
+		status.Commit = state.Commit
+		status.Owner = state.Owner
+		status.WorkspaceCompressed = state.WorkspaceCompressed
+		if state.Deployment != nil {
+			status.AllowIPs = state.Deployment.AllowIPs
+		}
+	}
+	return status
+}
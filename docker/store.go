@@ -0,0 +1,277 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Store persists what the manager remembers between runs: project state,
+// event history and the deploy sequence. Secrets are encrypted before they
+// reach the store, and read-modify-write of project state is serialized by
+// stateMutex above it, so a store only needs to make single operations
+// atomic.
+type Store interface {
+	// LoadProject returns a project's state as stored, empty when none was
+	// saved
+	LoadProject(project string) (*ProjectState, error)
+	// SaveProject replaces a project's state
+	SaveProject(project string, state *ProjectState) error
+	// DeleteProject removes a project's state, keeping its events
+	DeleteProject(project string) error
+	// Projects lists the projects with a saved state
+	Projects() ([]string, error)
+
+	// AppendEvents adds events to the end of a project's history
+	AppendEvents(project string, events []Event) error
+	// Events returns a project's history, oldest first
+	Events(project string) ([]Event, error)
+	// HasEvents reports whether a project has any history
+	HasEvents(project string) bool
+	// MoveEvents gives a project's history to a new name
+	MoveEvents(oldName, newName string) error
+
+	// NextSequence returns the next deployment sequence number, persisting
+	// it before it is handed out so numbers are never reused
+	NextSequence() (uint64, error)
+}
+
+// store is where state is kept, the JSON files under the state directory
+// unless replaced with SetStore
+var store Store = &fileStore{}
+
+// SetStore replaces the state store. It must be called before anything is
+// deployed.
+func SetStore(s Store) {
+	store = s
+}
+
+// fileStore keeps state as files under the state directory: one JSON file
+// per project, a JSON lines event log per project and the last sequence
+// number
+type fileStore struct {
+	eventsMutex   sync.Mutex
+	sequenceMutex sync.Mutex
+}
+
+func projectStatePath(project string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "projects", project+".json"), nil
+}
+
+func eventsPath(project string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "events", project+".jsonl"), nil
+}
+
+func sequencePath() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "deploy_sequence"), nil
+}
+
+func (s *fileStore) LoadProject(project string) (*ProjectState, error) {
+	path, err := projectStatePath(project)
+	if err != nil {
+		return nil, err
+	}
+	state := &ProjectState{}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read project state: %v", err)
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("failed to parse project state: %v", err)
+	}
+	return state, nil
+}
+
+func (s *fileStore) SaveProject(project string, state *ProjectState) error {
+	path, err := projectStatePath(project)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so a crash never leaves a truncated state file
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write project state: %v", err)
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func (s *fileStore) DeleteProject(project string) error {
+	path, err := projectStatePath(project)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove project state: %v", err)
+	}
+	return nil
+}
+
+func (s *fileStore) Projects() ([]string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "projects"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list project state: %v", err)
+	}
+	var projects []string
+	for _, entry := range entries {
+		if project, ok := strings.CutSuffix(entry.Name(), ".json"); ok && !entry.IsDir() {
+			projects = append(projects, project)
+		}
+	}
+	return projects, nil
+}
+
+func (s *fileStore) AppendEvents(project string, events []Event) error {
+	var lines bytes.Buffer
+	for _, event := range events {
+		line, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		lines.Write(append(line, '\n'))
+	}
+	path, err := eventsPath(project)
+	if err != nil {
+		return err
+	}
+
+	s.eventsMutex.Lock()
+	defer s.eventsMutex.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create events directory: %v", err)
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open event log: %v", err)
+	}
+	defer file.Close()
+	_, err = file.Write(lines.Bytes())
+	return err
+}
+
+func (s *fileStore) Events(project string) ([]Event, error) {
+	path, err := eventsPath(project)
+	if err != nil {
+		return nil, err
+	}
+
+	s.eventsMutex.Lock()
+	defer s.eventsMutex.Unlock()
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []Event{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event log: %v", err)
+	}
+	defer file.Close()
+
+	events := []Event{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var event Event
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			continue // Skip a partially written line
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+func (s *fileStore) HasEvents(project string) bool {
+	path, err := eventsPath(project)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+func (s *fileStore) MoveEvents(oldName, newName string) error {
+	oldPath, err := eventsPath(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := eventsPath(newName)
+	if err != nil {
+		return err
+	}
+
+	s.eventsMutex.Lock()
+	defer s.eventsMutex.Unlock()
+
+	if _, err := os.Stat(oldPath); err != nil {
+		return nil
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (s *fileStore) NextSequence() (uint64, error) {
+	s.sequenceMutex.Lock()
+	defer s.sequenceMutex.Unlock()
+
+	path, err := sequencePath()
+	if err != nil {
+		return 0, err
+	}
+	var last uint64
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if last, err = strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64); err != nil {
+			return 0, fmt.Errorf("corrupt deploy sequence in %s: %v", path, err)
+		}
+	case !os.IsNotExist(err):
+		return 0, fmt.Errorf("failed to read deploy sequence: %v", err)
+	}
+
+	next := last + 1
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, fmt.Errorf("failed to create state directory: %v", err)
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(strconv.FormatUint(next, 10)+"\n"), 0644); err != nil {
+		return 0, fmt.Errorf("failed to write deploy sequence: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return 0, fmt.Errorf("failed to write deploy sequence: %v", err)
+	}
+	return next, nil
+}
@@ -0,0 +1,77 @@
+package docker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFileStoreProjects(t *testing.T) {
+	newTestSetup(t, 43400)
+	s := &fileStore{}
+
+	if state, err := s.LoadProject("app"); err != nil || !reflect.DeepEqual(state, &ProjectState{}) {
+		t.Fatalf("got %+v, %v for a project never saved, want an empty state", state, err)
+	}
+	saved := &ProjectState{Owner: "key1", Commit: "abc123", Deployment: &Deployment{ProjectName: "app", EnvVars: map[string]string{"A": "1"}}}
+	if err := s.SaveProject("app", saved); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := s.LoadProject("app"); err != nil || !reflect.DeepEqual(loaded, saved) {
+		t.Errorf("got %+v, %v, want %+v", loaded, err, saved)
+	}
+	if projects, err := s.Projects(); err != nil || !reflect.DeepEqual(projects, []string{"app"}) {
+		t.Errorf("got projects %v, %v, want [app]", projects, err)
+	}
+
+	if err := s.DeleteProject("app"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteProject("app"); err != nil {
+		t.Errorf("deleting a missing project: %v", err)
+	}
+	if projects, err := s.Projects(); err != nil || len(projects) != 0 {
+		t.Errorf("got projects %v, %v after deleting, want none", projects, err)
+	}
+}
+
+func TestFileStoreEvents(t *testing.T) {
+	newTestSetup(t, 43410)
+	s := &fileStore{}
+
+	if s.HasEvents("app") {
+		t.Error("project without history has events")
+	}
+	if err := s.AppendEvents("app", []Event{{Type: EventDeploy, DeployID: "d1"}, {Type: EventRedeploy, DeployID: "d2"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendEvents("app", []Event{{Type: EventEnv}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.MoveEvents("app", "web"); err != nil {
+		t.Fatal(err)
+	}
+	if s.HasEvents("app") {
+		t.Error("history still under the old name after moving it")
+	}
+
+	events, err := s.Events("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, event := range events {
+		types = append(types, event.Type)
+	}
+	if want := []string{EventDeploy, EventRedeploy, EventEnv}; !reflect.DeepEqual(types, want) {
+		t.Errorf("got events %v, want %v in order", types, want)
+	}
+}
+
+func TestFileStoreNextSequence(t *testing.T) {
+	newTestSetup(t, 43420)
+	for want := uint64(1); want <= 3; want++ {
+		if got, err := (&fileStore{}).NextSequence(); err != nil || got != want {
+			t.Fatalf("got %d, %v, want %d", got, err, want)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package docker
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// hasSubmodules reports whether the checkout declares git submodules
+func hasSubmodules(workDir string) bool {
+	_, err := os.Stat(filepath.Join(workDir, ".gitmodules"))
+	return err == nil
+}
+
+// updateSubmodules checks out the submodules of a cloned repository. The
+// credentials of the URL the repository was cloned from are reused for
+// submodules on the same host, passed through the environment so they
+// never show up in the process list or the logs.
+func (d *DockerSetup) updateSubmodules(workDir, remote string, sendLog func(string)) error {
+	sendLog("[GIT] Updating submodules")
+	cmd := exec.Command("git", "submodule", "update", "--init", "--recursive", "--progress")
+	cmd.Dir = workDir
+	cmd.Env = append(os.Environ(), "GIT_LFS_SKIP_SMUDGE=1", "GIT_TERMINAL_PROMPT=0")
+	if u, err := url.Parse(remote); err == nil && u.User != nil && u.Host != "" {
+		base := u.Scheme + "://" + u.Host + "/"
+		cmd.Env = append(cmd.Env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=url."+u.Scheme+"://"+u.User.String()+"@"+u.Host+"/.insteadOf",
+			"GIT_CONFIG_VALUE_0="+base,
+		)
+	}
+	if err := d.streamCommand(cmd, "[GIT]", sendLog); err != nil {
+		return fmt.Errorf("git submodule update failed: %v", err)
+	}
+	return nil
+}
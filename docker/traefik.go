@@ -0,0 +1,71 @@
+package docker
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// TraefikConfig describes the Traefik instance deployments are routed through
+type TraefikConfig struct {
+	// Network is the external docker network Traefik watches
+	Network string
+	// Entrypoint is the Traefik entrypoint routers attach to
+	Entrypoint string
+	// CertResolver is the TLS certificate resolver, none when empty
+	CertResolver string
+}
+
+var domainPattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?\.)+[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?$`)
+
+// deploymentDomain returns the domain a deployment is served on
+func deploymentDomain(deployment Deployment) string {
+	if deployment.Domain != "" {
+		return deployment.Domain
+	}
+	return fmt.Sprintf("%s.localhost", hostLabel(deployment))
+}
+
+// validateDomain rejects domains that can't be used in routing rules
+func validateDomain(domain string) error {
+	if domain != "" && !domainPattern.MatchString(domain) {
+		return fmt.Errorf("invalid domain: %q", domain)
+	}
+	return nil
+}
+
+// traefikLabels renders the router and service labels for the app service
+func (d *DockerSetup) traefikLabels(deployment Deployment) string {
+	router := composeProjectName(deployment.ProjectName)
+	labels := []string{
+		"traefik.enable=true",
+		"traefik.docker.network=" + d.Traefik.Network,
+		fmt.Sprintf("traefik.http.routers.%s.rule=Host(`%s`)", router, deploymentDomain(deployment)),
+		fmt.Sprintf("traefik.http.routers.%s.entrypoints=%s", router, d.Traefik.Entrypoint),
+		fmt.Sprintf("traefik.http.routers.%s.tls=true", router),
+		fmt.Sprintf("traefik.http.services.%s.loadbalancer.server.port=8080", router),
+	}
+	if deployment.ProxyProtocol == ProtocolGRPC {
+		labels = append(labels, fmt.Sprintf("traefik.http.services.%s.loadbalancer.server.scheme=h2c", router))
+	}
+	if d.Traefik.CertResolver != "" {
+		labels = append(labels, fmt.Sprintf("traefik.http.routers.%s.tls.certresolver=%s", router, d.Traefik.CertResolver))
+	}
+
+	var b strings.Builder
+	for _, label := range labels {
+		name, value, _ := strings.Cut(label, "=")
+		fmt.Fprintf(&b, "      %s: %s\n", name, composeQuote(value))
+	}
+	return b.String()
+}
+
+// checkTraefikNetwork fails early when the Traefik network is missing, since
+// compose would otherwise error out after the build
+func (d *DockerSetup) checkTraefikNetwork() error {
+	if err := d.runner.Run(exec.Command("docker", "network", "inspect", d.Traefik.Network)); err != nil {
+		return fmt.Errorf("traefik network %q not found, is Traefik running?", d.Traefik.Network)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+//go:build integration
+
+package docker
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// requireDocker skips the test unless a docker daemon is reachable
+func requireDocker(t *testing.T) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("integration test skipped in short mode")
+	}
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skipf("docker is not available: %v", err)
+	}
+}
+
+// dockerRun runs a docker command for the test's own setup
+func dockerRun(t *testing.T, args ...string) string {
+	t.Helper()
+	out, err := exec.Command("docker", args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("docker %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// TestTraefikRoutesDeployment deploys an app in traefik mode behind a
+// throwaway Traefik container and requests it through Traefik by domain.
+// Run with: go test -tags integration -run TestTraefikRoutesDeployment ./docker/
+func TestTraefikRoutesDeployment(t *testing.T) {
+	requireDocker(t)
+	SetBaseDir(t.TempDir())
+	t.Cleanup(func() { SetBaseDir("") })
+	loadTestSecretKey(t)
+	startingPort = 44200
+
+	suffix := fmt.Sprintf("%d", time.Now().UnixNano()%1000000)
+	network := "erebrus-it-proxy-" + suffix
+	traefik := "erebrus-it-traefik-" + suffix
+	dockerRun(t, "network", "create", network)
+	t.Cleanup(func() { exec.Command("docker", "network", "rm", network).Run() })
+	dockerRun(t, "run", "-d", "--name", traefik, "--network", network,
+		"-v", "/var/run/docker.sock:/var/run/docker.sock:ro",
+		"-p", "127.0.0.1::443",
+		"traefik:v3.1",
+		"--providers.docker=true",
+		"--providers.docker.exposedbydefault=false",
+		"--entrypoints.websecure.address=:443")
+	t.Cleanup(func() { exec.Command("docker", "rm", "-f", traefik).Run() })
+	published := dockerRun(t, "port", traefik, "443/tcp")
+	_, hostPort, err := net.SplitHostPort(strings.Split(published, "\n")[0])
+	if err != nil {
+		t.Fatalf("unexpected published port %q: %v", published, err)
+	}
+
+	d := NewDockerSetup()
+	if err := d.DetectCompose(); err != nil {
+		t.Fatal(err)
+	}
+	d.NetworkName = "erebrus-it-apps-" + suffix
+	d.Traefik = TraefikConfig{Network: network, Entrypoint: "websecure"}
+	const project, domain = "whoami", "whoami.erebrus.test"
+	result, err := d.DeployProject(Deployment{
+		ProjectName: project,
+		Image:       "traefik/whoami:v1.10",
+		Domain:      domain,
+		Proxy:       ProxyTraefik,
+		EnvVars:     map[string]string{"WHOAMI_PORT_NUMBER": "8080"},
+	})
+	t.Cleanup(func() {
+		d.removeProject(project)
+		exec.Command("docker", "network", "rm", d.NetworkName).Run()
+	})
+	if err != nil {
+		t.Fatalf("DeployProject: %v", err)
+	}
+	if result.URL != "https://"+domain {
+		t.Errorf("got URL %s, want https://%s", result.URL, domain)
+	}
+
+	// Traefik serves its default certificate, the domain is routed by SNI
+	// and Host
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{ServerName: domain, InsecureSkipVerify: true},
+		},
+	}
+	request, err := http.NewRequest("GET", "https://127.0.0.1:"+hostPort+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Host = domain
+
+	var status int
+	var body []byte
+	for deadline := time.Now().Add(60 * time.Second); time.Now().Before(deadline); time.Sleep(time.Second) {
+		resp, err := client.Do(request)
+		if err != nil {
+			continue
+		}
+		status = resp.StatusCode
+		body, _ = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if status == http.StatusOK {
+			break
+		}
+	}
+	if status != http.StatusOK || !strings.Contains(string(body), "Hostname:") {
+		t.Fatalf("got status %d from Traefik for %s:\n%s", status, domain, body)
+	}
+}
@@ -0,0 +1,70 @@
+package docker
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTraefikLabels(t *testing.T) {
+	d := &DockerSetup{Traefik: TraefikConfig{Network: "proxy", Entrypoint: "websecure", CertResolver: "le"}}
+
+	labels := d.traefikLabels(Deployment{ProjectName: "shop", Domain: "shop.example.com", ProxyProtocol: ProtocolGRPC})
+	for _, want := range []string{
+		`traefik.enable: "true"`,
+		`traefik.docker.network: "proxy"`,
+		"traefik.http.routers.shop.rule: \"Host(`shop.example.com`)\"",
+		`traefik.http.routers.shop.entrypoints: "websecure"`,
+		`traefik.http.routers.shop.tls: "true"`,
+		`traefik.http.routers.shop.tls.certresolver: "le"`,
+		`traefik.http.services.shop.loadbalancer.server.port: "8080"`,
+		`traefik.http.services.shop.loadbalancer.server.scheme: "h2c"`,
+	} {
+		if !strings.Contains(labels, "      "+want+"\n") {
+			t.Errorf("labels lack %s:\n%s", want, labels)
+		}
+	}
+
+	// Without a domain the router matches the project's .localhost host
+	labels = d.traefikLabels(Deployment{ProjectName: "shop"})
+	if want := "Host(`shop.localhost`)"; !strings.Contains(labels, want) {
+		t.Errorf("labels lack %s:\n%s", want, labels)
+	}
+	if strings.Contains(labels, "scheme") {
+		t.Errorf("http deployment routed with a scheme override:\n%s", labels)
+	}
+}
+
+func TestDeployProjectTraefik(t *testing.T) {
+	d, runner := newTestSetup(t, 43300)
+	d.Traefik = TraefikConfig{Network: "proxy", Entrypoint: "websecure"}
+
+	result, err := d.DeployProject(Deployment{ProjectName: "shop", Image: "nginx:1.27", Domain: "shop.example.com", Proxy: ProxyTraefik})
+	if err != nil {
+		t.Fatalf("DeployProject: %v", err)
+	}
+	if result.URL != "https://shop.example.com" {
+		t.Errorf("got URL %s, want https://shop.example.com", result.URL)
+	}
+	assertCommands(t, runner.Commands(), []string{
+		"docker network inspect proxy",
+		"docker compose up --no-build -d --remove-orphans",
+	})
+
+	compose, err := os.ReadFile(filepath.Join(testWorkspace(t, "shop"), "docker-compose.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		// The app joins the deployment network and Traefik's
+		"    networks:\n      - deployment-network\n      - proxy\n",
+		// Traefik's network is created by Traefik, not by the project
+		"  proxy:\n    external: true\n",
+		"      traefik.http.routers.shop.rule: \"Host(`shop.example.com`)\"\n",
+	} {
+		if !strings.Contains(string(compose), want) {
+			t.Errorf("compose file lacks %q:\n%s", want, compose)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package docker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Upload is a source archive staged on disk for a deploy
+type Upload struct {
+	Path   string
+	SHA256 string
+}
+
+// StageUpload writes an uploaded .tar.gz to the state directory, hashing it
+// on the way. The file is removed once the deploy using it finishes.
+func StageUpload(r io.Reader) (*Upload, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, "uploads")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp(dir, "upload-*.tar.gz")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), r); err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &Upload{Path: file.Name(), SHA256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// Defaults for what an uploaded archive may expand to
+const (
+	defaultMaxExtractBytes   = 1 << 30
+	defaultMaxExtractEntries = 100000
+)
+
+// extractLimits caps the extraction of an uploaded archive
+type extractLimits struct {
+	maxBytes   int64
+	maxEntries int
+}
+
+func (d *DockerSetup) extractLimits() extractLimits {
+	limits := extractLimits{maxBytes: d.MaxExtractBytes, maxEntries: d.MaxExtractEntries}
+	if limits.maxBytes <= 0 {
+		limits.maxBytes = defaultMaxExtractBytes
+	}
+	if limits.maxEntries <= 0 {
+		limits.maxEntries = defaultMaxExtractEntries
+	}
+	return limits
+}
+
+// extractUpload unpacks a staged archive into the workspace, replacing the
+// previous source but keeping the run logs. The upload size cap only bounds
+// the compressed archive, so the extracted bytes and entries are capped too;
+// an archive over the limits is aborted and its partial extraction cleared.
+func extractUpload(archivePath, workDir string, limits extractLimits) error {
+	err := extractArchive(archivePath, workDir, limits)
+	if _, exceeded := err.(*extractLimitError); exceeded {
+		clearWorkspace(workDir)
+	}
+	return err
+}
+
+// extractLimitError reports an archive expanding past the extraction limits
+type extractLimitError struct {
+	reason string
+}
+
+func (e *extractLimitError) Error() string {
+	return "archive " + e.reason
+}
+
+func extractArchive(archivePath, workDir string, limits extractLimits) error {
+	if err := clearWorkspace(workDir); err != nil {
+		return fmt.Errorf("failed to clear workspace: %v", err)
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("archive is not gzip compressed: %v", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	budget := limits.maxBytes
+	for entries := 1; ; entries++ {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+
+		target, err := archiveEntryPath(workDir, header.Name)
+		if err != nil {
+			return err
+		}
+		if target == "" {
+			continue
+		}
+		if entries > limits.maxEntries {
+			return &extractLimitError{reason: fmt.Sprintf("has more than %d entries", limits.maxEntries)}
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, header.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			// Copy one byte past the budget to tell an exact fit from an overrun
+			written, err := io.CopyN(out, tr, budget+1)
+			out.Close()
+			if err != nil && err != io.EOF {
+				return err
+			}
+			if written > budget {
+				return &extractLimitError{reason: fmt.Sprintf("expands to more than %d MB", limits.maxBytes>>20)}
+			}
+			budget -= written
+		default:
+			// Links and special files could point outside the workspace
+			return fmt.Errorf("unsupported archive entry %q: only regular files and directories are allowed", header.Name)
+		}
+	}
+}
+
+// archiveEntryPath maps an archive entry name into workDir, rejecting
+// absolute paths and any ".." component. The logs directory is skipped so an
+// archive can't overwrite the run logs; an empty path means skip the entry.
+func archiveEntryPath(workDir, name string) (string, error) {
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(name) {
+		return "", fmt.Errorf("archive entry %q has an absolute path", name)
+	}
+	for _, part := range strings.Split(filepath.ToSlash(name), "/") {
+		if part == ".." {
+			return "", fmt.Errorf("archive entry %q escapes the workspace", name)
+		}
+	}
+	clean := filepath.Clean(name)
+	if clean == "." {
+		return "", nil
+	}
+	if first := strings.Split(clean, string(filepath.Separator))[0]; keptInWorkspace(first) {
+		return "", nil
+	}
+	return filepath.Join(workDir, clean), nil
+}
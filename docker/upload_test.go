@@ -0,0 +1,79 @@
+package docker
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeArchive writes a .tar.gz of the given files and returns its path
+func writeArchive(t *testing.T, files map[string]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "upload.tar.gz")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestExtractUploadLimits(t *testing.T) {
+	files := map[string]string{
+		"Dockerfile":  "FROM scratch\n",
+		"src/main.go": strings.Repeat("x", 100),
+		"src/util.go": strings.Repeat("y", 100),
+	}
+	total := int64(len(files["Dockerfile"]) + 200)
+
+	tests := []struct {
+		name    string
+		limits  extractLimits
+		wantErr string
+	}{
+		{name: "within limits", limits: extractLimits{maxBytes: total, maxEntries: 3}},
+		{name: "too many bytes", limits: extractLimits{maxBytes: total - 1, maxEntries: 3}, wantErr: "expands to more than"},
+		{name: "too many entries", limits: extractLimits{maxBytes: total, maxEntries: 2}, wantErr: "more than 2 entries"},
+	}
+	archive := writeArchive(t, files)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workDir := t.TempDir()
+			err := extractUpload(archive, workDir, tt.limits)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("extractUpload: %v", err)
+				}
+				if data, err := os.ReadFile(filepath.Join(workDir, "src", "main.go")); err != nil || len(data) != 100 {
+					t.Errorf("src/main.go not extracted: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+			if entries, _ := os.ReadDir(workDir); len(entries) != 0 {
+				t.Errorf("partial extraction left %d entries in the workspace", len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// dockerPackages returns the apt package arguments for docker, pinned to
+// DockerVersion when set
+func (d *DockerSetup) dockerPackages() string {
+	if d.DockerVersion == "" {
+		return "docker-ce docker-ce-cli containerd.io"
+	}
+	return fmt.Sprintf("docker-ce=%[1]s docker-ce-cli=%[1]s containerd.io", d.DockerVersion)
+}
+
+// composeDownloadURL returns the docker-compose release to install, pinned
+// to ComposeVersion when set
+func (d *DockerSetup) composeDownloadURL() (string, error) {
+	arch, ok := composeArchitectures[runtime.GOARCH]
+	if !ok {
+		return "", fmt.Errorf("no docker-compose release for architecture %s", runtime.GOARCH)
+	}
+	asset := fmt.Sprintf("docker-compose-%s-%s", runtime.GOOS, arch)
+	if d.ComposeVersion == "" {
+		return "https://github.com/docker/compose/releases/latest/download/" + asset, nil
+	}
+	return fmt.Sprintf("https://github.com/docker/compose/releases/download/%s/%s", d.ComposeVersion, asset), nil
+}
+
+// composeArchitectures maps Go architectures to docker-compose asset names
+var composeArchitectures = map[string]string{
+	"amd64": "x86_64",
+	"arm64": "aarch64",
+	"arm":   "armv7",
+}
+
+// upstreamVersion strips the apt epoch and revision from a package version,
+// e.g. "5:24.0.7-1~ubuntu.22.04~jammy" becomes "24.0.7"
+func upstreamVersion(version string) string {
+	if i := strings.Index(version, ":"); i >= 0 {
+		version = version[i+1:]
+	}
+	if i := strings.Index(version, "-"); i >= 0 {
+		version = version[:i]
+	}
+	return strings.TrimPrefix(version, "v")
+}
+
+// verifyVersions checks the installed docker and compose match the pins
+func (d *DockerSetup) verifyVersions() error {
+	if d.DockerVersion != "" {
+		result, err := d.executor.Run(context.Background(), "docker", "version", "--format", "{{.Server.Version}}")
+		if err != nil {
+			return fmt.Errorf("failed to read docker version: %v", err)
+		}
+		if got, want := strings.TrimSpace(string(result.Stdout)), upstreamVersion(d.DockerVersion); got != want {
+			return fmt.Errorf("docker %s is installed but %s was requested", got, want)
+		}
+	}
+	if d.ComposeVersion != "" {
+		result, err := d.executor.Run(context.Background(), "docker-compose", "version", "--short")
+		if err != nil {
+			return fmt.Errorf("failed to read docker-compose version: %v", err)
+		}
+		if got, want := upstreamVersion(strings.TrimSpace(string(result.Stdout))), upstreamVersion(d.ComposeVersion); got != want {
+			return fmt.Errorf("docker-compose %s is installed but %s was requested", got, want)
+		}
+	}
+	return nil
+}
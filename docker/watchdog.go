@@ -0,0 +1,222 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"erebrusvps/websocket"
+)
+
+// StatusCrashLooping marks a deployment whose containers keep restarting
+const StatusCrashLooping = "crash_looping"
+
+// WatchdogConfig controls crash loop detection
+type WatchdogConfig struct {
+	// Interval between container inspections
+	Interval time.Duration
+	// RestartThreshold restarts within RestartWindow flag a crash loop
+	RestartThreshold int
+	RestartWindow    time.Duration
+	// RestartingTimeout flags containers stuck in the restarting state
+	RestartingTimeout time.Duration
+	// AutoStopAfter stops a crash looping project once its containers have
+	// restarted this many times; zero disables auto-stop
+	AutoStopAfter int
+}
+
+// restartSample is a container's restart count observed at a point in time
+type restartSample struct {
+	at    time.Time
+	count int
+}
+
+// containerWatch is the watchdog's memory of a single container
+type containerWatch struct {
+	samples         []restartSample
+	restartingSince time.Time
+}
+
+// watchdog tracks crash looping projects between inspections
+type watchdog struct {
+	mutex        sync.Mutex
+	containers   map[string]*containerWatch
+	crashLooping map[string]bool
+}
+
+// containerInspect holds the fields of docker inspect the watchdog needs
+type containerInspect struct {
+	Name         string `json:"Name"`
+	RestartCount int    `json:"RestartCount"`
+	State        struct {
+		Status string `json:"Status"`
+	} `json:"State"`
+}
+
+// IsCrashLooping reports whether the watchdog has flagged a project
+func (d *DockerSetup) IsCrashLooping(project string) bool {
+	d.watchdog.mutex.Lock()
+	defer d.watchdog.mutex.Unlock()
+	return d.watchdog.crashLooping[project]
+}
+
+// StartWatchdog periodically inspects managed deployments for crash loops.
+// A zero interval disables the watchdog.
+func (d *DockerSetup) StartWatchdog(cfg WatchdogConfig) {
+	if cfg.Interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := d.checkCrashLoops(cfg); err != nil {
+				fmt.Printf("[WATCHDOG] Check failed: %v\n", err)
+			}
+		}
+	}()
+}
+
+func (d *DockerSetup) checkCrashLoops(cfg WatchdogConfig) error {
+	projects, err := ListProjects()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	for _, project := range projects {
+		containers, err := inspectProjectContainers(project)
+		if err != nil {
+			fmt.Printf("[WATCHDOG] Failed to inspect %s: %v\n", project, err)
+			continue
+		}
+
+		looping, restarts := false, 0
+		for _, container := range containers {
+			seen[container.Name] = true
+			if d.watchdog.observe(container, now, cfg) {
+				looping = true
+			}
+			restarts += container.RestartCount
+		}
+		d.updateCrashLoopFlag(project, looping, restarts, cfg)
+	}
+	d.watchdog.forget(seen)
+	return nil
+}
+
+// observe records a sample and reports whether the container looks crash looping
+func (w *watchdog) observe(container containerInspect, now time.Time, cfg WatchdogConfig) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	watch, ok := w.containers[container.Name]
+	if !ok {
+		watch = &containerWatch{}
+		w.containers[container.Name] = watch
+	}
+
+	watch.samples = append(watch.samples, restartSample{at: now, count: container.RestartCount})
+	for len(watch.samples) > 1 && now.Sub(watch.samples[0].at) > cfg.RestartWindow {
+		watch.samples = watch.samples[1:]
+	}
+
+	if container.State.Status == "restarting" {
+		if watch.restartingSince.IsZero() {
+			watch.restartingSince = now
+		}
+	} else {
+		watch.restartingSince = time.Time{}
+	}
+
+	increase := container.RestartCount - watch.samples[0].count
+	stuck := !watch.restartingSince.IsZero() && now.Sub(watch.restartingSince) >= cfg.RestartingTimeout
+	return increase >= cfg.RestartThreshold || stuck
+}
+
+// forget drops containers that no longer exist
+func (w *watchdog) forget(seen map[string]bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for name := range w.containers {
+		if !seen[name] {
+			delete(w.containers, name)
+		}
+	}
+}
+
+// updateCrashLoopFlag flips a project's flag, announcing changes and applying
+// the auto-stop policy
+func (d *DockerSetup) updateCrashLoopFlag(project string, looping bool, restarts int, cfg WatchdogConfig) {
+	d.watchdog.mutex.Lock()
+	wasLooping := d.watchdog.crashLooping[project]
+	if looping {
+		d.watchdog.crashLooping[project] = true
+	} else {
+		delete(d.watchdog.crashLooping, project)
+	}
+	d.watchdog.mutex.Unlock()
+
+	if looping && !wasLooping {
+		message := fmt.Sprintf("[WATCHDOG] Project %s is crash looping (%d restarts)", project, restarts)
+		websocket.Logger.SendProjectLog(project, message)
+		fmt.Println(message)
+	}
+	if !looping && wasLooping {
+		message := fmt.Sprintf("[WATCHDOG] Project %s has recovered", project)
+		websocket.Logger.SendProjectLog(project, message)
+		fmt.Println(message)
+	}
+
+	if looping && cfg.AutoStopAfter > 0 && restarts >= cfg.AutoStopAfter {
+		message := fmt.Sprintf("[WATCHDOG] Stopping %s after %d restarts", project, restarts)
+		websocket.Logger.SendProjectLog(project, message)
+		fmt.Println(message)
+		if err := d.stopProject(project); err != nil {
+			fmt.Printf("[WATCHDOG] Failed to stop %s: %v\n", project, err)
+		}
+	}
+}
+
+// stopProject stops a project's containers without removing them
+func (d *DockerSetup) stopProject(project string) error {
+	workDir, err := workspaceDir(project)
+	if err != nil {
+		return err
+	}
+	cmd := d.composeCmd("stop")
+	cmd.Dir = workDir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return newCommandError("compose stop", err, output)
+	}
+	return nil
+}
+
+// inspectProjectContainers returns docker inspect data for all of a project's
+// containers, including stopped and restarting ones
+func inspectProjectContainers(project string) ([]containerInspect, error) {
+	out, err := exec.Command("docker", "ps", "-a", "-q",
+		"--filter", "label=com.docker.compose.project="+composeProjectName(project)).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+	ids := strings.Fields(string(out))
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	out, err = exec.Command("docker", append([]string{"inspect"}, ids...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("docker inspect failed: %v", err)
+	}
+	var containers []containerInspect
+	if err := json.Unmarshal(out, &containers); err != nil {
+		return nil, fmt.Errorf("failed to parse docker inspect output: %v", err)
+	}
+	return containers, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// bootstrapStatus records startup steps that failed, so the server keeps
+// serving already deployed apps and reports itself as degraded instead
+type bootstrapStatus struct {
+	mutex    sync.Mutex
+	failures map[string]string
+}
+
+var bootstrap = &bootstrapStatus{failures: make(map[string]string)}
+
+// fail records a failed startup step and logs it as a warning
+func (b *bootstrapStatus) fail(step string, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.failures[step] = err.Error()
+	fmt.Printf("[SERVER] Warning: %s failed, continuing degraded: %v\n", step, err)
+}
+
+// snapshot returns a copy of the recorded failures
+func (b *bootstrapStatus) snapshot() map[string]string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	failures := make(map[string]string, len(b.failures))
+	for step, reason := range b.failures {
+		failures[step] = reason
+	}
+	return failures
+}
+
+// healthResponse is returned by /health
+type healthResponse struct {
+	Status   string            `json:"status"`
+	Degraded bool              `json:"degraded"`
+	Failures map[string]string `json:"failures,omitempty"`
+}
+
+// healthHandler reports whether startup completed, for load balancers and
+// monitoring. It needs no API key.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	failures := bootstrap.snapshot()
+	response := healthResponse{Status: "ok", Failures: failures}
+	if len(failures) > 0 {
+		response.Status = "degraded"
+		response.Degraded = true
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// diagnosticsHandler is served on the HTTP listener when the HTTPS listener
+// could not start, so the reason is visible without shell access
+func diagnosticsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/health" {
+		healthHandler(w, r)
+		return
+	}
+
+	failures := bootstrap.snapshot()
+	steps := make([]string, 0, len(failures))
+	for step := range failures {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintln(w, "The management API is unavailable, startup failed:")
+	for _, step := range steps {
+		fmt.Fprintf(w, "  %s: %s\n", step, failures[step])
+	}
+}
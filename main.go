@@ -1,15 +1,18 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"erebrusvps/docker"
 	"erebrusvps/websocket"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 //lint:ignore U1000 logHandler is used to wrap HTTP handlers
@@ -20,6 +23,49 @@ func logHandler(handler http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
+// allowedOrigin returns the Access-Control-Allow-Origin value for a request
+// origin, or an empty string when the origin is not allowed
+func allowedOrigin(origin string) string {
+	wildcard := false
+	for _, allowed := range config.CORSOrigins {
+		if allowed == "*" {
+			wildcard = true
+		} else if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	if wildcard {
+		return "*"
+	}
+	return ""
+}
+
+// dockerSetup is shared by all handlers so its settings apply to every request
+var dockerSetup *docker.DockerSetup
+
+// withCORS sets the CORS headers on every response and answers preflight requests
+func withCORS(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if origin := allowedOrigin(r.Header.Get("Origin")); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "POST, PUT, DELETE, OPTIONS, GET")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Expose-Headers", "X-Deploy-ID")
+			if origin != "*" {
+				// Credentials are only valid alongside an explicit origin
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		w.Header().Add("Vary", "Origin")
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		handler(w, r)
+	}
+}
+
 // Simplified request structure matching docker.Deployment
 type DeploymentRequest struct {
 	GitURL  string            `json:"git_url"`
@@ -35,30 +81,189 @@ func deploymentHandler(w http.ResponseWriter, r *http.Request) {
 
 	var deployment docker.Deployment
 	if err := json.NewDecoder(r.Body).Decode(&deployment); err != nil {
+		if bodyTooLarge(err) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
 		return
 	}
+	if err := docker.ValidateSecretValues(deployment); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	// Validate required fields
-	if deployment.GitURL == "" {
+	sources := 0
+	for _, source := range []string{deployment.GitURL, deployment.LocalPath, deployment.Image} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		http.Error(w, "exactly one of git_url, local_path or image is required", http.StatusBadRequest)
+		return
+	}
+
+	setDefaultProjectName(&deployment)
+	serveDeployment(w, r, deployment)
+}
+
+// setDefaultProjectName names a project after its source when no name was given
+func setDefaultProjectName(deployment *docker.Deployment) {
+	if deployment.ProjectName == "" && deployment.LocalPath != "" {
+		deployment.ProjectName = filepath.Base(deployment.LocalPath)
+	} else if deployment.ProjectName == "" && deployment.Image != "" {
+		// Use the image's repository name without its registry, tag or digest
+		name := strings.SplitN(deployment.Image, "@", 2)[0]
+		name = name[strings.LastIndex(name, "/")+1:]
+		deployment.ProjectName = strings.SplitN(name, ":", 2)[0]
+	} else if deployment.ProjectName == "" {
+		// Extract project name from git URL
+		parts := strings.Split(deployment.GitURL, "/")
+		deployment.ProjectName = strings.TrimSuffix(parts[len(parts)-1], ".git")
+	}
+}
+
+// validateGitHandler checks that a repository is reachable and lists its
+// branches without cloning it, e.g. {"git_url":"...","username":"...","password":"<token>"}
+func validateGitHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body struct {
+		GitURL   string `json:"git_url"`
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+	if body.GitURL == "" {
 		http.Error(w, "git_url is required", http.StatusBadRequest)
 		return
 	}
+	gitURL, err := docker.WithGitCredentials(body.GitURL, body.Username, body.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	info, err := dockerSetup.CheckGitRemote(gitURL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// validateHandler runs the preflight checks of a deployment without
+// building it, so CI can catch misconfigurations before a real deploy
+func validateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var deployment docker.Deployment
+	if err := json.NewDecoder(r.Body).Decode(&deployment); err != nil {
+		if bodyTooLarge(err) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+	setDefaultProjectName(&deployment)
+	deployment.ProjectName = docker.EnvironmentProjectName(deployment.ProjectName, deployment.Environment)
+	if err := docker.ValidateProjectName(deployment.ProjectName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dockerSetup.Preflight(deployment))
+}
+
+// serveDeployment runs a parsed deployment request and writes the result,
+// right away in async mode or once the deploy finishes otherwise
+func serveDeployment(w http.ResponseWriter, r *http.Request, deployment docker.Deployment) {
+	// A rejected upload is never deployed, so nothing else removes it
+	accepted := false
+	defer func() {
+		if !accepted && deployment.Upload != nil {
+			os.Remove(deployment.Upload.Path)
+		}
+	}()
 
 	// Set default port if not provided
 	if deployment.Port == "" {
 		deployment.Port = "3000" // or generate a random available port
 	}
 
-	// Set default project name if not provided
-	if deployment.ProjectName == "" {
-		// Extract project name from git URL
-		parts := strings.Split(deployment.GitURL, "/")
-		deployment.ProjectName = strings.TrimSuffix(parts[len(parts)-1], ".git")
+	if err := docker.ValidateEnvironment(deployment.Environment); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deployment.ProjectName = docker.EnvironmentProjectName(deployment.ProjectName, deployment.Environment)
+	if err := docker.ValidateProjectName(deployment.ProjectName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	deployment.ProjectName = dockerSetup.ResolveProjectName(deployment)
+
+	if !authorizeProject(w, r, deployment.ProjectName) {
+		return
+	}
+	if evict, ok := checkQuota(w, r, deployment.ProjectName); !ok || (evict > 0 && !evictForQuota(w, r, evict, deployment)) {
+		return
+	}
+	owner := requestOwner(r)
+	if err := docker.UpdateProjectState(deployment.ProjectName, func(state *docker.ProjectState) {
+		if state.Owner == "" {
+			state.Owner = owner
+		}
+	}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	accepted = true
+
+	eventType := docker.EventDeploy
+	if docker.HasEvents(deployment.ProjectName) {
+		eventType = docker.EventRedeploy
+	}
+
+	actor := requestActor(r)
+	started := time.Now()
+
+	// In async mode respond with the deploy ID right away; the client follows
+	// the logs on /ws?deploy_id=<id>
+	if r.URL.Query().Get("async") == "true" {
+		deployID, sequence := dockerSetup.StartDeployment(deployment, func(result *docker.DeploymentResult, err error) {
+			recordDeployEvent(actor, deployment.ProjectName, eventType, started, result, err)
+		})
+		w.Header().Set("X-Deploy-ID", deployID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(&docker.DeploymentResult{
+			Status:      "running",
+			DeployID:    deployID,
+			Sequence:    sequence,
+			ProjectName: deployment.ProjectName,
+		})
+		return
 	}
 
-	dockerSetup := docker.NewDockerSetup()
 	result, err := dockerSetup.DeployProject(deployment)
+	recordDeployEvent(actor, deployment.ProjectName, eventType, started, result, err)
+	if result != nil {
+		w.Header().Set("X-Deploy-ID", result.DeployID)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -70,12 +275,7 @@ func deploymentHandler(w http.ResponseWriter, r *http.Request) {
 
 // Add certificate generation function
 func generateSSLCertificates(dockerSetup *docker.DockerSetup) error {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		return fmt.Errorf("failed to get home directory: %v", err)
-	}
-
-	certDir := filepath.Join(homeDir, "certs")
+	certDir := docker.CertDir()
 	if err := os.MkdirAll(certDir, 0755); err != nil {
 		return fmt.Errorf("failed to create certs directory: %v", err)
 	}
@@ -155,15 +355,19 @@ IP.1 = 127.0.0.1`
 		// Sign server certificate with CA
 		fmt.Sprintf("openssl x509 -req -in %s/server.csr -CA %s/ca.crt -CAkey %s/ca.key -CAcreateserial -out %s/server.crt -days 365 -sha256 -extensions v3_req -extfile %s",
 			certDir, certDir, certDir, certDir, serverConfigPath),
+	}
 
-		// Set proper permissions and copy to nginx directory
-		fmt.Sprintf("sudo mkdir -p /etc/nginx/ssl"),
-		fmt.Sprintf("sudo cp %s/server.crt /etc/nginx/ssl/", certDir),
-		fmt.Sprintf("sudo cp %s/server.key /etc/nginx/ssl/", certDir),
-		fmt.Sprintf("sudo cp %s/ca.crt /etc/nginx/ssl/", certDir),
-		fmt.Sprintf("sudo chmod 644 /etc/nginx/ssl/server.crt"),
-		fmt.Sprintf("sudo chmod 600 /etc/nginx/ssl/server.key"),
-		fmt.Sprintf("sudo chmod 644 /etc/nginx/ssl/ca.crt"),
+	// Set proper permissions and copy to nginx directory
+	if config.Proxy == docker.ProxyNginx {
+		commands = append(commands,
+			dockerSetup.Elevate("mkdir -p /etc/nginx/ssl"),
+			dockerSetup.Elevate(fmt.Sprintf("cp %s/server.crt /etc/nginx/ssl/", certDir)),
+			dockerSetup.Elevate(fmt.Sprintf("cp %s/server.key /etc/nginx/ssl/", certDir)),
+			dockerSetup.Elevate(fmt.Sprintf("cp %s/ca.crt /etc/nginx/ssl/", certDir)),
+			dockerSetup.Elevate("chmod 644 /etc/nginx/ssl/server.crt"),
+			dockerSetup.Elevate("chmod 600 /etc/nginx/ssl/server.key"),
+			dockerSetup.Elevate("chmod 644 /etc/nginx/ssl/ca.crt"),
+		)
 	}
 
 	// Execute all commands
@@ -180,72 +384,248 @@ IP.1 = 127.0.0.1`
 	return nil
 }
 
-func main() {
-	// Initialize Docker setup
-	dockerSetup := docker.NewDockerSetup()
+// managementTLSConfig returns the TLS settings of the management API. The
+// cipher suites mirror the ones in the generated nginx configs (Go has no
+// DHE suites and ignores the list for TLS 1.3), and HTTP/2 is negotiated
+// via ALPN.
+func managementTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: config.TLSMinVersion,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+}
 
-	// Install required packages
-	err := dockerSetup.ExecuteCommand("sudo DEBIAN_FRONTEND=noninteractive apt-get -y update")
+// listenUnixSocket creates a unix socket listener with the given file mode,
+// removing a stale socket left behind by a previous run
+func listenUnixSocket(path string, mode os.FileMode) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+	}
+	listener, err := net.Listen("unix", path)
 	if err != nil {
-		log.Fatalf("Update failed: %v", err)
+		return nil, err
 	}
+	if err := os.Chmod(path, mode); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set socket mode: %v", err)
+	}
+	return listener, nil
+}
 
-	// Install Nginx and OpenSSL
-	if err := dockerSetup.ExecuteCommand("sudo DEBIAN_FRONTEND=noninteractive apt-get install -y nginx openssl"); err != nil {
-		log.Fatalf("Nginx/OpenSSL installation failed: %v", err)
+// installPackages installs nginx and openssl for the configured proxy mode
+func installPackages() error {
+	if err := dockerSetup.ExecuteCommand(dockerSetup.Elevate("DEBIAN_FRONTEND=noninteractive apt-get -y update")); err != nil {
+		return fmt.Errorf("update failed: %v", err)
 	}
 
-	// Create SSL directory for Nginx
-	if err := dockerSetup.ExecuteCommand("sudo mkdir -p /etc/nginx/ssl"); err != nil {
-		log.Fatalf("Failed to create SSL directory: %v", err)
+	if config.Proxy == docker.ProxyNginx {
+		// Install Nginx and OpenSSL
+		if err := dockerSetup.ExecuteCommand(dockerSetup.Elevate("DEBIAN_FRONTEND=noninteractive apt-get install -y nginx openssl")); err != nil {
+			return fmt.Errorf("nginx/OpenSSL installation failed: %v", err)
+		}
+
+		// Create SSL directory for Nginx
+		if err := dockerSetup.ExecuteCommand(dockerSetup.Elevate("mkdir -p /etc/nginx/ssl")); err != nil {
+			return fmt.Errorf("failed to create SSL directory: %v", err)
+		}
+	} else {
+		// OpenSSL is still needed for the management API certificate
+		if err := dockerSetup.ExecuteCommand(dockerSetup.Elevate("DEBIAN_FRONTEND=noninteractive apt-get install -y openssl")); err != nil {
+			return fmt.Errorf("OpenSSL installation failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func main() {
+	// Load server configuration
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	config = cfg
+
+	docker.SetBaseDir(config.BaseDir)
+
+	// Existing JSON state is imported into the database the first time
+	if config.StateStore == "sqlite" {
+		store, err := docker.OpenSQLiteStore(config.StateDB)
+		if err != nil {
+			log.Fatalf("Failed to open state database: %v", err)
+		}
+		docker.SetStore(store)
+	}
+
+	// Without the key stored secrets can't be read, nor new ones kept safe
+	if err := docker.LoadSecretKey(config.SecretKeyFile); err != nil {
+		log.Fatalf("Failed to load secret key: %v", err)
+	}
+
+	// Initialize Docker setup
+	dockerSetup = docker.NewDockerSetup()
+	dockerSetup.LogRetentionBytes = config.LogRetentionBytes
+	dockerSetup.NetworkName = config.NetworkName
+	dockerSetup.ImageRetention = config.ImageRetention
+	dockerSetup.BuildCacheMaxAge = config.BuildCacheMaxAge
+	dockerSetup.ProjectDeployLog = config.ProjectDeployLog
+	dockerSetup.CompressWorkspaces = config.CompressWorkspaces
+	dockerSetup.DefaultProxy = config.Proxy
+	dockerSetup.PublicHost = config.PublicHost
+	dockerSetup.Traefik = config.Traefik
+	dockerSetup.Registry = config.Registry
+	dockerSetup.PushRegistry = config.PushRegistry
+	dockerSetup.LocalRegistry = config.LocalRegistry
+	dockerSetup.ExecPolicy = config.Exec
+	dockerSetup.ComposeTemplate = config.ComposeTemplate
+	docker.EnableIPv6(config.IPv6)
+	dockerSetup.Webhooks = config.Webhooks
+	dockerSetup.Rootless = config.Rootless
+	dockerSetup.LocalPathRoot = config.LocalPathRoot
+	dockerSetup.MaxExtractBytes = config.MaxExtractBytes
+	dockerSetup.MaxExtractEntries = config.MaxExtractEntries
+	dockerSetup.DockerVersion = config.DockerVersion
+	dockerSetup.ComposeVersion = config.ComposeVersion
+	dockerSetup.SetMaxConcurrentDeploys(config.MaxConcurrentDeploys)
+	docker.ReservePorts(config.ReservedPorts)
+
+	// Detect which docker compose flavour is available
+	if err := dockerSetup.DetectCompose(); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
+	// Bootstrap the host. Failures are reported on /health rather than
+	// stopping the server, so a transient mirror outage doesn't take the
+	// management API of running apps down with it. Rootless setups must
+	// provide the packages up front.
+	if config.Rootless {
+		fmt.Println("[SERVER] Rootless mode, skipping package installation (openssl must be installed)")
+	} else {
+		dockerSetup.DetectElevation()
+		if err := dockerSetup.CheckElevation(); err != nil {
+			bootstrap.fail("privileges", err)
+		} else if err := installPackages(); err != nil {
+			bootstrap.fail("packages", err)
+		}
 	}
 
 	// Generate SSL certificates
 	if err := generateSSLCertificates(dockerSetup); err != nil {
-		log.Fatalf("Failed to generate SSL certificates: %v", err)
+		bootstrap.fail("certificates", err)
 	}
 
-	// Get home directory for certificates
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		log.Fatalf("Failed to get home directory: %v", err)
-	}
-	certDir := filepath.Join(homeDir, "certs")
+	certDir := docker.CertDir()
 
-	// Add CORS and handlers with updated headers
-	http.HandleFunc("/deploy", func(w http.ResponseWriter, r *http.Request) {
-		// Set CORS headers
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	// Certificates left by an earlier run are enough to serve HTTPS
+	_, certErr := tls.LoadX509KeyPair(filepath.Join(certDir, "server.crt"), filepath.Join(certDir, "server.key"))
+	if certErr != nil {
+		bootstrap.fail("https", fmt.Errorf("no usable certificate in %s: %v", certDir, certErr))
+	}
 
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusOK)
-			return
+	// Archive builds in the local registry so rollbacks survive pruning
+	if config.LocalRegistry {
+		if err := dockerSetup.EnsureLocalRegistry(); err != nil {
+			bootstrap.fail("registry", err)
 		}
-		deploymentHandler(w, r)
-	})
+	}
+
+	// Watch running deployments for crash loops
+	dockerSetup.StartWatchdog(config.Watchdog)
+
+	// Report crashes of running apps as they happen
+	dockerSetup.StartLifecycleMonitor()
+
+	// Restore nginx configs lost since the last run, and keep them in place
+	dockerSetup.StartReconciler(config.ReconcileInterval)
+
+	// Redeploy projects with a redeploy_cron when their branch moves
+	dockerSetup.StartRedeployScheduler()
+
+	// Add CORS and handlers with updated headers
+	deployLimiter := newRateLimiter(config.DeployRatePerMinute, config.DeployBurst)
+	http.HandleFunc("/deploy", withCORS(withAuth(deployLimiter.limit(deploymentHandler))))
+	http.HandleFunc("/validate", withCORS(withAuth(deployLimiter.limit(validateHandler))))
+	http.HandleFunc("/validate-git", withCORS(withAuth(deployLimiter.limit(validateGitHandler))))
+	http.HandleFunc(uploadPath, withCORS(withAuth(deployLimiter.limit(uploadDeploymentHandler))))
+	http.HandleFunc("/deployments", withCORS(withAuth(listDeploymentsHandler)))
+	http.HandleFunc("/deployments/", withCORS(withAuth(deployLimiter.limit(deploymentRoutes))))
+	http.HandleFunc("/stacks", withCORS(withAuth(deployLimiter.limit(stacksHandler))))
+	http.HandleFunc("/stacks/", withCORS(withAuth(deployLimiter.limit(stackRoutes))))
+	http.HandleFunc("/system/", withCORS(withAuth(systemRoutes)))
+	http.HandleFunc("/jobs", withCORS(withAuth(listJobsHandler)))
+	http.HandleFunc("/jobs/", withCORS(withAuth(jobHandler)))
+
+	// Push webhooks carry a signature instead of an API key
+	webhookDedup = newCommitDedup(config.WebhookDedupWindow)
+	http.HandleFunc("/webhooks/", deployLimiter.limit(webhookHandler))
+
+	http.HandleFunc("/health", healthHandler)
 
 	// Add WebSocket handler
-	http.HandleFunc("/ws", websocket.Logger.HandleWebSocket)
+	websocket.EnableCompression(config.WebSocketCompression)
+	http.HandleFunc("/ws", withAuth(logsHandler))
+	http.HandleFunc("/ws/logs/", withAuth(containerLogsHandler))
+
+	// Start HTTPS server, only a missing or invalid certificate keeps it down
+	if certErr == nil {
+		httpsListener, err := net.Listen("tcp", config.HTTPSAddr)
+		if err != nil {
+			log.Fatalf("Failed to listen on %s: %v", config.HTTPSAddr, err)
+		}
+		fmt.Printf("[SERVER] HTTPS server bound to %s\n", httpsListener.Addr())
+		httpsServer := newServer(http.DefaultServeMux)
+		httpsServer.TLSConfig = managementTLSConfig()
+		go func() {
+			if err := httpsServer.ServeTLS(httpsListener,
+				filepath.Join(certDir, "server.crt"),
+				filepath.Join(certDir, "server.key")); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 
-	// Start HTTPS server
-	fmt.Println("[SERVER] Starting HTTPS server on :8443")
-	go func() {
-		if err := http.ListenAndServeTLS(":8443",
-			filepath.Join(certDir, "server.crt"),
-			filepath.Join(certDir, "server.key"),
-			nil); err != nil {
-			log.Fatal(err)
+	// Serve the API on a unix socket for local tooling
+	if config.UnixSocket != "" {
+		unixListener, err := listenUnixSocket(config.UnixSocket, config.UnixSocketMode)
+		if err != nil {
+			log.Fatalf("Failed to listen on unix socket: %v", err)
 		}
-	}()
+		fmt.Printf("[SERVER] API bound to unix socket %s (mode %#o)\n", config.UnixSocket, config.UnixSocketMode)
+		go func() {
+			if err := newServer(http.DefaultServeMux).Serve(unixListener); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 
-	// Redirect HTTP to HTTPS
-	fmt.Println("[SERVER] Starting HTTP redirect server on :8080")
-	if err := http.ListenAndServe(":8080", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	// Redirect HTTP to HTTPS, an empty address disables the redirect listener
+	if config.HTTPAddr == "" {
+		fmt.Println("[SERVER] HTTP redirect server disabled")
+		select {}
+	}
+	httpListener, err := net.Listen("tcp", config.HTTPAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", config.HTTPAddr, err)
+	}
+	httpHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "https://"+r.Host+r.URL.String(), http.StatusMovedPermanently)
-	})); err != nil {
+	})
+	if certErr != nil {
+		// Nothing to redirect to, explain why instead
+		httpHandler = diagnosticsHandler
+		fmt.Printf("[SERVER] HTTP diagnostics server bound to %s\n", httpListener.Addr())
+	} else {
+		fmt.Printf("[SERVER] HTTP redirect server bound to %s\n", httpListener.Addr())
+	}
+	httpServer := newServer(httpHandler)
+	if err := httpServer.Serve(httpListener); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// tokenBucket tracks the remaining request allowance of a single client
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token-bucket limiter keyed by API key or remote IP
+type rateLimiter struct {
+	mutex   sync.Mutex
+	rate    float64 // tokens added per second
+	burst   float64
+	buckets map[string]*tokenBucket
+}
+
+// maxBuckets bounds memory use before idle, fully refilled buckets are pruned
+const maxBuckets = 10000
+
+func newRateLimiter(perMinute float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    perMinute / 60,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token for key, returning how long to wait when none is left
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	if len(l.buckets) >= maxBuckets {
+		for k, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+				delete(l.buckets, k)
+			}
+		}
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// rateLimitKey identifies the client by its API key once the key is
+// validated, by remote IP otherwise, so made-up keys don't each get a fresh
+// bucket
+func rateLimitKey(r *http.Request) string {
+	if authEnabled() && validKey(r) {
+		return "key:" + apiKeyID(bearerKey(r))
+	}
+	return "ip:" + remoteIP(r)
+}
+
+// limit rejects POST requests over the configured rate with 429 and Retry-After
+func (l *rateLimiter) limit(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if l.rate <= 0 || r.Method != http.MethodPost {
+			handler(w, r)
+			return
+		}
+		if ok, wait := l.allow(rateLimitKey(r)); !ok {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRateLimitKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		apiKeys []string
+		bearer  string
+		want    string
+	}{
+		{name: "auth disabled", bearer: "anything", want: "ip:192.0.2.1"},
+		{name: "no key", apiKeys: []string{"secret"}, want: "ip:192.0.2.1"},
+		{name: "invalid key", apiKeys: []string{"secret"}, bearer: "made-up", want: "ip:192.0.2.1"},
+		{name: "valid key", apiKeys: []string{"secret"}, bearer: "secret", want: "key:" + apiKeyID("secret")},
+	}
+	defer func(saved *Config) { config = saved }(config)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config = &Config{APIKeys: tt.apiKeys}
+			r := httptest.NewRequest("POST", "/deploy", nil)
+			r.RemoteAddr = "192.0.2.1:51234"
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			if got := rateLimitKey(r); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitRejectsWithRetryAfter(t *testing.T) {
+	defer func(saved *Config) { config = saved }(config)
+	config = &Config{}
+	limited := newRateLimiter(6, 1).limit(func(w http.ResponseWriter, r *http.Request) {})
+	for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+		w := httptest.NewRecorder()
+		limited(w, httptest.NewRequest("POST", "/webhooks/app", nil))
+		if w.Code != want {
+			t.Fatalf("request %d: got status %d, want %d", i+1, w.Code, want)
+		}
+		if want == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "10" {
+			t.Errorf("got Retry-After %q, want 10", w.Header().Get("Retry-After"))
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// limitBody caps the size of every request body so a single request can't
+// exhaust memory while it is decoded. Archive uploads get their own limit.
+func limitBody(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		maxBytes := config.MaxBodyBytes
+		if r.URL.Path == uploadPath || r.URL.Path == importPath {
+			maxBytes = config.MaxUploadBytes
+		}
+		if maxBytes > 0 && r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// bodyTooLarge reports whether err came from reading past the body limit
+func bodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// newServer returns an http.Server with the configured size limit and timeouts
+func newServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           limitBody(handler),
+		ReadHeaderTimeout: config.ReadTimeout,
+		ReadTimeout:       config.ReadTimeout,
+		WriteTimeout:      config.WriteTimeout,
+		IdleTimeout:       config.IdleTimeout,
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"erebrusvps/docker"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// stacksHandler lists stacks on GET and deploys one on POST, e.g.
+// {"name":"shop","deployments":[{"project_name":"api",...},{"project_name":"frontend",...}],
+// "links":{"frontend":["api"]}}
+func stacksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		stacks, err := docker.ListStacks()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stacks)
+	case http.MethodPost:
+		deployStackHandler(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// deployStackHandler deploys every member of a stack in dependency order
+func deployStackHandler(w http.ResponseWriter, r *http.Request) {
+	var stack docker.Stack
+	if err := json.NewDecoder(r.Body).Decode(&stack); err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+	deployments, err := docker.StackDeployments(stack)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, deployment := range deployments {
+		if err := docker.ValidateSecretValues(deployment); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Every member must be allowed, and fit the quota together, before any
+	// of them is deployed
+	projects := make([]string, len(deployments))
+	for i, deployment := range deployments {
+		if !authorizeProject(w, r, deployment.ProjectName) {
+			return
+		}
+		projects[i] = deployment.ProjectName
+	}
+	evict, ok := checkQuota(w, r, projects...)
+	if !ok || (evict > 0 && !evictForQuota(w, r, evict, deployments...)) {
+		return
+	}
+	owner := requestOwner(r)
+	for _, deployment := range deployments {
+		if err := docker.UpdateProjectState(deployment.ProjectName, func(state *docker.ProjectState) {
+			if state.Owner == "" {
+				state.Owner = owner
+			}
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	result, err := dockerSetup.DeployStack(stack, stackDeployRecorder(requestActor(r)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeStackResult(w, result)
+}
+
+// stackRoutes dispatches /stacks/{name} and /stacks/{name}/redeploy
+func stackRoutes(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/stacks/"), "/"), "/")
+	name := parts[0]
+	if err := docker.ValidateProjectName(name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodGet:
+		status, err := dockerSetup.GetStackStatus(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		if !authorizeStack(w, r, name) {
+			return
+		}
+		result, err := dockerSetup.TeardownStack(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeStackResult(w, result)
+	case len(parts) == 2 && parts[1] == "redeploy" && r.Method == http.MethodPost:
+		if !authorizeStack(w, r, name) {
+			return
+		}
+		result, err := dockerSetup.RedeployStack(name, stackDeployRecorder(requestActor(r)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeStackResult(w, result)
+	case len(parts) <= 2:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorizeStack checks the caller may change every member of a stack
+func authorizeStack(w http.ResponseWriter, r *http.Request, name string) bool {
+	projects, err := docker.StackProjects(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return false
+	}
+	for _, project := range projects {
+		if !authorizeProject(w, r, project) {
+			return false
+		}
+	}
+	return true
+}
+
+// stackDeployRecorder records each member deploy in the member's history
+func stackDeployRecorder(actor string) docker.StackDeployFunc {
+	return func(project string, started time.Time, result *docker.DeploymentResult, err error) {
+		eventType := docker.EventDeploy
+		if docker.HasEvents(project) {
+			eventType = docker.EventRedeploy
+		}
+		recordDeployEvent(actor, project, eventType, started, result, err)
+	}
+}
+
+// writeStackResult responds with a stack result, as a 500 when a member
+// failed so clients notice the partial rollout
+func writeStackResult(w http.ResponseWriter, result *docker.StackResult) {
+	w.Header().Set("Content-Type", "application/json")
+	if result.FailedMember != "" {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(result)
+}
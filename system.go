@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"erebrusvps/docker"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// systemRoutes dispatches /system/{action} requests
+func systemRoutes(w http.ResponseWriter, r *http.Request) {
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/system/"), "/") {
+	case "stats":
+		systemStatsHandler(w, r)
+	case "reconcile":
+		reconcileHandler(w, r)
+	case "network":
+		networkHandler(w, r)
+	case "network/recreate":
+		recreateNetworkHandler(w, r)
+	case "export":
+		exportHandler(w, r)
+	case "import":
+		importHandler(w, r)
+	case "secret-key/rotate":
+		rotateSecretKeyHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// systemStatsHandler returns host load and memory plus usage of all deployments
+func systemStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats, err := dockerSetup.GetSystemStats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// reconcileHandler restores missing nginx configs right away instead of
+// waiting for the next periodic pass
+func reconcileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if authEnabled() && !isAdmin(r) {
+		http.Error(w, "Reconciling needs the admin key", http.StatusForbidden)
+		return
+	}
+
+	report, err := dockerSetup.ReconcileNginx()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// networkHandler returns the deployment network and the containers attached to it
+func networkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	info, err := dockerSetup.InspectNetwork()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// recreateNetworkHandler rebuilds a deployment network in a bad state and
+// reattaches the deployments to it
+func recreateNetworkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if authEnabled() && !isAdmin(r) {
+		http.Error(w, "Recreating the network needs the admin key", http.StatusForbidden)
+		return
+	}
+
+	report, err := dockerSetup.RecreateNetwork()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// passphraseHeader carries the passphrase export archives are encrypted
+// with, kept out of the URL so it doesn't end up in access logs
+const passphraseHeader = "X-Erebrus-Passphrase"
+
+// importPath is where export archives are restored, with the upload limits
+const importPath = "/system/import"
+
+// exportHandler downloads every deployment as a tar.gz for moving to another
+// host. The deployment specs are encrypted with the passphrase header;
+// ?sources=true adds the workspace sources.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if authEnabled() && !isAdmin(r) {
+		http.Error(w, "Exporting needs the admin key", http.StatusForbidden)
+		return
+	}
+
+	// Build the archive first so errors can still be reported with a status
+	archive, err := os.CreateTemp("", "erebrus-export-*.tar.gz")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(archive.Name())
+	defer archive.Close()
+
+	opts := docker.ExportOptions{
+		Passphrase: r.Header.Get(passphraseHeader),
+		Sources:    r.URL.Query().Get("sources") == "true",
+	}
+	if err := dockerSetup.Export(archive, opts); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := archive.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename := fmt.Sprintf("erebrus-export-%s.tar.gz", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	io.Copy(w, archive)
+}
+
+// importHandler restores an export archive sent as the request body and
+// rebuilds its projects one by one, reporting the outcome of each
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if authEnabled() && !isAdmin(r) {
+		http.Error(w, "Importing needs the admin key", http.StatusForbidden)
+		return
+	}
+	http.NewResponseController(w).SetReadDeadline(time.Now().Add(uploadReadTimeout))
+
+	results, err := dockerSetup.Import(r.Body, r.Header.Get(passphraseHeader))
+	if err != nil {
+		if bodyTooLarge(err) {
+			http.Error(w, "Archive too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// rotateSecretKeyHandler replaces the master key and re-encrypts every
+// stored secret under the new one
+func rotateSecretKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if authEnabled() && !isAdmin(r) {
+		http.Error(w, "Rotating the secret key needs the admin key", http.StatusForbidden)
+		return
+	}
+
+	rotated, err := docker.RotateSecretKey()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"reencrypted": rotated})
+}
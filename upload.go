@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"erebrusvps/docker"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// uploadPath is where source archives are deployed from
+const uploadPath = "/deploy/upload"
+
+// uploadReadTimeout replaces the server read timeout for archive uploads,
+// which can take much longer than a JSON request
+const uploadReadTimeout = 10 * time.Minute
+
+// uploadDeploymentHandler deploys a project from an uploaded .tar.gz. The
+// multipart form carries the archive in "archive" and the deployment fields,
+// minus git_url, as JSON in "deployment".
+func uploadDeploymentHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	http.NewResponseController(w).SetReadDeadline(time.Now().Add(uploadReadTimeout))
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart form", http.StatusBadRequest)
+		return
+	}
+
+	var deployment docker.Deployment
+	var upload *docker.Upload
+	var haveMetadata bool
+	cleanup := func() {
+		if upload != nil {
+			os.Remove(upload.Path)
+		}
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			cleanup()
+			if bodyTooLarge(err) {
+				http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Error reading multipart form", http.StatusBadRequest)
+			return
+		}
+
+		switch part.FormName() {
+		case "deployment":
+			err = json.NewDecoder(io.LimitReader(part, config.MaxBodyBytes)).Decode(&deployment)
+			haveMetadata = true
+		case "archive":
+			if upload == nil {
+				upload, err = docker.StageUpload(part)
+			}
+		}
+		part.Close()
+		if err != nil {
+			cleanup()
+			if bodyTooLarge(err) {
+				http.Error(w, "Upload too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "Error reading "+part.FormName()+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	switch {
+	case upload == nil:
+		http.Error(w, "archive is required", http.StatusBadRequest)
+	case !haveMetadata || deployment.ProjectName == "":
+		http.Error(w, "deployment with a project_name is required", http.StatusBadRequest)
+	case deployment.GitURL != "" || deployment.LocalPath != "":
+		http.Error(w, "git_url and local_path are not allowed for uploads", http.StatusBadRequest)
+	case docker.ValidateProjectName(deployment.ProjectName) != nil:
+		http.Error(w, docker.ValidateProjectName(deployment.ProjectName).Error(), http.StatusBadRequest)
+	case docker.ValidateSecretValues(deployment) != nil:
+		http.Error(w, docker.ValidateSecretValues(deployment).Error(), http.StatusBadRequest)
+	default:
+		deployment.Upload = upload
+		serveDeployment(w, r, deployment)
+		return
+	}
+	cleanup()
+}
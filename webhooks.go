@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"erebrusvps/docker"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pushEvent is the part of a GitHub, Gitea or GitLab push payload a
+// redeploy needs
+type pushEvent struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Repository struct {
+		DefaultBranch string `json:"default_branch"`
+	} `json:"repository"`
+	// Project is where GitLab puts the repository's details
+	Project struct {
+		DefaultBranch string `json:"default_branch"`
+	} `json:"project"`
+}
+
+// webhookResponse tells the sender what became of a push
+type webhookResponse struct {
+	Status   string `json:"status"`
+	Project  string `json:"project"`
+	Commit   string `json:"commit,omitempty"`
+	DeployID string `json:"deploy_id,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// seenCommit is a commit a project's webhook already redeployed
+type seenCommit struct {
+	deployID string
+	at       time.Time
+}
+
+// commitDedup collapses deliveries of the same commit to a project within a
+// window into the redeploy started by the first one. Each project is
+// deployed from a single repository, so this is the repository's dedup.
+type commitDedup struct {
+	mutex  sync.Mutex
+	window time.Duration
+	seen   map[string]*seenCommit
+}
+
+func newCommitDedup(window time.Duration) *commitDedup {
+	return &commitDedup{window: window, seen: make(map[string]*seenCommit)}
+}
+
+// claim records a commit for a project, reporting false with the deploy ID
+// of the earlier redeploy when it was seen within the window
+func (c *commitDedup) claim(project, commit string, now time.Time) (string, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for key, seen := range c.seen {
+		if now.Sub(seen.at) >= c.window {
+			delete(c.seen, key)
+		}
+	}
+	key := project + "@" + commit
+	if seen, ok := c.seen[key]; ok {
+		return seen.deployID, false
+	}
+	c.seen[key] = &seenCommit{at: now}
+	return "", true
+}
+
+// started records the deploy ID of a claimed commit's redeploy
+func (c *commitDedup) started(project, commit, deployID string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if seen, ok := c.seen[project+"@"+commit]; ok {
+		seen.deployID = deployID
+	}
+}
+
+var webhookDedup *commitDedup
+
+// validWebhookSignature checks a delivery against the webhook secret: the
+// HMAC-SHA256 in X-Hub-Signature-256 sent by GitHub and Gitea, or the token
+// in X-Gitlab-Token
+func validWebhookSignature(r *http.Request, body []byte) bool {
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return keyMatches(token, config.WebhookSecret)
+	}
+	signature, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	if !ok {
+		return false
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(config.WebhookSecret))
+	mac.Write(body)
+	return hmac.Equal(got, mac.Sum(nil))
+}
+
+// webhookHandler redeploys a git project on a push to its default branch,
+// e.g. POST /webhooks/<project> configured as the repository's push hook.
+// Deliveries are verified with EREBRUS_WEBHOOK_SECRET instead of an API key.
+func webhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if config.WebhookSecret == "" {
+		http.Error(w, "Webhooks are not configured", http.StatusNotFound)
+		return
+	}
+	project := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks/"), "/")
+	if err := docker.ValidateProjectName(project); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Error reading body", http.StatusBadRequest)
+		return
+	}
+	if !validWebhookSignature(r, body) {
+		http.Error(w, "Invalid webhook signature", http.StatusUnauthorized)
+		return
+	}
+	var push pushEvent
+	if err := json.Unmarshal(body, &push); err != nil {
+		http.Error(w, "Error parsing JSON", http.StatusBadRequest)
+		return
+	}
+
+	state, err := docker.LoadProjectState(project)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if state.Deployment == nil || state.Deployment.GitURL == "" {
+		http.Error(w, "project "+project+" has no git deployment to redeploy", http.StatusNotFound)
+		return
+	}
+
+	response := webhookResponse{Status: "ignored", Project: project, Commit: push.After}
+	defaultBranch := push.Repository.DefaultBranch
+	if defaultBranch == "" {
+		defaultBranch = push.Project.DefaultBranch
+	}
+	switch {
+	case push.After == "" || strings.Trim(push.After, "0") == "":
+		response.Reason = "push carries no commit"
+	case defaultBranch != "" && push.Ref != "refs/heads/"+defaultBranch:
+		response.Reason = "push is not to the default branch"
+	case state.Deployment.Commit != "":
+		response.Reason = "deployment is pinned to a commit"
+	case push.After == state.Commit:
+		response.Reason = "commit is already deployed"
+	}
+	if response.Reason != "" {
+		writeWebhookResponse(w, http.StatusOK, response)
+		return
+	}
+
+	if deployID, ok := webhookDedup.claim(project, push.After, time.Now()); !ok {
+		response.Status = "duplicate"
+		response.DeployID = deployID
+		writeWebhookResponse(w, http.StatusAccepted, response)
+		return
+	}
+	started := time.Now()
+	deployID, _ := dockerSetup.StartDeployment(*state.Deployment, func(result *docker.DeploymentResult, err error) {
+		recordDeployEvent("webhook", project, docker.EventRedeploy, started, result, err)
+	})
+	webhookDedup.started(project, push.After, deployID)
+
+	response.Status = "running"
+	response.DeployID = deployID
+	w.Header().Set("X-Deploy-ID", deployID)
+	writeWebhookResponse(w, http.StatusAccepted, response)
+}
+
+func writeWebhookResponse(w http.ResponseWriter, status int, response webhookResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"erebrusvps/docker"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommitDedup(t *testing.T) {
+	dedup := newCommitDedup(time.Minute)
+	now := time.Now()
+	if _, ok := dedup.claim("app", "abc", now); !ok {
+		t.Fatal("first delivery of a commit was collapsed")
+	}
+	dedup.started("app", "abc", "d1")
+	if deployID, ok := dedup.claim("app", "abc", now.Add(30*time.Second)); ok || deployID != "d1" {
+		t.Errorf("got %q, %v for a repeated commit, want it collapsed into d1", deployID, ok)
+	}
+	if _, ok := dedup.claim("api", "abc", now.Add(30*time.Second)); !ok {
+		t.Error("the same commit of another project was collapsed")
+	}
+	if _, ok := dedup.claim("app", "abc", now.Add(2*time.Minute)); !ok {
+		t.Error("a commit seen outside the window was collapsed")
+	}
+}
+
+// signWebhook signs a delivery like GitHub does
+func signWebhook(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookHandler(t *testing.T) {
+	docker.SetBaseDir(t.TempDir())
+	defer docker.SetBaseDir("")
+	defer func(saved *Config) { config = saved }(config)
+	defer func(saved *commitDedup) { webhookDedup = saved }(webhookDedup)
+	config = &Config{WebhookSecret: "hook-secret"}
+	webhookDedup = newCommitDedup(time.Minute)
+	if err := docker.UpdateProjectState("app", func(state *docker.ProjectState) {
+		state.Deployment = &docker.Deployment{ProjectName: "app", GitURL: "https://github.com/org/app.git"}
+		state.Commit = "abc"
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := docker.UpdateProjectState("web", func(state *docker.ProjectState) {
+		state.Deployment = &docker.Deployment{ProjectName: "web", Image: "nginx:1.27"}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	// A redeploy of def is already running from an earlier delivery
+	webhookDedup.claim("app", "def", time.Now())
+	webhookDedup.started("app", "def", "d1")
+
+	push := func(ref, after string) string {
+		return `{"ref":"` + ref + `","after":"` + after + `","repository":{"default_branch":"main"}}`
+	}
+	tests := []struct {
+		name       string
+		project    string
+		body       string
+		sign       func(r *http.Request, body string)
+		wantStatus int
+		want       webhookResponse
+	}{
+		{
+			name: "unsigned", project: "app", body: push("refs/heads/main", "def"),
+			sign:       func(r *http.Request, body string) {},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong signature", project: "app", body: push("refs/heads/main", "def"),
+			sign:       func(r *http.Request, body string) { r.Header.Set("X-Hub-Signature-256", signWebhook("other", body)) },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong gitlab token", project: "app", body: push("refs/heads/main", "def"),
+			sign:       func(r *http.Request, body string) { r.Header.Set("X-Gitlab-Token", "other") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "not a git deployment", project: "web", body: push("refs/heads/main", "def"),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name: "other branch", project: "app", body: push("refs/heads/feature", "def"),
+			wantStatus: http.StatusOK,
+			want:       webhookResponse{Status: "ignored", Project: "app", Commit: "def", Reason: "push is not to the default branch"},
+		},
+		{
+			name: "branch deleted", project: "app", body: push("refs/heads/main", strings.Repeat("0", 40)),
+			wantStatus: http.StatusOK,
+			want:       webhookResponse{Status: "ignored", Project: "app", Commit: strings.Repeat("0", 40), Reason: "push carries no commit"},
+		},
+		{
+			name: "already deployed", project: "app", body: push("refs/heads/main", "abc"),
+			sign:       func(r *http.Request, body string) { r.Header.Set("X-Gitlab-Token", "hook-secret") },
+			wantStatus: http.StatusOK,
+			want:       webhookResponse{Status: "ignored", Project: "app", Commit: "abc", Reason: "commit is already deployed"},
+		},
+		{
+			name: "duplicate", project: "app", body: push("refs/heads/main", "def"),
+			wantStatus: http.StatusAccepted,
+			want:       webhookResponse{Status: "duplicate", Project: "app", Commit: "def", DeployID: "d1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/webhooks/"+tt.project, strings.NewReader(tt.body))
+			if tt.sign != nil {
+				tt.sign(r, tt.body)
+			} else {
+				r.Header.Set("X-Hub-Signature-256", signWebhook("hook-secret", tt.body))
+			}
+			w := httptest.NewRecorder()
+			webhookHandler(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("got status %d (%s), want %d", w.Code, w.Body, tt.wantStatus)
+			}
+			if tt.want.Status == "" {
+				return
+			}
+			var got webhookResponse
+			if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	config.WebhookSecret = ""
+	r := httptest.NewRequest("POST", "/webhooks/app", strings.NewReader(push("refs/heads/main", "def")))
+	w := httptest.NewRecorder()
+	webhookHandler(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("got status %d without a webhook secret, want 404", w.Code)
+	}
+}
@@ -3,14 +3,55 @@ package websocket
 import (
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// sessionBufferSize is how many lines of a session are kept for replay
+const sessionBufferSize = 2000
+
+// sessionRetention is how long a finished session stays replayable
+const sessionRetention = 10 * time.Minute
+
+// logMessage is a log line, optionally tied to a project and a deployment
+// session of it
+type logMessage struct {
+	session string
+	project string
+	text    string
+}
+
+// logSession buffers the recent lines of a session
+type logSession struct {
+	project string
+	lines   []string
+}
+
+// logClient is a connection and the logs it may receive
+type logClient struct {
+	conn *websocket.Conn
+	// session is the session followed, "" for all logs
+	session string
+	// allow reports whether a project's lines may be sent, nil allowing
+	// everything including lines of no project
+	allow func(project string) bool
+}
+
+// wants reports whether a line goes to the client
+func (c *logClient) wants(message logMessage) bool {
+	if c.session != "" && c.session != message.session {
+		return false
+	}
+	return c.allow == nil || (message.project != "" && c.allow(message.project))
+}
+
 type LoggerService struct {
-	clients   map[*websocket.Conn]bool
-	broadcast chan string
-	mutex     sync.Mutex
+	clients   map[*websocket.Conn]*logClient
+	broadcast chan logMessage
+	// sessions buffers recent lines per session so reconnecting clients can catch up
+	sessions map[string]*logSession
+	mutex    sync.Mutex
 }
 
 var (
@@ -22,23 +63,60 @@ var (
 	Logger = NewLoggerService()
 )
 
+// EnableCompression negotiates permessage-deflate with clients that support
+// it, trading CPU for bandwidth on verbose logs. It must be called before
+// serving connections.
+func EnableCompression(enabled bool) {
+	upgrader.EnableCompression = enabled
+}
+
 func NewLoggerService() *LoggerService {
 	ls := &LoggerService{
-		clients:   make(map[*websocket.Conn]bool),
-		broadcast: make(chan string),
+		clients:   make(map[*websocket.Conn]*logClient),
+		broadcast: make(chan logMessage),
+		sessions:  make(map[string]*logSession),
 	}
 	go ls.handleMessages()
 	return ls
 }
 
+// HandleWebSocket streams logs to the client. With ?deploy_id=<id> only that
+// deployment's lines are sent, starting with the ones already emitted.
 func (ls *LoggerService) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+	ls.ServeLogs(w, r, nil)
+}
+
+// ServeLogs is HandleWebSocket limited to the lines of the projects allow
+// accepts; lines of no project are not sent. allow is only called by one
+// goroutine at a time.
+func (ls *LoggerService) ServeLogs(w http.ResponseWriter, r *http.Request, allow func(project string) bool) {
+	session := r.URL.Query().Get("deploy_id")
+	ls.mutex.Lock()
+	buffered := ls.sessions[session]
+	ls.mutex.Unlock()
+	if session != "" && buffered != nil && allow != nil && !allow(buffered.project) {
+		http.Error(w, "deployment belongs to another API key", http.StatusForbidden)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
+	conn.EnableWriteCompression(upgrader.EnableCompression)
 
+	// Replay under the lock so no line is missed or sent twice. A session's
+	// project never changes, so one already allowed isn't checked again.
+	checked := buffered != nil
 	ls.mutex.Lock()
-	ls.clients[conn] = true
+	if buffered := ls.sessions[session]; buffered != nil && (allow == nil || checked || allow(buffered.project)) {
+		for _, line := range buffered.lines {
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(line)); err != nil {
+				break
+			}
+		}
+	}
+	ls.clients[conn] = &logClient{conn: conn, session: session, allow: allow}
 	ls.mutex.Unlock()
 
 	// Remove client when connection closes
@@ -59,19 +137,62 @@ func (ls *LoggerService) HandleWebSocket(w http.ResponseWriter, r *http.Request)
 }
 
 func (ls *LoggerService) SendLog(message string) {
-	ls.broadcast <- message
+	ls.broadcast <- logMessage{text: message}
+}
+
+// SendProjectLog sends a line about a project, only shown to clients that
+// may see the project
+func (ls *LoggerService) SendProjectLog(project, message string) {
+	ls.broadcast <- logMessage{project: project, text: message}
+}
+
+// SendSessionLog sends a line belonging to a session of a project's
+// deployment, buffering it for clients that connect or reconnect later
+func (ls *LoggerService) SendSessionLog(session, project, message string) {
+	ls.broadcast <- logMessage{session: session, project: project, text: message}
+}
+
+// EndSession drops a session's replay buffer once the retention period passes
+func (ls *LoggerService) EndSession(session string) {
+	time.AfterFunc(sessionRetention, func() {
+		ls.mutex.Lock()
+		delete(ls.sessions, session)
+		ls.mutex.Unlock()
+	})
 }
 
+// handleMessages delivers lines. Clients' filters may read project state, so
+// they run outside the lock; only this goroutine writes to registered clients.
 func (ls *LoggerService) handleMessages() {
 	for message := range ls.broadcast {
 		ls.mutex.Lock()
-		for client := range ls.clients {
-			err := client.WriteMessage(websocket.TextMessage, []byte(message))
-			if err != nil {
-				client.Close()
-				delete(ls.clients, client)
+		if message.session != "" {
+			buffered := ls.sessions[message.session]
+			if buffered == nil {
+				buffered = &logSession{project: message.project}
+				ls.sessions[message.session] = buffered
 			}
+			buffered.lines = append(buffered.lines, message.text)
+			if len(buffered.lines) > sessionBufferSize {
+				buffered.lines = buffered.lines[len(buffered.lines)-sessionBufferSize:]
+			}
+		}
+		clients := make([]*logClient, 0, len(ls.clients))
+		for _, client := range ls.clients {
+			clients = append(clients, client)
 		}
 		ls.mutex.Unlock()
+
+		for _, client := range clients {
+			if !client.wants(message) {
+				continue
+			}
+			if err := client.conn.WriteMessage(websocket.TextMessage, []byte(message.text)); err != nil {
+				client.conn.Close()
+				ls.mutex.Lock()
+				delete(ls.clients, client.conn)
+				ls.mutex.Unlock()
+			}
+		}
 	}
 }
@@ -0,0 +1,45 @@
+package websocket
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+// SendFunc writes a single message to a streaming client. Strings are sent
+// as text frames, anything else is encoded as JSON.
+type SendFunc func(message interface{}) error
+
+// Stream upgrades the request and hands a send function to produce, which
+// runs until it returns or the client disconnects (cancelling ctx).
+func Stream(w http.ResponseWriter, r *http.Request, produce func(ctx context.Context, send SendFunc) error) error {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.EnableWriteCompression(upgrader.EnableCompression)
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// Detect client disconnects by reading until an error occurs
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	send := func(message interface{}) error {
+		if text, ok := message.(string); ok {
+			return conn.WriteMessage(websocket.TextMessage, []byte(text))
+		}
+		return conn.WriteJSON(message)
+	}
+
+	return produce(ctx, send)
+}